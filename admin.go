@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// admin represents the runtime API to add, remove and list the targets,
+// the added targets are ephemeral and they're kept by the config reloads
+// unless they've been added with persist=false
+type admin struct {
+	sync.Mutex
+	ctx     context.Context
+	tp      *tp
+	req     *request
+	targets map[string]*adminTarget
+}
+
+// adminTarget represents a target which has been added by the API
+type adminTarget struct {
+	running *configTarget
+	persist bool
+}
+
+// adminTargetStatus represents a target in the API's list
+type adminTargetStatus struct {
+	Target    string  `json:"target"`
+	Addr      string  `json:"addr"`
+	Ephemeral bool    `json:"ephemeral"`
+	LastProbe string  `json:"last_probe,omitempty"`
+	LastError string  `json:"last_error,omitempty"`
+	Success   float64 `json:"success"`
+}
+
+func newAdmin(ctx context.Context, tp *tp, req *request) *admin {
+	return &admin{
+		ctx:     ctx,
+		tp:      tp,
+		req:     req,
+		targets: make(map[string]*adminTarget),
+	}
+}
+
+// adminServer serves the admin API until the context is canceled
+func adminServer(ctx context.Context, a *admin, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("admin server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/targets", a)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatalf("%v", err)
+		}
+	}()
+
+	return nil
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.list(w)
+	case http.MethodPost:
+		a.add(w, r)
+	case http.MethodDelete:
+		a.remove(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list writes the running targets with their last probe
+func (a *admin) list(w http.ResponseWriter) {
+	a.Lock()
+	a.tp.Lock()
+	targets := []adminTargetStatus{}
+	for key, p := range a.tp.targets {
+		_, ephemeral := a.targets[key]
+		last, err, success := p.client.status.get()
+
+		s := adminTargetStatus{
+			Target:    key,
+			Addr:      p.client.target,
+			Ephemeral: ephemeral,
+			LastError: err,
+			Success:   success,
+		}
+
+		if !last.IsZero() {
+			s.LastProbe = last.UTC().Format(time.RFC3339)
+		}
+
+		targets = append(targets, s)
+	}
+	a.tp.Unlock()
+	a.Unlock()
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Target < targets[j].Target
+	})
+
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// add starts the requested target, the target's options are same
+// as the config's target
+func (a *admin) add(w http.ResponseWriter, r *http.Request) {
+	t := target{}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, fmt.Sprintf("invalid target: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if errs := t.check(); len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		http.Error(w, strings.Join(msgs, ", "), http.StatusBadRequest)
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	req := t.request(a.req)
+	key := getTargetKey(withFamily(a.ctx, req), t.Addr)
+	if _, ok := a.targets[key]; ok || a.tp.isExist(key) {
+		http.Error(w, fmt.Sprintf("%v: %s", errExist, key), http.StatusConflict)
+		return
+	}
+
+	a.targets[key] = &adminTarget{
+		running: a.tp.startTarget(a.ctx, t, req, func() {}),
+		persist: r.URL.Query().Get("persist") != "false",
+	}
+
+	infof("target: %s has been added by the API", t.Addr)
+
+	writeJSON(w, http.StatusCreated, adminTargetStatus{Target: key, Addr: t.Addr, Ephemeral: true})
+}
+
+// remove stops the target, the target is one of the listed targets
+func (a *admin) remove(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("target")
+
+	a.Lock()
+	defer a.Unlock()
+
+	if at, ok := a.targets[key]; ok {
+		at.running.cancel()
+		<-at.running.done
+		delete(a.targets, key)
+	} else if a.tp.isExist(key) {
+		a.tp.stop(key)
+	} else {
+		http.Error(w, fmt.Sprintf("target not found: %s", key), http.StatusNotFound)
+		return
+	}
+
+	infof("target: %s has been deleted by the API", key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reload stops the targets which haven't been persisted
+// across the config reloads
+func (a *admin) reload() {
+	a.Lock()
+	defer a.Unlock()
+
+	for key, at := range a.targets {
+		if at.persist {
+			continue
+		}
+
+		at.running.cancel()
+		<-at.running.done
+		delete(a.targets, key)
+
+		infof("target: %s has been deleted by the reload", key)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
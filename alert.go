@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+)
+
+// alertState represents the target's failing state for the
+// notifications, the target is failing once the consecutive
+// failed probes reached the failure threshold
+type alertState struct {
+	failing bool
+	fails   int
+	since   time.Time
+}
+
+// alertEvent represents the target's transition to failing or recovered
+type alertEvent struct {
+	Target   string            `json:"target"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	State    string            `json:"state"`
+	Error    string            `json:"error,omitempty"`
+	Failures int               `json:"failures"`
+	Since    time.Time         `json:"since"`
+	Time     time.Time         `json:"time"`
+	Downtime string            `json:"downtime,omitempty"`
+	Stats    stats             `json:"stats"`
+}
+
+const (
+	alertFailing   = "failing"
+	alertRecovered = "recovered"
+)
+
+// update records the probe's result, it returns true once the
+// target became failing or it's recovered
+func (s *alertState) update(err error, threshold int) bool {
+	if err != nil {
+		s.fails++
+		if !s.failing && s.fails >= threshold {
+			s.failing = true
+			s.since = time.Now()
+			return true
+		}
+		return false
+	}
+
+	s.fails = 0
+	if s.failing {
+		s.failing = false
+		return true
+	}
+
+	return false
+}
+
+// checkAlert notifies the target's transition
+func (c *client) checkAlert(err error) {
+	fails := c.alert.fails
+	if !c.alert.update(err, c.req.failureThreshold) {
+		return
+	}
+
+	e := alertEvent{
+		Target:   c.target,
+		Labels:   c.labels,
+		State:    alertFailing,
+		Failures: c.alert.fails,
+		Since:    c.alert.since,
+		Time:     time.Now(),
+		Stats:    c.stats,
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.State = alertRecovered
+		e.Failures = fails
+		e.Downtime = e.Time.Sub(e.Since).Round(time.Millisecond).String()
+	}
+
+	c.notify(e)
+}
+
+// notify sends the transition to the notifiers
+func (c *client) notify(e alertEvent) {
+	if c.webhook != nil && c.req.webhookURL != "" {
+		c.webhook.send(c.req.webhookURL, e)
+	}
+
+	if c.alertmanager != nil {
+		c.alertmanager.send(e)
+	}
+
+	if c.hook == nil {
+		return
+	}
+
+	if e.State == alertFailing && c.req.onFailureCmd != "" {
+		c.hook.exec(c.req.onFailureCmd, e)
+	} else if e.State == alertRecovered && c.req.onRecoveryCmd != "" {
+		c.hook.exec(c.req.onRecoveryCmd, e)
+	}
+}
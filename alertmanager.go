@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertmanagerAlertName is the alertname label of the targets' alerts
+const alertmanagerAlertName = "TCPProbeTargetDown"
+
+// alertmanager represents the alertmanager notifier, the failing
+// targets' alerts are resent at the resend interval until they're
+// recovered and the alerts are posted to the first available url
+type alertmanager struct {
+	sync.Mutex
+	urls       []string
+	interval   time.Duration
+	httpClient *http.Client
+	alerts     map[string]amAlert
+	ch         chan []amAlert
+	done       chan struct{}
+}
+
+// amAlert represents the alertmanager's postable alert
+type amAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+func newAlertmanager(req *request) *alertmanager {
+	return &alertmanager{
+		urls:       req.alertmanagerURLs,
+		interval:   req.alertmanagerResend,
+		httpClient: &http.Client{Timeout: req.alertmanagerTimeout},
+		alerts:     map[string]amAlert{},
+		ch:         make(chan []amAlert, 100),
+		done:       make(chan struct{}),
+	}
+}
+
+func (a *alertmanager) run(ctx context.Context) {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case alerts := <-a.ch:
+			a.post(alerts)
+		case <-ticker.C:
+			if alerts := a.firing(); len(alerts) > 0 {
+				a.post(alerts)
+			}
+		case <-ctx.Done():
+			// the queued alerts are sent before exit, the firing
+			// alerts are resolved by their endsAt at the alertmanager
+			for {
+				select {
+				case alerts := <-a.ch:
+					a.post(alerts)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *alertmanager) wait() {
+	<-a.done
+}
+
+// send fires the failing target's alert or resolves the recovered one
+func (a *alertmanager) send(e alertEvent) {
+	labels := map[string]string{}
+	for k, v := range e.Labels {
+		labels[k] = v
+	}
+	labels["target"] = e.Target
+	labels["alertname"] = alertmanagerAlertName
+
+	key := joinLabels(labels)
+
+	a.Lock()
+	alert, ok := a.alerts[key]
+	if e.State == alertFailing {
+		alert = amAlert{
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is down", e.Target),
+				"description": fmt.Sprintf("%d consecutive failed probes: %s", e.Failures, e.Error),
+			},
+			StartsAt: e.Since,
+			EndsAt:   a.validUntil(e.Time),
+		}
+		a.alerts[key] = alert
+	} else {
+		delete(a.alerts, key)
+	}
+	a.Unlock()
+
+	if e.State == alertRecovered {
+		if !ok {
+			return
+		}
+		alert.EndsAt = e.Time
+	}
+
+	select {
+	case a.ch <- []amAlert{alert}:
+	default:
+		warnf("alertmanager queue is full, the alert dropped: %s %s", e.Target, e.State)
+	}
+}
+
+// firing returns the firing alerts with the extended endsAt
+func (a *alertmanager) firing() []amAlert {
+	a.Lock()
+	defer a.Unlock()
+
+	var alerts []amAlert
+	now := time.Now()
+	for key, alert := range a.alerts {
+		alert.EndsAt = a.validUntil(now)
+		a.alerts[key] = alert
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
+
+// validUntil returns the firing alert's endsAt, the alert is resolved
+// by the alertmanager if it's not resent e.g. tcpprobe is stopped
+func (a *alertmanager) validUntil(t time.Time) time.Time {
+	return t.Add(4 * a.interval)
+}
+
+// post posts the alerts to the urls in order until one of them succeeds
+func (a *alertmanager) post(alerts []amAlert) {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		errorf("alertmanager: %v", err)
+		return
+	}
+
+	for _, u := range a.urls {
+		if err = a.do(u, body); err == nil {
+			return
+		}
+		warnf("alertmanager: %v", err)
+	}
+
+	errorf("alertmanager: %d alert(s) dropped, all alertmanagers failed", len(alerts))
+}
+
+func (a *alertmanager) do(u string, body []byte) error {
+	req, err := http.NewRequest("POST", u+"/api/v2/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s post failed: %s", u, resp.Status)
+	}
+
+	return nil
+}
+
+// getAlertmanagerURLs parses the comma separated alertmanager urls
+func getAlertmanagerURLs(s string) ([]string, error) {
+	var urls []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid alertmanager-url: %s", v)
+		}
+
+		urls = append(urls, strings.TrimSuffix(v, "/"))
+	}
+
+	return urls, nil
+}
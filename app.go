@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// defaultRecvLimit is the maximum response bytes to read
+// if the recv-limit is not specified
+const defaultRecvLimit = 1024
+
+// getPayload returns the payload to send from the hex string
+// or the file, they are mutually exclusive
+func getPayload(hexStr, filename string) ([]byte, error) {
+	if hexStr != "" && filename != "" {
+		return nil, errors.New("the send-hex and send-file options are mutually exclusive")
+	}
+
+	if filename != "" {
+		return ioutil.ReadFile(filename)
+	}
+
+	return decodeHex(hexStr)
+}
+
+// getExpectation returns the expected response prefix from
+// the hex string or the plain text prefix
+func getExpectation(hexStr, prefix string) ([]byte, error) {
+	if hexStr != "" && prefix != "" {
+		return nil, errors.New("the expect-hex and expect-prefix options are mutually exclusive")
+	}
+
+	if prefix != "" {
+		return []byte(prefix), nil
+	}
+
+	return decodeHex(hexStr)
+}
+
+// decodeHex decodes the hex string, it accepts 0x prefix and spaces
+func decodeHex(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	s = strings.TrimPrefix(strings.ReplaceAll(s, " ", ""), "0x")
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex payload: %v", err)
+	}
+
+	return b, nil
+}
+
+// appProbe sends the payload and measures the time to the first
+// response byte, it reads until the expectation length or the limit
+func (c *client) appProbe(ctx context.Context) error {
+	c.stats.AppRtt = 0
+	c.stats.AppRcvdBytes = 0
+
+	c.conn.SetDeadline(time.Now().Add(c.req.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	t := time.Now()
+	if _, err := c.conn.Write(c.req.sendPayload); err != nil {
+		return err
+	}
+
+	limit := c.req.recvLimit
+	if limit < 1 {
+		limit = defaultRecvLimit
+	}
+
+	buf := make([]byte, limit)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.checkAppExpectation(nil)
+		return err
+	}
+
+	c.stats.AppRtt = time.Since(t).Microseconds()
+
+	for n < len(c.req.expectPayload) && n < len(buf) {
+		m, err := c.conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			if err != io.EOF {
+				c.stats.AppRcvdBytes = int64(n)
+				c.checkAppExpectation(buf[:n])
+				return err
+			}
+			break
+		}
+	}
+
+	c.stats.AppRcvdBytes = int64(n)
+	c.checkAppExpectation(buf[:n])
+
+	return nil
+}
+
+func (c *client) checkAppExpectation(resp []byte) {
+	if c.req.expectPayload != nil && !bytes.HasPrefix(resp, c.req.expectPayload) {
+		c.stats.AppMismatch++
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// availability failures, a probe is unavailable by its error,
+// the unexpected HTTP status or body, or the max-rtt breach
+const (
+	availError = 1 << iota
+	availStatus
+	availThreshold
+)
+
+var availFailures = map[string]int{
+	"error":     availError,
+	"status":    availStatus,
+	"threshold": availThreshold,
+}
+
+// availability represents the target's availability state, the
+// time between the probes is accounted as the previous state
+type availability struct {
+	down     bool
+	last     time.Time
+	downtime time.Duration
+}
+
+// account accounts the probe's availability into the stats
+func (c *client) account(err error) {
+	if c.warming {
+		return
+	}
+
+	now := time.Now()
+	down := c.isUnavailable(err)
+
+	if c.avail.down && !c.avail.last.IsZero() {
+		c.avail.downtime += now.Sub(c.avail.last)
+	}
+
+	if c.avail.last.IsZero() || c.avail.down != down {
+		c.stats.AvailLastChange = now.Unix()
+	}
+
+	c.avail.down = down
+	c.avail.last = now
+
+	c.stats.AvailProbes++
+	if down {
+		c.stats.AvailFailed++
+		c.stats.AvailConsecutiveFailures++
+	} else {
+		c.stats.AvailConsecutiveFailures = 0
+	}
+
+	c.stats.AvailDowntime = int64(c.avail.downtime.Seconds())
+}
+
+// isUnavailable returns true if the probe failed by the
+// availability-failure causes
+func (c *client) isUnavailable(err error) bool {
+	failure := c.req.availFailure
+	if failure == 0 {
+		failure = availError
+	}
+
+	switch {
+	case failure&availError != 0 && err != nil:
+		return true
+	case failure&availStatus != 0 && c.stats.HTTPExpectationMismatch > 0:
+		return true
+	case failure&availThreshold != 0 && c.req.maxRtt > 0 &&
+		time.Duration(c.stats.Rtt)*time.Microsecond > c.req.maxRtt:
+		return true
+	}
+
+	return false
+}
+
+// availabilityRatio returns the available probes' percentage
+func (c *client) availabilityRatio() float64 {
+	if c.stats.AvailProbes == 0 {
+		return 0
+	}
+
+	return float64(c.stats.AvailProbes-c.stats.AvailFailed) / float64(c.stats.AvailProbes) * 100
+}
+
+// getAvailFailure parses the comma separated availability failures
+func getAvailFailure(s string) (int, error) {
+	failure := 0
+	for _, v := range strings.Split(s, ",") {
+		f, ok := availFailures[strings.TrimSpace(v)]
+		if !ok {
+			return 0, fmt.Errorf("invalid availability-failure: %s, expected error, status or threshold", v)
+		}
+		failure |= f
+	}
+
+	return failure, nil
+}
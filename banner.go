@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the banner is read up to the limit, the server speaks first
+// e.g. SSH and SMTP so it's expected shortly after connect
+const (
+	bannerLimit   = 256
+	bannerTimeout = 2 * time.Second
+)
+
+// readsBanner returns true if the banner is read after connect, the
+// HTTP, gRPC and TLS servers don't speak first so they're skipped
+// unless the target's banner is enabled explicitly, the database
+// probes read their greeting themselves
+func (c *client) readsBanner() bool {
+	if !c.req.readBanner {
+		return false
+	}
+
+	return c.req.forceBanner || !c.isHTTP() && !c.isGRPC() && !c.isTLSOnly() && !c.isDatabase() && !c.isKVStore() && !c.isWebSocket() && !c.isBroker()
+}
+
+// readBanner reads the server's banner and measures the time
+// to the banner after connect
+func (c *client) readBanner(ctx context.Context) error {
+	c.stats.BannerTime = 0
+	c.stats.Banner = ""
+
+	c.conn.SetReadDeadline(time.Now().Add(capTimeout(bannerTimeout, c.req.timeout)))
+	defer c.conn.SetReadDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	t := time.Now()
+	buf := make([]byte, bannerLimit)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.checkBanner(nil)
+		return err
+	}
+
+	c.stats.BannerTime = time.Since(t).Microseconds()
+	c.stats.Banner = sanitizeBanner(buf[:n])
+	c.checkBanner(buf[:n])
+
+	return nil
+}
+
+// checkBanner matches the raw banner against the expect-banner-regex
+func (c *client) checkBanner(banner []byte) {
+	if c.bannerRegex != nil && !c.bannerRegex.Match(banner) {
+		c.stats.BannerMismatch++
+	}
+}
+
+// sanitizeBanner escapes the banner's non-printable bytes
+// e.g. the line ending is \r\n
+func sanitizeBanner(b []byte) string {
+	var s strings.Builder
+
+	for _, ch := range b {
+		switch {
+		case ch == '\r':
+			s.WriteString(`\r`)
+		case ch == '\n':
+			s.WriteString(`\n`)
+		case ch == '\t':
+			s.WriteString(`\t`)
+		case ch < 0x20 || ch > 0x7e:
+			fmt.Fprintf(&s, `\x%02x`, ch)
+		default:
+			s.WriteByte(ch)
+		}
+	}
+
+	return s.String()
+}
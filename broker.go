@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// mqttKeepAlive is the keep alive of the MQTT CONNECT, the
+// connection is disconnected right after the CONNACK though
+const mqttKeepAlive = 60
+
+// isBroker returns true if the target is probed by the message
+// broker's connect e.g. mqtt://host:port or nats://host:port
+func (c *client) isBroker() bool {
+	switch c.urlSchema.Scheme {
+	case "mqtt", "mqtts", "nats":
+		return true
+	}
+
+	return false
+}
+
+// brokerProbe connects to the broker by its protocol and verifies
+// its answer, it's not a subscription so it disconnects right after
+func (c *client) brokerProbe(ctx context.Context) error {
+	c.stats.AppRtt = 0
+	c.stats.MQTTReturnCode = 0
+
+	c.conn.SetDeadline(time.Now().Add(c.req.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	if c.urlSchema.Scheme == "nats" {
+		return c.natsProbe(ctx)
+	}
+
+	conn := c.conn
+	if c.urlSchema.Scheme == "mqtts" || c.req.brokerTLS {
+		var err error
+		if conn, err = c.tlsHandshake(ctx, c.tlsConfig()); err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(c.req.timeout))
+	}
+
+	return c.mqttProbe(conn)
+}
+
+// mqttProbe sends the MQTT 3.1.1 CONNECT and measures the time
+// to its CONNACK, the non-zero return code is a rejection
+func (c *client) mqttProbe(conn net.Conn) error {
+	clientID := c.req.mqttClientID
+	if clientID == "" {
+		b := make([]byte, 4)
+		rand.Read(b)
+		clientID = "tcpprobe-" + hex.EncodeToString(b)
+	}
+
+	t := time.Now()
+	if _, err := conn.Write(mqttConnect(clientID, c.req.mqttUsername, c.req.mqttPassword)); err != nil {
+		return err
+	}
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		c.stats.AppMismatch++
+		return err
+	}
+	c.stats.AppRtt = time.Since(t).Microseconds()
+
+	if b[0] != 0x20 || b[1] != 0x02 {
+		c.stats.AppMismatch++
+		return fmt.Errorf("%s: unexpected MQTT packet: %#x", c.target, b[0])
+	}
+
+	c.stats.MQTTReturnCode = int(b[3])
+	if b[3] != 0 {
+		c.stats.AppMismatch++
+		return fmt.Errorf("%s: MQTT connection refused, return code %d", c.target, b[3])
+	}
+
+	// the DISCONNECT
+	_, err := conn.Write([]byte{0xe0, 0x00})
+
+	return err
+}
+
+// mqttConnect returns the CONNECT packet with clean session,
+// the password isn't allowed without the username
+func mqttConnect(clientID, username, password string) []byte {
+	var flags byte = 0x02
+
+	payload := mqttString(clientID)
+	if username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(username)...)
+	}
+
+	if username != "" && password != "" {
+		flags |= 0x40
+		payload = append(payload, mqttString(password)...)
+	}
+
+	b := append(mqttString("MQTT"), 4, flags, 0, mqttKeepAlive)
+	b = append(b, payload...)
+
+	// the remaining length is variable length encoded
+	packet := []byte{0x10}
+	size := len(b)
+	for {
+		digit := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if size == 0 {
+			break
+		}
+	}
+
+	return append(packet, b...)
+}
+
+// mqttString returns the length prefixed UTF-8 string
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// natsProbe reads the INFO and sends the PING after the CONNECT, the
+// TLS is upgraded after the INFO which is always plaintext
+func (c *client) natsProbe(ctx context.Context) error {
+	r := bufio.NewReader(c.conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		c.stats.AppMismatch++
+		return err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		c.stats.AppMismatch++
+		return fmt.Errorf("%s: unexpected NATS response: %s", c.target, strings.TrimSpace(line))
+	}
+
+	conn := c.conn
+	if c.req.brokerTLS {
+		if conn, err = c.tlsHandshake(ctx, c.tlsConfig()); err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(c.req.timeout))
+		r = bufio.NewReader(conn)
+	}
+
+	t := time.Now()
+	if _, err = io.WriteString(conn, "CONNECT {\"verbose\":false,\"name\":\"tcpprobe\"}\r\nPING\r\n"); err != nil {
+		return err
+	}
+
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			c.stats.AppMismatch++
+			return err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			c.stats.AppRtt = time.Since(t).Microseconds()
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			c.stats.AppMismatch++
+			return fmt.Errorf("%s: NATS %s", c.target, strings.TrimSpace(line))
+		case strings.HasPrefix(line, "+OK"), strings.HasPrefix(line, "PING"), strings.HasPrefix(line, "INFO "):
+			// the acks and the server's own PING and INFO are skipped
+		default:
+			c.stats.AppMismatch++
+			return fmt.Errorf("%s: unexpected NATS response: %s", c.target, strings.TrimSpace(line))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	yml "gopkg.in/yaml.v3"
+)
+
+// checkConfig validates the config without probing and returns
+// the problems, the unknown keys are reported as well
+func checkConfig(filename string) []string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	b, err = expandEnv(b)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+
+	c := &config{}
+	dec := yml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(c); err != nil {
+		var e *yml.TypeError
+		if !errors.As(err, &e) {
+			return []string{err.Error()}
+		}
+		problems = append(problems, e.Errors...)
+	}
+
+	lines := getTargetLines(b)
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		t.inherit(c.Defaults.target)
+
+		prefix := fmt.Sprintf("target #%d", i+1)
+		if i < len(lines) {
+			prefix = fmt.Sprintf("line %d: %s", lines[i], prefix)
+		}
+		if t.Addr != "" {
+			prefix += " " + t.Addr
+		}
+
+		for _, err := range t.check() {
+			msg := strings.TrimPrefix(err.Error(), t.Addr+": ")
+			problems = append(problems, fmt.Sprintf("%s: %s", prefix, msg))
+		}
+	}
+
+	return problems
+}
+
+// check returns all the problems of the target
+func (t *target) check() []error {
+	var errs []error
+
+	if err := checkAddr(t.Addr); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := t.parse(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for k := range t.Labels {
+		name := strings.Replace(k, "-", "_", -1)
+		if name == "" || !reLabel.MatchString(name) || name[0] >= '0' && name[0] <= '9' {
+			errs = append(errs, fmt.Errorf("invalid label name: %q", k))
+		}
+	}
+
+	return errs
+}
+
+// checkAddr validates the target address without resolving it
+func checkAddr(addr string) error {
+	if addr == "" {
+		return errors.New("missing addr")
+	}
+
+	if socket, _, err := getUnixSocket(addr); socket != "" || err != nil {
+		return err
+	}
+
+	c := newClient(&request{}, addr)
+	if strings.Contains(addr, "://") && c.urlSchema.Scheme == "" {
+		return fmt.Errorf("invalid address: %s", addr)
+	}
+
+	host, port, err := c.getHostPort()
+	if err != nil {
+		return err
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("invalid port: %s", port)
+	}
+
+	if host == "" {
+		return fmt.Errorf("missing host: %s", addr)
+	}
+
+	if c.urlSchema.Scheme == "dns" {
+		_, err = getDNSQuery(c.urlSchema)
+	}
+
+	return err
+}
+
+// getTargetLines returns the line of each target in the config
+func getTargetLines(b []byte) []int {
+	var (
+		doc   yml.Node
+		lines []int
+	)
+
+	if err := yml.Unmarshal(b, &doc); err != nil || len(doc.Content) < 1 {
+		return nil
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "targets" {
+			continue
+		}
+
+		for _, n := range root.Content[i+1].Content {
+			lines = append(lines, n.Line)
+		}
+	}
+
+	return lines
+}
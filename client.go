@@ -8,103 +8,320 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"os"
+	"regexp"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
-	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
 )
 
 // stats represents the metrics including socket
 // statistics, TCP connect, DNS, TLS, HTTP and errors.
 type stats struct {
 	State         uint8   `name:"tcpinfo_state" help:"TCP state"`
-	CaState       uint8   `name:"tcpinfo_ca_state" help:"state of congestion avoidance"`
-	Retransmits   uint8   `name:"tcpinfo_retransmits" help:"number of retranmissions on timeout invoked"`
-	Probes        uint8   `name:"tcpinfo_probes" help:"consecutive zero window probes that have gone unanswered"`
-	Backoff       uint8   `name:"tcpinfo_backoff" help:"used for exponential backoff re-transmission"`
-	Options       uint8   `name:"tcpinfo_options" help:"number of requesting options"`
+	CaState       uint8   `name:"tcpinfo_ca_state" help:"state of congestion avoidance" os:"linux"`
+	Retransmits   uint8   `name:"tcpinfo_retransmits" help:"number of retranmissions on timeout invoked" os:"linux"`
+	Probes        uint8   `name:"tcpinfo_probes" help:"consecutive zero window or keepalive probes that have gone unanswered" os:"linux"`
+	Backoff       uint8   `name:"tcpinfo_backoff" help:"used for exponential backoff re-transmission" os:"linux"`
+	Options       uint8   `name:"tcpinfo_options" help:"number of requesting options" os:"linux,darwin"`
 	pad           [2]byte `unexported:"true"`
-	Rto           uint32  `name:"tcpinfo_rto" help:"tcp re-transmission timeout value, the unit is microsecond"`
-	Ato           uint32  `name:"tcpinfo_ato" help:"ack timeout, unit is microsecond"`
+	Rto           uint32  `name:"tcpinfo_rto" help:"tcp re-transmission timeout value, the unit is microsecond" os:"linux,darwin"`
+	Ato           uint32  `name:"tcpinfo_ato" help:"ack timeout, unit is microsecond" os:"linux"`
 	SndMss        uint32  `name:"tcpinfo_snd_mss" help:"current maximum segment size"`
-	RcvMss        uint32  `name:"tcpinfo_rcv_mss" help:"maximum observed segment size from the remote host"`
-	Unacked       uint32  `name:"tcpinfo_unacked" help:"number of unack'd segments"`
-	Sacked        uint32  `name:"tcpinfo_sacked" help:"scoreboard segment marked SACKED by sack blocks accounting for the pipe algorithm"`
-	Lost          uint32  `name:"tcpinfo_lost" help:"scoreboard segments marked lost by loss detection heuristics accounting for the pipe algorithm"`
-	Retrans       uint32  `name:"tcpinfo_retrans" help:"how many times the retran occurs"`
-	Fackets       uint32  `name:"tcpinfo_fackets" help:""`
-	LastDataSent  uint32  `name:"tcpinfo_last_data_sent" help:"time since last data segment was sent"`
-	LastAckSent   uint32  `name:"tcpinfo_last_ack_sent" help:"how long time since the last ack sent"`
-	LastDataRecv  uint32  `name:"tcpinfo_last_data_recv" help:"time since last data segment was received"`
-	LastAckRecv   uint32  `name:"tcpinfo_last_ack_recv" help:"how long time since the last ack received"`
-	Pmtu          uint32  `name:"tcpinfo_path_mtu" help:"path MTU"`
-	RcvSsthresh   uint32  `name:"tcpinfo_rev_ss_thresh" help:"tcp congestion window slow start threshold"`
-	Rtt           uint32  `name:"tcpinfo_rtt" help:"smoothed round trip time"`
-	Rttvar        uint32  `name:"tcpinfo_rtt_var" help:"RTT variance"`
-	SndSsthresh   uint32  `name:"tcpinfo_snd_ss_thresh" help:"slow start threshold"`
+	RcvMss        uint32  `name:"tcpinfo_rcv_mss" help:"maximum observed segment size from the remote host" os:"linux"`
+	Unacked       uint32  `name:"tcpinfo_unacked" help:"number of unack'd segments" os:"linux"`
+	Sacked        uint32  `name:"tcpinfo_sacked" help:"scoreboard segment marked SACKED by sack blocks accounting for the pipe algorithm" os:"linux"`
+	Lost          uint32  `name:"tcpinfo_lost" help:"scoreboard segments marked lost by loss detection heuristics accounting for the pipe algorithm" os:"linux"`
+	Retrans       uint32  `name:"tcpinfo_retrans" help:"how many times the retran occurs" os:"linux"`
+	Fackets       uint32  `name:"tcpinfo_fackets" help:"forward acknowledged segments, unused by the recent kernels" os:"linux"`
+	LastDataSent  uint32  `name:"tcpinfo_last_data_sent" help:"time since last data segment was sent" os:"linux"`
+	LastAckSent   uint32  `name:"tcpinfo_last_ack_sent" help:"how long time since the last ack sent" os:"linux"`
+	LastDataRecv  uint32  `name:"tcpinfo_last_data_recv" help:"time since last data segment was received" os:"linux"`
+	LastAckRecv   uint32  `name:"tcpinfo_last_ack_recv" help:"how long time since the last ack received" os:"linux"`
+	Pmtu          uint32  `name:"tcpinfo_path_mtu" help:"path MTU" os:"linux"`
+	RcvSsthresh   uint32  `name:"tcpinfo_rev_ss_thresh" help:"tcp congestion window slow start threshold" os:"linux"`
+	Rtt           uint32  `name:"tcpinfo_rtt" help:"smoothed round trip time" unit:"us"`
+	Rttvar        uint32  `name:"tcpinfo_rtt_var" help:"RTT variance" unit:"us" os:"linux,darwin"`
+	SndSsthresh   uint32  `name:"tcpinfo_snd_ss_thresh" help:"slow start threshold" os:"linux,darwin"`
 	SndCwnd       uint32  `name:"tcpinfo_snd_cwnd" help:"congestion window size"`
-	Advmss        uint32  `name:"tcpinfo_adv_mss" help:"advertised maximum segment size"`
-	Reordering    uint32  `name:"tcpinfo_reordering" help:"number of reordered segments allowed"`
-	RcvRtt        uint32  `name:"tcpinfo_rcv_rtt" help:"receiver side RTT estimate"`
-	RcvSpace      uint32  `name:"tcpinfo_rcv_space" help:"space reserved for the receive queue"`
-	TotalRetrans  uint32  `name:"tcpinfo_total_retrans" help:"total number of segments containing retransmitted data"`
-	PacingRate    uint64  `name:"tcpinfo_pacing_rate" help:"the pacing rate"`
+	Advmss        uint32  `name:"tcpinfo_adv_mss" help:"advertised maximum segment size" os:"linux"`
+	Reordering    uint32  `name:"tcpinfo_reordering" help:"number of reordered segments allowed" os:"linux"`
+	RcvRtt        uint32  `name:"tcpinfo_rcv_rtt" help:"receiver side RTT estimate" unit:"us" os:"linux"`
+	RcvSpace      uint32  `name:"tcpinfo_rcv_space" help:"space reserved for the receive queue" os:"linux"`
+	TotalRetrans  uint32  `name:"tcpinfo_total_retrans" help:"total number of segments containing retransmitted data" os:"linux,darwin"`
+	PacingRate    uint64  `name:"tcpinfo_pacing_rate" help:"the pacing rate" os:"linux"`
 	maxPacingRate uint64  `name:"tcpinfo_max_pacing_rate" help:"" unexported:"true"`
-	BytesAcked    uint64  `name:"tcpinfo_bytes_acked" help:"bytes acked"`
+	BytesAcked    uint64  `name:"tcpinfo_bytes_acked" help:"bytes acked" os:"linux"`
 	BytesReceived uint64  `name:"tcpinfo_bytes_received" help:"bytes received"`
-	SegsOut       uint32  `name:"tcpinfo_segs_out" help:"segments sent out"`
-	SegsIn        uint32  `name:"tcpinfo_segs_in" help:"segments received"`
-	NotsentBytes  uint32  `name:"tcpinfo_notsent_bytes" help:""`
-	MinRtt        uint32  `name:"tcpinfo_min_rtt" help:""`
-	DataSegsIn    uint32  `name:"tcpinfo_data_segs_in" help:"RFC4898 tcpEStatsDataSegsIn"`
-	DataSegsOut   uint32  `name:"tcpinfo_data_segs_out" help:"RFC4898 tcpEStatsDataSegsOut"`
-	DeliveryRate  uint64  `name:"tcpinfo_delivery_rate" help:""`
-	BusyTime      uint64  `name:"tcpinfo_busy_time" help:"time (usec) busy sending data"`
-	RwndLimited   uint64  `name:"tcpinfo_rwnd_limited" help:"time (usec) limited by receive window"`
-	SndbufLimited uint64  `name:"tcpinfo_sndbuf_limited" help:"time (usec) limited by send buffer"`
-	Delivered     uint32  `name:"tcpinfo_delivered" help:""`
-	DeliveredCe   uint32  `name:"tcpinfo_delivered_ce" help:""`
-	BytesSent     uint64  `name:"tcpinfo_bytes_sent" help:""`
+	SegsOut       uint32  `name:"tcpinfo_segs_out" help:"segments sent out" os:"linux,darwin"`
+	SegsIn        uint32  `name:"tcpinfo_segs_in" help:"segments received" os:"linux,darwin"`
+	NotsentBytes  uint32  `name:"tcpinfo_notsent_bytes" help:"bytes in the write queue not sent yet" os:"linux"`
+	MinRtt        uint32  `name:"tcpinfo_min_rtt" help:"minimum RTT observed" unit:"us" os:"linux,windows"`
+	DataSegsIn    uint32  `name:"tcpinfo_data_segs_in" help:"RFC4898 tcpEStatsDataSegsIn" os:"linux"`
+	DataSegsOut   uint32  `name:"tcpinfo_data_segs_out" help:"RFC4898 tcpEStatsDataSegsOut" os:"linux"`
+	DeliveryRate  uint64  `name:"tcpinfo_delivery_rate" help:"most recent delivery rate, bytes per second" os:"linux"`
+	BusyTime      uint64  `name:"tcpinfo_busy_time" help:"time (usec) busy sending data" unit:"us" os:"linux"`
+	RwndLimited   uint64  `name:"tcpinfo_rwnd_limited" help:"time (usec) limited by receive window" unit:"us" os:"linux"`
+	SndbufLimited uint64  `name:"tcpinfo_sndbuf_limited" help:"time (usec) limited by send buffer" unit:"us" os:"linux"`
+	Delivered     uint32  `name:"tcpinfo_delivered" help:"data segments delivered to the receiver including retransmits" os:"linux"`
+	DeliveredCe   uint32  `name:"tcpinfo_delivered_ce" help:"delivered segments marked with ECN CE" os:"linux"`
+	BytesSent     uint64  `name:"tcpinfo_bytes_sent" help:"RFC4898 tcpEStatsPerfHCDataOctetsOut"`
 	BytesRetrans  uint64  `name:"tcpinfo_bytes_retrans" help:"RFC4898 tcpEStatsPerfOctetsRetrans"`
-	DsackDups     uint32  `name:"tcpinfo_dsack_dups" help:"RFC4898 tcpEStatsStackDSACKDups"`
-	ReordSeen     uint32  `name:"tcpinfo_reord_seen" help:"reordering events seen"`
-	RcvOoopack    uint32  `name:"tcpinfo_rcv_ooopack" help:"out-of-order packets received"`
-	SndWnd        uint32  `name:"tcpinfo_snd_wnd" help:""`
+	DsackDups     uint32  `name:"tcpinfo_dsack_dups" help:"RFC4898 tcpEStatsStackDSACKDups" os:"linux"`
+	ReordSeen     uint32  `name:"tcpinfo_reord_seen" help:"reordering events seen" os:"linux"`
+	RcvOoopack    uint32  `name:"tcpinfo_rcv_ooopack" help:"out-of-order packets received" os:"linux"`
+	SndWnd        uint32  `name:"tcpinfo_snd_wnd" help:"peer's advertised receive window after scaling (bytes)"`
+	RcvWnd        uint32  `name:"tcpinfo_rcv_wnd" help:"local advertised receive window after scaling (bytes)"`
+	Rehash        uint32  `name:"tcpinfo_rehash" help:"PLB or timeout triggered rehash attempts" os:"linux"`
+	TotalRto      uint16  `name:"tcpinfo_total_rto" help:"total number of RTO timeouts" os:"linux,windows"`
+	TotalRtoRecov uint16  `name:"tcpinfo_total_rto_recoveries" help:"total number of RTO recoveries" os:"linux"`
+	TotalRtoTime  uint32  `name:"tcpinfo_total_rto_time" help:"total time spent in RTO recoveries, the unit is millisecond" os:"linux"`
+
+	TCPCongesAlg string `help:"TCP network congestion-avoidance algorithm" os:"linux"`
+
+	RcvOooBytes uint64 `name:"tcpinfo_rcv_ooo_bytes" help:"out-of-order bytes received" os:"darwin"`
 
-	TCPCongesAlg string `help:"TCP network congestion-avoidance algorithm"`
+	BBRBandwidth  uint64 `name:"bbr_bw" help:"BBR estimated bandwidth, bytes per second" os:"linux"`
+	BBRMinRtt     uint32 `name:"bbr_min_rtt" help:"BBR minimum RTT" unit:"us" os:"linux"`
+	BBRPacingGain uint32 `name:"bbr_pacing_gain" help:"BBR pacing gain shifted left 8 bits" os:"linux"`
+	BBRCwndGain   uint32 `name:"bbr_cwnd_gain" help:"BBR congestion window gain shifted left 8 bits" os:"linux"`
 
 	HTTPStatusCode int   `name:"http_status_code" help:"HTTP 1xx-5xx status code"`
 	HTTPRcvdBytes  int64 `name:"http_rcvd_bytes" help:"HTTP bytes received"`
-	HTTPRequest    int64 `name:"http_request" help:"HTTP request, the unit is microsecond"`
-	HTTPResponse   int64 `name:"http_response" help:"HTTP response, the unit is microsecond"`
+	HTTPSentBytes  int64 `name:"http_sent_bytes" help:"HTTP bytes sent including headers"`
+	HTTPRequest    int64 `name:"http_request" help:"HTTP request, the unit is microsecond" unit:"us"`
+	HTTPResponse   int64 `name:"http_response" help:"HTTP response, the unit is microsecond" unit:"us"`
+	HTTPTTFB       int64 `name:"http_ttfb" help:"HTTP time to first byte, the unit is microsecond" unit:"us"`
+	HTTPTransfer   int64 `name:"http_transfer" help:"HTTP content transfer, the unit is microsecond" unit:"us"`
+
+	HTTPProto string `name:"http_proto" help:"HTTP protocol e.g. http/1.1 or h2"`
+	HTTP2     int    `name:"http2" help:"HTTP version 2 used (1) or not (0)"`
+
+	HTTPRedirects    int   `name:"http_redirects" help:"number of HTTP redirects followed"`
+	HTTPRedirectTime int64 `name:"http_redirect_time" help:"HTTP time spent on the redirects before the final request, the unit is microsecond" unit:"us"`
+
+	HTTPExpectationFailed   int64 `name:"http_expectation_failed" help:"total HTTP response didn't match the expected status or body" kind:"counter"`
+	HTTPExpectationMismatch int   `name:"http_expectation_mismatch" help:"last HTTP response didn't match the expected status or body (1) or matched (0)"`
+
+	DownloadBytes int64 `name:"download_bytes" help:"bytes downloaded up to the download-bytes"`
+	DownloadTime  int64 `name:"download_time" help:"download transfer time, the unit is microsecond" unit:"us"`
+	DownloadRate  int64 `name:"download_rate" help:"download rate, bytes per second"`
+	DownloadError int64 `name:"download_error" help:"total download error of the download-url" kind:"counter"`
+
+	UploadTime int64 `name:"upload_time" help:"upload body write time, the unit is microsecond" unit:"us"`
+	UploadRate int64 `name:"upload_rate" help:"upload rate, bytes per second"`
+
+	GRPCCheck  int64 `name:"grpc_check" help:"gRPC health check, the unit is microsecond" unit:"us"`
+	GRPCStatus int   `name:"grpc_status" help:"gRPC health serving status 0 unknown, 1 serving, 2 not serving, 3 service unknown"`
+	GRPCError  int64 `name:"grpc_error" help:"total gRPC health check error" kind:"counter"`
+
+	ICMPSent     int64 `name:"icmp_sent" help:"total ICMP echo requests sent" kind:"counter"`
+	ICMPLost     int64 `name:"icmp_lost" help:"total ICMP echo requests without reply" kind:"counter"`
+	ICMPReplyTTL int   `name:"icmp_reply_ttl" help:"TTL or hop limit of the ICMP echo reply"`
+
+	UDPRtt           int64 `name:"udp_rtt" help:"UDP round trip time to the reply, the unit is microsecond" unit:"us"`
+	UDPReplyReceived int   `name:"udp_reply_received" help:"UDP reply received (1) or not (0)"`
+	UDPUnreachable   int   `name:"udp_unreachable" help:"ICMP port unreachable received (1) or not (0)"`
+	UDPSendError     int64 `name:"udp_send_error" help:"total UDP send error" kind:"counter"`
+
+	QUICHandshake    int64 `name:"quic_handshake" help:"QUIC handshake, the unit is microsecond" unit:"us"`
+	QUIC0RTT         int   `name:"quic_0rtt" help:"QUIC 0-RTT resumption used (1) or not (0)"`
+	QUICConnectError int64 `name:"quic_connect_error" help:"total QUIC connect error e.g. no answer on UDP" kind:"counter"`
+	HTTP3Request     int64 `name:"http3_request" help:"HTTP/3 request to the response's end, the unit is microsecond" unit:"us"`
+	HTTP3RcvdBytes   int64 `name:"http3_rcvd_bytes" help:"HTTP/3 bytes received"`
+
+	AppRtt       int64 `name:"app_rtt" help:"time from sending the payload to the first response byte, the unit is microsecond" unit:"us"`
+	AppRcvdBytes int64 `name:"app_rcvd_bytes" help:"application response bytes received"`
+	AppMismatch  int64 `name:"app_mismatch" help:"total application response didn't match the expectation" kind:"counter"`
+
+	BannerTime     int64  `name:"banner_time" help:"time to the server's banner after connect, the unit is microsecond" unit:"us"`
+	Banner         string `name:"banner" help:"server's banner, the non-printable bytes are escaped"`
+	BannerMismatch int64  `name:"banner_mismatch" help:"total banner didn't match the expect-banner-regex" kind:"counter"`
+
+	DNSRtt         int64 `name:"dns_rtt" help:"DNS query response time of the dns:// target, the unit is microsecond" unit:"us"`
+	DNSAnswerCount int   `name:"dns_answer_count" help:"number of answers in the DNS response"`
+	DNSRcodeError  int64 `name:"dns_rcode_error" help:"total DNS response with non-zero RCODE" kind:"counter"`
+
+	DNSResolve   int64 `name:"dns_resolve" help:"domain lookup, the unit is microsecond" unit:"us"`
+	DNSCacheHit  int   `name:"dns_cache_hit" help:"1 if the target is resolved from the DNS cache"`
+	TCPConnect   int64 `name:"tcp_connect" help:"TCP connect, the unit is microsecond" unit:"us"`
+	TLSHandshake int64 `name:"tls_handshake" help:"TLS handshake, the unit is microsecond" unit:"us"`
+
+	StartTLS      int64 `name:"starttls" help:"plaintext exchange before the TLS handshake, the unit is microsecond" unit:"us"`
+	StartTLSError int64 `name:"starttls_error" help:"total plaintext exchange failed before the TLS handshake" kind:"counter"`
+
+	DBRtt     int64  `name:"db_rtt" help:"time to the first protocol byte of the database, the unit is microsecond" unit:"us"`
+	DBVersion string `name:"db_version" help:"database's advertised version, postgres doesn't advertise it before the authentication"`
+	DBTLS     int    `name:"db_tls" help:"1 if the database accepts TLS"`
+	DBError   int64  `name:"db_error" help:"total database handshake error" kind:"counter"`
+
+	WSUpgrade     int64 `name:"ws_upgrade" help:"WebSocket upgrade handshake, the unit is microsecond" unit:"us"`
+	WSPongRtt     int64 `name:"ws_pong_rtt" help:"WebSocket ping to pong round trip, the unit is microsecond" unit:"us"`
+	WSRejected    int64 `name:"ws_rejected" help:"total WebSocket upgrade rejected by the HTTP status" kind:"counter"`
+	WSBadAccept   int64 `name:"ws_bad_accept" help:"total WebSocket upgrade with invalid Sec-WebSocket-Accept" kind:"counter"`
+	WSPongTimeout int64 `name:"ws_pong_timeout" help:"total WebSocket ping without pong within the timeout" kind:"counter"`
 
-	DNSResolve   int64 `name:"dns_resolve" help:"domain lookup, the unit is microsecond"`
-	TCPConnect   int64 `name:"tcp_connect" help:"TCP connect, the unit is microsecond"`
-	TLSHandshake int64 `name:"tls_handshake" help:"TLS handshake, the unit is microsecond"`
+	MQTTReturnCode int `name:"mqtt_return_code" help:"return code of the MQTT CONNACK, zero is accepted"`
+
+	LocalAddr  string `name:"local_addr" help:"local IP address of the connection"`
+	LocalPort  int    `name:"local_port" help:"local ephemeral port of the connection"`
+	RemoteAddr string `name:"remote_addr" help:"remote IP address which dialed, it's the proxy's address in the proxy modes"`
 
 	TCPConnectError int64 `name:"tcp_connect_error" help:"total TCP connect error" kind:"counter"`
+	ProbeFailed     int64 `name:"probe_failed" help:"total probes failed to connect after the retries" kind:"counter"`
+	Reconnects      int64 `name:"reconnects" help:"total reconnects of the persistent connection" kind:"counter"`
 	DNSResolveError int64 `name:"dns_resolve_error" help:"total DNS resolve error" kind:"counter"`
+
+	TCPConnectTimeout int64 `name:"tcp_connect_timeout" help:"total DNS and TCP connect timed out by the connect-timeout" kind:"counter"`
+	TLSTimeout        int64 `name:"tls_timeout" help:"total TLS handshake timed out by the tls-timeout" kind:"counter"`
+	HTTPTimeout       int64 `name:"http_timeout" help:"total HTTP request and response timed out by the http-timeout" kind:"counter"`
+
+	TraceHops   int   `name:"trace_hops" help:"number of hops of the last traceroute after the connect failures"`
+	PathChanged int64 `name:"path_changed" help:"total traceroute hop list changed since the last trace" kind:"counter"`
+
+	ResolvedIP string `name:"resolved_ip" help:"IP address of the target which probed"`
+	IPChanged  int64  `name:"ip_changed" help:"total resolved IP address changed" kind:"counter"`
+
+	TLSCertExpiry   int64  `name:"tls_cert_expiry_seconds" help:"seconds until the server's leaf certificate expires"`
+	TLSCertChainLen int    `name:"tls_cert_chain_len" help:"number of certificates presented by the server"`
+	TLSCertIssuer   string `name:"tls_cert_issuer" help:"server's leaf certificate issuer"`
+	TLSCertSubject  string `name:"tls_cert_subject" help:"server's leaf certificate subject"`
+
+	TLSVersion         int    `name:"tls_version" help:"negotiated TLS version code e.g. 771 is TLS 1.2"`
+	TLSVersionName     string `name:"tls_version_name" help:"negotiated TLS version"`
+	TLSCipherSuite     int    `name:"tls_cipher_suite" help:"negotiated TLS cipher suite code"`
+	TLSCipherSuiteName string `name:"tls_cipher_suite_name" help:"negotiated TLS cipher suite"`
+
+	TLSHandshakeError  int64 `name:"tls_handshake_error" help:"total TLS handshake error" kind:"counter"`
+	TLSClientAuthError int64 `name:"tls_client_auth_error" help:"total TLS client certificate rejected by server" kind:"counter"`
+	TLSVersionError    int64 `name:"tls_version_error" help:"total TLS version not supported by server" kind:"counter"`
+
+	ProxyConnect      int64 `name:"proxy_connect" help:"proxy CONNECT or SOCKS5 handshake, the unit is microsecond" unit:"us"`
+	ProxyConnectError int64 `name:"proxy_connect_error" help:"total proxy CONNECT or SOCKS5 handshake error" kind:"counter"`
+
+	AvailProbes              int64 `name:"availability_probes" help:"total probes which accounted for the availability" kind:"counter"`
+	AvailFailed              int64 `name:"availability_failed" help:"total probes which failed by the availability-failure" kind:"counter"`
+	AvailConsecutiveFailures int64 `name:"availability_consecutive_failures" help:"current consecutive failed probes"`
+	AvailLastChange          int64 `name:"availability_last_change" help:"unix time of the last up or down state change"`
+	AvailDowntime            int64 `name:"availability_downtime_seconds" help:"cumulative downtime in seconds" kind:"counter"`
+
+	TargetDown int `name:"target_down" help:"target is down by the down-threshold consecutive failed probes"`
+
+	RttJitter uint32 `name:"rtt_jitter" help:"mean absolute difference of the consecutive RTTs of the window" unit:"us"`
+	RttP50    uint32 `name:"rtt_p50" help:"50th percentile RTT of the window" unit:"us"`
+	RttP95    uint32 `name:"rtt_p95" help:"95th percentile RTT of the window" unit:"us"`
+	RttP99    uint32 `name:"rtt_p99" help:"99th percentile RTT of the window" unit:"us"`
+	RttMin    uint32 `name:"rtt_min" help:"minimum RTT of the window" unit:"us"`
+	RttMax    uint32 `name:"rtt_max" help:"maximum RTT of the window" unit:"us"`
+
+	InfluxWriteError int64 `name:"influx_write_error" help:"total InfluxDB points not written e.g. the write failed or the queue is full" kind:"counter"`
 }
 
 // client represents a proble client to specific target
 type client struct {
+	// influxErrors is the influx's write errors, it's counted by the
+	// flush and the stats are updated on report. it's the first field
+	// to keep the 64-bit alignment of the atomic access
+	influxErrors int64
+
 	target    string
 	addr      string
 	timestamp int64
+	probed    time.Time
+	started   time.Time
+	avail     availability
+	window    *rttWindow
+	downState downState
+	warmed    int
+	warming   bool
+	stop      func(target string, err error)
+	labels    map[string]string
 	urlSchema *url.URL
 
-	conn net.Conn
-	req  *request
+	conn       net.Conn
+	req        *request
+	persistent *persistent
+
+	// quicSessions keeps the session tickets to resume the
+	// next HTTP/3 probes by 0-RTT
+	quicSessions tls.ClientSessionCache
 
 	subCh []chan *stats
 	mu    *sync.Mutex
 
+	summary   *summary
+	status    probeStatus
+	threshold threshold
+	output    outputState
+	alert     alertState
+
+	clientCert   *clientCert
+	handshakeErr error
+	bodyRegex    *regexp.Regexp
+	bannerRegex  *regexp.Regexp
+	resolver     *net.Resolver
+	resolves     int
+	ip           string
+
+	bindDevice bool
+	ifaceAddr  net.Addr
+
+	dialed   bool
+	hopConns []net.Conn
+	tlsConn  net.Conn
+	h2       bool
+	grpcConn *grpc.ClientConn
+	icmpSeq  int
+
+	unixSocket string
+	unixPath   string
+
+	connectFailures int
+	traceLast       time.Time
+	traceHops       []traceHop
+
+	// remoteIP is the dialed remote IP of the metrics' label,
+	// it's loaded by the scrapes while the probe dials
+	remoteIP atomic.Value
+
+	totals     map[string]uint64
+	totalsConn net.Conn
+
+	influx *influx
+
+	statsd     *statsd
+	statsdLast map[string]float64
+
+	otlp       *otlp
+	tracer     *tracer
+	probeTrace *probeTrace
+
+	kafka   *kafka
+	syslog  *syslog
+	history *history
+
+	ndjson  *ndjson
+	webhook *webhook
+	hook    *hook
+
+	alertmanager *alertmanager
+
+	scheduler *scheduler
+	splayRand *rand.Rand
+
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+	histograms map[string]prometheus.Histogram
+
 	stats
 }
 
@@ -118,95 +335,238 @@ func newClient(req *request, target string) *client {
 		target:    target,
 		urlSchema: urlSchema,
 		req:       req,
+		summary:   newSummary(),
+		window:    newRttWindow(req.rttWindow),
 	}
 
 	if req.grpc {
 		c.mu = &sync.Mutex{}
 	}
 
+	if req.splay > 0 {
+		c.splayRand = newSplayRand(target, req.splayStable)
+	}
+
+	c.unixSocket, c.unixPath, err = getUnixSocket(target)
+	if err != nil {
+		errorf("%v", err)
+	}
+
+	if req.tlsCert != "" {
+		c.clientCert, err = newClientCert(req.tlsCert, req.tlsKey)
+		if err != nil {
+			errorf("%v", err)
+		}
+	}
+
+	if req.iface != "" {
+		if err = bindToDevice(req.iface); err != nil {
+			c.ifaceAddr, _ = getInterfaceAddr(req.iface, req.ipv6)
+			warnf("%v, binding to the %s's address %v instead", err, req.iface, c.ifaceAddr)
+		} else {
+			c.bindDevice = true
+		}
+	}
+
+	if req.resolver != "" {
+		c.resolver = newResolver(req.resolver, req.timeout)
+	}
+
+	if req.expectBodyRegex != "" {
+		c.bodyRegex, err = regexp.Compile(req.expectBodyRegex)
+		if err != nil {
+			errorf("%v", err)
+		}
+	}
+
+	if req.expectBannerRegex != "" {
+		c.bannerRegex, err = regexp.Compile(req.expectBannerRegex)
+		if err != nil {
+			errorf("%v", err)
+		}
+	}
+
+	c.persistent = c.newPersistent()
+
 	return c
 }
 
 func (c *client) connect(ctx context.Context) error {
 	var err error
 
-	c.timestamp = time.Now().Unix()
+	c.probed = time.Now()
+	c.timestamp = c.probed.Unix()
+
+	if c.isUnix() {
+		return c.connectUnix(ctx)
+	}
+
+	proxyURL, err := c.getProxy()
+	if err != nil {
+		return err
+	}
 
-	addr, err := c.getAddr()
+	var addr string
+	end := c.span("dns")
+	if proxyURL != nil {
+		addr, err = c.resolve(ctx, proxyURL.Hostname(), proxyURL.Port())
+	} else {
+		addr, err = c.getAddr(ctx)
+	}
+	end(err)
 	if err != nil {
+		if isTimeout(err) {
+			c.stats.TCPConnectTimeout++
+		}
 		return err
 	}
 
 	c.addr = addr
 
 	d := net.Dialer{
-		LocalAddr: getSrcAddr(c.req.srcAddr),
+		LocalAddr: c.localAddr(),
 		Control:   c.control,
 	}
-	ctx, cancel := context.WithTimeout(ctx, c.req.timeout)
+
+	// the keepalive options are set by control
+	if c.req.soKeepAlive {
+		d.KeepAlive = -1
+	}
+	// the connect timeout bounds the DNS and the TCP connect
+	ctx, cancel := context.WithDeadline(ctx, c.probed.Add(c.connectTimeout()))
 	defer cancel()
 
+	network := "tcp"
+	if proxyURL == nil {
+		network = c.network()
+	}
+
+	end = c.span("connect")
 	t := time.Now()
-	c.conn, err = d.DialContext(ctx, "tcp", addr)
+	c.conn, err = d.DialContext(ctx, network, addr)
+	end(err)
 	if err != nil {
 		c.stats.TCPConnectError++
+		if isTimeout(err) {
+			c.stats.TCPConnectTimeout++
+		}
 		return err
 	}
 
 	c.stats.TCPConnect = time.Since(t).Microseconds()
+	c.setSocketAddr()
+
+	debugf("target: %s, ip: %s, local: %s has been connected", c.target, addr, c.conn.LocalAddr())
+
+	if proxyURL != nil {
+		if err = c.proxyConnect(ctx, proxyURL); err != nil {
+			c.stats.ProxyConnectError++
+			c.conn.Close()
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (c *client) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	return c.conn, nil
-}
+// setSocketAddr records the connection's local IP and port and the
+// dialed remote IP to correlate the probe with the packet captures
+func (c *client) setSocketAddr() {
+	c.stats.LocalAddr, c.stats.LocalPort, c.stats.RemoteAddr = "", 0, ""
 
-func (c *client) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	config := tls.Config{InsecureSkipVerify: c.req.insecure, ServerName: c.serverName()}
-	tlsConn := tls.Client(c.conn, &config)
+	if local, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		c.stats.LocalAddr = local.IP.String()
+		c.stats.LocalPort = local.Port
+	}
 
-	t := time.Now()
-	err := tlsConn.Handshake()
-	c.stats.TLSHandshake = time.Since(t).Microseconds()
+	if remote, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		c.stats.RemoteAddr = remote.IP.String()
+	}
 
-	return tlsConn, err
+	c.remoteIP.Store(c.stats.RemoteAddr)
 }
 
-func (c *client) control(network string, address string, conn syscall.RawConn) error {
-	return conn.Control(func(fd uintptr) {
+// getRemoteIP returns the last dialed remote IP
+func (c *client) getRemoteIP() string {
+	ip, _ := c.remoteIP.Load().(string)
+	return ip
+}
 
-		setSocketOptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PRIORITY, c.req.soPriority, false)
-		setSocketOptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, c.req.soSndBuf, false)
-		setSocketOptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, c.req.soRcvBuf, false)
-		setSocketOptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, boolToInt(!c.req.soTCPNoDelay), true)
-		setSocketOptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, boolToInt(!c.req.soTCPQuickACK), true)
-		setSocketOptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, c.req.soMaxSegSize, false)
+// connectRetry connects to the target, the failed connect is retried
+// with exponential backoff up to the retries within the probe timeout
+func (c *client) connectRetry(ctx context.Context) error {
+	if c.req.retries < 1 {
+		return c.connect(ctx)
+	}
 
-		if c.isIPv4() {
-			setSocketOptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, c.req.soIPTOS, false)
-			setSocketOptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, c.req.soIPTTL, false)
-		} else {
-			setSocketOptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, c.req.soIPTTL, false)
-			setSocketOptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, c.req.soIPTOS, false)
+	ctx, cancel := context.WithTimeout(ctx, c.req.timeout)
+	defer cancel()
+
+	backoff := c.req.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.connect(ctx)
+		if err == nil || attempt >= c.req.retries {
+			return err
 		}
 
-		err := syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, c.req.soCongestion)
-		if c.req.soCongestion != "" && err != nil {
-			log.Fatal(os.NewSyscallError("congestion-avoidance algorithm error", err))
+		warnf("%v, retrying in %s", err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
 		}
-	})
+
+		backoff *= 2
+	}
 }
 
-func setSocketOptInt(fd int, level int, opt int, value int, zeroExc bool) {
-	if (value == 0 && !zeroExc) || (value == 1 && zeroExc) {
-		return
+func (c *client) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.req.followRedirects && c.dialed {
+		conn, err := c.dialHop(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return countConn{conn, &c.stats.HTTPSentBytes}, nil
+	}
+	c.dialed = true
+
+	return c.track(countConn{c.conn, &c.stats.HTTPSentBytes}), nil
+}
+
+func (c *client) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// the connection has been negotiated already (http2)
+	if c.tlsConn != nil {
+		conn := c.tlsConn
+		c.tlsConn = nil
+		return conn, nil
 	}
 
-	err := syscall.SetsockoptInt(fd, level, opt, value)
+	if c.req.followRedirects && c.dialed {
+		return c.dialTLSHop(ctx, network, addr)
+	}
+	c.dialed = true
+
+	tlsConn := tls.Client(c.track(c.conn), c.tlsConfig())
+	c.conn.SetDeadline(c.tlsDeadline())
+	defer abortOnCancel(ctx, c.conn)()
+
+	end := c.span("tls")
+	t := time.Now()
+	err := tlsConn.Handshake()
+	c.stats.TLSHandshake = time.Since(t).Microseconds()
+	end(err)
+	c.handshakeErr = err
+	c.conn.SetDeadline(time.Time{})
 	if err != nil {
-		log.Println(os.NewSyscallError("setsockopt", err))
+		c.tlsError(err)
 	}
+
+	c.tlsCertStats(tlsConn.ConnectionState())
+	c.tlsVersionStats(tlsConn.ConnectionState())
+	c.h2 = tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+
+	return countConn{tlsConn, &c.stats.HTTPSentBytes}, err
 }
 
 func (c *client) getHostPort() (string, string, error) {
@@ -226,9 +586,30 @@ func (c *client) getHostPort() (string, string, error) {
 			host = c.target
 		}
 
-		if c.urlSchema.Scheme == "https" {
+		switch c.urlSchema.Scheme {
+		case "tcp", "tls", "grpc", "udp":
+			return "", "", fmt.Errorf("%s: missing port in address", c.target)
+		case "dns":
+			port = "53"
+		case "icmp":
+			port = "0"
+		case "postgres":
+			port = "5432"
+		case "mysql":
+			port = "3306"
+		case "redis":
+			port = "6379"
+		case "memcached":
+			port = "11211"
+		case "mqtt":
+			port = "1883"
+		case "mqtts":
+			port = "8883"
+		case "nats":
+			port = "4222"
+		case "https", "wss":
 			port = "443"
-		} else {
+		default:
 			port = "80"
 		}
 	} else if err != nil {
@@ -238,18 +619,50 @@ func (c *client) getHostPort() (string, string, error) {
 	return host, port, nil
 }
 
-func (c *client) getAddr() (string, error) {
+func (c *client) getAddr(ctx context.Context) (string, error) {
 	host, port, err := c.getHostPort()
 	if err != nil {
 		return "", err
 	}
 
+	// the address is pinned (all-ips)
+	if c.ip != "" {
+		c.stats.ResolvedIP = c.ip
+		return net.JoinHostPort(c.ip, port), nil
+	}
+
+	// the previous address is reused until the next resolve
+	lastIP := c.stats.ResolvedIP
+	c.resolves++
+	if lastIP != "" && c.req.resolveEvery > 1 && (c.resolves-1)%c.req.resolveEvery != 0 {
+		return net.JoinHostPort(lastIP, port), nil
+	}
+
+	addr, err := c.resolve(ctx, host, port)
+	if err != nil {
+		if lastIP == "" {
+			return "", err
+		}
+		// keep probing the previous address
+		warnf("%v, keep probing the previous address %s", err, lastIP)
+		addr = net.JoinHostPort(lastIP, port)
+	}
+
+	c.stats.ResolvedIP, _, _ = net.SplitHostPort(addr)
+	if lastIP != "" && lastIP != c.stats.ResolvedIP {
+		c.stats.IPChanged++
+	}
+
+	return addr, nil
+}
+
+func (c *client) resolve(ctx context.Context, host, port string) (string, error) {
 	if ok := isIPAddr(host); ok {
 		return net.JoinHostPort(host, port), nil
 	}
 
 	t := time.Now()
-	addrs, err := net.LookupHost(host)
+	addrs, err := c.lookupHost(ctx, host)
 	if err != nil {
 		c.stats.DNSResolveError++
 		return "", err
@@ -274,22 +687,105 @@ func (c *client) getAddr() (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("ip address not available")
+	c.stats.DNSResolveError++
+
+	family := c.req.family()
+	if family == "" {
+		family = "ip"
+	}
+
+	return "", fmt.Errorf("%s: %s address not available", host, family)
+}
+
+// network returns the dial network of the requested address family
+func (c *client) network() string {
+	switch {
+	case c.req.ipv4:
+		return "tcp4"
+	case c.req.ipv6:
+		return "tcp6"
+	}
+
+	return "tcp"
 }
 
 func (c *client) close() {
+	if c.grpcConn != nil {
+		c.grpcConn.Close()
+		c.grpcConn = nil
+	}
+
 	c.conn.Close()
 }
 
+// isHTTP returns true if the target is probed by HTTP
+// request after connect
+func (c *client) isHTTP() bool {
+	return !c.req.noHTTP && !c.req.tlsOnly && c.req.starttls == "" && (strings.HasPrefix(c.target, "http") || c.isUnix())
+}
+
+// isTLSOnly returns true if the target is probed by TLS
+// handshake without HTTP request
+func (c *client) isTLSOnly() bool {
+	return c.req.tlsOnly || c.urlSchema.Scheme == "tls"
+}
+
+// standalone returns the probe of the targets which don't
+// connect by TCP before, nil otherwise
+func (c *client) standalone() func(context.Context) error {
+	switch c.urlSchema.Scheme {
+	case "dns":
+		return c.dnsProbe
+	case "udp":
+		return c.udpProbe
+	case "icmp":
+		return c.icmpProbe
+	case "https":
+		if c.req.http3 {
+			return c.http3Probe
+		}
+	}
+
+	return nil
+}
+
+// isGRPC returns true if the target is probed by
+// gRPC health check
+func (c *client) isGRPC() bool {
+	return c.urlSchema.Scheme == "grpc"
+}
+
 func (c *client) isIPv4() bool {
-	return net.ParseIP(c.addr).To4() != nil
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		host = c.addr
+	}
+
+	return net.ParseIP(host).To4() != nil
 }
 
-func (c *client) httpGet() error {
-	tr := &http.Transport{
-		DialContext:       c.dialContext,
-		DialTLSContext:    c.dialTLSContext,
-		ForceAttemptHTTP2: c.req.http2,
+// httpGet requests the target over the probe's connection, the
+// request and its body read are aborted once the context is canceled
+func (c *client) httpGet(ctx context.Context) error {
+	c.dialed = false
+	c.tlsConn = nil
+	c.h2 = false
+	c.handshakeErr = nil
+
+	var tr http.RoundTripper = &http.Transport{
+		DialContext:    c.dialContext,
+		DialTLSContext: c.dialTLSContext,
+	}
+
+	if c.persistent != nil {
+		tr = c.persistent.transport
+	}
+
+	if c.req.http2 && c.urlSchema.Scheme == "https" {
+		var err error
+		if tr, err = c.http2Transport(ctx, tr); err != nil {
+			return err
+		}
 	}
 
 	httpClient := &http.Client{
@@ -297,25 +793,156 @@ func (c *client) httpGet() error {
 		Transport:     tr,
 		CheckRedirect: c.noRedirect,
 	}
+
+	c.stats.HTTPRedirects = 0
+	c.stats.HTTPRedirectTime = 0
+	defer c.closeHops()
+
+	// the http2 transport writes the request by its own goroutine
+	var (
+		mu                                    sync.Mutex
+		wroteHeaders, wroteRequest, firstByte time.Time
+	)
+	trace := &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			mu.Lock()
+			wroteHeaders = time.Now()
+			mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wroteRequest = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			firstByte = time.Now()
+			mu.Unlock()
+		},
+	}
+
+	method := c.req.httpMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	target := c.target
+	if c.isUnix() {
+		target = c.unixURL()
+	}
+
+	// the upload's generated body replaces the request's body
+	body, length := io.Reader(bytes.NewReader(c.req.httpBody)), int64(len(c.req.httpBody))
+	if c.req.uploadBytes > 0 {
+		method = uploadMethod(method)
+		body, length = c.uploadBody()
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace),
+		method, target, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+
+	for k, v := range c.req.httpHeaders {
+		req.Header[k] = v
+	}
+
+	// the host header overrides the request's host, the TLS server
+	// name is controlled by the server name option separately
+	if host := c.req.httpHeaders.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	c.stats.HTTPSentBytes = 0
+
+	// the request span is the parent of the server's span
+	end := c.span("request")
+	if c.req.tracePropagate {
+		if tp := c.traceparent(); tp != "" {
+			req.Header.Set("traceparent", tp)
+		}
+	}
+
 	t := time.Now()
-	resp, err := httpClient.Get(c.target)
+	if c.req.followRedirects {
+		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) > c.req.maxRedirects {
+				return fmt.Errorf("%s stopped after %d redirects", c.target, c.req.maxRedirects)
+			}
+			c.stats.HTTPRedirects = len(via)
+			c.stats.HTTPRedirectTime = time.Since(t).Microseconds()
+			return nil
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	end(err)
 	if err != nil {
+		// TLS 1.3 client certificate rejection arrives after handshake
+		if isTLSClientAuthError(err) && c.handshakeErr == nil {
+			c.stats.TLSClientAuthError++
+		}
+		// the handshake's timeout is counted by the TLS
+		if isTimeout(err) && !isTimeout(c.handshakeErr) {
+			c.stats.HTTPTimeout++
+		}
 		return err
 	}
 	c.stats.HTTPRequest = time.Since(t).Microseconds()
 
+	if c.req.uploadBytes > 0 {
+		mu.Lock()
+		c.recordUpload(wroteHeaders, wroteRequest)
+		mu.Unlock()
+	}
+
+	end = c.span("body-read")
+	defer func() { end(err) }()
+
 	t = time.Now()
-	written, err := io.Copy(ioutil.Discard, resp.Body)
+	var head []byte
+	if c.bodyRegex != nil {
+		head, err = ioutil.ReadAll(io.LimitReader(resp.Body, c.req.expectBodyLimit))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the body is read up to the download bytes to measure the throughput
+	var written int64
+	if c.req.downloadBytes > 0 && c.req.downloadURL == "" {
+		written, err = c.readDownload(resp.Body)
+	} else {
+		written, err = io.Copy(ioutil.Discard, resp.Body)
+	}
 	if err != nil {
+		if isTimeout(err) {
+			c.stats.HTTPTimeout++
+		}
 		return err
 	}
+	written += int64(len(head))
 	c.stats.HTTPResponse = time.Since(t).Microseconds()
+	mu.Lock()
+	c.stats.HTTPTTFB = firstByte.Sub(wroteRequest).Microseconds()
+	c.stats.HTTPTransfer = time.Since(firstByte).Microseconds()
+	mu.Unlock()
 
 	c.stats.HTTPStatusCode = resp.StatusCode
+	c.stats.HTTPProto = strings.ToLower(resp.Proto)
+	c.stats.HTTP2 = 0
+	if resp.ProtoMajor == 2 {
+		c.stats.HTTPProto = http2.NextProtoTLS
+		c.stats.HTTP2 = 1
+	}
 	c.stats.HTTPRcvdBytes = written
 
 	resp.Body.Close()
 
+	c.checkExpectations(resp.StatusCode, head)
+
 	return nil
 }
 
@@ -345,44 +972,243 @@ func (c *client) serverName() string {
 }
 
 func (c *client) probe(ctx context.Context) {
+	defer c.closePersistent()
+
+	if c.scheduler != nil {
+		c.scheduler.run(ctx, c)
+		return
+	}
+
 	counter := -1
 	wait := c.getInterval(ctx)
+
+	if offset := c.splayOffset(wait); offset > 0 {
+		select {
+		case <-time.After(offset):
+		case <-ctx.Done():
+			return
+		}
+	}
+
 	for counter < c.req.count-1 || c.req.count == 0 {
 		counter++
 
 		if counter != 0 {
 			select {
-			case <-time.After(wait):
+			case <-time.After(c.nextInterval(c.cadence(wait))):
 			case <-ctx.Done():
 				return
 			}
 		}
 
-		err := c.connect(ctx)
+		if !c.probeOnce(ctx, counter) {
+			return
+		}
+	}
+}
+
+// probeOnce probes the target once, it returns false if the
+// probe interrupted by the context
+func (c *client) probeOnce(ctx context.Context, counter int) bool {
+	c.started = time.Now()
+	c.startWarmup()
+	c.startTrace()
+	defer c.endTrace(ctx)
+
+	if probe := c.standalone(); probe != nil {
+		err := probe(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
 		if err != nil {
-			if ctx.Err() == nil {
-				log.Println(err)
-			}
-			continue
+			errorf("%v", err)
+		}
+
+		c.record(err)
+		if err == nil {
+			c.checkThresholds()
 		}
 
-		if strings.HasPrefix(c.target, "http") {
-			if err := c.httpGet(); err != nil {
-				log.Println(err)
+		c.account(err)
+		c.sampleRtt(err)
+		c.report(ctx, counter)
+		return true
+	}
+
+	var err error
+	if c.persistent != nil {
+		err = c.reuse(ctx)
+	} else {
+		err = c.connectRetry(ctx)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			errorf("%v", err)
+			c.stats.ProbeFailed++
+			c.record(err)
+			c.account(err)
+			c.connectFailures++
+			c.traceOnFailure(ctx)
+			c.report(ctx, counter)
+		}
+		return true
+	}
+	c.connectFailures = 0
+
+	if c.readsBanner() {
+		if err = c.readBanner(ctx); err != nil {
+			errorf("%v", err)
+		}
+	}
+
+	// the request is sent once the server's banner is read
+	if err == nil && c.isHTTP() {
+		if err = c.httpGet(ctx); err != nil {
+			errorf("%v", err)
+		} else if c.req.downloadURL != "" {
+			if e := c.download(ctx); e != nil {
+				errorf("%v", e)
+			}
+		}
+	} else if err == nil && c.isWebSocket() {
+		if err = c.wsProbe(ctx); err != nil {
+			errorf("%v", err)
+		}
+	} else if err == nil {
+		if c.isGRPC() {
+			if err = c.grpcHealthCheck(ctx); err != nil {
+				errorf("%v", err)
+			}
+		} else if c.isTLSOnly() {
+			if _, err = c.tlsHandshake(ctx, c.tlsConfig()); err != nil {
+				errorf("%v", err)
+			}
+		} else if c.req.starttls != "" {
+			if err = c.startTLS(ctx); err != nil {
+				errorf("%v", err)
+			}
+		} else if c.isDatabase() {
+			if err = c.dbProbe(ctx); err != nil {
+				errorf("%v", err)
+			}
+		} else if c.isKVStore() {
+			if err = c.kvProbe(ctx); err != nil {
+				errorf("%v", err)
+			}
+		} else if c.isBroker() {
+			if err = c.brokerProbe(ctx); err != nil {
+				errorf("%v", err)
+			}
+		} else if c.req.sendPayload != nil {
+			if err = c.appProbe(ctx); err != nil {
+				errorf("%v", err)
 			}
 		}
 
-		if err = c.getTCPInfo(); err != nil {
-			log.Println(err)
+		if c.req.hold > 0 {
+			select {
+			case <-time.After(c.req.hold):
+			case <-ctx.Done():
+			}
 		}
+	}
 
-		if c.req.grpc {
-			c.publish()
+	// the interrupted probe isn't recorded
+	if ctx.Err() != nil {
+		if c.persistent != nil {
+			c.drop()
+		} else {
+			c.close()
 		}
+		return false
+	}
 
-		c.printer(counter)
+	// the probe is recorded and checked by its own tcp_info e.g. the Rtt
+	if e := c.getTCPInfo(); e != nil {
+		errorf("%v", e)
+	}
+	c.record(err)
 
+	if err == nil {
+		c.checkThresholds()
+	}
+	c.checkDownloadRate()
+
+	// the availability is by the probe's error and its tcp_info RTT
+	c.account(err)
+	c.sampleRtt(err)
+	c.report(ctx, counter)
+
+	// the persistent connection is kept for the next probe unless it's failed
+	if c.persistent == nil {
 		c.close()
+	} else if err != nil {
+		c.drop()
+	}
+
+	return true
+}
+
+// record accumulates the probe's result
+func (c *client) record(err error) {
+	selfMetrics.probes.WithLabelValues(resultLabel(err)).Inc()
+	if !c.started.IsZero() {
+		selfMetrics.duration.Observe(time.Since(c.started).Seconds())
+	}
+
+	// the warm-up probes are printed but they aren't summarized
+	if !c.warming {
+		c.summary.record(&c.stats, err != nil)
+	}
+	c.status.update(err)
+	c.status.sample(&c.stats, err != nil)
+	c.output.update(c.isFailed(err), time.Now())
+	c.checkAlert(err)
+	c.checkDown(err)
+
+	if err != nil && c.stop != nil {
+		c.stop(c.target, err)
+	}
+}
+
+// report prints and exports the probe's stats
+func (c *client) report(ctx context.Context, counter int) {
+	if c.influx != nil {
+		c.stats.InfluxWriteError = atomic.LoadInt64(&c.influxErrors)
+	}
+
+	if c.histograms != nil && !c.warming {
+		c.observe()
+	}
+
+	if c.req.grpc {
+		c.publish()
+	}
+
+	c.printer(counter)
+
+	if c.influx != nil {
+		c.influx.write(ctx, c)
+	}
+
+	if c.statsd != nil {
+		c.statsd.send(ctx, c)
+	}
+
+	if c.otlp != nil {
+		c.otlp.record(ctx, c)
+	}
+
+	if c.kafka != nil {
+		c.kafka.produce(c, counter)
+	}
+
+	if c.history != nil {
+		c.history.write(c, counter)
+	}
+
+	if c.syslog != nil {
+		c.writeSyslog(counter)
 	}
 }
 
@@ -424,37 +1250,39 @@ func getSrcAddr(src string) net.Addr {
 	return &net.TCPAddr{IP: ip, Port: 0, Zone: ""}
 }
 
+// bsdStates maps the BSD style TCPS_* states, which Darwin and
+// Windows report, to the Linux's TCP states
+var bsdStates = [...]uint8{7, 10, 2, 3, 1, 8, 4, 11, 9, 5, 6}
+
 func (c *client) getTCPInfo() error {
+	// tcp_info doesn't apply to the unix domain socket
+	if c.isUnix() {
+		return nil
+	}
+
 	tcpConn := c.conn.(*net.TCPConn)
 	if tcpConn == nil {
 		return errors.New("tcp conn is nil")
 	}
 
-	file, err := tcpConn.File()
+	rawConn, err := tcpConn.SyscallConn()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	fd := file.Fd()
-	size := uint32(232)
-
-	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
-		uintptr(unsafe.Pointer(&c.stats)), uintptr(unsafe.Pointer(&size)), 0)
-	if e != 0 {
-		return fmt.Errorf("syscall err number=%d", e)
+	// the closed connection fails the control e.g. use of closed network connection
+	if e := rawConn.Control(func(fd uintptr) {
+		err = c.readTCPInfo(fd)
+	}); e != nil {
+		return e
 	}
-
-	ca := make([]byte, 10)
-	size = uint32(len(ca))
-
-	_, _, e = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
-		uintptr(unsafe.Pointer(&ca[0])), uintptr(unsafe.Pointer(&size)), 0)
-	if e != 0 {
-		return fmt.Errorf("syscall err number=%d", e)
+	if err != nil {
+		return err
 	}
 
-	c.stats.TCPCongesAlg = string(bytes.Trim(ca, "\x00"))
+	if c.req.delta {
+		c.delta()
+	}
 
 	return nil
 }
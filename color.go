@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorDim    = "\033[2m"
+)
+
+// useColor returns true if the text output is colorized, the auto
+// mode colorizes the terminal unless the NO_COLOR is set
+func useColor(mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorField returns the colorized name:value of the text output, the
+// Rtt is colored by its level, the errors and the unexpected HTTP
+// status are red and the zero values are dim
+func (c *client) colorField(f reflect.StructField, v reflect.Value) string {
+	s := fmt.Sprintf("%s:%v", f.Name, v.Interface())
+
+	switch {
+	case f.Name == "Rtt":
+		switch getRttLevel(c.stats.Rtt, c.req.warnRtt, c.req.critRtt) {
+		case rttCrit:
+			return colorRed + s + colorReset
+		case rttWarn:
+			return colorYellow + s + colorReset
+		}
+		return colorGreen + s + colorReset
+	case f.Name == "HTTPStatusCode" && !v.IsZero() && v.Int()/100 != 2:
+		return colorRed + s + colorReset
+	case isErrorField(f) && !v.IsZero():
+		return colorRed + s + colorReset
+	case v.IsZero():
+		return colorDim + s + colorReset
+	}
+
+	return s
+}
+
+// isErrorField returns true if the field counts the errors
+func isErrorField(f reflect.StructField) bool {
+	for _, suffix := range []string{"Error", "Failed", "Mismatch", "Lost"} {
+		if strings.HasSuffix(f.Name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,21 +1,125 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	yml "gopkg.in/yaml.v3"
 )
 
-// config represents tcpprobe config file
+// config represents tcpprobe config file, the targets
+// inherit the defaults unless they override
 type config struct {
-	Targets []target
+	Defaults defaults
+	Targets  []target
 }
 
+// defaults represents the targets' defaults and the
+// exported metrics' namespace and labels
+type defaults struct {
+	target `yaml:",inline"`
+
+	MetricPrefix string            `yaml:"metric_prefix"`
+	MetricLabels map[string]string `yaml:"metric_labels"`
+}
+
+// reEnv matches ${VAR} and ${VAR:-fallback} in the config
+var reEnv = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
 // target represents a target/host
 type target struct {
 	Addr     string
 	Interval string
 	Labels   map[string]string
+
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	CAFile  string `yaml:"ca_file"`
+
+	HTTPMethod   string   `yaml:"http_method"`
+	HTTPHeaders  []string `yaml:"http_headers"`
+	HTTPBody     string   `yaml:"http_body"`
+	HTTPBodyFile string   `yaml:"http_body_file"`
+
+	Family string
+	Mode   string
+	Hold   string
+	Splay  string
+
+	StartTLS string `yaml:"starttls"`
+
+	Timeout        string
+	HTTPTimeout    string `yaml:"http_timeout"`
+	ConnectTimeout string `yaml:"connect_timeout"`
+	TLSTimeout     string `yaml:"tls_timeout"`
+	Count          int
+	SourceAddr     string `yaml:"source_addr"`
+	ServerName     string `yaml:"server_name"`
+	Insecure       *bool
+	Filter         string
+
+	GRPCService string `yaml:"grpc_service"`
+	TLS         *bool
+
+	SendHex      string `yaml:"send_hex"`
+	SendFile     string `yaml:"send_file"`
+	ExpectHex    string `yaml:"expect_hex"`
+	ExpectPrefix string `yaml:"expect_prefix"`
+	UDPReply     bool   `yaml:"udp_reply"`
+
+	RedisPassword string `yaml:"redis_password"`
+	WSPing        bool   `yaml:"ws_ping"`
+
+	MQTTClientID string `yaml:"mqtt_client_id"`
+	MQTTUsername string `yaml:"mqtt_username"`
+	MQTTPassword string `yaml:"mqtt_password"`
+
+	KeepAlive         bool   `yaml:"keepalive"`
+	KeepAliveIdle     string `yaml:"keepalive_idle"`
+	KeepAliveInterval string `yaml:"keepalive_interval"`
+	KeepAliveCount    int    `yaml:"keepalive_count"`
+	UserTimeout       string `yaml:"user_timeout"`
+
+	ExpectStatus    []int  `yaml:"expect_status"`
+	ExpectBodyRegex string `yaml:"expect_body_regex"`
+	ExpectBodyLimit int64  `yaml:"expect_body_limit"`
+
+	Banner            *bool
+	ExpectBannerRegex string `yaml:"expect_banner_regex"`
+
+	Download    string
+	DownloadURL string `yaml:"download_url"`
+
+	FollowRedirects *bool `yaml:"follow_redirects"`
+	MaxRedirects    int   `yaml:"max_redirects"`
+
+	Webhook string
+
+	rootCAs     *x509.CertPool
+	httpHeaders http.Header
+	httpBody    []byte
+
+	sendPayload   []byte
+	expectPayload []byte
+	downloadBytes int64
+
+	keepAliveIdle     time.Duration
+	keepAliveInterval time.Duration
+	userTimeout       time.Duration
+	hold              time.Duration
+	splay             float64
+	timeout           time.Duration
+	timeoutHTTP       time.Duration
+	connectTimeout    time.Duration
+	tlsTimeout        time.Duration
 }
 
 func getConfig(filename string) (*config, error) {
@@ -28,11 +132,415 @@ func getConfig(filename string) (*config, error) {
 		return nil, err
 	}
 
+	return parseConfig(b)
+}
+
+// parseConfig parses and validates the config
+func parseConfig(b []byte) (*config, error) {
+	b, err := expandEnv(b)
+	if err != nil {
+		return nil, err
+	}
+
 	c := &config{}
 	err = yml.Unmarshal(b, c)
 	if err != nil {
 		return nil, err
 	}
 
+	for i := range c.Targets {
+		c.Targets[i].inherit(c.Defaults.target)
+
+		if err := c.Targets[i].parse(); err != nil {
+			return nil, fmt.Errorf("target %s: %v", c.Targets[i].Addr, err)
+		}
+
+		if err := checkICMP(c.Targets[i].Addr, c.Targets[i].Family == "ipv6"); err != nil {
+			return nil, fmt.Errorf("target %s: %v", c.Targets[i].Addr, err)
+		}
+	}
+
 	return c, nil
 }
+
+// parse validates the target's options and parses them
+// into the target's request options
+func (t *target) parse() error {
+	var err error
+
+	if err = checkClientCert(t.TLSCert, t.TLSKey); err != nil {
+		return err
+	}
+
+	if t.rootCAs, err = getCertPool(t.CAFile); err != nil {
+		return err
+	}
+
+	if t.httpHeaders, err = getHTTPHeaders(t.HTTPHeaders); err != nil {
+		return err
+	}
+
+	if t.httpBody, err = getHTTPBody(t.HTTPBody, t.HTTPBodyFile); err != nil {
+		return err
+	}
+
+	if t.Family != "" && t.Family != "ipv4" && t.Family != "ipv6" {
+		return fmt.Errorf("invalid family: %s, expected ipv4 or ipv6", t.Family)
+	}
+
+	if t.Mode != "" && t.Mode != "tcp" && t.Mode != "tls" && t.Mode != "http" {
+		return fmt.Errorf("invalid mode: %s, expected tcp, tls or http", t.Mode)
+	}
+
+	if _, err = getStartTLS(t.StartTLS); err != nil {
+		return err
+	}
+
+	if _, err = getDuration(t.Interval); err != nil {
+		return fmt.Errorf("invalid interval: %v", err)
+	}
+
+	if t.hold, err = getDuration(t.Hold); err != nil {
+		return err
+	}
+
+	if err = t.parseTimeouts(); err != nil {
+		return err
+	}
+
+	if t.Count < 0 {
+		return fmt.Errorf("invalid count: %d", t.Count)
+	}
+
+	if t.SourceAddr != "" && !isIPAddr(t.SourceAddr) {
+		return fmt.Errorf("invalid source address: %s", t.SourceAddr)
+	}
+
+	if t.splay, err = getSplay(t.Splay); err != nil {
+		return err
+	}
+
+	if t.sendPayload, err = getPayload(t.SendHex, t.SendFile); err != nil {
+		return err
+	}
+
+	if t.expectPayload, err = getExpectation(t.ExpectHex, t.ExpectPrefix); err != nil {
+		return err
+	}
+
+	if err = t.parseKeepAlive(); err != nil {
+		return err
+	}
+
+	if t.Download != "" {
+		if t.downloadBytes, err = getByteSize(t.Download); err != nil {
+			return fmt.Errorf("invalid download: %s", t.Download)
+		}
+	}
+
+	if err = checkDownloadURL(t.DownloadURL, t.downloadBytes); err != nil {
+		return err
+	}
+
+	for _, code := range t.ExpectStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid HTTP status code: %d", code)
+		}
+	}
+
+	if _, err = regexp.Compile(t.ExpectBodyRegex); err != nil {
+		return err
+	}
+
+	_, err = regexp.Compile(t.ExpectBannerRegex)
+
+	return err
+}
+
+// expandEnv replaces the environment variables in the config, the
+// undefined variable without fallback is an error
+func expandEnv(b []byte) ([]byte, error) {
+	var errs []string
+
+	for i, line := range strings.Split(string(b), "\n") {
+		for _, m := range reEnv.FindAllStringSubmatch(line, -1) {
+			if _, ok := os.LookupEnv(m[1]); !ok && m[2] == "" {
+				errs = append(errs, fmt.Sprintf("line %d: undefined environment variable %s", i+1, m[1]))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, ", "))
+	}
+
+	return reEnv.ReplaceAllFunc(b, func(s []byte) []byte {
+		m := reEnv.FindSubmatch(s)
+		if v, ok := os.LookupEnv(string(m[1])); ok {
+			return []byte(v)
+		}
+
+		return m[3]
+	}), nil
+}
+
+// inherit fills the target's unspecified options from the defaults,
+// the labels are merged and the target's labels take precedence
+func (t *target) inherit(d target) {
+	if len(t.Labels) > 0 && len(d.Labels) > 0 {
+		labels := make(map[string]string, len(d.Labels)+len(t.Labels))
+		for k, v := range d.Labels {
+			labels[k] = v
+		}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		t.Labels = labels
+	}
+
+	v, dv := reflect.ValueOf(t).Elem(), reflect.ValueOf(d)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if v.Type().Field(i).Name == "Addr" || !f.CanSet() || !f.IsZero() {
+			continue
+		}
+
+		f.Set(dv.Field(i))
+	}
+}
+
+func (t *target) parseKeepAlive() error {
+	var err error
+
+	if t.keepAliveIdle, err = getDuration(t.KeepAliveIdle); err != nil {
+		return err
+	}
+
+	if t.keepAliveInterval, err = getDuration(t.KeepAliveInterval); err != nil {
+		return err
+	}
+
+	if t.userTimeout, err = getDuration(t.UserTimeout); err != nil {
+		return err
+	}
+
+	return checkKeepAlive(t.keepAliveIdle, t.keepAliveInterval, t.KeepAliveCount, t.userTimeout)
+}
+
+func (t *target) parseTimeouts() error {
+	var err error
+
+	if t.timeout, err = getDuration(t.Timeout); err != nil {
+		return fmt.Errorf("invalid timeout: %v", err)
+	}
+
+	if t.timeoutHTTP, err = getDuration(t.HTTPTimeout); err != nil {
+		return fmt.Errorf("invalid http_timeout: %v", err)
+	}
+
+	if t.connectTimeout, err = getDuration(t.ConnectTimeout); err != nil {
+		return fmt.Errorf("invalid connect_timeout: %v", err)
+	}
+
+	if t.tlsTimeout, err = getDuration(t.TLSTimeout); err != nil {
+		return fmt.Errorf("invalid tls_timeout: %v", err)
+	}
+
+	if t.timeout < 0 || t.timeoutHTTP < 0 || t.connectTimeout < 0 || t.tlsTimeout < 0 {
+		return errors.New("invalid timeout: negative duration")
+	}
+
+	return nil
+}
+
+// getDuration parses the duration, empty means zero
+func getDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// request returns the target's request which the target's
+// options override the command line options
+func (t target) request(req *request) *request {
+	r := *req
+
+	if t.TLSCert != "" {
+		r.tlsCert = t.TLSCert
+		r.tlsKey = t.TLSKey
+	}
+
+	if t.rootCAs != nil {
+		r.rootCAs = t.rootCAs
+	}
+
+	if t.HTTPMethod != "" {
+		r.httpMethod = strings.ToUpper(t.HTTPMethod)
+	}
+
+	if len(t.httpHeaders) > 0 {
+		r.httpHeaders = t.httpHeaders
+	}
+
+	if t.httpBody != nil {
+		r.httpBody = t.httpBody
+	}
+
+	if t.Family != "" {
+		r.ipv4 = t.Family == "ipv4"
+		r.ipv6 = t.Family == "ipv6"
+	}
+
+	if t.Mode != "" {
+		r.noHTTP = t.Mode == "tcp"
+		r.tlsOnly = t.Mode == "tls"
+	}
+
+	if t.StartTLS != "" {
+		r.starttls = strings.ToLower(t.StartTLS)
+		r.tlsOnly = false
+	}
+
+	if t.hold > 0 {
+		r.hold = t.hold
+	}
+
+	if t.timeout > 0 {
+		r.timeout = t.timeout
+	}
+
+	if t.timeoutHTTP > 0 {
+		r.timeoutHTTP = t.timeoutHTTP
+	}
+
+	if t.connectTimeout > 0 {
+		r.connectTimeout = t.connectTimeout
+	}
+
+	if t.tlsTimeout > 0 {
+		r.tlsTimeout = t.tlsTimeout
+	}
+
+	if t.Count > 0 {
+		r.count = t.Count
+	}
+
+	if t.SourceAddr != "" {
+		r.srcAddr = t.SourceAddr
+	}
+
+	if t.ServerName != "" {
+		r.serverName = t.ServerName
+	}
+
+	if t.Insecure != nil {
+		r.insecure = *t.Insecure
+	}
+
+	if t.Filter != "" {
+		r.filter = t.Filter
+	}
+
+	if t.Webhook != "" {
+		r.webhookURL = t.Webhook
+	}
+
+	if t.Splay != "" {
+		r.splay = t.splay
+	}
+
+	if t.UDPReply {
+		r.udpReply = true
+	}
+
+	if t.RedisPassword != "" {
+		r.redisPassword = t.RedisPassword
+	}
+
+	if t.WSPing {
+		r.wsPing = true
+	}
+
+	if t.MQTTClientID != "" {
+		r.mqttClientID = t.MQTTClientID
+	}
+
+	if t.MQTTUsername != "" {
+		r.mqttUsername = t.MQTTUsername
+		r.mqttPassword = t.MQTTPassword
+	}
+
+	if t.GRPCService != "" {
+		r.grpcService = t.GRPCService
+	}
+
+	// the tls is for the gRPC and the brokers e.g. nats://host:port
+	if t.TLS != nil {
+		r.grpcTLS = *t.TLS
+		r.brokerTLS = *t.TLS
+	}
+
+	if t.sendPayload != nil {
+		r.sendPayload = t.sendPayload
+		r.expectPayload = t.expectPayload
+	}
+
+	if t.KeepAlive {
+		r.soKeepAlive = true
+	}
+
+	if t.keepAliveIdle > 0 {
+		r.soKeepAliveIdle = t.keepAliveIdle
+	}
+
+	if t.keepAliveInterval > 0 {
+		r.soKeepAliveInterval = t.keepAliveInterval
+	}
+
+	if t.KeepAliveCount > 0 {
+		r.soKeepAliveCount = t.KeepAliveCount
+	}
+
+	if t.userTimeout > 0 {
+		r.soUserTimeout = t.userTimeout
+	}
+
+	if len(t.ExpectStatus) > 0 {
+		r.expectStatus = t.ExpectStatus
+	}
+
+	if t.ExpectBodyRegex != "" {
+		r.expectBodyRegex = t.ExpectBodyRegex
+	}
+
+	if t.ExpectBodyLimit > 0 {
+		r.expectBodyLimit = t.ExpectBodyLimit
+	}
+
+	// the target's banner is read even if it's an HTTP target
+	if t.Banner != nil {
+		r.readBanner = *t.Banner
+		r.forceBanner = *t.Banner
+	}
+
+	if t.ExpectBannerRegex != "" {
+		r.expectBannerRegex = t.ExpectBannerRegex
+	}
+
+	if t.FollowRedirects != nil {
+		r.followRedirects = *t.FollowRedirects
+	}
+
+	if t.MaxRedirects > 0 {
+		r.maxRedirects = t.MaxRedirects
+	}
+
+	if t.downloadBytes > 0 {
+		r.downloadBytes = t.downloadBytes
+		r.downloadURL = t.DownloadURL
+	}
+
+	return &r
+}
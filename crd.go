@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// probeTargetResource is the ProbeTarget custom resource
+var probeTargetResource = schema.GroupVersionResource{
+	Group:    "tcpprobe.io",
+	Version:  "v1alpha1",
+	Resource: "probetargets",
+}
+
+// probeTarget represents a reconciled ProbeTarget resource, the
+// err is the spec's problem which is written back to the status
+type probeTarget struct {
+	running *configTarget
+	key     string
+	err     error
+}
+
+// probeTargetSpec represents the ProbeTarget resource's spec
+type probeTargetSpec struct {
+	Addr         string            `json:"addr"`
+	Interval     string            `json:"interval,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Timeout      string            `json:"timeout,omitempty"`
+	Expectations struct {
+		Status    []int  `json:"status,omitempty"`
+		BodyRegex string `json:"bodyRegex,omitempty"`
+		Prefix    string `json:"prefix,omitempty"`
+		Hex       string `json:"hex,omitempty"`
+	} `json:"expectations,omitempty"`
+}
+
+// watchProbeTargets reconciles the ProbeTarget resources of all the
+// namespaces into the targets and writes their status periodically
+func (k *k8s) watchProbeTargets(ctx context.Context, tp *tp, req *request) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(k.dynamic, k.resync)
+	informer := factory.ForResource(probeTargetResource).Informer()
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			selfMetrics.k8sEvents.Inc()
+			k.syncProbeTarget(ctx, tp, req, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			selfMetrics.k8sEvents.Inc()
+			k.syncProbeTarget(ctx, tp, req, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			selfMetrics.k8sEvents.Inc()
+
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				return
+			}
+
+			k.removeProbeTarget(key)
+		},
+	})
+
+	go informer.Run(ctx.Done())
+
+	for {
+		select {
+		case <-time.After(k.statusInterval):
+			k.writeProbeTargetsStatus(ctx, tp)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncProbeTarget starts the new resource's target, the changed
+// one is restarted and the unchanged one keeps running
+func (k *k8s) syncProbeTarget(ctx context.Context, tp *tp, req *request, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	key := u.GetNamespace() + "/" + u.GetName()
+	ct, err := getProbeTarget(u)
+
+	k.Lock()
+	defer k.Unlock()
+
+	if k.probeTargets == nil {
+		k.probeTargets = make(map[string]*probeTarget)
+	}
+
+	old, ok := k.probeTargets[key]
+	if ok && old.running != nil {
+		if err == nil && isSameTarget(old.running.target, ct) {
+			return
+		}
+
+		old.running.cancel()
+		<-old.running.done
+		infof("probetarget: %s, target: %s has been deleted", key, old.running.target.Addr)
+	}
+
+	if err != nil {
+		if ok && old.err != nil && old.err.Error() == err.Error() {
+			return
+		}
+
+		errorf("probetarget: %s, %v", key, err)
+		k.probeTargets[key] = &probeTarget{err: err}
+		return
+	}
+
+	r := ct.request(req)
+	tpKey := getTargetKey(withFamily(ctx, r), ct.Addr)
+	if tp.isExist(tpKey) {
+		warnf("%v: %s", errExist, ct.Addr)
+		k.probeTargets[key] = &probeTarget{err: errExist}
+		return
+	}
+
+	k.probeTargets[key] = &probeTarget{
+		running: tp.startTarget(ctx, ct, r, func() {}),
+		key:     tpKey,
+	}
+
+	infof("probetarget: %s, target: %s has been added", key, ct.Addr)
+}
+
+func (k *k8s) removeProbeTarget(key string) {
+	k.Lock()
+	defer k.Unlock()
+
+	pt, ok := k.probeTargets[key]
+	if !ok {
+		return
+	}
+
+	if pt.running != nil {
+		pt.running.cancel()
+		<-pt.running.done
+		infof("probetarget: %s, target: %s has been deleted", key, pt.running.target.Addr)
+	}
+
+	delete(k.probeTargets, key)
+}
+
+// writeProbeTargetsStatus writes the last probe's time and error
+// and the success ratio to the resources' status
+func (k *k8s) writeProbeTargetsStatus(ctx context.Context, tp *tp) {
+	status := make(map[string]map[string]interface{})
+
+	k.Lock()
+	for key, pt := range k.probeTargets {
+		if pt.err != nil {
+			status[key] = map[string]interface{}{"lastError": pt.err.Error()}
+			continue
+		}
+
+		tp.Lock()
+		p, ok := tp.targets[pt.key]
+		tp.Unlock()
+		if !ok {
+			continue
+		}
+
+		last, err, success := p.client.status.get()
+		if last.IsZero() {
+			continue
+		}
+
+		status[key] = map[string]interface{}{
+			"lastProbeTime": last.UTC().Format(time.RFC3339),
+			"lastError":     err,
+			"successRatio":  math.Round(success*100) / 100,
+		}
+	}
+	k.Unlock()
+
+	for key, s := range status {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		client := k.dynamic.Resource(probeTargetResource).Namespace(namespace)
+
+		u, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			errorf("probetarget: %s, %v", key, err)
+			continue
+		}
+
+		if err = unstructured.SetNestedField(u.Object, s, "status"); err != nil {
+			errorf("probetarget: %s, %v", key, err)
+			continue
+		}
+
+		if _, err = client.UpdateStatus(ctx, u, metav1.UpdateOptions{}); err != nil && ctx.Err() == nil {
+			errorf("probetarget: %s, %v", key, err)
+		}
+	}
+}
+
+// getProbeTarget returns the target of the ProbeTarget resource
+func getProbeTarget(u *unstructured.Unstructured) (target, error) {
+	spec, ok, err := unstructured.NestedMap(u.Object, "spec")
+	if err != nil {
+		return target{}, err
+	}
+
+	if !ok {
+		return target{}, errors.New("missing spec")
+	}
+
+	s := probeTargetSpec{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &s); err != nil {
+		return target{}, err
+	}
+
+	t := target{
+		Addr:            s.Addr,
+		Interval:        s.Interval,
+		Labels:          s.Labels,
+		Timeout:         s.Timeout,
+		ExpectStatus:    s.Expectations.Status,
+		ExpectBodyRegex: s.Expectations.BodyRegex,
+		ExpectPrefix:    s.Expectations.Prefix,
+		ExpectHex:       s.Expectations.Hex,
+	}
+
+	if errs := t.check(); len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+
+		return target{}, errors.New(strings.Join(msgs, ", "))
+	}
+
+	return t, nil
+}
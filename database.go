@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// pgSSLRequest is the postgres SSLRequest code, the server
+	// answers by S if it accepts TLS and N otherwise
+	pgSSLRequest = 80877103
+
+	// mysqlClientSSL is the capability flag of the TLS
+	mysqlClientSSL = 0x0800
+
+	// mysqlMaxGreeting is the maximum greeting packet to read
+	mysqlMaxGreeting = 4096
+)
+
+// isDatabase returns true if the target is probed by
+// the database's handshake e.g. postgres://host:port
+func (c *client) isDatabase() bool {
+	return c.urlSchema.Scheme == "postgres" || c.urlSchema.Scheme == "mysql"
+}
+
+// dbProbe exchanges the database's handshake and tears down
+// before the authentication so no credentials are needed
+func (c *client) dbProbe(ctx context.Context) error {
+	c.stats.DBRtt = 0
+	c.stats.DBVersion = ""
+	c.stats.DBTLS = 0
+
+	c.conn.SetDeadline(time.Now().Add(c.req.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	var err error
+	if c.urlSchema.Scheme == "postgres" {
+		err = c.postgresProbe()
+	} else {
+		err = c.mysqlProbe()
+	}
+
+	if err != nil {
+		c.stats.DBError++
+		return fmt.Errorf("%s: %v", c.target, err)
+	}
+
+	return nil
+}
+
+// postgresProbe sends the SSLRequest, postgres doesn't advertise
+// its version before the authentication
+func (c *client) postgresProbe() error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, 8)
+	binary.BigEndian.PutUint32(b[4:], pgSSLRequest)
+
+	t := time.Now()
+	if _, err := c.conn.Write(b); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(c.conn, b[:1]); err != nil {
+		return err
+	}
+	c.stats.DBRtt = time.Since(t).Microseconds()
+
+	switch b[0] {
+	case 'S':
+		c.stats.DBTLS = 1
+	case 'N':
+	default:
+		return fmt.Errorf("unexpected postgres SSL response: %q", b[0])
+	}
+
+	return nil
+}
+
+// mysqlProbe reads the server's greeting which advertises
+// the version and the capabilities e.g. TLS
+func (c *client) mysqlProbe() error {
+	header := make([]byte, 4)
+
+	t := time.Now()
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return err
+	}
+	c.stats.DBRtt = time.Since(t).Microseconds()
+
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if size < 1 || size > mysqlMaxGreeting {
+		return fmt.Errorf("invalid mysql greeting size: %d", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return err
+	}
+
+	version, caps, err := parseMySQLGreeting(payload)
+	if err != nil {
+		return err
+	}
+
+	c.stats.DBVersion = version
+	if caps&mysqlClientSSL != 0 {
+		c.stats.DBTLS = 1
+	}
+
+	return nil
+}
+
+// parseMySQLGreeting returns the server version and the lower
+// capability flags of the protocol v10 greeting, the server
+// sends an error packet instead if it refuses the client
+func parseMySQLGreeting(b []byte) (string, uint16, error) {
+	if b[0] == 0xff {
+		if len(b) < 3 {
+			return "", 0, errors.New("mysql error")
+		}
+		msg := b[3:]
+		// the SQL state marker and state
+		if len(msg) > 6 && msg[0] == '#' {
+			msg = msg[6:]
+		}
+		return "", 0, fmt.Errorf("mysql error %d: %s", binary.LittleEndian.Uint16(b[1:3]), msg)
+	}
+
+	if b[0] != 10 {
+		return "", 0, fmt.Errorf("unsupported mysql protocol version: %d", b[0])
+	}
+
+	i := bytes.IndexByte(b[1:], 0)
+	if i < 0 {
+		return "", 0, errors.New("invalid mysql greeting")
+	}
+	version := string(b[1 : i+1])
+
+	// the connection id, the auth plugin data part 1 and the filler
+	offset := i + 2 + 4 + 8 + 1
+	if len(b) < offset+2 {
+		return version, 0, nil
+	}
+
+	return version, binary.LittleEndian.Uint16(b[offset:]), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "reflect"
+
+// deltaFields are the cumulative tcp_info counters which reported as
+// the difference since the last probe in delta mode, Retrans and Lost
+// are the current scoreboard of the socket and reported as they are
+var deltaFields = []string{
+	"TotalRetrans", "BytesAcked", "BytesReceived", "SegsOut", "SegsIn",
+	"DataSegsIn", "DataSegsOut", "BusyTime", "RwndLimited", "SndbufLimited",
+	"Delivered", "DeliveredCe", "BytesSent", "BytesRetrans", "DsackDups",
+	"ReordSeen", "RcvOoopack", "RcvOooBytes", "Rehash", "TotalRto",
+	"TotalRtoRecov", "TotalRtoTime",
+}
+
+// delta replaces the cumulative counters with the difference since the
+// previous sample, the baseline resets once the connection changed
+func (c *client) delta() {
+	v := reflect.ValueOf(&c.stats).Elem()
+	reused := c.totals != nil && c.totalsConn == c.conn
+	totals := make(map[string]uint64, len(deltaFields))
+
+	for _, name := range deltaFields {
+		f := v.FieldByName(name)
+		total := f.Uint()
+		totals[name] = total
+
+		if reused && total >= c.totals[name] {
+			f.SetUint(total - c.totals[name])
+		}
+	}
+
+	c.totals = totals
+	c.totalsConn = c.conn
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTypes are the supported query types of the dns:// target
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// dnsQuery represents the query of a dns:// target
+type dnsQuery struct {
+	name  dnsmessage.Name
+	qtype dnsmessage.Type
+	proto string
+}
+
+// newResolver returns a resolver which queries the given DNS server
+// instead of the system default
+func newResolver(addr string, timeout time.Duration) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// getResolverAddr validates the resolver address, the port
+// is 53 if it's not specified
+func getResolverAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+
+	if isIPAddr(addr) {
+		return net.JoinHostPort(addr, "53"), nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || !isIPAddr(host) {
+		return "", fmt.Errorf("invalid resolver address: %s", addr)
+	}
+
+	return addr, nil
+}
+
+// resolveAll returns all the target's addresses of the requested family
+func (c *client) resolveAll(ctx context.Context) ([]string, error) {
+	var ips []string
+
+	host, _, err := c.getHostPort()
+	if err != nil {
+		return nil, err
+	}
+
+	if isIPAddr(host) {
+		return []string{host}, nil
+	}
+
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		c.stats.DNSResolveError++
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		v4 := net.ParseIP(addr).To4() != nil
+		if v4 && !c.req.ipv6 || !v4 && !c.req.ipv4 {
+			ips = append(ips, addr)
+		}
+	}
+
+	return ips, nil
+}
+
+func (c *client) lookupHost(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.connectTimeout())
+	defer cancel()
+
+	c.stats.DNSCacheHit = 0
+	if c.dnsCacheEnabled() {
+		return c.cachedLookup(ctx, host)
+	}
+
+	if c.resolver == nil {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil && !c.req.resolverStrict {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+
+	return addrs, err
+}
+
+// getDNSQuery parses the dns://server[:port]/name?type=A&proto=udp target,
+// the type is A and the proto is udp by default
+func getDNSQuery(u *url.URL) (*dnsQuery, error) {
+	name := strings.TrimPrefix(u.Path, "/")
+	if name == "" {
+		return nil, fmt.Errorf("%s: missing query name", u)
+	}
+
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+
+	q := &dnsQuery{name: n, qtype: dnsmessage.TypeA, proto: "udp"}
+
+	if t := u.Query().Get("type"); t != "" {
+		qtype, ok := dnsTypes[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid query type: %s", u, t)
+		}
+		q.qtype = qtype
+	}
+
+	if p := u.Query().Get("proto"); p != "" {
+		if p != "udp" && p != "tcp" {
+			return nil, fmt.Errorf("%s: invalid proto: %s, expected udp or tcp", u, p)
+		}
+		q.proto = p
+	}
+
+	return q, nil
+}
+
+// dnsProbe sends the query of the dns:// target and validates the
+// response, the truncated UDP response falls back to TCP
+func (c *client) dnsProbe(ctx context.Context) error {
+	c.probed = time.Now()
+	c.timestamp = c.probed.Unix()
+	c.stats.DNSRtt = 0
+	c.stats.DNSAnswerCount = 0
+
+	q, err := getDNSQuery(c.urlSchema)
+	if err != nil {
+		return err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: q.name, Type: q.qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return err
+	}
+
+	var resp []byte
+
+	t := time.Now()
+	if q.proto == "udp" {
+		resp, err = c.dnsUDP(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if q.proto == "tcp" || isTruncated(resp) {
+		resp, err = c.dnsTCP(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+	c.stats.DNSRtt = time.Since(t).Microseconds()
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return err
+	}
+
+	if h.ID != id || !h.Response {
+		return fmt.Errorf("%s: unexpected DNS response", c.target)
+	}
+
+	if h.RCode != dnsmessage.RCodeSuccess {
+		c.stats.DNSRcodeError++
+		return fmt.Errorf("%s: DNS response %s", c.target, h.RCode)
+	}
+
+	if err = p.SkipAllQuestions(); err != nil {
+		return err
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return err
+	}
+
+	c.stats.DNSAnswerCount = len(answers)
+
+	return nil
+}
+
+func (c *client) dnsUDP(ctx context.Context, msg []byte) ([]byte, error) {
+	conn, err := c.dialUDP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(c.req.timeout))
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// dnsTCP sends the query over TCP, the TCP stats are
+// sampled before the connection closed
+func (c *client) dnsTCP(ctx context.Context, msg []byte) ([]byte, error) {
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	c.conn.SetDeadline(time.Now().Add(c.req.timeout))
+
+	b := make([]byte, 2, len(msg)+2)
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	if _, err := c.conn.Write(append(b, msg...)); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+
+	if err := c.getTCPInfo(); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// isTruncated returns true if the DNS response's TC bit is set
+func isTruncated(resp []byte) bool {
+	if len(resp) < 3 {
+		return false
+	}
+
+	return resp[2]&0x02 != 0
+}
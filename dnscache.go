@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolverCache is the DNS cache which shared by the targets, the
+// addresses are cached by the resolver and the hostname
+var resolverCache = newDNSCache()
+
+// dnsEntry represents the cached addresses of a hostname
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache caches the resolved addresses until their TTL expired
+type dnsCache struct {
+	sync.Mutex
+
+	entries map[string]dnsEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]dnsEntry)}
+}
+
+func (d *dnsCache) get(key string) ([]string, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	e, ok := d.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(d.entries, key)
+		return nil, false
+	}
+
+	return e.addrs, true
+}
+
+// set caches the addresses for the TTL, the expired entries and then
+// the soonest to expire are evicted once the cache is full
+func (d *dnsCache) set(key string, addrs []string, ttl time.Duration, max int) {
+	if ttl <= 0 || max < 1 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	if _, ok := d.entries[key]; !ok && len(d.entries) >= max {
+		for k, e := range d.entries {
+			if now.After(e.expires) {
+				delete(d.entries, k)
+			}
+		}
+	}
+
+	for len(d.entries) >= max {
+		var soonest string
+		for k, e := range d.entries {
+			if soonest == "" || e.expires.Before(d.entries[soonest].expires) {
+				soonest = k
+			}
+		}
+		delete(d.entries, soonest)
+	}
+
+	d.entries[key] = dnsEntry{addrs: addrs, expires: now.Add(ttl)}
+}
+
+// dnsCacheEnabled returns true if the target's addresses are
+// cached, it's bypassed to measure the resolver at every probe
+func (c *client) dnsCacheEnabled() bool {
+	return !c.req.dnsNoCache && c.req.dnsCacheMax > 0
+}
+
+// cachedLookup returns the host's addresses from the DNS cache, they're
+// resolved and cached for their TTL if they're not cached or expired,
+// the system resolver doesn't surface the TTL so it's the min TTL
+func (c *client) cachedLookup(ctx context.Context, host string) ([]string, error) {
+	key := c.req.resolver + "/" + host
+	if addrs, ok := resolverCache.get(key); ok {
+		c.stats.DNSCacheHit = 1
+		selfMetrics.dnsCache.WithLabelValues("hit").Inc()
+		return addrs, nil
+	}
+
+	selfMetrics.dnsCache.WithLabelValues("miss").Inc()
+
+	var (
+		addrs []string
+		ttl   time.Duration
+		err   error
+	)
+
+	if c.req.resolver == "" {
+		addrs, err = net.DefaultResolver.LookupHost(ctx, host)
+	} else {
+		addrs, ttl, err = lookupTTL(ctx, c.req.resolver, host)
+		// fallback to the system resolver, it's cached by the min TTL
+		if err != nil && !c.req.resolverStrict {
+			addrs, err = net.DefaultResolver.LookupHost(ctx, host)
+			ttl = 0
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	resolverCache.set(key, addrs, clampTTL(ttl, c.req.dnsMinTTL, c.req.dnsMaxTTL), c.req.dnsCacheMax)
+
+	return addrs, nil
+}
+
+// clampTTL returns the TTL within the min and max TTL, the max is
+// ignored if it's zero
+func clampTTL(ttl, min, max time.Duration) time.Duration {
+	if ttl < min {
+		ttl = min
+	}
+
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+// lookupTTL queries the A and AAAA records of the host from the DNS
+// server, the TTL is the lowest TTL of the answers e.g. the CNAME's
+func lookupTTL(ctx context.Context, server, host string) ([]string, time.Duration, error) {
+	var (
+		addrs []string
+		ttl   uint32
+		found bool
+	)
+
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := dnsExchange(ctx, server, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, a := range answers {
+			if !found || a.Header.TTL < ttl {
+				ttl, found = a.Header.TTL, true
+			}
+
+			switch r := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(r.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(r.AAAA[:]).String())
+			}
+		}
+	}
+
+	if len(addrs) < 1 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// dnsExchange sends the query to the DNS server and returns the
+// answers, the truncated UDP response falls back to TCP
+func dnsExchange(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsRoundTrip(ctx, "udp", server, msg)
+	if err == nil && isTruncated(resp) {
+		resp, err = dnsRoundTrip(ctx, "tcp", server, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.ID != id || !h.Response {
+		return nil, errors.New("unexpected DNS response")
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name.String(), Server: server, IsNotFound: true}
+	default:
+		return nil, fmt.Errorf("%s: DNS response %s", name, h.RCode)
+	}
+
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	return p.AllAnswers()
+}
+
+// dnsRoundTrip writes the message and reads the response, the
+// TCP message is prefixed by its length
+func dnsRoundTrip(ctx context.Context, network, server string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err = conn.Write(msg); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 512)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+
+	b := make([]byte, 2, len(msg)+2)
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	if _, err = conn.Write(append(b, msg...)); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// dnsFQDN returns the fully qualified domain name of the host
+func dnsFQDN(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+
+	return host + "."
+}
+
+// checkDNSCache validates the DNS cache options
+func checkDNSCache(max int, minTTL, maxTTL time.Duration) error {
+	if max < 0 {
+		return fmt.Errorf("invalid dns-cache-max: %d, expected zero or greater", max)
+	}
+
+	if minTTL < 0 || maxTTL < 0 {
+		return errors.New("invalid dns ttl: negative duration")
+	}
+
+	if maxTTL > 0 && minTTL > maxTTL {
+		return fmt.Errorf("invalid dns-min-ttl: %s, expected less than the dns-max-ttl %s", minTTL, maxTTL)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+)
+
+// downState represents the target's down state, the target is down
+// once the consecutive failed probes reached the down threshold and
+// it's probed at the down interval until a probe succeeded
+type downState struct {
+	down  bool
+	fails int
+	since time.Time
+}
+
+// checkDown updates the target's down state by the probe's
+// result and prints the transition
+func (c *client) checkDown(err error) {
+	if c.req.downThreshold < 1 {
+		return
+	}
+
+	s := &c.downState
+	if err != nil {
+		s.fails++
+		if !s.down && s.fails >= c.req.downThreshold {
+			s.down = true
+			s.since = time.Now()
+			c.stats.TargetDown = 1
+			c.printDown(true, 0)
+		}
+		return
+	}
+
+	s.fails = 0
+	if s.down {
+		s.down = false
+		c.stats.TargetDown = 0
+		c.printDown(false, time.Since(s.since))
+	}
+}
+
+// cadence returns the down interval once the target is down
+func (c *client) cadence(interval time.Duration) time.Duration {
+	if c.downState.down && c.req.downInterval > 0 {
+		return c.req.downInterval
+	}
+
+	return interval
+}
+
+// printDown prints the target's down or recovery event,
+// the recovery has the downtime
+func (c *client) printDown(down bool, downtime time.Duration) {
+	if c.req.quiet || c.req.csv {
+		return
+	}
+
+	if c.ndjson != nil {
+		b, err := c.stateRecord(down, downtime)
+		if err != nil {
+			errorf("%v", err)
+			return
+		}
+		c.ndjson.write(b)
+		return
+	}
+
+	c.printState(down, downtime)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// readDownload reads the response body up to the download bytes
+// and records the transfer's time and rate
+func (c *client) readDownload(body io.Reader) (int64, error) {
+	t := time.Now()
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(body, c.req.downloadBytes))
+	elapsed := time.Since(t)
+
+	c.stats.DownloadBytes = n
+	c.stats.DownloadTime = elapsed.Microseconds()
+	c.stats.DownloadRate = 0
+	if elapsed > 0 {
+		c.stats.DownloadRate = int64(float64(n) / elapsed.Seconds())
+	}
+
+	return n, err
+}
+
+// download downloads the download URL by a separate connection
+// since the probe's URL may be a health endpoint with a tiny body
+func (c *client) download(ctx context.Context) error {
+	u, err := url.Parse(c.req.downloadURL)
+	if err != nil {
+		return err
+	}
+
+	d := &net.Dialer{
+		Timeout:   c.req.timeout,
+		LocalAddr: c.localAddr(),
+		Control:   c.control,
+	}
+
+	config := c.tlsConfig()
+	config.ServerName = u.Hostname()
+	config.NextProtos = nil
+
+	httpClient := &http.Client{
+		Timeout: c.req.timeoutHTTP,
+		Transport: &http.Transport{
+			DialContext:     d.DialContext,
+			TLSClientConfig: config,
+		},
+	}
+	defer httpClient.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.req.downloadURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		c.stats.DownloadError++
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		c.stats.DownloadError++
+		return fmt.Errorf("download %s: %s", c.req.downloadURL, resp.Status)
+	}
+
+	if _, err = c.readDownload(resp.Body); err != nil {
+		c.stats.DownloadError++
+		return err
+	}
+
+	return nil
+}
+
+// checkDownloadRate compares the download rate with the tcp_info's
+// delivery rate once the body is downloaded by the probe's connection
+func (c *client) checkDownloadRate() {
+	if c.req.downloadBytes < 1 || c.req.downloadURL != "" || c.stats.DeliveryRate == 0 {
+		return
+	}
+
+	debugf("target: %s, download rate: %d B/s, tcp_info delivery rate: %d B/s",
+		c.target, c.stats.DownloadRate, c.stats.DeliveryRate)
+}
+
+// checkDownloadURL validates the download URL, it's downloaded
+// up to the download bytes so they're required
+func checkDownloadURL(s string, size int64) error {
+	if s == "" {
+		return nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid download-url: %s, expected http or https URL", s)
+	}
+
+	if size < 1 {
+		return errors.New("the download-url requires the download-bytes")
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// filterMeta represents the printed fields besides the stats
+var filterMeta = []string{"Target", "IP", "Timestamp", "Time", "Seq", "Labels"}
+
+// fieldFilter selects the printed fields by the comma or semicolon
+// separated names or glob patterns, the ! prefixed ones are excluded
+type fieldFilter struct {
+	include []string
+	exclude []string
+}
+
+func newFieldFilter(s string) fieldFilter {
+	f := fieldFilter{}
+	for _, p := range getFilterPatterns(s) {
+		if strings.HasPrefix(p, "!") {
+			f.exclude = append(f.exclude, p[1:])
+		} else {
+			f.include = append(f.include, p)
+		}
+	}
+
+	return f
+}
+
+// match returns true if the field is selected, the excluded fields
+// are dropped and all the fields are selected if there's no include
+func (f fieldFilter) match(name string) bool {
+	name = strings.ToLower(name)
+
+	for _, p := range f.exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+
+	if len(f.include) < 1 {
+		return true
+	}
+
+	for _, p := range f.include {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkFilter returns an error if a name or a pattern doesn't
+// match any of the fields, the error has the valid names
+func checkFilter(s string) error {
+	names := getFieldNames()
+
+	var unknown []string
+	for _, p := range getFilterPatterns(s) {
+		pattern := strings.TrimPrefix(p, "!")
+		if _, err := path.Match(pattern, ""); err != nil {
+			unknown = append(unknown, p)
+			continue
+		}
+
+		found := false
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, strings.ToLower(name)); ok {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			unknown = append(unknown, p)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown filter field(s): %s, the valid fields: %s",
+			strings.Join(unknown, ", "), strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// getFieldNames returns the printed stats fields and the meta fields
+func getFieldNames() []string {
+	var names []string
+
+	t := reflect.TypeOf(stats{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("unexported") == "true" {
+			continue
+		}
+		names = append(names, t.Field(i).Name)
+	}
+
+	names = append(names, filterMeta...)
+	sort.Strings(names)
+
+	return names
+}
+
+func getFilterPatterns(s string) []string {
+	var patterns []string
+
+	for _, p := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+
+	return patterns
+}
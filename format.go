@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+// formatFuncs are the format template's functions
+var formatFuncs = template.FuncMap{
+	"labels": joinLabels,
+}
+
+// formatRecord represents the probe's record of the format template,
+// the Fields are the stats fields which are selected by the filter
+type formatRecord struct {
+	Target    string
+	IP        string
+	Labels    map[string]string
+	Timestamp time.Time
+	Time      string
+	Seq       int
+	Warmup    bool
+	Stats     stats
+	Fields    []formatField
+}
+
+// formatField represents a stats field's name and value
+type formatField struct {
+	Name  string
+	Value interface{}
+}
+
+// getFormat compiles the format template, the missing fields and
+// labels are errors rather than <no value>
+func getFormat(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := template.New("format").Funcs(formatFuncs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format: %v", err)
+	}
+
+	// the labels are unknown until the probe
+	dry, _ := t.Clone()
+	if err = dry.Option("missingkey=zero").Execute(ioutil.Discard, formatRecord{}); err != nil {
+		return nil, fmt.Errorf("invalid format: %v", err)
+	}
+
+	return t, nil
+}
+
+func (c *client) printFormat(counter int) {
+	meta := c.meta(counter)
+	r := formatRecord{
+		Target:    meta.Target,
+		IP:        meta.IP,
+		Labels:    meta.Labels,
+		Timestamp: c.probeTime(),
+		Time:      meta.Time,
+		Seq:       counter,
+		Warmup:    meta.Warmup,
+		Stats:     c.stats,
+	}
+
+	v := reflect.ValueOf(c.stats)
+	filter := newFieldFilter(c.req.filter)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+		if c.req.hideUnsupported && !isSupported(f) {
+			continue
+		}
+		if filter.match(f.Name) {
+			r.Fields = append(r.Fields, formatField{f.Name, v.Field(i).Interface()})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := c.req.format.Execute(buf, r); err != nil {
+		errorf("%v", err)
+		return
+	}
+
+	fmt.Fprintln(stdout{}, buf.String())
+}
@@ -3,16 +3,24 @@ module github.com/mehrdadrad/tcpprobe
 go 1.15
 
 require (
-	github.com/golang/protobuf v1.4.3
+	github.com/golang/protobuf v1.5.3
+	github.com/klauspost/compress v1.15.9
 	github.com/prometheus/client_golang v1.8.0
-	github.com/sethvargo/go-signalcontext v0.1.0
-	github.com/stretchr/testify v1.6.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/quic-go/quic-go v0.40.1
+	github.com/segmentio/kafka-go v0.4.38
+	github.com/stretchr/testify v1.8.0
 	github.com/urfave/cli/v2 v2.2.0
+	golang.org/x/crypto v0.4.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.8.0
 	google.golang.org/grpc v1.27.0
-	google.golang.org/protobuf v1.23.0
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
+	google.golang.org/protobuf v1.28.0
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/api v0.18.6
 	k8s.io/apimachinery v0.18.6
 	k8s.io/client-go v0.18.6
+	k8s.io/klog/v2 v2.30.0 // indirect
 	k8s.io/utils v0.0.0-20201110183641-67b214c5f920 // indirect
+	modernc.org/sqlite v1.18.1
 )
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"reflect"
 	"time"
@@ -83,14 +82,14 @@ func (g *gServer) Get(target *pb.Target, stream pb.TCPProbe_GetServer) error {
 func grpcServer(tp *tp, req *request) {
 	l, err := net.Listen("tcp", req.grpcAddr)
 	if err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
 	}
 
 	srv := &gServer{tp: tp, req: req}
 	s := grpc.NewServer()
 	pb.RegisterTCPProbeServer(s, srv)
 	go func() {
-		log.Fatal(s.Serve(l))
+		fatalf("%v", s.Serve(l))
 	}()
 }
 
@@ -110,7 +109,7 @@ func grpcClient(req *request) {
 
 	conn, err := grpc.Dial(req.cmd.addr, opts...)
 	if err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
 	}
 
 	c := pb.NewTCPProbeClient(conn)
@@ -132,14 +131,14 @@ func grpcClient(req *request) {
 		case "del":
 			resp, err = c.Delete(ctx, pt)
 		default:
-			log.Printf("%s doesn't support", req.cmd.cmd)
+			errorf("%s doesn't support", req.cmd.cmd)
 			return
 		}
 
 		if err != nil {
-			log.Println(err)
+			errorf("%v", err)
 		} else {
-			log.Printf("%s - %s", resp.Message, target)
+			infof("%s - %s", resp.Message, target)
 		}
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcHealthCheck issues grpc.health.v1.Health/Check over the probe's
+// connection, the connection is kept open to sample the TCP stats
+func (c *client) grpcHealthCheck(ctx context.Context) error {
+	var (
+		conn   = c.conn
+		dialed bool
+		err    error
+	)
+
+	c.stats.GRPCCheck = 0
+	c.stats.GRPCStatus = 0
+
+	if c.req.grpcTLS {
+		config := c.tlsConfig()
+		config.NextProtos = []string{http2.NextProtoTLS}
+		if conn, err = c.tlsHandshake(ctx, config); err != nil {
+			return err
+		}
+	}
+
+	// the connection can't be dialed again once it's closed
+	dialer := func(context.Context, string) (net.Conn, error) {
+		if dialed {
+			return nil, errors.New("grpc connection closed")
+		}
+		dialed = true
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.req.timeout)
+	defer cancel()
+
+	c.grpcConn, err = grpc.DialContext(ctx, c.target, grpc.WithInsecure(), grpc.WithContextDialer(dialer))
+	if err != nil {
+		c.stats.GRPCError++
+		return err
+	}
+
+	t := time.Now()
+	resp, err := grpc_health_v1.NewHealthClient(c.grpcConn).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: c.req.grpcService})
+	if err != nil {
+		c.stats.GRPCError++
+		return err
+	}
+
+	c.stats.GRPCCheck = time.Since(t).Microseconds()
+	c.stats.GRPCStatus = int(resp.Status)
+
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s: grpc health status %s", c.target, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	// the pure go sqlite driver, it's built without cgo
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// historyFlushInterval is the queued rows' insert interval
+	historyFlushInterval = time.Second
+	// historyPruneInterval is the expired rows' delete interval
+	historyPruneInterval = 10 * time.Minute
+	// historyQueue is the maximum queued rows, the rows
+	// are dropped once it's full
+	historyQueue = 10000
+	// historyBusyTimeout is the wait for the database's lock
+	historyBusyTimeout = 5000
+)
+
+// historyMigrations are the schema's migrations, the database's
+// user_version is the number of the applied migrations. the stats'
+// columns aren't here since they're added once they're new
+var historyMigrations = []string{
+	`CREATE TABLE probes (
+		id INTEGER PRIMARY KEY,
+		target TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		addr TEXT NOT NULL DEFAULT '',
+		labels TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX probes_target_timestamp ON probes (target, timestamp)`,
+	`CREATE INDEX probes_timestamp ON probes (timestamp)`,
+}
+
+// history represents the sqlite local history, the probes' stats
+// are inserted in the background and the rows older than the
+// retention are deleted periodically
+type history struct {
+	db        *sql.DB
+	retention time.Duration
+	columns   []string
+
+	ch   chan historyRow
+	done chan struct{}
+}
+
+// historyRow represents a probe's row, the timestamp is the unix nanoseconds
+type historyRow struct {
+	target    string
+	timestamp int64
+	seq       int
+	addr      string
+	labels    map[string]string
+	stats     stats
+}
+
+// historyReq represents the history command's options
+type historyReq struct {
+	path       string
+	target     string
+	since      time.Duration
+	json       bool
+	jsonPretty bool
+	csv        bool
+	filter     string
+}
+
+func newHistory(req *request) (*history, error) {
+	db, err := openHistory(req.sqlite)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateHistory(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: %v", err)
+	}
+
+	return &history{
+		db:        db,
+		retention: req.retention,
+		columns:   historyColumns(),
+		ch:        make(chan historyRow, historyQueue),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// openHistory opens the database in the WAL mode, the history
+// command reads it while the rows are inserted
+func openHistory(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %v", err)
+	}
+
+	// the pragmas are the connection's settings
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{
+		"PRAGMA busy_timeout = " + strconv.Itoa(historyBusyTimeout),
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = NORMAL",
+	} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite: %s: %v", path, err)
+		}
+	}
+
+	return db, nil
+}
+
+// migrateHistory applies the new migrations and adds the
+// stats' columns which don't exist e.g. after the upgrade
+func migrateHistory(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(historyMigrations) {
+		return fmt.Errorf("the schema version %d is newer than %d", version, len(historyMigrations))
+	}
+
+	for i := version; i < len(historyMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(historyMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// the pragma doesn't accept the bind parameter
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	existing, err := tableColumns(db)
+	if err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(stats{})
+	for _, name := range historyColumns() {
+		if existing[strings.ToLower(name)] {
+			continue
+		}
+
+		f, _ := t.FieldByName(name)
+		def := "INTEGER NOT NULL DEFAULT 0"
+		if f.Type.Kind() == reflect.String {
+			def = "TEXT NOT NULL DEFAULT ''"
+		}
+
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE probes ADD COLUMN "%s" %s`, name, def)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tableColumns returns the probes table's columns in lower case
+func tableColumns(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('probes')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+
+	return columns, rows.Err()
+}
+
+// historyColumns returns the stats' fields which are stored,
+// the columns are named by the fields same as the json records
+func historyColumns() []string {
+	var columns []string
+
+	t := reflect.TypeOf(stats{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.String:
+			columns = append(columns, f.Name)
+		}
+	}
+
+	return columns
+}
+
+// run inserts the queued rows at the interval and deletes the expired
+// rows, the remaining rows are inserted once the context is canceled
+func (h *history) run(ctx context.Context) {
+	defer close(h.done)
+	defer h.db.Close()
+
+	flush := time.NewTicker(historyFlushInterval)
+	defer flush.Stop()
+
+	prune := time.NewTicker(historyPruneInterval)
+	defer prune.Stop()
+
+	h.prune()
+
+	for {
+		select {
+		case <-flush.C:
+			h.flush()
+		case <-prune.C:
+			h.prune()
+		case <-ctx.Done():
+			h.flush()
+			return
+		}
+	}
+}
+
+func (h *history) wait() {
+	<-h.done
+}
+
+// write queues the probe's row, it's dropped if the queue is full
+func (h *history) write(c *client, counter int) {
+	row := historyRow{
+		target:    c.target,
+		timestamp: c.probeTime().UnixNano(),
+		seq:       counter,
+		addr:      c.addr,
+		labels:    c.labels,
+		stats:     c.stats,
+	}
+
+	select {
+	case h.ch <- row:
+	default:
+		selfMetrics.outputErrors.Inc()
+		debugf("sqlite queue is full, the row dropped: %s", c.target)
+	}
+}
+
+// flush inserts the queued rows in a transaction
+func (h *history) flush() {
+	if len(h.ch) == 0 {
+		return
+	}
+
+	if err := h.insert(); err != nil {
+		selfMetrics.outputErrors.Inc()
+		errorf("sqlite: %v", err)
+	}
+}
+
+func (h *history) insert() error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO probes (target, timestamp, seq, addr, labels, "` +
+		strings.Join(h.columns, `", "`) + `") VALUES (?` +
+		strings.Repeat(", ?", len(h.columns)+4) + ")"
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, 0, len(h.columns)+5)
+	for len(h.ch) > 0 {
+		row := <-h.ch
+
+		labels := ""
+		if len(row.labels) > 0 {
+			b, _ := json.Marshal(row.labels)
+			labels = string(b)
+		}
+
+		args = append(args[:0], row.target, row.timestamp, row.seq, row.addr, labels)
+
+		v := reflect.ValueOf(row.stats)
+		for _, name := range h.columns {
+			f := v.FieldByName(name)
+			switch f.Kind() {
+			case reflect.String:
+				args = append(args, f.String())
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				// the sqlite integer is signed, the uint64 is kept by its bits
+				args = append(args, int64(f.Uint()))
+			default:
+				args = append(args, f.Int())
+			}
+		}
+
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// prune deletes the rows older than the retention
+func (h *history) prune() {
+	before := time.Now().Add(-h.retention).UnixNano()
+
+	res, err := h.db.Exec("DELETE FROM probes WHERE timestamp < ?", before)
+	if err != nil {
+		errorf("sqlite: %v", err)
+		return
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		debugf("sqlite: %d rows older than %s deleted", n, h.retention)
+	}
+}
+
+// readHistory returns the rows since the duration, all the targets'
+// rows are returned if the target is empty
+func readHistory(path, target string, since time.Duration) ([]historyRow, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("sqlite: %v", err)
+	}
+
+	db, err := openHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	existing, err := tableColumns(db)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %v", err)
+	}
+
+	// the columns which don't exist in the older database are zero
+	var columns []string
+	for _, name := range historyColumns() {
+		if existing[strings.ToLower(name)] {
+			columns = append(columns, name)
+		}
+	}
+
+	query := `SELECT target, timestamp, seq, addr, labels`
+	for _, name := range columns {
+		query += `, "` + name + `"`
+	}
+	query += ` FROM probes WHERE timestamp >= ?`
+
+	args := []interface{}{time.Now().Add(-since).UnixNano()}
+	if target != "" {
+		query += " AND target = ?"
+		args = append(args, target)
+	}
+	query += " ORDER BY timestamp, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %v", err)
+	}
+	defer rows.Close()
+
+	var result []historyRow
+	for rows.Next() {
+		var (
+			row    historyRow
+			labels string
+			values = make([]interface{}, len(columns))
+		)
+
+		dest := []interface{}{&row.target, &row.timestamp, &row.seq, &row.addr, &labels}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("sqlite: %v", err)
+		}
+
+		if labels != "" {
+			json.Unmarshal([]byte(labels), &row.labels)
+		}
+
+		v := reflect.ValueOf(&row.stats).Elem()
+		for i, name := range columns {
+			f := v.FieldByName(name)
+			switch value := values[i].(type) {
+			case int64:
+				switch f.Kind() {
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+					f.SetUint(uint64(value))
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					f.SetInt(value)
+				}
+			case string:
+				if f.Kind() == reflect.String {
+					f.SetString(value)
+				}
+			}
+		}
+
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// printHistory prints the rows by the printers same as the probes
+func printHistory(r *historyReq) error {
+	rows, err := readHistory(r.path, r.target, r.since)
+	if err != nil {
+		return err
+	}
+
+	req := &request{json: r.json, jsonPretty: r.jsonPretty, csv: r.csv, filter: r.filter}
+	for _, row := range rows {
+		t := time.Unix(0, row.timestamp)
+		c := &client{
+			target:    row.target,
+			addr:      row.addr,
+			labels:    row.labels,
+			stats:     row.stats,
+			timestamp: t.Unix(),
+			probed:    t,
+			req:       req,
+		}
+		c.printer(row.seq)
+	}
+
+	return nil
+}
+
+// getDaysDuration parses the duration which may be in days e.g. 7d
+func getDaysDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hook represents the local command hooks, the commands run in
+// the background with a timeout so they don't block the probes
+type hook struct {
+	timeout time.Duration
+	sem     chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newHook(req *request) *hook {
+	return &hook{
+		timeout: req.hookTimeout,
+		sem:     make(chan struct{}, req.hookMaxConcurrency),
+	}
+}
+
+// exec runs the command once there is a free slot,
+// it's dropped if the concurrent commands are at the maximum
+func (h *hook) exec(cmd string, e alertEvent) {
+	select {
+	case h.sem <- struct{}{}:
+	default:
+		warnf("hook: too many running commands, the command dropped: %s %s", e.Target, e.State)
+		return
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer func() {
+			<-h.sem
+			h.wg.Done()
+		}()
+		h.run(cmd, e)
+	}()
+}
+
+// run runs the command with the event in its environment,
+// the command's arguments are split by the spaces
+func (h *hook) run(cmd string, e alertEvent) {
+	args := strings.Fields(cmd)
+	if len(args) < 1 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	labels, _ := json.Marshal(e.Labels)
+
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Env = append(os.Environ(),
+		"TP_TARGET="+e.Target,
+		"TP_STATE="+e.State,
+		"TP_ERROR="+e.Error,
+		"TP_FAILS="+strconv.Itoa(e.Failures),
+		"TP_LABELS_JSON="+string(labels),
+	)
+
+	start := time.Now()
+	out, err := c.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		errorf("hook: %s %s: %s timed out after %s", e.Target, e.State, args[0], h.timeout)
+		return
+	}
+
+	if err != nil {
+		errorf("hook: %s %s: %s: %v: %s", e.Target, e.State, args[0], err, strings.TrimSpace(string(out)))
+		return
+	}
+
+	infof("hook: %s %s: %s exited 0 in %s", e.Target, e.State, args[0], time.Since(start).Round(time.Millisecond))
+}
+
+// wait waits until the running commands are finished
+func (h *hook) wait() {
+	h.wg.Wait()
+}
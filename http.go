@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// countConn represents a connection which counts the written bytes
+type countConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	*c.written += int64(n)
+	return n, err
+}
+
+// dialHop dials a redirect hop, the target's address is re-resolved
+// since a redirect may point to another host. the probe's socket is
+// still the first hop's one, so the TCP_INFO and TLS stats reflect the
+// original target not the final host
+func (c *client) dialHop(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyURL, err := c.getProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL != nil {
+		return nil, fmt.Errorf("%s: following redirects through proxy is not supported", addr)
+	}
+
+	d := net.Dialer{
+		Timeout:   c.req.timeout,
+		LocalAddr: c.localAddr(),
+		Control:   c.control,
+	}
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.hopConns = append(c.hopConns, conn)
+
+	return conn, nil
+}
+
+func (c *client) dialTLSHop(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := c.dialHop(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := c.tlsConfig()
+	config.ServerName = host
+	// the hop has to speak the same protocol as the first hop's transport
+	if c.h2 {
+		config.NextProtos = []string{http2.NextProtoTLS}
+	} else {
+		config.NextProtos = nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return countConn{tlsConn, &c.stats.HTTPSentBytes}, nil
+}
+
+// http2Transport handshakes ahead of the request since the transport
+// depends on the negotiated protocol, it falls back to HTTP/1.1 if the
+// target doesn't offer h2. the probe's socket is used either way.
+func (c *client) http2Transport(ctx context.Context, tr http.RoundTripper) (http.RoundTripper, error) {
+	conn, err := c.dialTLSContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.tlsConn = conn
+
+	if !c.h2 {
+		return tr, nil
+	}
+
+	return &http2.Transport{
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return c.dialTLSContext(context.Background(), network, addr)
+		},
+	}, nil
+}
+
+func (c *client) closeHops() {
+	for _, conn := range c.hopConns {
+		conn.Close()
+	}
+	c.hopConns = nil
+}
+
+// checkExpectations evaluates the response against the expected
+// status codes and the body regex (first expect-body-limit bytes)
+func (c *client) checkExpectations(status int, body []byte) {
+	c.stats.HTTPExpectationMismatch = 0
+
+	if len(c.req.expectStatus) > 0 && !isExpectedStatus(status, c.req.expectStatus) ||
+		c.bodyRegex != nil && !c.bodyRegex.Match(body) {
+		c.stats.HTTPExpectationFailed++
+		c.stats.HTTPExpectationMismatch = 1
+	}
+}
+
+// getHTTPHeaders parses the headers in "Name: value" format
+func getHTTPHeaders(headers []string) (http.Header, error) {
+	h := http.Header{}
+
+	for _, header := range headers {
+		kv := strings.SplitN(header, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid HTTP header: %s, expected \"Name: value\"", header)
+		}
+		h.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	return h, nil
+}
+
+// getHTTPBody returns the body from the file if it's given
+func getHTTPBody(body, filename string) ([]byte, error) {
+	if filename != "" {
+		return ioutil.ReadFile(filename)
+	}
+
+	if body != "" {
+		return []byte(body), nil
+	}
+
+	return nil, nil
+}
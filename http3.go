@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Probe requests the https target by HTTP/3 over QUIC, the next
+// probes are resumed by 0-RTT if the server allows. the tcp_info
+// isn't available since there's no TCP connection
+func (c *client) http3Probe(ctx context.Context) error {
+	c.probed = time.Now()
+	c.timestamp = c.probed.Unix()
+	c.stats.QUICHandshake = 0
+	c.stats.QUIC0RTT = 0
+	c.stats.HTTP3Request = 0
+	c.stats.HTTP3RcvdBytes = 0
+	c.stats.HTTPStatusCode = 0
+	c.stats.HTTPProto = ""
+
+	ctx, cancel := context.WithTimeout(ctx, c.req.timeout)
+	defer cancel()
+
+	pconn, err := c.listenQUIC()
+	if err != nil {
+		return err
+	}
+	defer pconn.Close()
+
+	conn, err := c.dialQUIC(ctx, pconn)
+	if err != nil {
+		c.stats.QUICConnectError++
+		return err
+	}
+
+	tr := &http3.RoundTripper{
+		Dial: func(context.Context, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error) {
+			return conn, nil
+		},
+	}
+	defer tr.Close()
+
+	method := c.req.httpMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.target, bytes.NewReader(c.req.httpBody))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range c.req.httpHeaders {
+		req.Header[k] = v
+	}
+
+	if host := c.req.httpHeaders.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	end := c.span("request")
+	t := time.Now()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		end(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	var head []byte
+	if c.bodyRegex != nil {
+		head, err = ioutil.ReadAll(io.LimitReader(resp.Body, c.req.expectBodyLimit))
+		if err != nil {
+			end(err)
+			return err
+		}
+	}
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	end(err)
+	if err != nil {
+		return err
+	}
+
+	c.stats.HTTP3Request = time.Since(t).Microseconds()
+	c.stats.HTTP3RcvdBytes = n + int64(len(head))
+	c.stats.HTTPStatusCode = resp.StatusCode
+	c.stats.HTTPProto = "h3"
+	c.checkExpectations(resp.StatusCode, head)
+
+	return nil
+}
+
+// listenQUIC returns the UDP socket of the QUIC connection,
+// it's bound to the source address if it's requested
+func (c *client) listenQUIC() (net.PacketConn, error) {
+	laddr := &net.UDPAddr{}
+	if src, ok := c.localAddr().(*net.TCPAddr); ok {
+		laddr.IP = src.IP
+	}
+
+	return net.ListenUDP("udp", laddr)
+}
+
+// dialQUIC dials the target over the UDP socket and waits
+// for the handshake, the session tickets are kept for 0-RTT
+func (c *client) dialQUIC(ctx context.Context, pconn net.PacketConn) (quic.EarlyConnection, error) {
+	addr, err := c.getAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.addr = addr
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.quicSessions == nil {
+		c.quicSessions = tls.NewLRUClientSessionCache(1)
+	}
+
+	config := c.tlsConfig()
+	config.NextProtos = []string{http3.NextProtoH3}
+	config.ClientSessionCache = c.quicSessions
+
+	end := c.span("quic")
+	t := time.Now()
+	conn, err := quic.DialEarly(ctx, pconn, raddr, config, &quic.Config{HandshakeIdleTimeout: c.req.timeout})
+	if err != nil {
+		end(err)
+		return nil, err
+	}
+
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		// the handshake's error e.g. timeout is the context's cause
+		err = context.Cause(conn.Context())
+		end(err)
+		return nil, err
+	case <-ctx.Done():
+		conn.CloseWithError(0, "")
+		end(ctx.Err())
+		return nil, ctx.Err()
+	}
+	end(nil)
+
+	c.stats.QUICHandshake = time.Since(t).Microseconds()
+	if conn.ConnectionState().Used0RTT {
+		c.stats.QUIC0RTT = 1
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// icmpSocket represents the detected ICMP socket type of an address
+// family, raw socket requires CAP_NET_RAW and the unprivileged one
+// requires the group in net.ipv4.ping_group_range on Linux
+type icmpSocket struct {
+	once    sync.Once
+	network string
+	err     error
+}
+
+var icmpSockets = map[bool]*icmpSocket{false: {}, true: {}}
+
+// getICMPNetwork returns the permitted ICMP socket type, it's
+// detected once and the raw socket is preferred
+func getICMPNetwork(ipv6 bool) (string, error) {
+	s := icmpSockets[ipv6]
+	s.once.Do(func() {
+		networks, addr := []string{"ip4:icmp", "udp4"}, "0.0.0.0"
+		if ipv6 {
+			networks, addr = []string{"ip6:ipv6-icmp", "udp6"}, "::"
+		}
+
+		for _, network := range networks {
+			conn, err := icmp.ListenPacket(network, addr)
+			if err == nil {
+				conn.Close()
+				s.network = network
+				return
+			}
+		}
+
+		s.err = errors.New("icmp: neither raw socket (CAP_NET_RAW) nor unprivileged ping socket " +
+			"(net.ipv4.ping_group_range) is permitted")
+	})
+
+	return s.network, s.err
+}
+
+// checkICMP validates the ICMP socket availability of the icmp:// target
+func checkICMP(target string, ipv6 bool) error {
+	if !strings.HasPrefix(target, "icmp://") {
+		return nil
+	}
+
+	_, err := getICMPNetwork(ipv6)
+
+	return err
+}
+
+// icmpProbe sends an echo request and waits for the reply up
+// to the timeout, the lost replies are counted
+func (c *client) icmpProbe(ctx context.Context) error {
+	c.probed = time.Now()
+	c.timestamp = c.probed.Unix()
+	c.stats.Rtt = 0
+	c.stats.ICMPReplyTTL = 0
+
+	addr, err := c.getAddr(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.addr = addr
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	v6 := ip.To4() == nil
+
+	network, err := getICMPNetwork(v6)
+	if err != nil {
+		return err
+	}
+
+	var (
+		proto             = 1
+		reqType icmp.Type = ipv4.ICMPTypeEcho
+		dst     net.Addr  = &net.IPAddr{IP: ip}
+		laddr             = "0.0.0.0"
+	)
+
+	if v6 {
+		proto, reqType, laddr = 58, ipv6.ICMPTypeEchoRequest, "::"
+	}
+
+	// the unprivileged socket's echo id is the local port
+	privileged := !strings.HasPrefix(network, "udp")
+	if !privileged {
+		dst = &net.UDPAddr{IP: ip}
+	}
+
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if v6 {
+		conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	}
+
+	c.icmpSeq++
+	id := os.Getpid() & 0xffff
+	b, err := (&icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: id, Seq: c.icmpSeq & 0xffff, Data: []byte("tcpprobe")},
+	}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(c.req.timeout))
+
+	c.stats.ICMPSent++
+	t := time.Now()
+	if _, err = conn.WriteTo(b, dst); err != nil {
+		c.stats.ICMPLost++
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, ttl, err := readICMP(conn, v6, buf)
+		if err != nil {
+			c.stats.ICMPLost++
+			return err
+		}
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || msg.Type == reqType || echo.Seq != c.icmpSeq&0xffff || privileged && echo.ID != id {
+			continue
+		}
+
+		if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+			c.stats.ICMPLost++
+			return fmt.Errorf("%s: unexpected ICMP %v", c.target, msg.Type)
+		}
+
+		c.stats.Rtt = uint32(time.Since(t).Microseconds())
+		c.stats.ICMPReplyTTL = ttl
+
+		return nil
+	}
+}
+
+// readICMP reads an ICMP message and its TTL or hop limit
+func readICMP(conn *icmp.PacketConn, v6 bool, buf []byte) (int, int, error) {
+	if v6 {
+		n, cm, _, err := conn.IPv6PacketConn().ReadFrom(buf)
+		if cm != nil {
+			return n, cm.HopLimit, err
+		}
+		return n, 0, err
+	}
+
+	n, cm, _, err := conn.IPv4PacketConn().ReadFrom(buf)
+	if cm != nil {
+		return n, cm.TTL, err
+	}
+	return n, 0, err
+}
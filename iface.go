@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// checkInterface validates the network interface name
+func checkInterface(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	_, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("interface %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// getInterfaceAddr returns the interface's first address, IPv4 is
+// preferred unless IPv6 requested
+func getInterfaceAddr(name string, ipv6 bool) (net.Addr, error) {
+	var addr6 net.IP
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil && !ipv6 {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+
+		if ipNet.IP.To4() == nil && addr6 == nil {
+			addr6 = ipNet.IP
+		}
+	}
+
+	if addr6 == nil {
+		return nil, fmt.Errorf("interface %s: address not available", name)
+	}
+
+	return &net.TCPAddr{IP: addr6}, nil
+}
+
+// localAddr returns the source address, the interface's address
+// is used if the socket can't be bound to the interface
+func (c *client) localAddr() net.Addr {
+	if c.req.srcAddr == "" && c.ifaceAddr != nil {
+		return c.ifaceAddr
+	}
+
+	return getSrcAddr(c.req.srcAddr)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	influxTagEscaper    = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influx represents InfluxDB line protocol writer
+type influx struct {
+	url           string
+	username      string
+	password      string
+	batchSize     int
+	flushInterval time.Duration
+
+	httpClient *http.Client
+	ch         chan influxPoint
+	done       chan struct{}
+}
+
+// influxPoint represents a single line and its owner, the owner's
+// write errors are counted once the point isn't written
+type influxPoint struct {
+	line   string
+	client *client
+}
+
+func newInflux(req *request) *influx {
+	batchSize := req.influxBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	return &influx{
+		url:           req.influxURL,
+		username:      req.influxUsername,
+		password:      req.influxPassword,
+		batchSize:     batchSize,
+		flushInterval: req.influxFlushInterval,
+		httpClient:    &http.Client{Timeout: req.timeoutHTTP},
+		ch:            make(chan influxPoint, batchSize*10),
+		done:          make(chan struct{}),
+	}
+}
+
+func (i *influx) run(ctx context.Context) {
+	var points []influxPoint
+
+	defer close(i.done)
+
+	ticker := time.NewTicker(i.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p := <-i.ch:
+			points = append(points, p)
+			if len(points) >= i.batchSize {
+				i.flush(points)
+				points = points[:0]
+			}
+		case <-ticker.C:
+			i.flush(points)
+			points = points[:0]
+		case <-ctx.Done():
+			for {
+				select {
+				case p := <-i.ch:
+					points = append(points, p)
+				default:
+					i.flush(points)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (i *influx) wait() {
+	<-i.done
+}
+
+func (i *influx) write(ctx context.Context, c *client) {
+	p := influxPoint{
+		line:   influxLine(c, getLabels(ctx, c.target), time.Now()),
+		client: c,
+	}
+
+	select {
+	case i.ch <- p:
+	default:
+		atomic.AddInt64(&c.influxErrors, 1)
+		selfMetrics.influxDropped.Inc()
+	}
+}
+
+func (i *influx) flush(points []influxPoint) {
+	if len(points) < 1 {
+		return
+	}
+
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		lines = append(lines, p.line)
+	}
+
+	err := i.post(strings.Join(lines, "\n"))
+	if err != nil {
+		errorf("%v", err)
+		selfMetrics.influxDropped.Add(float64(len(points)))
+		// the stats are updated by the probe's goroutine on report
+		for _, p := range points {
+			atomic.AddInt64(&p.client.influxErrors, 1)
+		}
+	}
+}
+
+func (i *influx) post(body string) error {
+	req, err := http.NewRequest("POST", i.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influxdb write failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func influxLine(c *client, labels map[string]string, t time.Time) string {
+	var (
+		tags   []string
+		fields []string
+	)
+
+	for k, v := range labels {
+		if v == "" {
+			continue
+		}
+		tags = append(tags, influxTagEscaper.Replace(k)+"="+influxTagEscaper.Replace(v))
+	}
+	sort.Strings(tags)
+
+	v := reflect.ValueOf(c.stats)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+
+		key := influxTagEscaper.Replace(f.Name)
+
+		switch v.Field(i).Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fields = append(fields, fmt.Sprintf("%s=%di", key, v.Field(i).Uint()))
+		case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
+			fields = append(fields, fmt.Sprintf("%s=%di", key, v.Field(i).Int()))
+		case reflect.String:
+			fields = append(fields, fmt.Sprintf("%s=\"%s\"", key, influxStringEscaper.Replace(v.Field(i).String())))
+		}
+	}
+
+	measurement := strings.Join(append([]string{"tcpprobe"}, tags...), ",")
+
+	return fmt.Sprintf("%s %s %d", measurement, strings.Join(fields, ","), t.UnixNano())
+}
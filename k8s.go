@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -16,19 +19,63 @@ import (
 )
 
 type k8s struct {
+	sync.Mutex
 	clientset kubernetes.Interface
 	pods      sync.Map
+	endpoints sync.Map
+	resync    time.Duration
+
+	watch watchState
+
+	dynamic        dynamic.Interface
+	probeTargets   map[string]*probeTarget
+	statusInterval time.Duration
+}
+
+// kubePod represents the started targets of a pod and
+// the annotations which they have been started with
+type kubePod struct {
+	interval string
+	labels   string
+	targets  map[string]*kubeTarget
+}
+
+// kubeTarget represents a running target of a pod
+type kubeTarget struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// endpoint represents a probe target of a service's ready endpoint
+type endpoint struct {
+	service  string
+	target   string
+	interval string
+	labels   []byte
 }
 
 func kube() *k8s {
-	cs, err := newClientset()
+	clusterConfig, err := rest.InClusterConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
+	}
+
+	cs, err := kubernetes.NewForConfig(clusterConfig)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	dc, err := dynamic.NewForConfig(clusterConfig)
+	if err != nil {
+		fatalf("%v", err)
 	}
 
 	k := &k8s{
-		clientset: cs,
-		pods:      sync.Map{},
+		clientset:      cs,
+		pods:           sync.Map{},
+		resync:         5 * time.Second,
+		dynamic:        dc,
+		statusInterval: 30 * time.Second,
 	}
 	return k
 }
@@ -36,75 +83,288 @@ func kube() *k8s {
 func (k *k8s) start(ctx context.Context, tp *tp, req *request) {
 	go func() {
 		for {
-			pods, err := k.clientset.CoreV1().Pods(req.namespace).List(ctx, metav1.ListOptions{})
+			err := k.syncPods(ctx, tp, req)
+			k.watch.update(err)
 			if err != nil {
 				if ctx.Err() != nil {
 					return
 				}
-				log.Println(err)
+				errorf("%v", err)
 				time.Sleep(time.Second)
 				continue
 			}
 
-			for _, pod := range pods.Items {
-				if _, ok := k.pods.Load(pod.Name); !ok && pod.Status.Phase == "Running" {
-					k.pods.Store(pod.Name, pod.Status.PodIP)
-					for _, target := range getTargets(&pod) {
-						if ok := tp.isExist(target); ok {
-							log.Println(errExist, target)
-							continue
-						}
-						go func(ctx context.Context, pod v1.Pod, target string) {
-							ctx = context.WithValue(ctx, intervalKey, pod.Annotations["tcpprobe/interval"])
-							ctx = context.WithValue(ctx, labelsKey, []byte(pod.Annotations["tcpprobe/labels"]))
-							tp.start(ctx, target, req)
-							tp.cleanup(ctx, target)
-						}(ctx, pod, target)
-
-						log.Printf("pod: %s, target: %s has been added", pod.Name, target)
-					}
-				}
+			select {
+			case <-time.After(k.resync):
+			case <-ctx.Done():
+				return
 			}
-			<-time.After(5 * time.Second)
 		}
 	}()
 
-	factory := informers.NewSharedInformerFactoryWithOptions(k.clientset, time.Second*5, informers.WithNamespace(req.namespace))
-	informer := factory.Core().V1().Pods().Informer()
+	stop := make(chan struct{})
+	for _, namespace := range getNamespaces(req) {
+		factory := informers.NewSharedInformerFactoryWithOptions(k.clientset, time.Second*5,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = req.kubeSelector
+			}))
+		informer := factory.Core().V1().Pods().Informer()
 
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		DeleteFunc: func(obj interface{}) {
-			pod, ok := obj.(*v1.Pod)
-			if !ok {
-				return
-			}
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(_, obj interface{}) {
+				selfMetrics.k8sEvents.Inc()
 
-			podIP, ok := k.pods.Load(pod.Name)
-			if !ok {
-				return
-			}
+				pod, ok := obj.(*v1.Pod)
+				if !ok || pod.Status.Phase != "Running" {
+					return
+				}
+
+				k.syncPod(ctx, tp, req, getPodKey(pod), pod)
+			},
+			DeleteFunc: func(obj interface{}) {
+				selfMetrics.k8sEvents.Inc()
+
+				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+				if err != nil {
+					return
+				}
+
+				k.removePod(tp, key)
+			},
+		})
+
+		go informer.Run(stop)
+	}
+
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+
+	if req.kubeServices {
+		go k.watchServices(ctx, tp, req)
+	}
+
+	if req.kubeProbeTargets {
+		go k.watchProbeTargets(ctx, tp, req)
+	}
+
+	infof("k8s has been started")
+}
+
+// syncPods starts the targets of the new running pods and stops the
+// targets of the pods which no longer match the selector
+func (k *k8s) syncPods(ctx context.Context, tp *tp, req *request) error {
+	current := make(map[string]bool)
+	for _, namespace := range getNamespaces(req) {
+		pods, err := k.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: req.kubeSelector})
+		if err != nil {
+			return err
+		}
 
-			pod.Status.PodIP = podIP.(string)
-			for _, target := range getTargets(pod) {
-				log.Printf("pod: %s, target: %s has been deleted", pod.Name, target)
-				tp.stop(target)
+		for _, pod := range pods.Items {
+			key := getPodKey(&pod)
+			current[key] = true
+
+			if pod.Status.Phase == "Running" {
+				k.syncPod(ctx, tp, req, key, &pod)
 			}
-			k.pods.Delete(pod.Name)
-		},
+		}
+	}
+
+	k.pods.Range(func(key, _ interface{}) bool {
+		if !current[key.(string)] {
+			k.removePod(tp, key.(string))
+		}
+		return true
 	})
 
-	stop := make(chan struct{})
-	go informer.Run(stop)
-	log.Println("k8s has been started")
+	return nil
 }
 
-func newClientset() (*kubernetes.Clientset, error) {
-	clusterConfig, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
+// syncPod applies the pod's annotations, the removed targets are
+// stopped and the new ones are started. all the targets are restarted
+// once the interval or the labels changed
+func (k *k8s) syncPod(ctx context.Context, tp *tp, req *request, key string, pod *v1.Pod) {
+	k.Lock()
+	defer k.Unlock()
+
+	interval := pod.Annotations["tcpprobe/interval"]
+	labels := expandPod(pod, pod.Annotations["tcpprobe/labels"])
+
+	p := &kubePod{interval: interval, labels: labels, targets: make(map[string]*kubeTarget)}
+	if v, ok := k.pods.Load(key); ok {
+		p = v.(*kubePod)
+	}
+
+	if p.interval != interval || p.labels != labels {
+		infof("pod: %s, the interval or the labels have been changed", key)
+		for target := range p.targets {
+			p.stop(key, target)
+		}
+		p.interval, p.labels = interval, labels
+	}
+
+	current := make(map[string]bool)
+	for _, target := range getTargets(pod) {
+		current[target] = true
+	}
+
+	for target := range p.targets {
+		if !current[target] {
+			p.stop(key, target)
+		}
+	}
+
+	for target := range current {
+		if _, ok := p.targets[target]; ok {
+			continue
+		}
+
+		if ok := tp.isExist(target); ok {
+			warnf("%v: %s", errExist, target)
+			continue
+		}
+
+		p.start(ctx, tp, req, target)
+		infof("pod: %s, target: %s has been added", key, target)
 	}
 
-	return kubernetes.NewForConfig(clusterConfig)
+	k.pods.Store(key, p)
+}
+
+// removePod stops the targets which have been started for the pod
+func (k *k8s) removePod(tp *tp, key string) {
+	k.Lock()
+	defer k.Unlock()
+
+	v, ok := k.pods.LoadAndDelete(key)
+	if !ok {
+		return
+	}
+
+	p := v.(*kubePod)
+	for target := range p.targets {
+		p.stop(key, target)
+	}
+}
+
+func (p *kubePod) start(ctx context.Context, tp *tp, req *request, target string) {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &kubeTarget{cancel: cancel, done: make(chan struct{})}
+	p.targets[target] = t
+
+	ctx = context.WithValue(ctx, intervalKey, p.interval)
+	ctx = context.WithValue(ctx, labelsKey, []byte(p.labels))
+
+	go func() {
+		defer close(t.done)
+		tp.start(ctx, target, req)
+		tp.cleanup(ctx, target)
+	}()
+}
+
+// stop stops the target and waits until it's cleaned up
+func (p *kubePod) stop(key, target string) {
+	t := p.targets[target]
+	t.cancel()
+	<-t.done
+	delete(p.targets, target)
+
+	infof("pod: %s, target: %s has been deleted", key, target)
+}
+
+// watchServices probes the ready endpoints of the annotated services,
+// the endpoints are synced periodically
+func (k *k8s) watchServices(ctx context.Context, tp *tp, req *request) {
+	for {
+		if err := k.syncServices(ctx, tp, req); err != nil && ctx.Err() == nil {
+			errorf("%v", err)
+		}
+
+		select {
+		case <-time.After(k.resync):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncServices adds the new endpoints' targets and removes
+// the targets of the endpoints which are gone
+func (k *k8s) syncServices(ctx context.Context, tp *tp, req *request) error {
+	var services []v1.Service
+	for _, namespace := range getNamespaces(req) {
+		list, err := k.clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		services = append(services, list.Items...)
+	}
+
+	current := make(map[string]endpoint)
+	for _, svc := range services {
+		if _, ok := svc.Annotations["tcpprobe/targets"]; !ok {
+			continue
+		}
+
+		ep, err := k.clientset.CoreV1().Endpoints(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			errorf("service: %s, %v", svc.Name, err)
+			continue
+		}
+
+		for _, e := range getEndpointTargets(&svc, ep) {
+			current[e.target] = e
+		}
+	}
+
+	for target, e := range current {
+		if _, ok := k.endpoints.Load(target); ok {
+			continue
+		}
+
+		if ok := tp.isExist(target); ok {
+			warnf("%v: %s", errExist, target)
+			continue
+		}
+
+		k.endpoints.Store(target, e)
+		go func(ctx context.Context, e endpoint) {
+			ctx = context.WithValue(ctx, intervalKey, e.interval)
+			ctx = context.WithValue(ctx, labelsKey, e.labels)
+			tp.start(ctx, e.target, req)
+			tp.cleanup(ctx, e.target)
+		}(ctx, e)
+
+		infof("service: %s, target: %s has been added", e.service, target)
+	}
+
+	k.endpoints.Range(func(key, value interface{}) bool {
+		if _, ok := current[key.(string)]; !ok {
+			tp.stop(key.(string))
+			k.endpoints.Delete(key)
+			infof("service: %s, target: %s has been deleted", value.(endpoint).service, key)
+		}
+		return true
+	})
+
+	return nil
+}
+
+// getNamespaces returns the watched namespaces, the empty
+// namespace means all the namespaces
+func getNamespaces(req *request) []string {
+	if req.kubeNamespaces != nil {
+		return req.kubeNamespaces
+	}
+
+	return []string{req.namespace}
+}
+
+func getPodKey(pod *v1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
 }
 
 func getTargets(n *v1.Pod) []string {
@@ -113,6 +373,56 @@ func getTargets(n *v1.Pod) []string {
 		return []string{}
 	}
 
-	targets = strings.Replace(targets, "PODIP", n.Status.PodIP, -1)
-	return strings.Split(targets, ";;")
+	return strings.Split(expandPod(n, targets), ";;")
+}
+
+// expandPod replaces the pod's template variables, the PODIP
+// is kept for the backward compatibility
+func expandPod(n *v1.Pod, s string) string {
+	return strings.NewReplacer(
+		"PODIP", n.Status.PodIP,
+		"{podIP}", n.Status.PodIP,
+		"{podName}", n.Name,
+		"{nodeName}", n.Spec.NodeName,
+		"{namespace}", n.Namespace,
+	).Replace(s)
+}
+
+// getEndpointTargets returns the targets of the service's ready endpoints,
+// the ENDPOINT in the targets annotation is replaced by the endpoint's
+// address and port, and the endpoint is labeled by its pod and node
+func getEndpointTargets(svc *v1.Service, ep *v1.Endpoints) []endpoint {
+	var endpoints []endpoint
+
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			labels := map[string]string{}
+			json.Unmarshal([]byte(svc.Annotations["tcpprobe/labels"]), &labels)
+			labels["service"] = svc.Name
+
+			if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+				labels["pod"] = addr.TargetRef.Name
+			}
+
+			if addr.NodeName != nil {
+				labels["node"] = *addr.NodeName
+			}
+
+			b, _ := json.Marshal(labels)
+
+			for _, port := range subset.Ports {
+				hostPort := net.JoinHostPort(addr.IP, strconv.Itoa(int(port.Port)))
+				for _, target := range strings.Split(svc.Annotations["tcpprobe/targets"], ";;") {
+					endpoints = append(endpoints, endpoint{
+						service:  svc.Name,
+						target:   strings.Replace(target, "ENDPOINT", hostPort, -1),
+						interval: svc.Annotations["tcpprobe/interval"],
+						labels:   b,
+					})
+				}
+			}
+		}
+	}
+
+	return endpoints
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	// kafkaTimeout is the broker's connect, request and produce timeout
+	kafkaTimeout = 10 * time.Second
+	// kafkaLinger is the maximum wait of a message before its batch
+	kafkaLinger = 100 * time.Millisecond
+	// kafkaBatch is the maximum messages of a produce request
+	kafkaBatch = 500
+	// kafkaAttempts is the produce attempts of a batch
+	kafkaAttempts = 2
+)
+
+// kafka represents the kafka producer, the probes' json records are
+// queued and produced in batches keyed by the target, the records are
+// dropped and counted once the queue is full so the probes aren't blocked
+type kafka struct {
+	writer kafkaWriter
+	grace  time.Duration
+
+	ch   chan kafkago.Message
+	done chan struct{}
+}
+
+// kafkaWriter produces the messages, the messages are partitioned
+// by the murmur2 of the key the same as the java client
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+func newKafka(req *request) (*kafka, error) {
+	transport := &kafkago.Transport{
+		DialTimeout: kafkaTimeout,
+		ClientID:    "tcpprobe",
+	}
+
+	if req.kafkaTLS {
+		transport.TLS = &tls.Config{InsecureSkipVerify: req.kafkaInsecure}
+
+		pool, err := getCertPool(req.kafkaCAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS.RootCAs = pool
+
+		if req.kafkaTLSCert != "" {
+			cc, err := newClientCert(req.kafkaTLSCert, req.kafkaTLSKey)
+			if err != nil {
+				return nil, err
+			}
+			transport.TLS.GetClientCertificate = cc.get
+		}
+	}
+
+	if req.kafkaSASLMechanism != "" {
+		mechanism, err := getKafkaSASL(req.kafkaSASLMechanism, req.kafkaUsername, req.kafkaPassword)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	return &kafka{
+		writer: &kafkago.Writer{
+			Addr:         kafkago.TCP(req.kafkaBrokers...),
+			Topic:        req.kafkaTopic,
+			Balancer:     &kafkago.Murmur2Balancer{},
+			RequiredAcks: kafkago.RequiredAcks(req.kafkaAcks),
+			MaxAttempts:  kafkaAttempts,
+			BatchSize:    kafkaBatch,
+			BatchTimeout: kafkaLinger,
+			ReadTimeout:  kafkaTimeout,
+			WriteTimeout: kafkaTimeout,
+			Transport:    transport,
+		},
+		grace: req.shutdownGrace,
+		ch:    make(chan kafkago.Message, req.kafkaQueueSize),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// run produces the queued messages in batches, the remaining messages
+// are produced within the shutdown grace period once the context is canceled
+func (k *kafka) run(ctx context.Context) {
+	defer close(k.done)
+	defer k.writer.Close()
+
+	for {
+		select {
+		case m := <-k.ch:
+			wctx, cancel := context.WithTimeout(context.Background(), kafkaTimeout)
+			k.write(wctx, k.batch(m))
+			cancel()
+		case <-ctx.Done():
+			k.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown produces the queued messages, the messages
+// which aren't produced in the grace period are dropped
+func (k *kafka) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), k.grace)
+	defer cancel()
+
+	for len(k.ch) > 0 {
+		k.write(ctx, k.batch(<-k.ch))
+	}
+}
+
+func (k *kafka) wait() {
+	<-k.done
+}
+
+// produce queues the probe's json record, it's dropped if the
+// queue is full e.g. the brokers aren't available
+func (k *kafka) produce(c *client, counter int) {
+	b, err := c.jsonRecord(counter, false)
+	if err != nil {
+		errorf("%v", err)
+		return
+	}
+
+	m := kafkago.Message{
+		Key:   []byte(c.target),
+		Value: b,
+		Time:  time.Now(),
+	}
+
+	select {
+	case k.ch <- m:
+	default:
+		k.drop(1)
+		debugf("kafka queue is full, the record dropped: %s", c.target)
+	}
+}
+
+func (k *kafka) drop(n int) {
+	selfMetrics.kafkaDropped.Add(float64(n))
+}
+
+// batch returns the message and the queued messages up to the batch size
+func (k *kafka) batch(m kafkago.Message) []kafkago.Message {
+	batch := []kafkago.Message{m}
+	for len(batch) < kafkaBatch && len(k.ch) > 0 {
+		batch = append(batch, <-k.ch)
+	}
+
+	return batch
+}
+
+// write produces the batch, the messages which
+// aren't produced are dropped and counted
+func (k *kafka) write(ctx context.Context, batch []kafkago.Message) {
+	err := k.writer.WriteMessages(ctx, batch...)
+	if err == nil {
+		return
+	}
+
+	n := len(batch)
+	if errs, ok := err.(kafkago.WriteErrors); ok {
+		n = errs.Count()
+	}
+
+	errorf("kafka: %v, %d messages dropped", err, n)
+	k.drop(n)
+}
+
+// getKafkaSASL returns the SASL mechanism: plain, scram-sha-256 or scram-sha-512
+func getKafkaSASL(mechanism, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToLower(mechanism) {
+	case "plain":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+
+	return nil, fmt.Errorf("invalid kafka-sasl-mechanism: %s", mechanism)
+}
+
+// getKafkaAcks returns the produce's required acks: 0, 1 or all
+func getKafkaAcks(s string) (int16, error) {
+	switch strings.ToLower(s) {
+	case "0":
+		return 0, nil
+	case "1":
+		return 1, nil
+	case "all", "-1":
+		return -1, nil
+	}
+
+	return 0, fmt.Errorf("invalid kafka-acks: %s", s)
+}
+
+// checkKafkaBrokers validates the brokers' host:port
+func checkKafkaBrokers(brokers []string) error {
+	for _, b := range brokers {
+		if _, port, err := net.SplitHostPort(b); err != nil || port == "" {
+			return fmt.Errorf("invalid kafka-brokers: %s", b)
+		}
+	}
+
+	return nil
+}
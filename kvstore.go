@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// isKVStore returns true if the target is probed by
+// the redis or memcached command e.g. redis://host:port
+func (c *client) isKVStore() bool {
+	return c.urlSchema.Scheme == "redis" || c.urlSchema.Scheme == "memcached"
+}
+
+// kvProbe sends the PING to redis or the version to memcached and
+// measures the round trip, the redis is authenticated before if
+// the password is set
+func (c *client) kvProbe(ctx context.Context) error {
+	c.stats.AppRtt = 0
+	c.stats.AppRcvdBytes = 0
+
+	c.conn.SetDeadline(time.Now().Add(c.req.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	r := bufio.NewReader(c.conn)
+
+	cmd, expect := "version\r\n", "VERSION "
+	if c.urlSchema.Scheme == "redis" {
+		cmd, expect = "PING\r\n", "+PONG"
+
+		if c.req.redisPassword != "" {
+			auth := fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(c.req.redisPassword), c.req.redisPassword)
+			if _, err := c.kvCmd(r, auth, "+OK"); err != nil {
+				return err
+			}
+		}
+	}
+
+	t := time.Now()
+	n, err := c.kvCmd(r, cmd, expect)
+	if n > 0 {
+		c.stats.AppRtt = time.Since(t).Microseconds()
+		c.stats.AppRcvdBytes = int64(n)
+	}
+
+	return err
+}
+
+// kvCmd sends the command and reads the response's line, the response
+// which doesn't start with the expectation is a protocol error
+func (c *client) kvCmd(r *bufio.Reader, cmd, expect string) (int, error) {
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return 0, err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		c.stats.AppMismatch++
+		return len(line), err
+	}
+
+	if !strings.HasPrefix(line, expect) {
+		c.stats.AppMismatch++
+		return len(line), fmt.Errorf("%s: unexpected response: %s", c.target, strings.TrimSpace(line))
+	}
+
+	return len(line), nil
+}
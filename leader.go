@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leader represents the leader election of the replicas, the targets
+// are watched by all the replicas but only the leader probes them
+type leader struct {
+	sync.Mutex
+	id      string
+	term    context.Context
+	changed chan struct{}
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+func newLeader(id string) *leader {
+	return &leader{
+		id:      id,
+		changed: make(chan struct{}),
+
+		leaseDuration: 15 * time.Second,
+		renewDeadline: 10 * time.Second,
+		retryPeriod:   2 * time.Second,
+	}
+}
+
+// run campaigns for the lease until the context is canceled,
+// the replica campaigns again once it lost the leadership
+func (l *leader) run(ctx context.Context, clientset kubernetes.Interface, req *request) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      req.kubeLeaseName,
+			Namespace: req.namespace,
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: l.id},
+	}
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   l.leaseDuration,
+		RenewDeadline:   l.renewDeadline,
+		RetryPeriod:     l.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            req.kubeLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				infof("%s is the leader", l.id)
+				l.set(ctx)
+			},
+			OnStoppedLeading: func() {
+				l.set(nil)
+			},
+			OnNewLeader: func(id string) {
+				if id != l.id {
+					infof("%s is the leader, %s is standby", id, l.id)
+				}
+			},
+		},
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	for ctx.Err() == nil {
+		le.Run(ctx)
+	}
+}
+
+func (l *leader) set(term context.Context) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.term == nil && term == nil {
+		return
+	}
+
+	l.term = term
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// get returns the current term's context, it's nil if the
+// replica isn't the leader, and the leadership change channel
+func (l *leader) get() (context.Context, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.term != nil && l.term.Err() != nil {
+		return nil, l.changed
+	}
+
+	return l.term, l.changed
+}
+
+func (l *leader) isLeader() bool {
+	term, _ := l.get()
+	return term != nil
+}
+
+// do calls the function once the replica is the leader, the function's
+// context is canceled once the leadership is lost, and it's called
+// again at the next term unless it returned by itself
+func (l *leader) do(ctx context.Context, f func(ctx context.Context)) {
+	for {
+		term, changed := l.get()
+		if term == nil {
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		fctx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-term.Done():
+				cancel()
+			case <-fctx.Done():
+			}
+		}()
+
+		f(fctx)
+		cancel()
+
+		if ctx.Err() != nil || term.Err() == nil {
+			return
+		}
+	}
+}
+
+// register exports the leadership of the replica
+func (l *leader) register() {
+	g := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        metricName("leader"),
+		Help:        "the replica is the leader and probes the targets",
+		ConstLabels: metricLabels,
+	}, func() float64 {
+		return float64(boolToInt(l.isLeader()))
+	})
+
+	err := prometheus.Register(g)
+	if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		prometheus.Unregister(e.ExistingCollector)
+		err = prometheus.Register(g)
+	}
+
+	if err != nil {
+		errorf("%v", err)
+	}
+}
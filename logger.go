@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel represents the diagnostic messages' severity,
+// the zero value is the info level
+type logLevel int
+
+const (
+	levelDebug logLevel = iota - 1
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// logger writes the diagnostic messages to the log's output (stderr)
+// in the text or json format, the stdout is kept for the probes
+type logger struct {
+	sync.Mutex
+	level logLevel
+	json  bool
+}
+
+// logRecord represents a diagnostic message in json format
+type logRecord struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+var logs = &logger{level: levelInfo}
+
+// set applies the log level and the format
+func (l *logger) set(level logLevel, format string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.level = level
+	l.json = format == "json"
+}
+
+func (l *logger) output(level logLevel, msg string) {
+	l.Lock()
+	enabled, isJSON := level >= l.level, l.json
+	l.Unlock()
+
+	if !enabled {
+		return
+	}
+
+	if !isJSON {
+		log.Printf("%s: %s", logLevels[level], msg)
+		return
+	}
+
+	b, _ := json.Marshal(logRecord{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: logLevels[level],
+		Msg:   msg,
+	})
+	log.Writer().Write(append(b, '\n'))
+}
+
+func debugf(format string, v ...interface{}) {
+	logs.output(levelDebug, fmt.Sprintf(format, v...))
+}
+
+func infof(format string, v ...interface{}) {
+	logs.output(levelInfo, fmt.Sprintf(format, v...))
+}
+
+func warnf(format string, v ...interface{}) {
+	logs.output(levelWarn, fmt.Sprintf(format, v...))
+}
+
+func errorf(format string, v ...interface{}) {
+	logs.output(levelError, fmt.Sprintf(format, v...))
+}
+
+// fatalf logs the error and exits
+func fatalf(format string, v ...interface{}) {
+	logs.output(levelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func getLogLevel(s string) (logLevel, error) {
+	for level, name := range logLevels {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+
+	return levelInfo, fmt.Errorf("invalid log-level: %s, expected debug, info, warn or error", s)
+}
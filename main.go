@@ -2,16 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sethvargo/go-signalcontext"
+	"time"
 )
 
 var (
@@ -21,6 +17,9 @@ var (
 
 type intervalContextKey string
 type labelsContextKey string
+type ipContextKey string
+type familyContextKey string
+type connContextKey string
 
 type prop struct {
 	cancel context.CancelFunc
@@ -29,74 +28,287 @@ type prop struct {
 
 type tp struct {
 	sync.Mutex
-	targets map[string]prop
+	targets  map[string]prop
+	config   map[string]*configTarget
+	violated bool
+	failed   bool
+
+	cancel  context.CancelFunc
+	stopped sync.Once
+
+	stdinTargets []target
+	remote       *remoteConfig
+
+	influx  *influx
+	statsd  *statsd
+	otlp    *otlp
+	tracer  *tracer
+	kafka   *kafka
+	syslog  *syslog
+	history *history
+	ndjson  *ndjson
+	webhook *webhook
+	hook    *hook
+
+	alertmanager *alertmanager
+	pushgateway  *pushgateway
+	remoteWrite  *remoteWrite
+
+	scheduler *scheduler
+	leader    *leader
+	admin     *admin
+	ready     *readiness
 }
 
 var (
 	intervalKey intervalContextKey
 	labelsKey   labelsContextKey
+	ipKey       ipContextKey
+	familyKey   familyContextKey
+	connKey     connContextKey
 
 	errExist = errors.New("the target already exist")
 )
 
 func main() {
 	wg := &sync.WaitGroup{}
-	ctx, cancel := signalcontext.OnInterrupt()
+	ctx, cancel, stop := onShutdown()
+	defer stop()
 	defer cancel()
 
+	// the output sinks are flushed once the probes are finished
+	sinks, stopSinks := context.WithCancel(context.Background())
+	defer stopSinks()
+
 	req, targets, err := getCli(os.Args)
 	if err != nil {
+		os.Exit(exitFailure)
+	}
+
+	if req == nil {
 		return
 	}
 
+	logs.set(req.logLevel, req.logFormat)
+
 	if req.cmd != nil {
 		grpcClient(req)
 		return
 	}
 
+	if req.history != nil {
+		if err := printHistory(req.history); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+
 	tp := &tp{targets: make(map[string]prop)}
 
+	// metrics namespace and labels
+	if err := setMetrics(req); err != nil {
+		fatalf("%v", err)
+	}
+
+	// the prober's own metrics
+	selfMetrics = newTelemetry()
+	if !req.promDisabled {
+		selfMetrics.register(tp)
+	}
+
+	// kubernetes
+	var k *k8s
+	if req.k8s || req.kubeLeaderElect {
+		k = kube()
+	}
+
+	// prometheus
+	if !req.promDisabled {
+		// the k8s client is used by the leader election as well
+		var watched *k8s
+		if req.k8s {
+			watched = k
+		}
+
+		tp.ready = newReadiness(tp, watched, req)
+		tp.ready.register()
+
+		if err := promServer(ctx, req, tp.ready); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	// influxdb
+	if req.influxURL != "" {
+		tp.influx = newInflux(req)
+		go tp.influx.run(sinks)
+	}
+
+	// statsd
+	if req.statsdAddr != "" {
+		tp.statsd, err = newStatsd(req)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		go tp.statsd.run(sinks)
+	}
+
+	// opentelemetry
+	if req.otlpEndpoint != "" {
+		tp.otlp = newOTLP(req)
+		go tp.otlp.run(sinks)
+	}
+
+	// opentelemetry traces
+	if req.otlpTracesEndpoint != "" {
+		tp.tracer = newTracer(req)
+		go tp.tracer.run(sinks)
+	}
+
+	// kafka
+	if len(req.kafkaBrokers) > 0 {
+		tp.kafka, err = newKafka(req)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		go tp.kafka.run(sinks)
+	}
+
+	// syslog
+	if req.syslog {
+		tp.syslog = newSyslog(req)
+		go tp.syslog.run(sinks)
+	}
+
+	// sqlite local history
+	if req.sqlite != "" {
+		tp.history, err = newHistory(req)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		go tp.history.run(sinks)
+	}
+
+	// ndjson output file
+	if req.outputFile != "" {
+		tp.ndjson, err = newNDJSON(req)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		go tp.ndjson.run(sinks)
+	}
+
+	// webhook notifications, the targets may have their own webhook
+	tp.webhook = newWebhook(req)
+	go tp.webhook.run(sinks)
+
+	// local command hooks
+	if req.onFailureCmd != "" || req.onRecoveryCmd != "" {
+		tp.hook = newHook(req)
+	}
+
+	// alertmanager alerts
+	if len(req.alertmanagerURLs) > 0 {
+		tp.alertmanager = newAlertmanager(req)
+		go tp.alertmanager.run(sinks)
+	}
+
+	// pushgateway, the metrics are pushed once the probes are finished
+	if req.pushgatewayURL != "" {
+		tp.pushgateway = newPushgateway(req)
+		go tp.pushgateway.run(sinks)
+	}
+
+	// prometheus remote write
+	if req.remoteWriteURL != "" {
+		tp.remoteWrite = newRemoteWrite(req)
+		go tp.remoteWrite.run(sinks)
+	}
+
+	// worker pool
+	if req.maxConcurrency > 0 {
+		tp.scheduler = newScheduler(ctx, req.maxConcurrency)
+		if !req.promDisabled {
+			tp.scheduler.register()
+		}
+	}
+
+	// leader election
+	if req.kubeLeaderElect {
+		id, err := os.Hostname()
+		if err != nil {
+			fatalf("%v", err)
+		}
+
+		tp.leader = newLeader(id)
+		if !req.promDisabled {
+			tp.leader.register()
+		}
+		go tp.leader.run(ctx, k.clientset, req)
+	}
+
+	// stop conditions
+	tp.cancel = cancel
+	if req.duration > 0 {
+		timer := time.AfterFunc(req.duration, cancel)
+		defer timer.Stop()
+	}
+
 	// command line targets
 	wg.Add(len(targets))
 	for _, target := range targets {
-		if ok := tp.isExist(target); ok {
-			log.Println(errExist, target)
+		if ok := tp.isExist(getTargetKey(withFamily(ctx, req), target)); ok {
+			warnf("%v: %s", errExist, target)
 			continue
 		}
 
 		go func(target string) {
 			defer wg.Done()
-			tp.start(ctx, target, req)
-			tp.cleanup(ctx, target)
+			tp.run(ctx, target, req)
 		}(target)
 	}
 
-	// config
-	cfg, err := getConfig(req.config)
+	// remote config
+	if req.configURL != "" {
+		tp.remote, err = newRemoteConfig(req)
+		if err != nil {
+			fatalf("%v", err)
+		}
+
+		if !req.promDisabled {
+			tp.remote.register()
+		}
+
+		tp.remote.refresh(ctx)
+	}
+
+	// config and targets file
+	cfg, err := tp.getTargets(req)
 	if err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
 	}
 
-	wg.Add(len(cfg.Targets))
-	for _, t := range cfg.Targets {
-		if ok := tp.isExist(t.Addr); ok {
-			log.Println(errExist, t.Addr)
-			continue
-		}
+	if tp.ready != nil {
+		tp.ready.setConfig(nil)
+	}
 
-		go func(ctx context.Context, target target) {
-			defer wg.Done()
-			b, _ := json.Marshal(target.Labels)
-			ctx = context.WithValue(ctx, intervalKey, target.Interval)
-			ctx = context.WithValue(ctx, labelsKey, b)
-			tp.start(ctx, target.Addr, req)
-			tp.cleanup(ctx, target.Addr)
-		}(ctx, t)
+	tp.loadConfig(ctx, wg, cfg, req)
+
+	if req.reloadable() {
+		go tp.watchConfig(ctx, wg, req)
 	}
 
 	// kubernetes
 	if req.k8s {
-		kube().start(ctx, tp, req)
+		k.start(ctx, tp, req)
+	}
+
+	// admin api
+	if req.adminAddr != "" {
+		tp.admin = newAdmin(ctx, tp, req)
+		if err := adminServer(ctx, tp.admin, req.adminAddr); err != nil {
+			fatalf("%v", err)
+		}
 	}
 
 	// grpc server
@@ -104,52 +316,296 @@ func main() {
 		grpcServer(tp, req)
 	}
 
-	// prometheus
-	if !req.promDisabled {
-		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			log.Fatal(http.ListenAndServe(req.promAddr, nil))
-		}()
+	var dashboard *top
+	if req.top {
+		dashboard = newTop(tp, cancel)
+		go dashboard.run(ctx)
 	}
 
 	wait(ctx, wg, req)
+
+	// stop the probes and wait for their summary
+	cancel()
+	if dashboard != nil {
+		dashboard.wait()
+	}
+	tp.drain(wg, req.shutdownGrace)
+
+	// flush the output sinks
+	stopSinks()
+
+	if tp.influx != nil {
+		tp.influx.wait()
+	}
+
+	if tp.otlp != nil {
+		tp.otlp.wait()
+	}
+
+	if tp.tracer != nil {
+		tp.tracer.wait()
+	}
+
+	if tp.kafka != nil {
+		tp.kafka.wait()
+	}
+
+	if tp.syslog != nil {
+		tp.syslog.wait()
+	}
+
+	if tp.history != nil {
+		tp.history.wait()
+	}
+
+	if tp.ndjson != nil {
+		tp.ndjson.wait()
+	}
+
+	tp.webhook.wait()
+
+	if tp.hook != nil {
+		tp.hook.wait()
+	}
+
+	if tp.alertmanager != nil {
+		tp.alertmanager.wait()
+	}
+
+	if tp.remoteWrite != nil {
+		tp.remoteWrite.wait()
+	}
+
+	if tp.pushgateway != nil {
+		tp.pushgateway.wait()
+
+		// the cron jobs are failed by the push as well as the thresholds
+		if tp.pushgateway.failed() && req.hasThresholds() {
+			tp.Lock()
+			tp.failed = true
+			tp.Unlock()
+		}
+	}
+
+	if code := tp.exitCode(); code != 0 {
+		os.Exit(code)
+	}
 }
 
 func wait(ctx context.Context, wg *sync.WaitGroup, req *request) {
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// the config targets may be added by reload
+		if req.k8s || req.grpc || req.kubeLeaderElect || req.adminAddr != "" || req.reloadable() && req.count == 0 {
+			<-ctx.Done()
+		}
+	case <-ctx.Done():
+	}
+}
+
+// run probes the target, or its all resolved addresses if it's requested
+func (t *tp) run(ctx context.Context, target string, req *request) {
+	ctx = withFamily(ctx, req)
+
+	if req.allIPs {
+		t.fanout(ctx, target, req)
+		return
+	}
+
+	if req.parallel > 1 {
+		t.parallel(ctx, target, req)
+		return
+	}
+
+	t.start(ctx, target, req)
+	t.cleanup(ctx, target)
+}
+
+// fanout expands the target into one client per resolved address, the
+// addresses are refreshed periodically and the clients are added or
+// removed as the records come and go
+func (t *tp) fanout(ctx context.Context, target string, req *request) {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
 
-	if req.k8s || req.grpc {
-		<-ctx.Done()
+	c := newClient(req, target)
+	ips := make(map[string]bool)
+
+	for {
+		addrs, err := c.resolveAll(ctx)
+		if err != nil {
+			errorf("%v", err)
+		}
+
+		current := make(map[string]bool)
+		for _, ip := range addrs {
+			current[ip] = true
+			if ips[ip] {
+				continue
+			}
+
+			ips[ip] = true
+			wg.Add(1)
+			go func(ctx context.Context) {
+				defer wg.Done()
+				t.start(ctx, target, req)
+				t.cleanup(ctx, target)
+			}(context.WithValue(ctx, ipKey, ip))
+
+			infof("target: %s, ip: %s has been added", target, ip)
+		}
+
+		// the clients are kept if the resolve failed
+		for ip := range ips {
+			if err == nil && !current[ip] {
+				t.stop(getTargetKey(context.WithValue(ctx, ipKey, ip), target))
+				delete(ips, ip)
+
+				infof("target: %s, ip: %s has been deleted", target, ip)
+			}
+		}
+
+		// the clients stop after count requests
+		if req.count > 0 {
+			return
+		}
+
+		select {
+		case <-time.After(req.allIPsRefresh):
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (t *tp) start(ctx context.Context, target string, req *request) {
+// getTargetKey returns the target's key in the targets, the target
+// has a key per family, per address once all-ips requested and
+// per connection once parallel requested
+func getTargetKey(ctx context.Context, target string) string {
+	if family, ok := ctx.Value(familyKey).(string); ok {
+		target += "/" + family
+	}
+
+	if ip, ok := ctx.Value(ipKey).(string); ok {
+		target += "@" + ip
+	}
+
+	if conn, ok := connLabel(ctx); ok {
+		target += "#" + conn
+	}
+
+	return target
+}
+
+// withFamily adds the requested address family to the context
+func withFamily(ctx context.Context, req *request) context.Context {
+	if family := req.family(); family != "" {
+		return context.WithValue(ctx, familyKey, family)
+	}
+
+	return ctx
+}
+
+// start probes the target until it's stopped and returns its client
+func (t *tp) start(ctx context.Context, target string, req *request) *client {
 	t.Lock()
 
 	ctx, cancel := context.WithCancel(ctx)
 	c := newClient(req, target)
-	t.targets[target] = prop{cancel, c}
+	c.ip, _ = ctx.Value(ipKey).(string)
+	c.labels = getRecordLabels(ctx)
+	c.influx = t.influx
+	c.statsd = t.statsd
+	c.otlp = t.otlp
+	c.tracer = t.tracer
+	c.kafka = t.kafka
+	c.syslog = t.syslog
+	c.history = t.history
+	c.ndjson = t.ndjson
+	c.webhook = t.webhook
+	c.hook = t.hook
+	c.alertmanager = t.alertmanager
+	if req.stopOnFailure {
+		c.stop = t.stopOnFailure
+	}
+	c.scheduler = t.scheduler
+	t.targets[getTargetKey(ctx, target)] = prop{cancel, c}
 	t.Unlock()
 
-	c.prometheus(ctx)
-	c.probe(ctx)
+	if t.pushgateway != nil {
+		t.pushgateway.forget(getTargetKey(ctx, target))
+	}
+
+	if t.leader != nil {
+		// the standby keeps the target without probing
+		t.leader.do(ctx, func(ctx context.Context) {
+			c.prometheus(ctx)
+			c.probe(ctx)
+			c.deprometheus(ctx)
+		})
+	} else {
+		c.prometheus(ctx)
+		c.probe(ctx)
+	}
+	c.printSummary()
+
+	if c.summary.failed > 0 {
+		t.Lock()
+		t.failed = true
+		t.Unlock()
+	}
+
+	if v := c.violations(); len(v) > 0 {
+		for _, msg := range v {
+			warnf("threshold violated: %s %s", target, msg)
+		}
+
+		t.Lock()
+		t.violated = true
+		t.Unlock()
+	}
+
+	return c
 }
 
 func (t *tp) cleanup(ctx context.Context, target string) {
 	t.Lock()
 	defer t.Unlock()
 
-	if _, ok := t.targets[target]; !ok {
+	key := getTargetKey(ctx, target)
+	if _, ok := t.targets[key]; !ok {
 		return
 	}
 
-	t.targets[target].client.deprometheus(ctx)
+	c := t.targets[key].client
+	collectors := c.collectors
+	c.deprometheus(ctx)
+
+	// the finished probes' metrics are pushed at the end
+	if t.pushgateway != nil && c.req.count > 0 {
+		t.pushgateway.keep(key, collectors)
+	}
+
+	// the finished target's last samples are written by the next flush
+	if t.remoteWrite != nil {
+		t.remoteWrite.keep(collectors)
+	}
+
+	if t.otlp != nil {
+		t.otlp.remove(key)
+	}
 
-	for _, ch := range t.targets[target].client.subCh {
+	for _, ch := range c.subCh {
 		close(ch)
 	}
 
-	delete(t.targets, target)
+	delete(t.targets, key)
 }
 
 func (t *tp) stop(target string) {
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ndjsonFlushInterval is the buffered records' flush interval
+const ndjsonFlushInterval = time.Second
+
+// ndjson represents the newline delimited json file output, the file
+// is rotated by its size or age and the rotated files are compressed
+type ndjson struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	interval time.Duration
+
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	opened  time.Time
+	errors  int64
+	lastErr string
+
+	compress sync.WaitGroup
+	done     chan struct{}
+}
+
+func newNDJSON(req *request) (*ndjson, error) {
+	n := &ndjson{
+		path:     req.outputFile,
+		maxSize:  req.outputMaxSize,
+		maxFiles: req.outputMaxFiles,
+		interval: req.outputRotateInterval,
+		done:     make(chan struct{}),
+	}
+
+	if err := n.open(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// run flushes the buffered records periodically and
+// once the context is canceled
+func (n *ndjson) run(ctx context.Context) {
+	defer close(n.done)
+
+	ticker := time.NewTicker(ndjsonFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.Lock()
+			n.flush()
+			n.Unlock()
+		case <-ctx.Done():
+			n.Lock()
+			n.flush()
+			n.file.Close()
+			n.Unlock()
+			n.compress.Wait()
+			return
+		}
+	}
+}
+
+func (n *ndjson) wait() {
+	<-n.done
+}
+
+// write appends the record to the file, the write errors such as
+// disk full are counted and logged without stopping the probes
+func (n *ndjson) write(b []byte) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.size > 0 && (n.size+int64(len(b))+1 > n.maxSize ||
+		n.interval > 0 && time.Since(n.opened) >= n.interval) {
+		if err := n.rotate(); err != nil {
+			n.failed(err)
+			return
+		}
+	}
+
+	if _, err := n.w.Write(append(b, '\n')); err != nil {
+		n.failed(err)
+		return
+	}
+
+	n.size += int64(len(b)) + 1
+}
+
+func (n *ndjson) open() error {
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("output file: %v", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("output file: %v", err)
+	}
+
+	n.file = f
+	n.w = bufio.NewWriter(f)
+	n.size = info.Size()
+	n.opened = time.Now()
+
+	return nil
+}
+
+func (n *ndjson) flush() {
+	if err := n.w.Flush(); err != nil {
+		n.failed(err)
+	}
+}
+
+// rotate renames the current file and opens a new one, the rotated
+// file is compressed in the background and the oldest ones are removed
+func (n *ndjson) rotate() error {
+	n.flush()
+	n.file.Close()
+
+	rotated := n.path + "." + time.Now().Format("20060102T150405.000000000")
+	if err := os.Rename(n.path, rotated); err != nil {
+		errorf("output file: %v", err)
+	} else {
+		n.compress.Add(1)
+		go func() {
+			defer n.compress.Done()
+			if err := gzipFile(rotated); err != nil {
+				errorf("output file: %v", err)
+			}
+			n.prune()
+		}()
+	}
+
+	return n.open()
+}
+
+// prune removes the oldest rotated files more than the max files
+func (n *ndjson) prune() {
+	if n.maxFiles < 1 {
+		return
+	}
+
+	files, err := filepath.Glob(n.path + ".*.gz")
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+
+	for len(files) > n.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			errorf("output file: %v", err)
+		}
+		files = files[1:]
+	}
+}
+
+// failed counts the write error, the buffered records are dropped
+// and the error is logged once until it's changed
+func (n *ndjson) failed(err error) {
+	n.errors++
+	n.w.Reset(n.file)
+	selfMetrics.outputErrors.Inc()
+
+	if err.Error() != n.lastErr {
+		errorf("output file: %v", err)
+		n.lastErr = err.Error()
+	}
+}
+
+func (n *ndjson) getErrors() int64 {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.errors
+}
+
+// gzipFile compresses the file to the .gz file and removes it
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// getByteSize parses the size such as 100MB, the units
+// are B, KB, MB and GB in powers of 1024
+func getByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	v := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, unit = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	return n * unit, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prober runs the on-demand probes of the /probe endpoint, the targets'
+// addresses are validated by the allow and deny lists so the endpoint
+// can't be used as a relay to the internal addresses
+type prober struct {
+	req   *request
+	sem   chan struct{}
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newProber(req *request) (*prober, error) {
+	allow, err := getCIDRs(req.probeAllow)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := getCIDRs(req.probeDeny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &prober{
+		req:   req,
+		sem:   make(chan struct{}, req.probeMaxConcurrency),
+		allow: allow,
+		deny:  deny,
+	}, nil
+}
+
+// ServeHTTP probes the target once and writes its stats
+// in the prometheus text exposition format
+func (p *prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "missing target", http.StatusBadRequest)
+		return
+	}
+
+	req := *p.req
+	req.count = 1
+	req.quiet = true
+	req.grpc = false
+	req.followRedirects = false
+
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout: %s", v), http.StatusBadRequest)
+			return
+		}
+		req.timeout, req.timeoutHTTP = timeout, timeout
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		defer func() { <-p.sem }()
+	default:
+		http.Error(w, "too many concurrent probes", http.StatusServiceUnavailable)
+		return
+	}
+
+	c := newClient(&req, target)
+	if err := p.pin(r.Context(), c); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	c.registerer = registry
+
+	ctx, cancel := context.WithTimeout(r.Context(), req.timeout+req.timeoutHTTP)
+	defer cancel()
+
+	c.prometheus(ctx)
+
+	t := time.Now()
+	c.probeOnce(ctx, 0)
+	duration := time.Since(t)
+
+	_, _, success := c.status.get()
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        metricName("probe_success"),
+			Help:        "the on-demand probe succeeded",
+			ConstLabels: metricLabels,
+		}, func() float64 { return float64(boolToInt(success == 100)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        metricName("probe_duration_seconds"),
+			Help:        "the on-demand probe's duration in seconds",
+			ConstLabels: metricLabels,
+		}, func() float64 { return duration.Seconds() }),
+	)
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// pin validates the target's addresses and pins the client to
+// the first address, so the target isn't resolved again
+func (p *prober) pin(ctx context.Context, c *client) error {
+	if socket, _, _ := getUnixSocket(c.target); socket != "" {
+		return fmt.Errorf("target not allowed: %s", c.target)
+	}
+
+	if err := checkAddr(c.target); err != nil {
+		return err
+	}
+
+	addrs, err := c.resolveAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(addrs) < 1 {
+		return fmt.Errorf("no address: %s", c.target)
+	}
+
+	for _, addr := range addrs {
+		if !p.isAllowed(net.ParseIP(addr)) {
+			return fmt.Errorf("address not allowed: %s", addr)
+		}
+	}
+
+	c.ip = addrs[0]
+
+	return nil
+}
+
+// isAllowed returns true if the ip isn't denied, and it's
+// allowed once the allow list is given
+func (p *prober) isAllowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(p.allow) < 1 {
+		return true
+	}
+
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getCIDRs parses the comma separated CIDRs
+func getCIDRs(s string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s", v)
+		}
+		cidrs = append(cidrs, n)
+	}
+
+	return cidrs, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpCumulative = 2
+
+// otlp represents OpenTelemetry metrics exporter (OTLP/HTTP JSON)
+type otlp struct {
+	sync.Mutex
+
+	url        string
+	interval   time.Duration
+	startTime  time.Time
+	httpClient *http.Client
+
+	targets map[string]otlpTarget
+	done    chan struct{}
+}
+
+// otlpTarget represents the last recorded stats of a target
+type otlpTarget struct {
+	labels    map[string]string
+	stats     stats
+	timestamp time.Time
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+func newOTLP(req *request) *otlp {
+	url := strings.TrimSuffix(req.otlpEndpoint, "/")
+	if !strings.HasSuffix(url, "/v1/metrics") {
+		url += "/v1/metrics"
+	}
+
+	return &otlp{
+		url:        url,
+		interval:   req.otlpInterval,
+		startTime:  time.Now(),
+		httpClient: &http.Client{Timeout: req.timeoutHTTP},
+		targets:    make(map[string]otlpTarget),
+		done:       make(chan struct{}),
+	}
+}
+
+func (o *otlp) run(ctx context.Context) {
+	defer close(o.done)
+
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := o.export(); err != nil {
+				errorf("%v", err)
+			}
+		case <-ctx.Done():
+			if err := o.export(); err != nil {
+				errorf("%v", err)
+			}
+			return
+		}
+	}
+}
+
+func (o *otlp) wait() {
+	<-o.done
+}
+
+func (o *otlp) record(ctx context.Context, c *client) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.targets[getTargetKey(ctx, c.target)] = otlpTarget{
+		labels:    getLabels(ctx, c.target),
+		stats:     c.stats,
+		timestamp: time.Now(),
+	}
+}
+
+func (o *otlp) remove(target string) {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.targets, target)
+}
+
+func (o *otlp) export() error {
+	o.Lock()
+	metrics := o.metrics()
+	o.Unlock()
+
+	if len(metrics) < 1 {
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"resourceMetrics": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{otlpString("service.name", "tcpprobe")},
+				},
+				"scopeMetrics": []interface{}{
+					map[string]interface{}{
+						"scope":   map[string]string{"name": "tcpprobe", "version": version},
+						"metrics": metrics,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.httpClient.Post(o.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (o *otlp) metrics() []otlpMetric {
+	var (
+		metrics []otlpMetric
+		targets []string
+		value   string
+	)
+
+	for target := range o.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	t := reflect.TypeOf(stats{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+
+		var points []otlpDataPoint
+		for _, target := range targets {
+			ot := o.targets[target]
+			v := reflect.ValueOf(ot.stats).Field(i)
+
+			switch v.Kind() {
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				value = strconv.FormatUint(v.Uint(), 10)
+			case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
+				value = strconv.FormatInt(v.Int(), 10)
+			default:
+				continue
+			}
+
+			points = append(points, otlpDataPoint{
+				Attributes:   otlpAttributes(ot.labels),
+				TimeUnixNano: strconv.FormatInt(ot.timestamp.UnixNano(), 10),
+				AsInt:        value,
+			})
+		}
+
+		if len(points) < 1 {
+			continue
+		}
+
+		m := otlpMetric{
+			Name:        metricName(f.Tag.Get("name")),
+			Description: f.Tag.Get("help"),
+			Unit:        f.Tag.Get("unit"),
+		}
+
+		if f.Tag.Get("kind") == "counter" {
+			for i := range points {
+				points[i].StartTimeUnixNano = strconv.FormatInt(o.startTime.UnixNano(), 10)
+			}
+			m.Sum = &otlpSum{
+				DataPoints:             points,
+				AggregationTemporality: otlpCumulative,
+				IsMonotonic:            true,
+			}
+		} else {
+			m.Gauge = &otlpGauge{DataPoints: points}
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	return metrics
+}
+
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, otlpString(k, labels[k]))
+	}
+
+	return attrs
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// reservedFiles are the open files which kept for the prober
+// itself e.g. the metrics server, the output file and the logs
+const reservedFiles = 64
+
+// parallelSummary represents the aggregate of the parallel connections
+// to a target, the RTT spread is over the connections' average RTT
+type parallelSummary struct {
+	Target      string
+	Parallel    bool `json:"parallel"`
+	Connections int
+	Connected   int
+	Backends    map[string]int
+	Rtt         *summaryMetric
+}
+
+// parallel probes the target by the parallel connections, each
+// connection is a client with its conn label and the aggregate
+// summary is printed once all of them are finished
+func (t *tp) parallel(ctx context.Context, target string, req *request) {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		clients []*client
+	)
+
+	for i := 0; i < req.parallel; i++ {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			c := t.start(ctx, target, req)
+			t.cleanup(ctx, target)
+
+			mu.Lock()
+			clients = append(clients, c)
+			mu.Unlock()
+		}(context.WithValue(ctx, connKey, i))
+	}
+
+	wg.Wait()
+
+	printParallelSummary(target, clients, req)
+}
+
+// newParallelSummary aggregates the connections' summary, a connection
+// is connected if at least one of its probes succeeded
+func newParallelSummary(target string, clients []*client) *parallelSummary {
+	s := &parallelSummary{
+		Target:      target,
+		Parallel:    true,
+		Connections: len(clients),
+		Backends:    make(map[string]int),
+		Rtt:         &summaryMetric{},
+	}
+
+	for _, c := range clients {
+		if c.summary.sent <= c.summary.failed {
+			continue
+		}
+
+		s.Connected++
+
+		if ip, _, err := net.SplitHostPort(c.addr); err == nil {
+			s.Backends[ip]++
+		}
+
+		if m, ok := c.summary.metrics["Rtt"]; ok && m.n > 0 {
+			s.Rtt.add(m.Avg)
+		}
+	}
+
+	return s
+}
+
+func printParallelSummary(target string, clients []*client, req *request) {
+	if req.quiet || req.csv {
+		return
+	}
+
+	s := newParallelSummary(target, clients)
+
+	if req.json || req.jsonPretty {
+		var (
+			b   []byte
+			err error
+		)
+
+		if req.jsonPretty {
+			b, err = json.MarshalIndent(s, "", "  ")
+		} else {
+			b, err = json.Marshal(s)
+		}
+
+		if err != nil {
+			errorf("%v", err)
+			return
+		}
+
+		fmt.Fprintln(stdout{}, string(b))
+		return
+	}
+
+	backends := make([]string, 0, len(s.Backends))
+	for ip := range s.Backends {
+		backends = append(backends, ip)
+	}
+	sort.Strings(backends)
+
+	fmt.Fprintf(stdout{}, "--- %s tcpprobe parallel statistics ---\n", target)
+	fmt.Fprintf(stdout{}, "%d connections, %d connected\n", s.Connections, s.Connected)
+	for _, ip := range backends {
+		fmt.Fprintf(stdout{}, "backend %s: %d connections\n", ip, s.Backends[ip])
+	}
+	fmt.Fprintf(stdout{}, "Rtt spread min/avg/max/stddev = %.0f/%.0f/%.0f/%.0f us\n",
+		s.Rtt.Min, s.Rtt.Avg, s.Rtt.Max, s.Rtt.Stddev)
+}
+
+// checkFileLimit returns error if the connections exceed the open files
+// limit, the limit is unknown e.g. on Windows if it's zero
+func checkFileLimit(conns int) error {
+	limit, err := fileLimit()
+	if err != nil || limit == 0 {
+		return err
+	}
+
+	if uint64(conns+reservedFiles) > limit {
+		return fmt.Errorf("invalid parallel: %d connections exceed the open files limit %d (%d reserved), raise it by ulimit -n",
+			conns, limit, reservedFiles)
+	}
+
+	return nil
+}
+
+// connLabel returns the parallel connection's index label
+func connLabel(ctx context.Context) (string, bool) {
+	if i, ok := ctx.Value(connKey).(int); ok {
+		return strconv.Itoa(i), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// persistent represents the target's long-lived connection, the
+// probes reuse the socket and it's reconnected once it's died
+type persistent struct {
+	transport *http.Transport
+	closed    *int32
+	lost      bool
+}
+
+// trackedConn marks the persistent connection closed once
+// it's closed e.g. by the HTTP transport
+type trackedConn struct {
+	net.Conn
+	closed *int32
+}
+
+func (t trackedConn) Close() error {
+	atomic.StoreInt32(t.closed, 1)
+	return t.Conn.Close()
+}
+
+// newPersistent returns the persistent connection state of the target,
+// the gRPC, TLS only, DNS, UDP and ICMP probes connect on every probe
+func (c *client) newPersistent() *persistent {
+	if !c.req.persistent || c.standalone() != nil || c.isGRPC() || c.isTLSOnly() || c.req.starttls != "" || c.isDatabase() || c.isWebSocket() || c.isBroker() {
+		return nil
+	}
+
+	p := &persistent{}
+	if c.isHTTP() {
+		p.transport = &http.Transport{
+			DialContext:         c.dialContext,
+			DialTLSContext:      c.dialTLSContext,
+			MaxIdleConnsPerHost: 1,
+		}
+	}
+
+	return p
+}
+
+// reuse connects the target once and returns the alive connection
+// on the next probes, it reconnects if the connection has died
+func (c *client) reuse(ctx context.Context) error {
+	if c.persistent.closed != nil && c.isAlive() {
+		c.probed = time.Now()
+		c.timestamp = c.probed.Unix()
+		return nil
+	}
+
+	if c.persistent.closed != nil {
+		debugf("target: %s connection has died, reconnecting", c.target)
+		c.drop()
+	}
+
+	if err := c.connectRetry(ctx); err != nil {
+		return err
+	}
+
+	c.persistent.closed = new(int32)
+	if c.persistent.lost {
+		c.persistent.lost = false
+		c.stats.Reconnects++
+	}
+
+	return nil
+}
+
+// isAlive returns true if the persistent connection hasn't been closed,
+// the HTTP transport owns the reads so the peer's close is detected by
+// the transport otherwise by a short read
+func (c *client) isAlive() bool {
+	if atomic.LoadInt32(c.persistent.closed) == 1 {
+		return false
+	}
+
+	if c.isHTTP() {
+		return true
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	_, err := c.conn.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+
+	return err == nil
+}
+
+// track wraps the persistent connection to know once it's closed
+func (c *client) track(conn net.Conn) net.Conn {
+	if c.persistent == nil || c.persistent.closed == nil {
+		return conn
+	}
+
+	return trackedConn{conn, c.persistent.closed}
+}
+
+// drop closes the persistent connection, the next probe reconnects
+func (c *client) drop() {
+	if c.persistent.closed == nil {
+		return
+	}
+
+	if c.persistent.transport != nil {
+		c.persistent.transport.CloseIdleConnections()
+	}
+
+	c.close()
+	c.persistent.closed = nil
+	c.persistent.lost = true
+}
+
+// closePersistent closes the persistent connection once the target stopped
+func (c *client) closePersistent() {
+	if c.persistent == nil || c.persistent.closed == nil {
+		return
+	}
+
+	c.drop()
+}
@@ -1,25 +1,73 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+var csvHeader sync.Once
+
+// jsonSchemaVersion is the json records' schema version, it's
+// increased once the records' keys are changed
+const jsonSchemaVersion = 1
+
+// recordMeta represents the target's identity of the printed records,
+// the Time is RFC3339Nano and the Timestamp is the unix seconds
+type recordMeta struct {
+	SchemaVersion int `json:"schema_version"`
+	Target        string
+	IP            string
+	Timestamp     int64  `json:",omitempty"`
+	Time          string `json:",omitempty"`
+	Seq           int
+	Labels        map[string]string `json:",omitempty"`
+	Warmup        bool              `json:",omitempty"`
+}
+
+// outputState represents the target's success or failure state
+// for the quiet-success and on-change output modes
+type outputState struct {
+	known    bool
+	failed   bool
+	changed  bool
+	since    time.Time
+	downtime time.Duration
+}
+
 func (c *client) printer(counter int) {
-	if c.req.quiet {
+	if c.req.quiet || c.req.syslogOnly || !c.isPrintable() {
+		return
+	}
+
+	if c.ndjson != nil {
+		c.writeNDJSON(counter)
 		return
 	}
 
+	if c.req.onChange && !c.req.csv {
+		c.printState(c.output.failed, c.output.downtime)
+	}
+
 	switch {
+	case c.req.format != nil:
+		c.printFormat(counter)
 	case c.req.json:
 		c.printJSON(counter, false)
 	case c.req.jsonPretty:
 		c.printJSON(counter, true)
+	case c.req.csv:
+		c.printCSV(counter)
 	default:
 		c.printText(counter)
 	}
@@ -27,60 +75,342 @@ func (c *client) printer(counter int) {
 
 func (c *client) printText(counter int) {
 	v := reflect.ValueOf(c.stats)
-	filter := strings.ToLower(c.req.filter)
+	filter := newFieldFilter(c.req.filter)
 
-	ip, _, _ := net.SplitHostPort(c.addr)
-	datetime := time.Unix(c.timestamp, 0).Format(time.RFC3339)
-	fmt.Printf("%s target: %s (%s) seq: %d\n", datetime, c.target, ip, counter)
+	fmt.Fprintln(stdout{}, c.textHeader(counter))
 	for i := 0; i < v.NumField(); i++ {
 		f := v.Type().Field(i)
 		if f.Tag.Get("unexported") == "true" {
 			continue
 		}
-		if strings.Contains(filter, strings.ToLower(f.Name)) || filter == "" {
-			fmt.Printf("%s:%v ", f.Name, v.Field(i).Interface())
+		if c.req.hideUnsupported && !isSupported(f) {
+			continue
+		}
+		if filter.match(f.Name) {
+			if c.req.color {
+				fmt.Fprintf(stdout{}, "%s ", c.colorField(f, v.Field(i)))
+			} else {
+				fmt.Fprintf(stdout{}, "%s:%v ", f.Name, v.Field(i).Interface())
+			}
 		}
 	}
-	fmt.Println("")
+	fmt.Fprintln(stdout{})
 }
 
 func (c *client) printJSON(counter int, pretty bool) {
-	var (
-		b   []byte
-		err error
-	)
+	b, err := c.jsonRecord(counter, pretty)
+	if err != nil {
+		errorf("%v", err)
+		return
+	}
 
-	ip, _, _ := net.SplitHostPort(c.addr)
+	fmt.Fprintln(stdout{}, string(b))
+}
+
+// writeNDJSON writes the json record to the output file
+func (c *client) writeNDJSON(counter int) {
+	if c.req.onChange {
+		b, err := c.stateRecord(c.output.failed, c.output.downtime)
+		if err != nil {
+			errorf("%v", err)
+			return
+		}
+		c.ndjson.write(b)
+	}
+
+	b, err := c.jsonRecord(counter, false)
+	if err != nil {
+		errorf("%v", err)
+		return
+	}
+
+	c.ndjson.write(b)
+}
+
+// jsonRecord returns the probe's json record
+func (c *client) jsonRecord(counter int, pretty bool) ([]byte, error) {
 	d := struct {
-		Target    string
-		IP        string
-		Timestamp int64
-		Seq       int
+		recordMeta
 		stats
 	}{
-		c.target,
-		ip,
-		c.timestamp,
-		counter,
+		c.meta(counter),
 		c.stats,
 	}
 
+	var s interface{} = d
+	if c.req.delta && c.totals != nil || c.req.hideUnsupported {
+		m, err := jsonMap(d)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, total := range c.totals {
+			m[name+"_total"] = total
+		}
+
+		if c.req.hideUnsupported {
+			t := reflect.TypeOf(c.stats)
+			for i := 0; i < t.NumField(); i++ {
+				if !isSupported(t.Field(i)) {
+					delete(m, t.Field(i).Name)
+					delete(m, t.Field(i).Name+"_total")
+				}
+			}
+		}
+
+		s = m
+	}
+
 	if c.req.filter != "" {
-		b, err = jsonMarshalFilter(d, c.req.filter, pretty)
+		return jsonMarshalFilter(s, c.req.filter, pretty)
 	} else if pretty {
-		b, err = json.MarshalIndent(d, "", "  ")
-	} else {
-		b, err = json.Marshal(d)
+		return json.MarshalIndent(s, "", "  ")
+	}
+
+	return json.Marshal(s)
+}
+
+func (c *client) printCSV(counter int) {
+	var (
+		meta   = c.meta(counter)
+		header = []string{"Target", "Seq", "Labels"}
+		record = []string{meta.Target, strconv.Itoa(meta.Seq), joinLabels(meta.Labels)}
+	)
+
+	if !c.req.noTimestamp {
+		header = append([]string{"Timestamp"}, header...)
+		record = append([]string{meta.Time}, record...)
+	}
+
+	if c.req.warmup > 0 {
+		header = append(header, "Warmup")
+		record = append(record, strconv.FormatBool(meta.Warmup))
+	}
+
+	v := reflect.ValueOf(c.stats)
+	filter := newFieldFilter(c.req.filter)
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+		if c.req.hideUnsupported && !isSupported(f) {
+			continue
+		}
+		if filter.match(f.Name) {
+			header = append(header, f.Name)
+			record = append(record, fmt.Sprintf("%v", v.Field(i).Interface()))
+		}
+	}
+
+	w := csv.NewWriter(stdout{})
+
+	// the header is shared between all of the targets
+	csvHeader.Do(func() {
+		w.Write(header)
+	})
+
+	w.Write(record)
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		errorf("%v", err)
 	}
+}
+
+// update records the probe's result, the downtime is
+// set once the target recovered
+func (s *outputState) update(failed bool, t time.Time) {
+	s.changed = !s.known || s.failed != failed
+	s.downtime = 0
 
+	if s.changed {
+		if s.known && !failed {
+			s.downtime = t.Sub(s.since)
+		}
+		s.since = t
+	}
+
+	s.known = true
+	s.failed = failed
+}
+
+// isFailed returns true if the probe failed by its error or by the
+// unexpected HTTP status e.g. 404 or the expect-status mismatch
+func (c *client) isFailed(err error) bool {
 	if err != nil {
-		log.Println(err)
+		return true
+	}
+
+	if !c.isHTTP() {
+		return false
+	}
+
+	return c.stats.HTTPExpectationMismatch > 0 ||
+		len(c.req.expectStatus) == 0 && c.stats.HTTPStatusCode >= http.StatusBadRequest
+}
+
+// isPrintable returns true if the probe is printed by the output mode,
+// the on-change prints the transitions and the quiet-success the failures
+func (c *client) isPrintable() bool {
+	switch {
+	case c.req.onChange:
+		return c.output.changed
+	case c.req.quietSuccess:
+		return c.output.failed
+	}
+
+	return true
+}
+
+// printState prints the target's transition to down or up,
+// the recovery has the downtime
+func (c *client) printState(failed bool, downtime time.Duration) {
+	state := "up"
+	if failed {
+		state = "down"
+	}
+
+	if c.req.json || c.req.jsonPretty {
+		b, err := c.stateRecord(failed, downtime)
+		if err != nil {
+			errorf("%v", err)
+			return
+		}
+
+		fmt.Fprintln(stdout{}, string(b))
 		return
 	}
 
-	fmt.Println(string(b))
+	if downtime > 0 {
+		fmt.Fprintf(stdout{}, "%s state: %s downtime: %s\n", c.textHeader(-1), state, downtime)
+	} else {
+		fmt.Fprintf(stdout{}, "%s state: %s\n", c.textHeader(-1), state)
+	}
+}
+
+// stateRecord returns the target's transition json record
+func (c *client) stateRecord(failed bool, downtime time.Duration) ([]byte, error) {
+	state := "up"
+	if failed {
+		state = "down"
+	}
+
+	return json.Marshal(struct {
+		recordMeta
+		State    string
+		Downtime int64 `json:",omitempty"`
+	}{
+		c.meta(-1),
+		state,
+		downtime.Microseconds(),
+	})
+}
+
+// meta returns the record's identity, the seq is omitted from
+// the text header if it's negative
+func (c *client) meta(counter int) recordMeta {
+	ip, _, _ := net.SplitHostPort(c.addr)
+	m := recordMeta{
+		SchemaVersion: jsonSchemaVersion,
+		Target:        c.target,
+		IP:            ip,
+		Seq:           counter,
+		Labels:        c.labels,
+		Warmup:        c.warming,
+	}
+
+	if !c.req.noTimestamp {
+		m.Timestamp = c.timestamp
+		m.Time = c.probeTime().Format(time.RFC3339Nano)
+	}
+
+	return m
 }
 
+// textHeader returns the text record's first line
+func (c *client) textHeader(counter int) string {
+	meta := c.meta(counter)
+
+	header := fmt.Sprintf("target: %s (%s)", meta.Target, meta.IP)
+	if !c.req.noTimestamp {
+		header = meta.Time + " " + header
+	}
+
+	if counter >= 0 {
+		header += fmt.Sprintf(" seq: %d", counter)
+	}
+
+	if len(meta.Labels) > 0 {
+		header += " labels: " + joinLabels(meta.Labels)
+	}
+
+	if meta.Warmup {
+		header += " warmup=true"
+	}
+
+	return header
+}
+
+// probeTime returns the last probe's time
+func (c *client) probeTime() time.Time {
+	if c.probed.IsZero() {
+		return time.Unix(c.timestamp, 0)
+	}
+
+	return c.probed
+}
+
+// joinLabels returns the sorted key=value labels with comma delimited
+func joinLabels(labels map[string]string) string {
+	var kv []string
+	for k, v := range labels {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+
+	return strings.Join(kv, ",")
+}
+
+// jsonMap returns the JSON object of s as a map, the numbers
+// are kept as they are rather than float64
+func jsonMap(s interface{}) (map[string]interface{}, error) {
+	var m map[string]interface{}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// isSupported returns true if the stats field is available on the
+// running platform, the os tag lists the platforms with comma delimited
+func isSupported(f reflect.StructField) bool {
+	platforms := f.Tag.Get("os")
+	if platforms == "" {
+		return true
+	}
+
+	for _, platform := range strings.Split(platforms, ",") {
+		if platform == runtime.GOOS {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonMarshalFilter marshals the selected fields of s, the delta
+// totals are selected by their field
 func jsonMarshalFilter(s interface{}, filter string, pretty bool) ([]byte, error) {
 	var m map[string]interface{}
 
@@ -91,10 +421,14 @@ func jsonMarshalFilter(s interface{}, filter string, pretty bool) ([]byte, error
 
 	json.Unmarshal(b, &m)
 
-	lFilter := strings.ToLower(filter)
+	f := newFieldFilter(filter)
 
 	for k := range m {
-		if !strings.Contains(lFilter, strings.ToLower(k)) {
+		if k == "schema_version" || k == "Warmup" {
+			continue
+		}
+
+		if !f.match(strings.TrimSuffix(k, "_total")) {
 			delete(m, k)
 		}
 	}
@@ -2,116 +2,338 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var reLabel = regexp.MustCompile(`^[a-zA-Z0-9_]*$`)
+var (
+	reLabel      = regexp.MustCompile(`^[a-zA-Z0-9_]*$`)
+	reMetricName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
 
-func (c *client) prometheus(ctx context.Context) {
-	var (
-		err error
-		f   func() float64
-	)
+// metricPrefix and metricLabels are the exported metrics' namespace and
+// the const labels of all the series, they're set once at the startup
+var (
+	metricPrefix = "tp"
+	metricLabels prometheus.Labels
+)
 
-	v := reflect.ValueOf(&c.stats).Elem()
-	for i := 0; i < v.NumField(); i++ {
-		i := i
+// histogramFields maps the stats fields to the histogram names
+var histogramFields = map[string]string{
+	"Rtt":          "rtt",
+	"TLSHandshake": "tls_handshake",
+	"HTTPResponse": "http_response",
+}
+
+// statsCollector represents the target's stats collector, the stats are
+// exported as the const metrics on collect rather than a metric per field
+type statsCollector struct {
+	stats  *stats
+	fields []statsMetric
+
+	// warming is true during the warm-up probes, the metrics are
+	// suppressed or they have the warmup label by the warmup-metrics
+	warming func() bool
+	label   bool
+
+	// remoteIP returns the dialed remote IP label, it's off by default
+	// since the label's values are by the target's addresses
+	remoteIP func() string
+}
 
-		if v.Type().Field(i).Tag.Get("unexported") == "true" {
+// statsMetric represents a stats field's metric, the fields with the
+// kind:"counter" tag are counters and the rest e.g. kind:"gauge" are gauges
+type statsMetric struct {
+	index     int
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+}
+
+func newStatsCollector(s *stats, labels prometheus.Labels, warming func() bool, mode string, remoteIP func() string) *statsCollector {
+	c := &statsCollector{stats: s, warming: warming, label: warming != nil && mode == warmupLabel, remoteIP: remoteIP}
+
+	var variableLabels []string
+	if c.label {
+		variableLabels = append(variableLabels, "warmup")
+	}
+
+	if c.remoteIP != nil {
+		variableLabels = append(variableLabels, "remote_ip")
+	}
+
+	t := reflect.TypeOf(s).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("unexported") == "true" {
 			continue
 		}
 
-		switch v.Field(i).Kind() {
-		case reflect.Uint, reflect.Uint8, reflect.Uint32, reflect.Uint64:
-			f = func() float64 {
-				return float64(v.Field(i).Uint())
-			}
-
-		case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
-			f = func() float64 {
-				return float64(v.Field(i).Int())
-			}
-		case reflect.String:
+		switch f.Type.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
+		default:
 			continue
 		}
 
-		if v.Type().Field(i).Tag.Get("kind") == "counter" {
-			err = prometheus.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
-				Name:        "tp_" + v.Type().Field(i).Tag.Get("name"),
-				Help:        v.Type().Field(i).Tag.Get("help"),
-				ConstLabels: getLabels(ctx, c.target),
-			}, f))
+		valueType := prometheus.GaugeValue
+		if f.Tag.Get("kind") == "counter" {
+			valueType = prometheus.CounterValue
+		}
 
-		} else {
-			err = prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-				Name:        "tp_" + v.Type().Field(i).Tag.Get("name"),
-				Help:        v.Type().Field(i).Tag.Get("help"),
-				ConstLabels: getLabels(ctx, c.target),
-			}, f))
+		c.fields = append(c.fields, statsMetric{
+			index:     i,
+			desc:      prometheus.NewDesc(metricName(f.Tag.Get("name")), f.Tag.Get("help"), variableLabels, constLabels(labels)),
+			valueType: valueType,
+		})
+	}
+
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, f := range c.fields {
+		ch <- f.desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	var labelValues []string
+	if c.warming != nil {
+		warming := c.warming()
+		if warming && !c.label {
+			return
 		}
 
-		if err != nil {
-			log.Println(err, c.target)
+		if c.label {
+			labelValues = append(labelValues, strconv.FormatBool(warming))
+		}
+	}
+
+	if c.remoteIP != nil {
+		labelValues = append(labelValues, c.remoteIP())
+	}
+
+	v := reflect.ValueOf(c.stats).Elem()
+	for _, f := range c.fields {
+		var value float64
+
+		field := v.Field(f.index)
+		switch field.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			value = float64(field.Uint())
+		default:
+			value = float64(field.Int())
 		}
+
+		ch <- prometheus.MustNewConstMetric(f.desc, f.valueType, value, labelValues...)
 	}
+}
 
+func (c *client) prometheus(ctx context.Context) {
+	var warming func() bool
+	if c.req.warmup > 0 {
+		warming = c.isWarmingUp
+	}
+
+	var remoteIP func() string
+	if c.req.promRemoteIP {
+		remoteIP = c.getRemoteIP
+	}
+
+	err := c.register(newStatsCollector(&c.stats, getLabels(ctx, c.target), warming, c.req.warmupMetrics, remoteIP))
+	if err != nil {
+		errorf("%v: %s", err, c.target)
+	}
+
+	if c.req.promHistograms {
+		c.registerHistograms(ctx)
+	}
 }
 
-func (c *client) deprometheus(ctx context.Context) {
-	var (
-		ok bool
-		f  func() float64
-	)
+func (c *client) registerHistograms(ctx context.Context) {
+	c.histograms = map[string]prometheus.Histogram{}
 
-	v := reflect.ValueOf(&c.stats).Elem()
-	for i := 0; i < v.NumField(); i++ {
-		i := i
+	for field, name := range histogramFields {
+		h := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        metricName(name + "_seconds"),
+			Help:        field + " distribution in seconds",
+			ConstLabels: constLabels(getLabels(ctx, c.target)),
+			Buckets:     c.req.promBuckets,
+		})
 
-		if v.Type().Field(i).Tag.Get("unexported") == "true" {
+		if err := c.register(h); err != nil {
+			errorf("%v: %s", err, c.target)
 			continue
 		}
+		c.histograms[field] = h
+	}
+}
 
-		switch v.Field(i).Kind() {
-		case reflect.Uint, reflect.Uint8, reflect.Uint32, reflect.Uint64:
-			f = func() float64 {
-				return float64(v.Field(i).Uint())
-			}
+// register registers the collector and keeps it to unregister
+// once the target removed. the collector of another client with
+// the same target and labels isn't replaced, it's an error.
+func (c *client) register(collector prometheus.Collector) error {
+	registerer := c.registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
 
-		case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
-			f = func() float64 {
-				return float64(v.Field(i).Int())
-			}
-		case reflect.String:
+	if err := registerer.Register(collector); err != nil {
+		return err
+	}
+
+	c.collectors = append(c.collectors, collector)
+
+	return nil
+}
+
+func (c *client) observe() {
+	v := reflect.ValueOf(&c.stats).Elem()
+	for field, h := range c.histograms {
+		var us float64
+
+		f := v.FieldByName(field)
+		switch f.Kind() {
+		case reflect.Uint32:
+			us = float64(f.Uint())
+		case reflect.Int64:
+			us = float64(f.Int())
+		}
+
+		// the phase didn't happen e.g. TLS handshake for plain HTTP
+		if us == 0 {
 			continue
 		}
 
-		if v.Type().Field(i).Tag.Get("kind") == "counter" {
-			ok = prometheus.Unregister(prometheus.NewCounterFunc(prometheus.CounterOpts{
-				Name:        "tp_" + v.Type().Field(i).Tag.Get("name"),
-				ConstLabels: getLabels(ctx, c.target),
-			}, f))
-		} else {
-			ok = prometheus.Unregister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-				Name:        "tp_" + v.Type().Field(i).Tag.Get("name"),
-				ConstLabels: getLabels(ctx, c.target),
-			}, f))
+		h.Observe(us / 1e6)
+	}
+}
+
+func (c *client) deprometheus(ctx context.Context) {
+	registerer := c.registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	for _, collector := range c.collectors {
+		if ok := registerer.Unregister(collector); !ok {
+			warnf("prometheus unregister failed: %s", c.target)
+		}
+	}
+
+	c.collectors = nil
+}
+
+// metricName returns the metric's name in the metrics namespace
+func metricName(name string) string {
+	return metricPrefix + "_" + name
+}
+
+// constLabels returns the labels with the metric labels,
+// the target's labels take precedence
+func constLabels(labels prometheus.Labels) prometheus.Labels {
+	if len(metricLabels) < 1 {
+		return labels
+	}
+
+	l := prometheus.Labels{}
+	for k, v := range metricLabels {
+		l[k] = v
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+
+	return l
+}
+
+// setMetrics sets the metrics namespace and labels, the
+// flags take precedence over the config's defaults
+func setMetrics(req *request) error {
+	prefix, labels := "tp", prometheus.Labels{}
+
+	if req.config != "" {
+		cfg, err := getConfig(req.config)
+		if err != nil {
+			return err
+		}
+
+		if cfg.Defaults.MetricPrefix != "" {
+			prefix = cfg.Defaults.MetricPrefix
 		}
 
-		if !ok {
-			log.Println("prometheus unregister failed:", c.target)
+		for k, v := range cfg.Defaults.MetricLabels {
+			labels[k] = v
 		}
 	}
+
+	if req.metricPrefix != "" {
+		prefix = req.metricPrefix
+	}
+
+	for k, v := range req.metricLabels {
+		labels[k] = v
+	}
+
+	if !reMetricName.MatchString(prefix) {
+		return fmt.Errorf("invalid metric-prefix: %s", prefix)
+	}
+
+	for k := range labels {
+		if !reMetricName.MatchString(k) || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid metric-label: %s", k)
+		}
+	}
+
+	metricPrefix, metricLabels = prefix, labels
+
+	return nil
+}
+
+// getMetricLabels parses the name=value metric labels
+func getMetricLabels(values []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !reMetricName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid metric-label: %s", v)
+		}
+		labels[name] = strings.TrimSpace(kv[1])
+	}
+
+	return labels, nil
 }
 
 func getLabels(ctx context.Context, target string) prometheus.Labels {
 	labels := prometheus.Labels{"target": target}
 
+	if family, ok := ctx.Value(familyKey).(string); ok {
+		labels["family"] = family
+	}
+
+	if ip, ok := ctx.Value(ipKey).(string); ok {
+		labels["ip"] = ip
+	}
+
+	if conn, ok := connLabel(ctx); ok {
+		labels["conn"] = conn
+	}
+
 	if v := ctx.Value(labelsKey); v != nil {
 		m := map[string]string{}
 		if err := json.Unmarshal(v.([]byte), &m); err != nil {
@@ -127,3 +349,71 @@ func getLabels(ctx context.Context, target string) prometheus.Labels {
 
 	return labels
 }
+
+// getRecordLabels returns the printed records' labels
+func getRecordLabels(ctx context.Context) map[string]string {
+	labels := getLabels(ctx, "")
+	delete(labels, "target")
+
+	if len(labels) < 1 {
+		return nil
+	}
+
+	return labels
+}
+
+func promServer(ctx context.Context, req *request, ready *readiness) error {
+	srv := &http.Server{}
+
+	if req.promTLSCert != "" || req.promTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(req.promTLSCert, req.promTLSKey)
+		if err != nil {
+			return fmt.Errorf("metrics server tls: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	l, err := net.Listen("tcp", req.promAddr)
+	if err != nil {
+		return fmt.Errorf("metrics server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(req.promPath, promhttp.Handler())
+	srv.Handler = mux
+
+	if ready != nil {
+		mux.HandleFunc("/healthz", ready.healthz)
+		mux.HandleFunc("/readyz", ready.readyz)
+	}
+
+	if req.probeEndpoint {
+		p, err := newProber(req)
+		if err != nil {
+			return err
+		}
+		mux.Handle("/probe", p)
+	}
+
+	go func() {
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatalf("%v", err)
+		}
+	}()
+
+	return nil
+}
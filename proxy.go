@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// proxyMaxHeader limits the proxy's CONNECT response header
+const proxyMaxHeader = 8192
+
+// socks5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+)
+
+func (c *client) getProxy() (*url.URL, error) {
+	if c.req.proxyURL != nil {
+		return c.req.proxyURL, nil
+	}
+
+	if !c.req.proxyFromEnv {
+		return nil, nil
+	}
+
+	host, port, err := c.getHostPort()
+	if err != nil {
+		return nil, err
+	}
+
+	// the raw TCP targets are tunneled the same as HTTPS
+	u := &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)}
+	if c.urlSchema.Scheme == "http" {
+		u.Scheme = "http"
+	}
+
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+
+	if proxyURL.Port() == "" {
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	return proxyURL, nil
+}
+
+// proxyConnect establishes a tunnel to the target through
+// the proxy over the already connected socket
+func (c *client) proxyConnect(ctx context.Context, proxyURL *url.URL) error {
+	host, port, err := c.getHostPort()
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		return c.socks5Connect(ctx, proxyURL, host, port)
+	}
+
+	hostPort := net.JoinHostPort(host, port)
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", hostPort, hostPort)
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+
+	t := time.Now()
+	if _, err := c.conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	// reads byte by byte to not consume the tunneled data
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) > proxyMaxHeader {
+			return errors.New("proxy response header too long")
+		}
+		if _, err := c.conn.Read(b); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return err
+	}
+
+	c.stats.ProxyConnect = time.Since(t).Microseconds()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s CONNECT %s: %s", proxyURL.Host, hostPort, resp.Status)
+	}
+
+	return nil
+}
+
+// socks5Connect establishes a tunnel to the target through the
+// SOCKS5 proxy, the socks5h scheme delegates name resolution to proxy
+func (c *client) socks5Connect(ctx context.Context, proxyURL *url.URL, host, port string) error {
+	var (
+		req  []byte
+		resp = make([]byte, 2)
+	)
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+
+	methods := []byte{socks5AuthNone}
+	if proxyURL.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+
+	req = append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := c.conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return err
+	}
+
+	switch {
+	case resp[0] != socks5Version:
+		return fmt.Errorf("socks5 %s: unexpected version %d", proxyURL.Host, resp[0])
+	case resp[1] == socks5NoAcceptable:
+		return fmt.Errorf("socks5 %s: no acceptable authentication methods", proxyURL.Host)
+	case resp[1] == socks5AuthPassword:
+		password, _ := proxyURL.User.Password()
+		username := proxyURL.User.Username()
+		req = []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := c.conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return fmt.Errorf("socks5 %s: authentication failed", proxyURL.Host)
+		}
+	}
+
+	req = []byte{socks5Version, socks5CmdConnect, 0x00}
+
+	if !isIPAddr(host) && proxyURL.Scheme == "socks5" {
+		addr, err := c.resolve(ctx, host, port)
+		if err != nil {
+			return err
+		}
+		host, _, _ = net.SplitHostPort(addr)
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip.To4() != nil {
+		req = append(req, socks5AtypIPv4)
+		req = append(req, ip.To4()...)
+	} else {
+		req = append(req, socks5AtypIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(portNum>>8), byte(portNum))
+
+	if _, err := c.conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type
+	resp = make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("socks5 %s: connect %s failed, reply code %d", proxyURL.Host, net.JoinHostPort(host, port), resp[1])
+	}
+
+	// bound address and port
+	var n int
+	switch resp[3] {
+	case socks5AtypIPv4:
+		n = net.IPv4len + 2
+	case socks5AtypIPv6:
+		n = net.IPv6len + 2
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c.conn, l); err != nil {
+			return err
+		}
+		n = int(l[0]) + 2
+	default:
+		return fmt.Errorf("socks5 %s: unknown address type %d", proxyURL.Host, resp[3])
+	}
+
+	if _, err := io.ReadFull(c.conn, make([]byte, n)); err != nil {
+		return err
+	}
+
+	c.stats.ProxyConnect = time.Since(t).Microseconds()
+
+	return nil
+}
+
+func getProxyURL(proxy string) (*url.URL, error) {
+	var defaultPort string
+
+	if proxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("proxy %s not supported, expected http, socks5 or socks5h scheme", proxy)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %s host not specified", proxy)
+	}
+
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	return u, nil
+}
+
+func getSocks5URL(addr, username, password string, remoteDNS bool) (*url.URL, error) {
+	u := &url.URL{Scheme: "socks5", Host: addr}
+	if remoteDNS {
+		u.Scheme = "socks5h"
+	}
+
+	if username != "" {
+		u.User = url.UserPassword(username, password)
+	}
+
+	return getProxyURL(u.String())
+}
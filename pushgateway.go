@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	// pushRetries is the failed push's retries
+	pushRetries = 2
+	// pushTimeout is the push request's timeout
+	pushTimeout = 10 * time.Second
+)
+
+// pushgateway represents the prometheus pushgateway pusher, the metrics
+// are pushed at the end of the run and optionally at the push interval,
+// the finished targets' metrics are kept to be pushed at the end
+type pushgateway struct {
+	sync.Mutex
+	url      string
+	job      string
+	grouping map[string]string
+	interval time.Duration
+	backoff  time.Duration
+	client   *http.Client
+	finished map[string]*prometheus.Registry
+	err      error
+	done     chan struct{}
+}
+
+func newPushgateway(req *request) *pushgateway {
+	return &pushgateway{
+		url:      req.pushgatewayURL,
+		job:      req.pushJob,
+		grouping: req.pushGrouping,
+		interval: req.pushInterval,
+		backoff:  time.Second,
+		client:   &http.Client{Timeout: pushTimeout},
+		finished: map[string]*prometheus.Registry{},
+		done:     make(chan struct{}),
+	}
+}
+
+// run pushes the metrics at the push interval if it's set
+// and once the context is canceled
+func (p *pushgateway) run(ctx context.Context) {
+	defer close(p.done)
+
+	var tick <-chan time.Time
+	if p.interval > 0 {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			p.push()
+		case <-ctx.Done():
+			p.push()
+			return
+		}
+	}
+}
+
+func (p *pushgateway) wait() {
+	<-p.done
+}
+
+// keep keeps the finished target's collectors to be pushed
+func (p *pushgateway) keep(key string, collectors []prometheus.Collector) {
+	registry := prometheus.NewRegistry()
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			errorf("pushgateway: %v", err)
+		}
+	}
+
+	p.Lock()
+	p.finished[key] = registry
+	p.Unlock()
+}
+
+// forget removes the finished target's collectors once it's restarted
+func (p *pushgateway) forget(key string) {
+	p.Lock()
+	delete(p.finished, key)
+	p.Unlock()
+}
+
+// push pushes the metrics, it's retried with exponential backoff
+// and the last push's error is kept for the exit code
+func (p *pushgateway) push() {
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		err := p.pusher().Push()
+		if err == nil {
+			p.setErr(nil)
+			return
+		}
+
+		if attempt >= pushRetries {
+			errorf("pushgateway: %v", err)
+			p.setErr(err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (p *pushgateway) pusher() *push.Pusher {
+	pusher := push.New(p.url, p.job).Client(p.client).Gatherer(prometheus.DefaultGatherer)
+	for name, value := range p.grouping {
+		pusher.Grouping(name, value)
+	}
+
+	p.Lock()
+	for _, registry := range p.finished {
+		pusher.Gatherer(registry)
+	}
+	p.Unlock()
+
+	return pusher
+}
+
+func (p *pushgateway) setErr(err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.err = err
+}
+
+// failed returns true if the last push failed
+func (p *pushgateway) failed() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.err != nil
+}
+
+// getPushGrouping parses the name=value grouping labels
+func getPushGrouping(values []string) (map[string]string, error) {
+	grouping := map[string]string{}
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || name == "job" || !reLabel.MatchString(name) {
+			return nil, fmt.Errorf("invalid push-grouping: %s", v)
+		}
+		grouping[name] = strings.TrimSpace(kv[1])
+	}
+
+	return grouping, nil
+}
+
+// getPushgatewayURL validates the pushgateway url
+func getPushgatewayURL(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid pushgateway: %s", s)
+	}
+
+	return strings.TrimSuffix(s, "/"), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// readiness represents the daemon's readiness, it's ready once the
+// config is loaded, a probe is completed and the k8s watch is connected
+type readiness struct {
+	sync.Mutex
+	tp  *tp
+	k8s *k8s
+
+	configLoaded bool
+	configErr    error
+
+	watchThreshold time.Duration
+}
+
+// watchState represents the connectivity of a watch
+type watchState struct {
+	sync.Mutex
+	established  bool
+	disconnected time.Time
+}
+
+func newReadiness(tp *tp, k *k8s, req *request) *readiness {
+	return &readiness{tp: tp, k8s: k, watchThreshold: req.kubeWatchThreshold}
+}
+
+// setConfig records the last config load, the daemon isn't ready
+// once the reload failed until the next successful one
+func (r *readiness) setConfig(err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.configLoaded = r.configLoaded || err == nil
+	r.configErr = err
+}
+
+// check returns the readiness problems, it's ready if there's none
+func (r *readiness) check() []string {
+	var problems []string
+
+	r.Lock()
+	if !r.configLoaded {
+		problems = append(problems, "the config has not been loaded")
+	}
+	if r.configErr != nil {
+		problems = append(problems, fmt.Sprintf("the config reload failed: %v", r.configErr))
+	}
+	r.Unlock()
+
+	if !r.probed() {
+		problems = append(problems, "no probe has been completed")
+	}
+
+	if r.k8s != nil && r.k8s.watch.isDown(r.watchThreshold) {
+		problems = append(problems, "the k8s watch is disconnected")
+	}
+
+	return problems
+}
+
+// probed returns true if a target has been probed, the standby
+// replica and the daemon without any target don't probe
+func (r *readiness) probed() bool {
+	if r.tp.leader != nil && !r.tp.leader.isLeader() {
+		return true
+	}
+
+	r.tp.Lock()
+	defer r.tp.Unlock()
+
+	if len(r.tp.targets) < 1 {
+		return true
+	}
+
+	for _, p := range r.tp.targets {
+		if last, _, _ := p.client.status.get(); !last.IsZero() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *readiness) healthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (r *readiness) readyz(w http.ResponseWriter, _ *http.Request) {
+	if problems := r.check(); len(problems) > 0 {
+		http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// register exports the readiness and the k8s watch connectivity
+func (r *readiness) register() {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        metricName("ready"),
+			Help:        "the daemon is ready",
+			ConstLabels: metricLabels,
+		}, func() float64 {
+			return float64(boolToInt(len(r.check()) == 0))
+		}),
+	}
+
+	if r.k8s != nil {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        metricName("watch_connected"),
+			Help:        "the k8s watch is connected",
+			ConstLabels: metricLabels,
+		}, func() float64 {
+			return float64(boolToInt(r.k8s.watch.isConnected()))
+		}))
+	}
+
+	for _, c := range collectors {
+		err := prometheus.Register(c)
+		if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			prometheus.Unregister(e.ExistingCollector)
+			err = prometheus.Register(c)
+		}
+
+		if err != nil {
+			errorf("%v", err)
+		}
+	}
+}
+
+// update records the watch's last list or watch result
+func (w *watchState) update(err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if err == nil {
+		w.established = true
+		w.disconnected = time.Time{}
+		return
+	}
+
+	if w.disconnected.IsZero() {
+		w.disconnected = time.Now()
+	}
+}
+
+func (w *watchState) isConnected() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.established && w.disconnected.IsZero()
+}
+
+// isDown returns true if the watch hasn't been established or
+// it's been disconnected longer than the threshold
+func (w *watchState) isDown(threshold time.Duration) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if !w.established {
+		return true
+	}
+
+	return !w.disconnected.IsZero() && time.Since(w.disconnected) > threshold
+}
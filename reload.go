@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	yml "gopkg.in/yaml.v3"
+)
+
+// configWatchInterval is the time between the config file checks
+const configWatchInterval = 5 * time.Second
+
+// configTarget represents a running target of the config
+type configTarget struct {
+	target target
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// loadConfig applies the config's targets, the new targets are started,
+// the deleted ones are stopped and the changed ones are restarted. the
+// unchanged targets keep running
+func (t *tp) loadConfig(ctx context.Context, wg *sync.WaitGroup, cfg *config, req *request) {
+	if t.config == nil {
+		t.config = make(map[string]*configTarget)
+	}
+
+	current := make(map[string]bool)
+	for _, ct := range cfg.Targets {
+		r := ct.request(req)
+		key := getTargetKey(withFamily(ctx, r), ct.Addr)
+		if current[key] {
+			warnf("%v: %s", errExist, ct.Addr)
+			continue
+		}
+		current[key] = true
+
+		if old, ok := t.config[key]; ok {
+			if isSameTarget(old.target, ct) {
+				continue
+			}
+
+			old.cancel()
+			<-old.done
+
+			infof("target: %s has been changed", ct.Addr)
+		} else if t.isExist(key) {
+			warnf("%v: %s", errExist, ct.Addr)
+			continue
+		}
+
+		t.startConfigTarget(ctx, wg, key, ct, r)
+	}
+
+	for key, old := range t.config {
+		if current[key] {
+			continue
+		}
+
+		old.cancel()
+		<-old.done
+		delete(t.config, key)
+
+		infof("target: %s has been deleted", old.target.Addr)
+	}
+}
+
+func (t *tp) startConfigTarget(ctx context.Context, wg *sync.WaitGroup, key string, ct target, req *request) {
+	wg.Add(1)
+	t.config[key] = t.startTarget(ctx, ct, req, wg.Done)
+}
+
+// startTarget runs the target with its interval and labels, the
+// done function is called once the target has been stopped
+func (t *tp) startTarget(ctx context.Context, ct target, req *request, done func()) *configTarget {
+	ctx, cancel := context.WithCancel(ctx)
+	running := &configTarget{target: ct, cancel: cancel, done: make(chan struct{})}
+
+	b, _ := json.Marshal(ct.Labels)
+	ctx = context.WithValue(ctx, intervalKey, ct.Interval)
+	ctx = context.WithValue(ctx, labelsKey, b)
+
+	go func() {
+		defer done()
+		defer close(running.done)
+		t.run(ctx, ct.Addr, req)
+	}()
+
+	return running
+}
+
+// reload reloads the config and the targets file, the current
+// targets stay active if the new ones are invalid
+func (t *tp) reload(ctx context.Context, wg *sync.WaitGroup, req *request) {
+	cfg, err := t.getTargets(req)
+	if t.ready != nil {
+		t.ready.setConfig(err)
+	}
+
+	selfMetrics.reloads.WithLabelValues(resultLabel(err)).Inc()
+
+	if err != nil {
+		errorf("config reload failed, the current config is kept: %v", err)
+		return
+	}
+
+	t.loadConfig(ctx, wg, cfg, req)
+
+	if t.admin != nil {
+		t.admin.reload()
+	}
+
+	infof("the targets have been reloaded")
+}
+
+// watchConfig reloads the config on SIGHUP, once the config files
+// changed if the watch requested and once the remote config changed
+func (t *tp) watchConfig(ctx context.Context, wg *sync.WaitGroup, req *request) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	var (
+		tick  <-chan time.Time
+		state string
+	)
+
+	if req.watchConfig {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+
+		state = getFilesState(req.configFiles())
+	}
+
+	var refresh <-chan time.Time
+	if t.remote != nil {
+		ticker := time.NewTicker(req.configRefresh)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	for {
+		select {
+		case <-sig:
+			t.reload(ctx, wg, req)
+		case <-tick:
+			current := getFilesState(req.configFiles())
+			if current == state {
+				continue
+			}
+			state = current
+
+			t.reload(ctx, wg, req)
+		case <-refresh:
+			if t.remote.refresh(ctx) {
+				t.reload(ctx, wg, req)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadable returns true if the targets may change by reload
+func (r *request) reloadable() bool {
+	return len(r.configFiles()) > 0 || r.configURL != ""
+}
+
+// configFiles returns the reloadable config and targets files
+func (r *request) configFiles() []string {
+	var files []string
+
+	for _, name := range []string{r.config, r.targetsFile} {
+		if name != "" && name != "-" {
+			files = append(files, name)
+		}
+	}
+
+	return files
+}
+
+// getFilesState returns the files' modification time and size
+func getFilesState(files []string) string {
+	var state []string
+
+	for _, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			state = append(state, name)
+			continue
+		}
+
+		state = append(state, fmt.Sprintf("%s:%d:%d", name, fi.ModTime().UnixNano(), fi.Size()))
+	}
+
+	return strings.Join(state, ",")
+}
+
+// isSameTarget returns true if the targets have the same options
+func isSameTarget(a, b target) bool {
+	ab, err := yml.Marshal(a)
+	if err != nil {
+		return false
+	}
+
+	bb, err := yml.Marshal(b)
+	if err != nil {
+		return false
+	}
+
+	return string(ab) == string(bb)
+}
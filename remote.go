@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// remoteConfig represents the config which is fetched from the config
+// URL, the last good config is kept once the fetch failed
+type remoteConfig struct {
+	url    string
+	client *http.Client
+
+	etag         string
+	lastModified string
+	body         []byte
+	config       *config
+
+	fetchErrors int64
+}
+
+func newRemoteConfig(req *request) (*remoteConfig, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: req.configInsecure}
+
+	pool, err := getCertPool(req.configCAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = pool
+
+	if req.configTLSCert != "" {
+		cc, err := newClientCert(req.configTLSCert, req.configTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = cc.get
+	}
+
+	return &remoteConfig{
+		url: req.configURL,
+		client: &http.Client{
+			Timeout:   req.timeoutHTTP,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// refresh fetches the config, it returns true if the config changed.
+// the fetch error is counted and the last good config is kept
+func (r *remoteConfig) refresh(ctx context.Context) bool {
+	changed, err := r.fetch(ctx)
+	if err != nil {
+		atomic.AddInt64(&r.fetchErrors, 1)
+		errorf("config %s: %v", r.url, err)
+		return false
+	}
+
+	return changed
+}
+
+func (r *remoteConfig) fetch(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	// the server may not support the conditional requests
+	if r.config != nil && bytes.Equal(b, r.body) {
+		return false, nil
+	}
+
+	cfg, err := parseConfig(b)
+	if err != nil {
+		return false, err
+	}
+
+	r.config, r.body = cfg, b
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+
+	return true, nil
+}
+
+// register exports the total fetch errors
+func (r *remoteConfig) register() {
+	c := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name:        metricName("config_fetch_error"),
+		Help:        "total remote config fetch or parse error",
+		ConstLabels: metricLabels,
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&r.fetchErrors))
+	})
+
+	err := prometheus.Register(c)
+	if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		prometheus.Unregister(e.ExistingCollector)
+		err = prometheus.Register(c)
+	}
+
+	if err != nil {
+		errorf("%v", err)
+	}
+}
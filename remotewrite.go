@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// remoteWriteRetries is the failed batch's retries on 5xx
+	remoteWriteRetries = 3
+	// remoteWriteTimeout is the write request's timeout
+	remoteWriteTimeout = 10 * time.Second
+	// remoteWriteBatch is the maximum samples of a write request
+	remoteWriteBatch = 2000
+	// remoteWriteMaxPending is the maximum pending samples, the
+	// oldest are dropped once the endpoint can't keep up
+	remoteWriteMaxPending = 100000
+)
+
+// errRemoteWriteDrop is the permanent failure e.g. 4xx,
+// the batch is dropped instead of the retries
+var errRemoteWriteDrop = errors.New("remote write dropped")
+
+// remoteWrite represents the prometheus remote write, the metrics are
+// converted to samples at the interval and written in batches, the
+// samples are pending until they're written or dropped
+type remoteWrite struct {
+	sync.Mutex
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	interval    time.Duration
+	backoff     time.Duration
+	client      *http.Client
+	pending     []rwSample
+	dropped     int
+	done        chan struct{}
+}
+
+// rwSample represents a sample with its series' labels,
+// the labels are sorted by name and __name__ included
+type rwSample struct {
+	labels    []rwLabel
+	value     float64
+	timestamp int64
+}
+
+type rwLabel struct {
+	name  string
+	value string
+}
+
+func newRemoteWrite(req *request) *remoteWrite {
+	return &remoteWrite{
+		url:         req.remoteWriteURL,
+		username:    req.remoteWriteUsername,
+		password:    req.remoteWritePassword,
+		bearerToken: req.remoteWriteBearerToken,
+		interval:    req.remoteWriteInterval,
+		backoff:     time.Second,
+		client:      &http.Client{Timeout: remoteWriteTimeout},
+		done:        make(chan struct{}),
+	}
+}
+
+// run collects and writes the metrics at the interval and
+// once more the context is canceled
+func (rw *remoteWrite) run(ctx context.Context) {
+	defer close(rw.done)
+
+	ticker := time.NewTicker(rw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rw.collect(prometheus.DefaultGatherer)
+			rw.flush()
+		case <-ctx.Done():
+			rw.collect(prometheus.DefaultGatherer)
+			rw.flush()
+			return
+		}
+	}
+}
+
+func (rw *remoteWrite) wait() {
+	<-rw.done
+}
+
+// keep collects the finished target's collectors before they're
+// unregistered, they're written by the next flush
+func (rw *remoteWrite) keep(collectors []prometheus.Collector) {
+	registry := prometheus.NewRegistry()
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			errorf("remote write: %v", err)
+		}
+	}
+
+	rw.collect(registry)
+}
+
+// collect converts the gathered metrics to the pending samples
+func (rw *remoteWrite) collect(g prometheus.Gatherer) {
+	families, err := g.Gather()
+	if err != nil {
+		errorf("remote write: %v", err)
+	}
+
+	samples := rwSamples(families, time.Now().UnixNano()/int64(time.Millisecond))
+
+	rw.Lock()
+	defer rw.Unlock()
+
+	rw.pending = append(rw.pending, samples...)
+	if n := len(rw.pending) - remoteWriteMaxPending; n > 0 {
+		rw.pending = rw.pending[n:]
+		rw.dropped += n
+		selfMetrics.remoteWriteDropped.Add(float64(n))
+	}
+	selfMetrics.remoteWritePending.Set(float64(len(rw.pending)))
+}
+
+// flush writes the pending samples in batches, the batch which failed
+// after the retries is kept pending for the next flush
+func (rw *remoteWrite) flush() {
+	for {
+		rw.Lock()
+		n := len(rw.pending)
+		if n > remoteWriteBatch {
+			n = remoteWriteBatch
+		}
+		batch := rw.pending[:n]
+		dropped := rw.dropped
+		rw.Unlock()
+
+		if n == 0 {
+			return
+		}
+
+		err := rw.write(batch)
+		if err != nil && !errors.Is(err, errRemoteWriteDrop) {
+			errorf("remote write: %v", err)
+			return
+		}
+
+		if err != nil {
+			errorf("remote write: %v", err)
+			selfMetrics.remoteWriteDropped.Add(float64(n))
+		}
+
+		// the pending may be dropped by the collect during the write
+		rw.Lock()
+		if n -= rw.dropped - dropped; n > 0 {
+			rw.pending = rw.pending[n:]
+		}
+		selfMetrics.remoteWritePending.Set(float64(len(rw.pending)))
+		rw.Unlock()
+	}
+}
+
+// write posts the batch, it's retried with exponential backoff on
+// the 5xx and the network errors, the 4xx is permanent
+func (rw *remoteWrite) write(batch []rwSample) error {
+	body := snappy.Encode(nil, marshalWriteRequest(batch))
+
+	backoff := rw.backoff
+	for attempt := 0; ; attempt++ {
+		err := rw.post(body)
+		if err == nil || errors.Is(err, errRemoteWriteDrop) || attempt >= remoteWriteRetries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (rw *remoteWrite) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if rw.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.bearerToken)
+	} else if rw.username != "" {
+		req.SetBasicAuth(rw.username, rw.password)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4:
+		return fmt.Errorf("%w: %s %s", errRemoteWriteDrop, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// rwSamples converts the metric families to the samples, the
+// histograms and summaries are expanded to their series
+func rwSamples(families []*dto.MetricFamily, timestamp int64) []rwSample {
+	var samples []rwSample
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ts := timestamp
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+
+			add := func(name string, value float64, extra ...rwLabel) {
+				samples = append(samples, rwSample{
+					labels:    rwLabels(name, m.GetLabel(), extra...),
+					value:     value,
+					timestamp: ts,
+				})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), rwLabel{"quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), rwLabel{"le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), rwLabel{"le", "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+
+	return samples
+}
+
+func rwLabels(name string, pairs []*dto.LabelPair, extra ...rwLabel) []rwLabel {
+	labels := append([]rwLabel{{"__name__", name}}, extra...)
+	for _, p := range pairs {
+		labels = append(labels, rwLabel{p.GetName(), p.GetValue()})
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	return labels
+}
+
+// marshalWriteRequest encodes the prometheus.WriteRequest protobuf,
+// each sample is a time series with its labels
+func marshalWriteRequest(samples []rwSample) []byte {
+	var b []byte
+
+	for _, s := range samples {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	return b
+}
+
+// getRemoteWriteURL validates the remote write url
+func getRemoteWriteURL(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid remote-write-url: %s", s)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scheduler dispatches the due probes of the targets to a bounded
+// worker pool, a target is rescheduled by its interval once its probe
+// finished so a slow target holds one worker at most
+type scheduler struct {
+	mu    sync.Mutex
+	queue jobQueue
+	wake  chan struct{}
+	due   chan *job
+}
+
+// job represents the probes of a target in the scheduler
+type job struct {
+	ctx     context.Context
+	c       *client
+	counter int
+	wait    time.Duration
+	next    time.Time
+	index   int
+	removed bool
+	done    chan struct{}
+}
+
+// jobQueue is a min-heap of the jobs by their next run time
+type jobQueue []*job
+
+func (q jobQueue) Len() int           { return len(q) }
+func (q jobQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q jobQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *jobQueue) Push(x interface{}) {
+	j := x.(*job)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	j.index = -1
+	*q = old[:len(old)-1]
+
+	return j
+}
+
+// newScheduler returns a scheduler with the given number of workers,
+// it runs until the context is canceled
+func newScheduler(ctx context.Context, workers int) *scheduler {
+	s := &scheduler{
+		wake: make(chan struct{}, 1),
+		due:  make(chan *job),
+	}
+
+	for i := 0; i < workers; i++ {
+		go s.worker(ctx)
+	}
+
+	go s.dispatch(ctx)
+
+	return s
+}
+
+// run schedules the client's probes and blocks until the
+// probes are finished or the context is canceled
+func (s *scheduler) run(ctx context.Context, c *client) {
+	wait := c.getInterval(ctx)
+	j := &job{
+		ctx:   ctx,
+		c:     c,
+		wait:  wait,
+		next:  time.Now().Add(c.splayOffset(wait)),
+		index: -1,
+		done:  make(chan struct{}),
+	}
+
+	s.push(j)
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		s.remove(j)
+		<-j.done
+	}
+}
+
+func (s *scheduler) push(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j.removed {
+		close(j.done)
+		return
+	}
+
+	heap.Push(&s.queue, j)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove removes the job, the running job is finished
+// by the worker once its probe returned
+func (s *scheduler) remove(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.removed = true
+	if j.index >= 0 {
+		heap.Remove(&s.queue, j.index)
+		close(j.done)
+	}
+}
+
+// queueDepth returns the number of the due jobs which are
+// waiting for a worker
+func (s *scheduler) queueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	depth, now := 0, time.Now()
+	for _, j := range s.queue {
+		if !j.next.After(now) {
+			depth++
+		}
+	}
+
+	return depth
+}
+
+func (s *scheduler) dispatch(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		var timer <-chan time.Time
+		if len(s.queue) > 0 {
+			if d := time.Until(s.queue[0].next); d > 0 {
+				timer = time.After(d)
+			} else {
+				j := heap.Pop(&s.queue).(*job)
+				s.mu.Unlock()
+
+				select {
+				case s.due <- j:
+				case <-ctx.Done():
+					close(j.done)
+					return
+				}
+				continue
+			}
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-timer:
+		case <-s.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *scheduler) worker(ctx context.Context) {
+	for {
+		select {
+		case j := <-s.due:
+			if j.ctx.Err() != nil || !j.c.probeOnce(j.ctx, j.counter) || j.ctx.Err() != nil ||
+				j.c.req.count > 0 && j.counter >= j.c.req.count-1 {
+				close(j.done)
+				continue
+			}
+
+			j.counter++
+			j.next = time.Now().Add(j.c.nextInterval(j.c.cadence(j.wait)))
+			s.push(j)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// register exports the scheduler's queue depth
+func (s *scheduler) register() {
+	g := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        metricName("scheduler_queue_depth"),
+		Help:        "number of the due probes which are waiting for a worker",
+		ConstLabels: metricLabels,
+	}, func() float64 {
+		return float64(s.queueDepth())
+	})
+
+	err := prometheus.Register(g)
+	if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		prometheus.Unregister(e.ExistingCollector)
+		err = prometheus.Register(g)
+	}
+
+	if err != nil {
+		errorf("%v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// exitFailure is the exit code once a probe failed
+	exitFailure = 1
+	// exitInterrupt is the exit code once the shutdown forced
+	exitInterrupt = 130
+)
+
+// onShutdown returns a context which is canceled on SIGINT or SIGTERM
+// to stop the probes gracefully, the next signal exits immediately
+// until the returned stop function is called
+func onShutdown() (context.Context, context.CancelFunc, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	quit := make(chan struct{})
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sig:
+			infof("shutting down, send the signal again to exit immediately")
+			cancel()
+		case <-ctx.Done():
+		case <-quit:
+			return
+		}
+
+		select {
+		case <-sig:
+			warnf("forced exit")
+			os.Exit(exitInterrupt)
+		case <-quit:
+		}
+	}()
+
+	stop := func() {
+		signal.Stop(sig)
+		close(quit)
+	}
+
+	return ctx, cancel, stop
+}
+
+// drain waits until all the targets finished their probes and printed
+// their summary, it returns false if the grace period is exceeded
+func (t *tp) drain(wg *sync.WaitGroup, grace time.Duration) bool {
+	deadline := time.After(grace)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-deadline:
+		warnf("the shutdown grace period %s exceeded", grace)
+		return false
+	}
+
+	// the targets which have been started by the k8s or the API
+	for {
+		t.Lock()
+		n := len(t.targets)
+		t.Unlock()
+
+		if n == 0 {
+			return true
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			warnf("the shutdown grace period %s exceeded, %d targets are still running", grace, n)
+			return false
+		}
+	}
+}
+
+// stopOnFailure stops all the targets gracefully once
+// a target failed, the exit code is the failure
+func (t *tp) stopOnFailure(target string, err error) {
+	t.stopped.Do(func() {
+		errorf("stop on failure: %s: %v", target, err)
+
+		t.Lock()
+		t.failed = true
+		t.Unlock()
+
+		if t.cancel != nil {
+			t.cancel()
+		}
+	})
+}
+
+// exitCode returns the exit code of the run, the threshold
+// violation takes precedence over the failed probes
+func (t *tp) exitCode() int {
+	t.Lock()
+	defer t.Unlock()
+
+	switch {
+	case t.violated:
+		return exitThreshold
+	case t.failed:
+		return exitFailure
+	}
+
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dscpNames are the DSCP class names (RFC 2474, 2597, 3246, 5865, 8622)
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+// getDSCP returns the type of service of the DSCP name or value
+func getDSCP(dscp string) (int, error) {
+	if v, ok := dscpNames[strings.ToLower(dscp)]; ok {
+		return v << 2, nil
+	}
+
+	v, err := strconv.ParseInt(dscp, 0, 64)
+	if err != nil || v < 0 || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP: %s, expected a class name or 0-63", dscp)
+	}
+
+	return int(v) << 2, nil
+}
+
+// checkIPOptions validates the type of service and the time to live
+func checkIPOptions(tos, ttl int) error {
+	if tos < 0 || tos > 255 {
+		return fmt.Errorf("invalid tos: %d, expected 0-255", tos)
+	}
+
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("invalid ttl: %d, expected 1-255", ttl)
+	}
+
+	return nil
+}
+
+// checkKeepAlive validates the keepalive and user timeout options, the
+// keepalive durations have second granularity
+func checkKeepAlive(idle, interval time.Duration, count int, userTimeout time.Duration) error {
+	if idle < 0 || idle > 0 && idle < time.Second {
+		return fmt.Errorf("invalid keepalive-idle: %s, expected at least 1s", idle)
+	}
+
+	if interval < 0 || interval > 0 && interval < time.Second {
+		return fmt.Errorf("invalid keepalive-interval: %s, expected at least 1s", interval)
+	}
+
+	if count < 0 {
+		return fmt.Errorf("invalid keepalive-count: %d", count)
+	}
+
+	if userTimeout < 0 {
+		return fmt.Errorf("invalid user-timeout: %s", userTimeout)
+	}
+
+	return nil
+}
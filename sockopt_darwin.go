@@ -0,0 +1,74 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setPlatformOptions sets the Darwin specific socket options, the
+// priority and quickack options are not available on Darwin
+func (c *client) setPlatformOptions(fd int, network string) {
+	if c.req.soKeepAlive {
+		setSocketOptInt(fd, syscall.IPPROTO_TCP, unix.TCP_KEEPALIVE, int(c.req.soKeepAliveIdle.Seconds()), false)
+		setSocketOptInt(fd, syscall.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(c.req.soKeepAliveInterval.Seconds()), false)
+		setSocketOptInt(fd, syscall.IPPROTO_TCP, unix.TCP_KEEPCNT, c.req.soKeepAliveCount, false)
+	}
+
+	// the closest to TCP_USER_TIMEOUT, it has second granularity
+	setSocketOptInt(fd, syscall.IPPROTO_TCP, unix.TCP_RXT_CONNDROPTIME, int(c.req.soUserTimeout.Seconds()), false)
+
+	if c.bindDevice {
+		iface, err := net.InterfaceByName(c.req.iface)
+		if err != nil {
+			errorf("%v", err)
+			return
+		}
+
+		if network == "tcp4" {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, unix.IP_BOUND_IF, iface.Index)
+		} else {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, unix.IPV6_BOUND_IF, iface.Index)
+		}
+		if err != nil {
+			errorf("%v", os.NewSyscallError("setsockopt", err))
+		}
+	}
+}
+
+// checkCongestion returns error if the congestion control
+// algorithm requested, it can't be changed on Darwin
+func checkCongestion(alg string) error {
+	if alg == "" {
+		return nil
+	}
+
+	return errors.New("congestion control algorithm is not supported on darwin")
+}
+
+// bindToDevice checks if a socket can be bound to the interface
+func bindToDevice(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, unix.IP_BOUND_IF, iface.Index)
+	if err != nil {
+		return os.NewSyscallError("setsockopt IP_BOUND_IF", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setPlatformOptions sets the Linux specific socket options
+func (c *client) setPlatformOptions(fd int, network string) {
+	setSocketOptInt(fd, syscall.SOL_SOCKET, syscall.SO_PRIORITY, c.req.soPriority, false)
+	setSocketOptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, boolToInt(!c.req.soTCPQuickACK), true)
+
+	if c.req.soKeepAlive {
+		setSocketOptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, int(c.req.soKeepAliveIdle.Seconds()), false)
+		setSocketOptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(c.req.soKeepAliveInterval.Seconds()), false)
+		setSocketOptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, c.req.soKeepAliveCount, false)
+	}
+
+	setSocketOptInt(fd, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(c.req.soUserTimeout.Milliseconds()), false)
+
+	if c.bindDevice {
+		err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, c.req.iface)
+		if err != nil {
+			errorf("%v", os.NewSyscallError("setsockopt", err))
+		}
+	}
+
+	err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, c.req.soCongestion)
+	if c.req.soCongestion != "" && err != nil {
+		fatalf("%v", os.NewSyscallError("congestion-avoidance algorithm error", err))
+	}
+}
+
+// checkCongestion checks if the congestion control algorithm
+// is available on the host
+func checkCongestion(alg string) error {
+	if alg == "" {
+		return nil
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, alg)
+	if err != nil {
+		available, _ := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+		return fmt.Errorf("congestion control algorithm %s is not available: %v, available: %s",
+			alg, err, strings.TrimSpace(string(available)))
+	}
+
+	return nil
+}
+
+// bindToDevice checks if a socket can be bound to the interface,
+// it requires CAP_NET_RAW on the older kernels
+func bindToDevice(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+	if err != nil {
+		return os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+	}
+
+	return nil
+}
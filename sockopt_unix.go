@@ -0,0 +1,73 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func (c *client) control(network string, address string, conn syscall.RawConn) error {
+	return conn.Control(func(fd uintptr) {
+
+		setSocketOptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, c.req.soSndBuf, false)
+		setSocketOptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, c.req.soRcvBuf, false)
+		setSocketOptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, boolToInt(!c.req.soTCPNoDelay), true)
+		setSocketOptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, c.req.soMaxSegSize, false)
+
+		if network == "tcp4" {
+			setSocketOptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, c.req.soIPTOS, false)
+			setSocketOptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, c.req.soIPTTL, false)
+		} else {
+			setSocketOptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, c.req.soIPTTL, false)
+			setSocketOptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, c.req.soIPTOS, false)
+		}
+
+		if c.req.soKeepAlive {
+			setSocketOptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1, false)
+		}
+
+		c.setPlatformOptions(int(fd), network)
+
+		if c.req.verbose {
+			c.logIPOptions(int(fd), network)
+		}
+	})
+}
+
+func setSocketOptInt(fd int, level int, opt int, value int, zeroExc bool) {
+	if (value == 0 && !zeroExc) || (value == 1 && zeroExc) {
+		return
+	}
+
+	err := syscall.SetsockoptInt(fd, level, opt, value)
+	if err != nil {
+		errorf("%v", os.NewSyscallError("setsockopt", err))
+	}
+}
+
+// logIPOptions reads back the applied type of service and time to live
+func (c *client) logIPOptions(fd int, network string) {
+	var tos, ttl int
+
+	if network == "tcp4" {
+		tos, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS)
+		ttl, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL)
+	} else {
+		tos, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS)
+		ttl, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS)
+	}
+
+	infof("%s socket options: tos: 0x%02x (dscp %d) ttl: %d", c.target, tos, tos>>2, ttl)
+}
+
+// fileLimit returns the soft limit of the open files
+func fileLimit() (uint64, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+
+	return uint64(rlimit.Cur), nil
+}
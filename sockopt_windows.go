@@ -0,0 +1,84 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func (c *client) control(network string, address string, conn syscall.RawConn) error {
+	return conn.Control(func(fd uintptr) {
+		h := syscall.Handle(fd)
+
+		setSocketOptInt(h, syscall.SOL_SOCKET, syscall.SO_SNDBUF, c.req.soSndBuf, false)
+		setSocketOptInt(h, syscall.SOL_SOCKET, syscall.SO_RCVBUF, c.req.soRcvBuf, false)
+		setSocketOptInt(h, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, boolToInt(!c.req.soTCPNoDelay), true)
+
+		if network == "tcp4" {
+			setSocketOptInt(h, syscall.IPPROTO_IP, syscall.IP_TOS, c.req.soIPTOS, false)
+			setSocketOptInt(h, syscall.IPPROTO_IP, syscall.IP_TTL, c.req.soIPTTL, false)
+		} else {
+			setSocketOptInt(h, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, c.req.soIPTTL, false)
+		}
+
+		// the keepalive count is fixed on Windows, the durations
+		// are the system defaults if they are not specified
+		if c.req.soKeepAlive {
+			ka := syscall.TCPKeepalive{OnOff: 1, Time: 7200000, Interval: 1000}
+			if c.req.soKeepAliveIdle > 0 {
+				ka.Time = uint32(c.req.soKeepAliveIdle.Milliseconds())
+			}
+			if c.req.soKeepAliveInterval > 0 {
+				ka.Interval = uint32(c.req.soKeepAliveInterval.Milliseconds())
+			}
+			size := uint32(unsafe.Sizeof(ka))
+			err := syscall.WSAIoctl(h, syscall.SIO_KEEPALIVE_VALS, (*byte)(unsafe.Pointer(&ka)),
+				size, nil, 0, &size, nil, 0)
+			if err != nil {
+				errorf("%v", os.NewSyscallError("wsaioctl", err))
+			}
+		}
+
+		if c.req.verbose && network == "tcp4" {
+			tos, _ := syscall.GetsockoptInt(h, syscall.IPPROTO_IP, syscall.IP_TOS)
+			ttl, _ := syscall.GetsockoptInt(h, syscall.IPPROTO_IP, syscall.IP_TTL)
+			infof("%s socket options: tos: 0x%02x (dscp %d) ttl: %d", c.target, tos, tos>>2, ttl)
+		}
+	})
+}
+
+func setSocketOptInt(fd syscall.Handle, level int, opt int, value int, zeroExc bool) {
+	if (value == 0 && !zeroExc) || (value == 1 && zeroExc) {
+		return
+	}
+
+	err := syscall.SetsockoptInt(fd, level, opt, value)
+	if err != nil {
+		errorf("%v", os.NewSyscallError("setsockopt", err))
+	}
+}
+
+// checkCongestion returns error if the congestion control
+// algorithm requested, it can't be changed per socket on Windows
+func checkCongestion(alg string) error {
+	if alg == "" {
+		return nil
+	}
+
+	return errors.New("congestion control algorithm is not supported on windows")
+}
+
+// bindToDevice returns error, the probes are bound to
+// the interface's address instead
+func bindToDevice(name string) error {
+	return errors.New("binding to device is not supported on windows")
+}
+
+// fileLimit returns zero, the open sockets aren't limited by a soft limit on Windows
+func fileLimit() (uint64, error) {
+	return 0, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getSplay parses the splay percentage of the interval e.g. 20%,
+// the percent sign is optional
+func getSplay(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid splay: %s, expected 0-100%%", s)
+	}
+
+	return v / 100, nil
+}
+
+// newSplayRand returns the random source of the splay, it's seeded
+// by the target once the stable phase requested
+func newSplayRand(target string, stable bool) *rand.Rand {
+	seed := time.Now().UnixNano()
+	if stable {
+		h := fnv.New64a()
+		h.Write([]byte(target))
+		seed = int64(h.Sum64())
+	}
+
+	return rand.New(rand.NewSource(seed))
+}
+
+// splayOffset returns the delay of the first probe, a random
+// fraction of the splay of the interval
+func (c *client) splayOffset(interval time.Duration) time.Duration {
+	if c.splayRand == nil {
+		return 0
+	}
+
+	return time.Duration(c.splayRand.Float64() * c.req.splay * float64(interval))
+}
+
+// nextInterval returns the interval of the next probe, it's
+// jittered by ±splay of the interval if it's requested
+func (c *client) nextInterval(interval time.Duration) time.Duration {
+	if c.splayRand == nil || !c.req.splayJitter {
+		return interval
+	}
+
+	return interval + time.Duration((c.splayRand.Float64()*2-1)*c.req.splay*float64(interval))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// starttls protocols, the client upgrades the plaintext
+// connection to TLS by the protocol's command
+const (
+	starttlsSMTP = "smtp"
+	starttlsIMAP = "imap"
+	starttlsPOP3 = "pop3"
+)
+
+// startTLS performs the protocol's plaintext exchange and then the TLS
+// handshake, the plaintext failures are counted apart from the TLS's
+func (c *client) startTLS(ctx context.Context) error {
+	c.stats.StartTLS = 0
+
+	t := time.Now()
+	err := c.starttlsExchange(ctx)
+	c.stats.StartTLS = time.Since(t).Microseconds()
+	if err != nil {
+		c.stats.StartTLSError++
+		return fmt.Errorf("%s: starttls: %v", c.target, err)
+	}
+
+	_, err = c.tlsHandshake(ctx, c.tlsConfig())
+
+	return err
+}
+
+// starttlsExchange sends the protocol's STARTTLS command, the greeting
+// is already consumed if the banner is read
+func (c *client) starttlsExchange(ctx context.Context) error {
+	c.conn.SetDeadline(time.Now().Add(c.req.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	conn := textproto.NewConn(c.conn)
+	greeted := c.readsBanner()
+
+	switch c.req.starttls {
+	case starttlsSMTP:
+		if !greeted {
+			if _, _, err := conn.ReadResponse(220); err != nil {
+				return err
+			}
+		}
+
+		if _, _, err := smtpCmd(conn, 250, "EHLO localhost"); err != nil {
+			return err
+		}
+
+		_, _, err := smtpCmd(conn, 220, "STARTTLS")
+		return err
+
+	case starttlsIMAP:
+		if !greeted {
+			if err := expectLine(conn, "* OK"); err != nil {
+				return err
+			}
+		}
+
+		if err := conn.PrintfLine("a1 STARTTLS"); err != nil {
+			return err
+		}
+
+		// the untagged responses come before the tagged one
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(line, "a1 ") {
+				if !strings.HasPrefix(line, "a1 OK") {
+					return fmt.Errorf("unexpected response: %s", line)
+				}
+				return nil
+			}
+		}
+
+	case starttlsPOP3:
+		if !greeted {
+			if err := expectLine(conn, "+OK"); err != nil {
+				return err
+			}
+		}
+
+		if err := conn.PrintfLine("STLS"); err != nil {
+			return err
+		}
+
+		return expectLine(conn, "+OK")
+	}
+
+	return fmt.Errorf("unsupported protocol: %s", c.req.starttls)
+}
+
+func smtpCmd(conn *textproto.Conn, code int, cmd string) (int, string, error) {
+	if err := conn.PrintfLine("%s", cmd); err != nil {
+		return 0, "", err
+	}
+
+	return conn.ReadResponse(code)
+}
+
+// expectLine reads a line and returns error if
+// it doesn't start with the prefix
+func expectLine(conn *textproto.Conn, prefix string) error {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, prefix) {
+		return fmt.Errorf("unexpected response: %s", line)
+	}
+
+	return nil
+}
+
+// getStartTLS validates the starttls protocol
+func getStartTLS(proto string) (string, error) {
+	switch strings.ToLower(proto) {
+	case "", starttlsSMTP, starttlsIMAP, starttlsPOP3:
+		return strings.ToLower(proto), nil
+	}
+
+	return "", fmt.Errorf("invalid starttls: %s, expected smtp, imap or pop3", proto)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// statsdMaxPacket keeps the datagrams below the common Ethernet MTU
+const statsdMaxPacket = 1432
+
+var statsdEscaper = strings.NewReplacer(",", "_", "|", "_", ":", "_", "#", "_")
+
+// statsd represents DogStatsD metrics emitter
+type statsd struct {
+	prefix string
+	conn   net.Conn
+	ch     chan []string
+}
+
+func newStatsd(req *request) (*statsd, error) {
+	conn, err := net.Dial("udp", req.statsdAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsd{
+		prefix: req.statsdPrefix,
+		conn:   conn,
+		ch:     make(chan []string, 100),
+	}, nil
+}
+
+func (s *statsd) run(ctx context.Context) {
+	defer s.conn.Close()
+
+	for {
+		select {
+		case metrics := <-s.ch:
+			for _, packet := range statsdPackets(metrics) {
+				// the errors such as connection refused are ignored
+				// to not slow down the probes
+				s.conn.Write([]byte(packet))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *statsd) send(ctx context.Context, c *client) {
+	metrics := statsdMetrics(c, s.prefix, getLabels(ctx, c.target))
+
+	select {
+	case s.ch <- metrics:
+	default:
+		warnf("statsd queue is full, metrics dropped: %s", c.target)
+	}
+}
+
+func statsdMetrics(c *client, prefix string, labels map[string]string) []string {
+	var (
+		tags    []string
+		metrics []string
+		value   float64
+	)
+
+	for k, v := range labels {
+		tags = append(tags, statsdEscaper.Replace(k)+":"+statsdEscaper.Replace(v))
+	}
+	sort.Strings(tags)
+
+	suffix := ""
+	if len(tags) > 0 {
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+
+	if c.statsdLast == nil {
+		c.statsdLast = make(map[string]float64)
+	}
+
+	v := reflect.ValueOf(c.stats)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+
+		switch v.Field(i).Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			value = float64(v.Field(i).Uint())
+		case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
+			value = float64(v.Field(i).Int())
+		default:
+			continue
+		}
+
+		name := prefix + f.Tag.Get("name")
+
+		switch {
+		case f.Tag.Get("kind") == "counter":
+			// the stats counters are cumulative, statsd expects increments
+			delta := value - c.statsdLast[f.Name]
+			c.statsdLast[f.Name] = value
+			if delta <= 0 {
+				continue
+			}
+			metrics = append(metrics, fmt.Sprintf("%s:%g|c%s", name, delta, suffix))
+		case f.Tag.Get("unit") == "us":
+			metrics = append(metrics, fmt.Sprintf("%s:%g|ms%s", name, value/1000, suffix))
+		default:
+			metrics = append(metrics, fmt.Sprintf("%s:%g|g%s", name, value, suffix))
+		}
+	}
+
+	return metrics
+}
+
+func statsdPackets(metrics []string) []string {
+	var (
+		packets []string
+		packet  string
+	)
+
+	for _, m := range metrics {
+		if len(packet) > 0 && len(packet)+len(m)+1 > statsdMaxPacket {
+			packets = append(packets, packet)
+			packet = ""
+		}
+
+		if len(packet) > 0 {
+			packet += "\n"
+		}
+		packet += m
+	}
+
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+
+	return packets
+}
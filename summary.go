@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// summaryFields are the stats fields which summarized at exit
+var summaryFields = []string{"Rtt", "TCPConnect", "HTTPResponse"}
+
+// summary represents the accumulated probes of a target
+type summary struct {
+	sent    int
+	failed  int
+	metrics map[string]*summaryMetric
+}
+
+// probeStatus represents the last probe's result of a target, it's
+// read by the other goroutines while the target is probing
+type probeStatus struct {
+	sync.Mutex
+	last   time.Time
+	err    string
+	sent   int
+	failed int
+	fails  int
+
+	rtt     uint32
+	rtts    []uint32
+	rttSum  float64
+	rttN    int
+	status  int
+	retrans uint32
+}
+
+// probeStatusRtts is the number of the kept RTTs
+const probeStatusRtts = 20
+
+// summaryMetric represents min/avg/max/stddev of a stats field
+type summaryMetric struct {
+	Min    float64
+	Avg    float64
+	Max    float64
+	Stddev float64
+
+	n     int
+	sum   float64
+	sumSq float64
+}
+
+func newSummary() *summary {
+	s := &summary{metrics: make(map[string]*summaryMetric)}
+	for _, name := range summaryFields {
+		s.metrics[name] = &summaryMetric{}
+	}
+
+	return s
+}
+
+func (s *summary) record(st *stats, failed bool) {
+	s.sent++
+
+	if failed {
+		s.failed++
+		return
+	}
+
+	v := reflect.ValueOf(st).Elem()
+	for _, name := range summaryFields {
+		var value float64
+
+		f := v.FieldByName(name)
+		switch f.Kind() {
+		case reflect.Uint32:
+			value = float64(f.Uint())
+		case reflect.Int64:
+			value = float64(f.Int())
+		}
+
+		s.metrics[name].add(value)
+	}
+}
+
+func (s *summary) success() float64 {
+	if s.sent == 0 {
+		return 0
+	}
+
+	return float64(s.sent-s.failed) / float64(s.sent) * 100
+}
+
+func (s *probeStatus) update(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.last = time.Now()
+	s.sent++
+	s.err = ""
+
+	if err != nil {
+		s.failed++
+		s.fails++
+		s.err = err.Error()
+		return
+	}
+
+	s.fails = 0
+}
+
+// sample keeps the probe's RTT, HTTP status and retransmits,
+// the RTT of the failed probe isn't kept
+func (s *probeStatus) sample(st *stats, failed bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.status = st.HTTPStatusCode
+	s.retrans = st.TotalRetrans
+
+	if failed {
+		return
+	}
+
+	s.rtt = st.Rtt
+	s.rttSum += float64(st.Rtt)
+	s.rttN++
+
+	s.rtts = append(s.rtts, st.Rtt)
+	if len(s.rtts) > probeStatusRtts {
+		s.rtts = s.rtts[1:]
+	}
+}
+
+// get returns the last probe's time and error and the success ratio
+func (s *probeStatus) get() (time.Time, string, float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.sent == 0 {
+		return s.last, s.err, 0
+	}
+
+	return s.last, s.err, float64(s.sent-s.failed) / float64(s.sent) * 100
+}
+
+func (m *summaryMetric) add(value float64) {
+	if m.n == 0 || value < m.Min {
+		m.Min = value
+	}
+	if value > m.Max {
+		m.Max = value
+	}
+
+	m.n++
+	m.sum += value
+	m.sumSq += value * value
+	m.Avg = m.sum / float64(m.n)
+	m.Stddev = math.Sqrt(math.Max(m.sumSq/float64(m.n)-m.Avg*m.Avg, 0))
+}
+
+func (c *client) printSummary() {
+	if c.req.quiet || c.req.csv || c.summary == nil {
+		return
+	}
+
+	if c.req.json || c.req.jsonPretty {
+		c.printSummaryJSON()
+		return
+	}
+
+	s := c.summary
+	fmt.Fprintf(stdout{}, "--- %s tcpprobe statistics ---\n", c.target)
+	fmt.Fprintf(stdout{}, "%d probes sent, %d failed, %.2f%% success\n", s.sent, s.failed, s.success())
+	fmt.Fprintf(stdout{}, "%.2f%% availability, %d unavailable, %d consecutive, %s downtime\n", c.availabilityRatio(),
+		c.stats.AvailFailed, c.stats.AvailConsecutiveFailures, time.Duration(c.stats.AvailDowntime)*time.Second)
+	for _, name := range summaryFields {
+		m := s.metrics[name]
+		fmt.Fprintf(stdout{}, "%s min/avg/max/stddev = %.0f/%.0f/%.0f/%.0f us\n", name, m.Min, m.Avg, m.Max, m.Stddev)
+	}
+}
+
+func (c *client) printSummaryJSON() {
+	var (
+		b   []byte
+		err error
+	)
+
+	d := struct {
+		Target              string
+		Summary             bool `json:"summary"`
+		Sent                int
+		Failed              int
+		Success             float64
+		Availability        float64
+		Unavailable         int64
+		ConsecutiveFailures int64
+		LastChange          int64
+		Downtime            int64
+		Metrics             map[string]*summaryMetric
+	}{
+		c.target,
+		true,
+		c.summary.sent,
+		c.summary.failed,
+		c.summary.success(),
+		c.availabilityRatio(),
+		c.stats.AvailFailed,
+		c.stats.AvailConsecutiveFailures,
+		c.stats.AvailLastChange,
+		c.stats.AvailDowntime,
+		c.summary.metrics,
+	}
+
+	if c.req.jsonPretty {
+		b, err = json.MarshalIndent(d, "", "  ")
+	} else {
+		b, err = json.Marshal(d)
+	}
+
+	if err != nil {
+		errorf("%v", err)
+		return
+	}
+
+	fmt.Fprintln(stdout{}, string(b))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// syslogTimeout is the syslog daemon's connect and write timeout
+	syslogTimeout = 5 * time.Second
+	// syslogQueue is the maximum queued messages, the messages
+	// are dropped once it's full
+	syslogQueue = 1000
+	// syslogMaxBackoff is the maximum wait before the reconnect
+	syslogMaxBackoff = 30 * time.Second
+
+	// syslogSDID is the structured data's id by the example
+	// private enterprise number (RFC 5612)
+	syslogSDID = "tcpprobe@32473"
+	// syslogLabelsSDID is the labels' structured data's id
+	syslogLabelsSDID = "labels@32473"
+)
+
+// syslog severities (RFC 5424)
+const (
+	syslogErr     = 3
+	syslogWarning = 4
+	syslogNotice  = 5
+	syslogInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslog represents the RFC 5424 syslog output, the messages are sent
+// in the background and they're dropped and counted if the daemon isn't
+// reachable, the connection is reconnected with backoff
+type syslog struct {
+	network  string
+	addr     string
+	facility int
+	tag      string
+	hostname string
+	pid      int
+
+	conn    net.Conn
+	stream  bool
+	retry   time.Time
+	backoff time.Duration
+
+	ch   chan []byte
+	done chan struct{}
+}
+
+func newSyslog(req *request) *syslog {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &syslog{
+		network:  req.syslogNetwork,
+		addr:     req.syslogAddr,
+		facility: req.syslogFacility,
+		tag:      req.syslogTag,
+		hostname: hostname,
+		pid:      os.Getpid(),
+		backoff:  time.Second,
+		ch:       make(chan []byte, syslogQueue),
+		done:     make(chan struct{}),
+	}
+}
+
+// run writes the queued messages, the remaining messages
+// are written once the context is canceled
+func (s *syslog) run(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		select {
+		case m := <-s.ch:
+			s.write(m)
+		case <-ctx.Done():
+			for len(s.ch) > 0 {
+				s.write(<-s.ch)
+			}
+
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (s *syslog) wait() {
+	<-s.done
+}
+
+// send queues the message of the target, the structured
+// data carries the target's identity and its labels
+func (s *syslog) send(meta recordMeta, severity int, msgID string, msg []byte) {
+	m := s.message(time.Now(), severity, msgID, syslogSD(meta), msg)
+
+	select {
+	case s.ch <- m:
+	default:
+		selfMetrics.syslogDropped.Inc()
+	}
+}
+
+// message returns the RFC 5424 message
+func (s *syslog) message(t time.Time, severity int, msgID, sd string, msg []byte) []byte {
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s %s ",
+		s.facility*8+severity,
+		t.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.tag,
+		s.pid,
+		msgID,
+		sd,
+	)
+
+	return append([]byte(header), msg...)
+}
+
+// write writes the message, it's dropped if the daemon isn't
+// connected and the reconnect is postponed by the backoff
+func (s *syslog) write(m []byte) {
+	if s.conn == nil {
+		if time.Now().Before(s.retry) {
+			selfMetrics.syslogDropped.Inc()
+			return
+		}
+
+		if err := s.dial(); err != nil {
+			s.failed(err)
+			return
+		}
+	}
+
+	// the stream's messages are framed by the octet counting (RFC 6587)
+	if s.stream {
+		m = append([]byte(strconv.Itoa(len(m))+" "), m...)
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := s.conn.Write(m); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.failed(err)
+		return
+	}
+
+	s.backoff = time.Second
+}
+
+// dial connects to the daemon, the unix socket is
+// the datagram or the stream e.g. /dev/log
+func (s *syslog) dial() error {
+	networks := []string{s.network}
+	if s.network == "unix" {
+		networks = []string{"unixgram", "unix"}
+	}
+
+	var err error
+	for _, network := range networks {
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, s.addr, syslogTimeout); err == nil {
+			s.conn = conn
+			s.stream = network == "tcp" || network == "unix"
+			return nil
+		}
+	}
+
+	return err
+}
+
+// failed drops the message and postpones the reconnect
+func (s *syslog) failed(err error) {
+	errorf("syslog: %v, reconnect in %s", err, s.backoff)
+	selfMetrics.syslogDropped.Inc()
+
+	s.retry = time.Now().Add(s.backoff)
+	if s.backoff *= 2; s.backoff > syslogMaxBackoff {
+		s.backoff = syslogMaxBackoff
+	}
+}
+
+// writeSyslog sends the target's transition and the probe's record,
+// the records are filtered by the on-change and the quiet-success
+func (c *client) writeSyslog(counter int) {
+	if c.output.changed {
+		state, severity := "up", syslogNotice
+		if c.output.failed {
+			state, severity = "down", syslogErr
+		}
+
+		b, err := c.stateRecord(c.output.failed, c.output.downtime)
+		if err != nil {
+			errorf("%v", err)
+			return
+		}
+		c.syslog.send(c.meta(-1), severity, state, b)
+	}
+
+	if !c.isPrintable() {
+		return
+	}
+
+	severity := syslogInfo
+	if c.output.failed {
+		severity = syslogWarning
+	}
+
+	b, err := c.jsonRecord(counter, false)
+	if err != nil {
+		errorf("%v", err)
+		return
+	}
+	c.syslog.send(c.meta(counter), severity, "probe", b)
+}
+
+// syslogSD returns the structured data of the record's identity
+func syslogSD(meta recordMeta) string {
+	sd := fmt.Sprintf(`[%s target="%s"`, syslogSDID, syslogEscaper.Replace(meta.Target))
+	if meta.IP != "" {
+		sd += fmt.Sprintf(` ip="%s"`, meta.IP)
+	}
+	if meta.Seq >= 0 {
+		sd += fmt.Sprintf(` seq="%d"`, meta.Seq)
+	}
+	sd += "]"
+
+	if len(meta.Labels) == 0 {
+		return sd
+	}
+
+	var keys []string
+	for k := range meta.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sd += "[" + syslogLabelsSDID
+	for _, k := range keys {
+		sd += fmt.Sprintf(` %s="%s"`, syslogParamName(k), syslogEscaper.Replace(meta.Labels[k]))
+	}
+
+	return sd + "]"
+}
+
+// syslogParamName returns the valid structured data's param name,
+// the name is up to 32 printable characters except = ] " and space
+func syslogParamName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+
+	if len(b) > 32 {
+		b = b[:32]
+	}
+
+	return string(b)
+}
+
+// getSyslogFacility returns the facility's code by its name
+func getSyslogFacility(s string) (int, error) {
+	f, ok := syslogFacilities[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid syslog-facility: %s", s)
+	}
+
+	return f, nil
+}
+
+// getSyslogAddr returns the syslog daemon's address, the
+// default is the local daemon of the network
+func getSyslogAddr(network, addr string) (string, error) {
+	switch network {
+	case "udp", "tcp":
+		if addr == "" {
+			return "localhost:514", nil
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", fmt.Errorf("invalid syslog-addr: %s", addr)
+		}
+	case "unix":
+		if addr == "" {
+			return "/dev/log", nil
+		}
+	default:
+		return "", fmt.Errorf("invalid syslog-network: %s", network)
+	}
+
+	return addr, nil
+}
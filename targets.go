@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readTargets reads the targets, one target per line with the optional
+// key=value labels after the address, the # comments are ignored
+func readTargets(r io.Reader) ([]target, error) {
+	var targets []target
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+
+		t := target{Addr: fields[0]}
+		if err := checkAddr(t.Addr); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		for _, label := range fields[1:] {
+			kv := strings.SplitN(label, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("line %d: invalid label: %s, expected key=value", n, label)
+			}
+
+			if t.Labels == nil {
+				t.Labels = make(map[string]string)
+			}
+			t.Labels[kv[0]] = kv[1]
+		}
+
+		targets = append(targets, t)
+	}
+
+	return targets, scanner.Err()
+}
+
+// getTargetsFile returns the targets of the file, - is the stdin
+func getTargetsFile(name string) ([]target, error) {
+	if name == "-" {
+		return readTargets(os.Stdin)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	targets, err := readTargets(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return targets, nil
+}
+
+// getTargets returns the targets of the config, the remote config and
+// the targets file, the stdin targets are read once and kept for the reloads
+func (t *tp) getTargets(req *request) (*config, error) {
+	cfg, err := getConfig(req.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.remote != nil && t.remote.config != nil {
+		cfg.Targets = append(cfg.Targets, t.remote.config.Targets...)
+	}
+
+	if req.targetsFile == "" {
+		return cfg, nil
+	}
+
+	targets := t.stdinTargets
+	if req.targetsFile != "-" || targets == nil {
+		targets, err = getTargetsFile(req.targetsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.targetsFile == "-" {
+			t.stdinTargets = targets
+		}
+	}
+
+	cfg.Targets = append(cfg.Targets, targets...)
+
+	return cfg, nil
+}
@@ -0,0 +1,83 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpConnectionInfo represents the Darwin's tcp_connection_info
+type tcpConnectionInfo struct {
+	state               uint8
+	sndWscale           uint8
+	rcvWscale           uint8
+	pad                 uint8
+	options             uint32
+	flags               uint32
+	rto                 uint32
+	maxseg              uint32
+	sndSsthresh         uint32
+	sndCwnd             uint32
+	sndWnd              uint32
+	sndSbbytes          uint32
+	rcvWnd              uint32
+	rttCur              uint32
+	srtt                uint32
+	rttvar              uint32
+	tfo                 uint32
+	txPackets           uint64
+	txBytes             uint64
+	txRetransmitBytes   uint64
+	rxPackets           uint64
+	rxBytes             uint64
+	rxOutOfOrderBytes   uint64
+	txRetransmitPackets uint64
+}
+
+// readTCPInfo populates the stats by TCP_CONNECTION_INFO, the time
+// values are in milliseconds and the congestion window is in bytes,
+// the fields without Darwin equivalent are zero
+func (c *client) readTCPInfo(fd uintptr) error {
+	info := tcpConnectionInfo{}
+	size := uint32(unsafe.Sizeof(info))
+
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, unix.TCP_CONNECTION_INFO,
+		uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	if e != 0 {
+		return fmt.Errorf("syscall err number=%d", e)
+	}
+
+	if int(info.state) < len(bsdStates) {
+		c.stats.State = bsdStates[info.state]
+	}
+
+	c.stats.Options = uint8(info.options)
+	c.stats.Rto = info.rto * 1000
+	c.stats.SndMss = info.maxseg
+	c.stats.Rtt = info.srtt * 1000
+	c.stats.Rttvar = info.rttvar * 1000
+	c.stats.SndWnd = info.sndWnd
+	c.stats.RcvWnd = info.rcvWnd
+
+	c.stats.SndSsthresh = info.sndSsthresh
+	c.stats.SndCwnd = info.sndCwnd
+	if info.maxseg > 0 {
+		c.stats.SndSsthresh /= info.maxseg
+		c.stats.SndCwnd /= info.maxseg
+	}
+
+	c.stats.SegsOut = uint32(info.txPackets)
+	c.stats.SegsIn = uint32(info.rxPackets)
+	c.stats.BytesSent = info.txBytes
+	c.stats.BytesReceived = info.rxBytes
+	c.stats.BytesRetrans = info.txRetransmitBytes
+	c.stats.TotalRetrans = uint32(info.txRetransmitPackets)
+	c.stats.RcvOooBytes = info.rxOutOfOrderBytes
+
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpInfoSize is the size of the kernel's tcp_info which
+// the stats covers at the beginning
+const tcpInfoSize = unsafe.Offsetof(stats{}.TotalRtoTime) + unsafe.Sizeof(stats{}.TotalRtoTime)
+
+// readTCPInfo populates the stats by TCP_INFO and TCP_CONGESTION
+func (c *client) readTCPInfo(fd uintptr) error {
+	size := uint32(tcpInfoSize)
+
+	// the older kernels return a shorter tcp_info, the rest is zero
+	info := (*[tcpInfoSize]byte)(unsafe.Pointer(&c.stats))
+	for i := range info {
+		info[i] = 0
+	}
+
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&c.stats)), uintptr(unsafe.Pointer(&size)), 0)
+	if e != 0 {
+		return fmt.Errorf("syscall err number=%d", e)
+	}
+
+	ca := make([]byte, 16)
+	size = uint32(len(ca))
+
+	_, _, e = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
+		uintptr(unsafe.Pointer(&ca[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if e != 0 {
+		return fmt.Errorf("syscall err number=%d", e)
+	}
+
+	c.stats.TCPCongesAlg = string(bytes.Trim(ca, "\x00"))
+
+	c.stats.BBRBandwidth = 0
+	c.stats.BBRMinRtt = 0
+	c.stats.BBRPacingGain = 0
+	c.stats.BBRCwndGain = 0
+	if c.stats.TCPCongesAlg == "bbr" {
+		if err := c.getBBRInfo(fd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bbrInfo represents the kernel's tcp_bbr_info
+type bbrInfo struct {
+	bwLo       uint32
+	bwHi       uint32
+	minRtt     uint32
+	pacingGain uint32
+	cwndGain   uint32
+}
+
+// getBBRInfo populates the BBR stats by TCP_CC_INFO
+func (c *client) getBBRInfo(fd uintptr) error {
+	info := bbrInfo{}
+	size := uint32(unsafe.Sizeof(info))
+
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, unix.TCP_CC_INFO,
+		uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	if e != 0 {
+		return fmt.Errorf("syscall err number=%d", e)
+	}
+
+	c.stats.BBRBandwidth = uint64(info.bwHi)<<32 | uint64(info.bwLo)
+	c.stats.BBRMinRtt = info.minRtt
+	c.stats.BBRPacingGain = info.pacingGain
+	c.stats.BBRCwndGain = info.cwndGain
+
+	return nil
+}
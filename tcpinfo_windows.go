@@ -0,0 +1,80 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// sioTCPInfo is the SIO_TCP_INFO ioctl code, Windows 10 1703 and later
+const sioTCPInfo = syscall.IOC_INOUT | syscall.IOC_VENDOR | 39
+
+// tcpInfoV0 represents the Windows's TCP_INFO_v0
+type tcpInfoV0 struct {
+	state             uint32
+	mss               uint32
+	connectionTimeMs  uint64
+	timestampsEnabled bool
+	rttUs             uint32
+	minRttUs          uint32
+	bytesInFlight     uint32
+	cwnd              uint32
+	sndWnd            uint32
+	rcvWnd            uint32
+	rcvBuf            uint32
+	bytesOut          uint64
+	bytesIn           uint64
+	bytesReordered    uint32
+	bytesRetrans      uint32
+	fastRetrans       uint32
+	dupAcksIn         uint32
+	timeoutEpisodes   uint32
+	synRetrans        uint8
+}
+
+var tcpInfoUnavailable sync.Once
+
+// readTCPInfo populates the stats by SIO_TCP_INFO, the kernel stats
+// are skipped on the older Windows and the rest of the probe works
+func (c *client) readTCPInfo(fd uintptr) error {
+	var (
+		version uint32
+		info    tcpInfoV0
+		size    uint32
+	)
+
+	err := syscall.WSAIoctl(syscall.Handle(fd), sioTCPInfo,
+		(*byte)(unsafe.Pointer(&version)), uint32(unsafe.Sizeof(version)),
+		(*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), &size, nil, 0)
+	if err != nil {
+		tcpInfoUnavailable.Do(func() {
+			warnf("SIO_TCP_INFO is not available: %v, TCP stats are skipped", err)
+		})
+		return nil
+	}
+
+	if int(info.state) < len(bsdStates) {
+		c.stats.State = bsdStates[info.state]
+	}
+
+	c.stats.SndMss = info.mss
+	c.stats.Rtt = info.rttUs
+	c.stats.MinRtt = info.minRttUs
+	c.stats.SndWnd = info.sndWnd
+	c.stats.RcvWnd = info.rcvWnd
+	c.stats.BytesSent = info.bytesOut
+	c.stats.BytesReceived = info.bytesIn
+	c.stats.BytesRetrans = uint64(info.bytesRetrans)
+	c.stats.TotalRto = uint16(info.timeoutEpisodes)
+
+	// the congestion window is in bytes
+	c.stats.SndCwnd = info.cwnd
+	if info.mss > 0 {
+		c.stats.SndCwnd /= info.mss
+	}
+
+	return nil
+}
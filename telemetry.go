@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfMetrics are the prober's own metrics, they're created once the
+// metrics namespace is set and they're exported even if they're zero
+var selfMetrics = newTelemetry()
+
+// telemetry represents the prober's own metrics to tell whether
+// the targets are down or the prober itself isn't working
+type telemetry struct {
+	probes       *prometheus.CounterVec
+	duration     prometheus.Histogram
+	reloads      *prometheus.CounterVec
+	k8sEvents    prometheus.Counter
+	outputErrors prometheus.Counter
+	dnsCache     *prometheus.CounterVec
+
+	remoteWritePending prometheus.Gauge
+	remoteWriteDropped prometheus.Counter
+	influxDropped      prometheus.Counter
+	kafkaDropped       prometheus.Counter
+	syslogDropped      prometheus.Counter
+}
+
+func newTelemetry() *telemetry {
+	t := &telemetry{
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        metricName("probes_total"),
+			Help:        "total probes by the result",
+			ConstLabels: metricLabels,
+		}, []string{"result"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        metricName("probe_duration_seconds"),
+			Help:        "probes' duration in seconds",
+			ConstLabels: metricLabels,
+			Buckets:     prometheus.DefBuckets,
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        metricName("config_reloads_total"),
+			Help:        "total config reloads by the result",
+			ConstLabels: metricLabels,
+		}, []string{"result"}),
+		k8sEvents: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricName("k8s_watch_events_total"),
+			Help:        "total k8s watch events",
+			ConstLabels: metricLabels,
+		}),
+		outputErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricName("output_write_errors_total"),
+			Help:        "total output write error",
+			ConstLabels: metricLabels,
+		}),
+		dnsCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        metricName("dns_cache_lookups_total"),
+			Help:        "total DNS cache lookups by the result",
+			ConstLabels: metricLabels,
+		}, []string{"result"}),
+		remoteWritePending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        metricName("remote_write_pending_samples"),
+			Help:        "number of the samples waiting to be written by the remote write",
+			ConstLabels: metricLabels,
+		}),
+		remoteWriteDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricName("remote_write_dropped_samples_total"),
+			Help:        "total samples dropped by the remote write e.g. rejected by 4xx",
+			ConstLabels: metricLabels,
+		}),
+		influxDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricName("influx_dropped_points_total"),
+			Help:        "total points dropped by the influxdb output e.g. the write failed",
+			ConstLabels: metricLabels,
+		}),
+		kafkaDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricName("kafka_dropped_messages_total"),
+			Help:        "total records dropped by the kafka output e.g. the queue is full",
+			ConstLabels: metricLabels,
+		}),
+		syslogDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricName("syslog_dropped_messages_total"),
+			Help:        "total messages dropped by the syslog output e.g. the daemon is unreachable",
+			ConstLabels: metricLabels,
+		}),
+	}
+
+	// the results exist before the first probe or reload
+	for _, result := range []string{"ok", "error"} {
+		t.probes.WithLabelValues(result)
+		t.reloads.WithLabelValues(result)
+	}
+
+	for _, result := range []string{"hit", "miss"} {
+		t.dnsCache.WithLabelValues(result)
+	}
+
+	return t
+}
+
+// register exports the prober's metrics and the configured targets
+func (t *telemetry) register(tp *tp) {
+	collectors := []prometheus.Collector{
+		t.probes,
+		t.duration,
+		t.reloads,
+		t.k8sEvents,
+		t.outputErrors,
+		t.dnsCache,
+		t.remoteWritePending,
+		t.remoteWriteDropped,
+		t.influxDropped,
+		t.kafkaDropped,
+		t.syslogDropped,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        metricName("targets_configured"),
+			Help:        "number of the configured targets",
+			ConstLabels: metricLabels,
+		}, func() float64 {
+			tp.Lock()
+			defer tp.Unlock()
+
+			return float64(len(tp.targets))
+		}),
+	}
+
+	for _, c := range collectors {
+		err := prometheus.Register(c)
+		if e, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			prometheus.Unregister(e.ExistingCollector)
+			err = prometheus.Register(c)
+		}
+
+		if err != nil {
+			errorf("%v", err)
+		}
+	}
+}
+
+// resultLabel returns the result label of the error
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+// stdout represents the records' output, the write errors
+// such as broken pipe are counted
+type stdout struct{}
+
+func (stdout) Write(b []byte) (int, error) {
+	n, err := os.Stdout.Write(b)
+	if err != nil {
+		selfMetrics.outputErrors.Inc()
+	}
+
+	return n, err
+}
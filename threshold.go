@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exitThreshold is the exit code once a threshold violated
+const exitThreshold = 2
+
+// threshold represents the threshold violations of a target
+type threshold struct {
+	rttExceeded    int
+	worstRtt       uint32
+	statusMismatch int
+	lastStatus     int
+}
+
+// rttLevel represents the Rtt against the warn-rtt and crit-rtt
+type rttLevel int
+
+const (
+	rttOK rttLevel = iota
+	rttWarn
+	rttCrit
+)
+
+// getRttLevel returns the Rtt's level, the unit of the Rtt
+// is microsecond and the zero thresholds are disabled
+func getRttLevel(rtt uint32, warn, crit time.Duration) rttLevel {
+	d := time.Duration(rtt) * time.Microsecond
+
+	switch {
+	case crit > 0 && d > crit:
+		return rttCrit
+	case warn > 0 && d > warn:
+		return rttWarn
+	}
+
+	return rttOK
+}
+
+// hasThresholds returns true if the exit code is by the thresholds
+func (r *request) hasThresholds() bool {
+	return r.maxRtt > 0 || r.maxLoss >= 0
+}
+
+func (c *client) checkThresholds() {
+	if c.warming {
+		return
+	}
+
+	if c.req.maxRtt > 0 && time.Duration(c.stats.Rtt)*time.Microsecond > c.req.maxRtt {
+		c.threshold.rttExceeded++
+		if c.stats.Rtt > c.threshold.worstRtt {
+			c.threshold.worstRtt = c.stats.Rtt
+		}
+	}
+
+	if len(c.req.expectStatus) > 0 && c.isHTTP() &&
+		!isExpectedStatus(c.stats.HTTPStatusCode, c.req.expectStatus) {
+		c.threshold.statusMismatch++
+		c.threshold.lastStatus = c.stats.HTTPStatusCode
+	}
+}
+
+func (c *client) violations() []string {
+	var v []string
+
+	if c.threshold.rttExceeded > 0 {
+		worst := time.Duration(c.threshold.worstRtt) * time.Microsecond
+		v = append(v, fmt.Sprintf("max-rtt: %d probe(s) exceeded %s, worst %s (+%s)",
+			c.threshold.rttExceeded, c.req.maxRtt, worst, worst-c.req.maxRtt))
+	}
+
+	if c.req.maxLoss >= 0 && c.summary.sent > 0 {
+		loss := float64(c.summary.failed) / float64(c.summary.sent) * 100
+		if loss > c.req.maxLoss {
+			v = append(v, fmt.Sprintf("max-loss: %.2f%% loss exceeded %.2f%% (+%.2f%%)",
+				loss, c.req.maxLoss, loss-c.req.maxLoss))
+		}
+	}
+
+	if c.threshold.statusMismatch > 0 {
+		v = append(v, fmt.Sprintf("expect-status: %d probe(s) unexpected status, last %d",
+			c.threshold.statusMismatch, c.threshold.lastStatus))
+	}
+
+	return v
+}
+
+func isExpectedStatus(status int, expected []int) bool {
+	for _, e := range expected {
+		if status == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getStatusCodes(s string) ([]int, error) {
+	codes := []int{}
+
+	if s == "" {
+		return codes, nil
+	}
+
+	for _, code := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil || i < 100 || i > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code: %s", code)
+		}
+		codes = append(codes, i)
+	}
+
+	return codes, nil
+}
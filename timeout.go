@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// connectTimeout returns the DNS and TCP connect timeout,
+// the timeout is the cap and the default
+func (c *client) connectTimeout() time.Duration {
+	return capTimeout(c.req.connectTimeout, c.req.timeout)
+}
+
+// tlsDeadline returns the TLS handshake's deadline, the handshake
+// and the connect together are capped by the timeout
+func (c *client) tlsDeadline() time.Time {
+	deadline := time.Now().Add(capTimeout(c.req.tlsTimeout, c.req.timeout))
+	if c.req.timeout > 0 && !c.probed.IsZero() {
+		if overall := c.probed.Add(c.req.timeout); overall.Before(deadline) {
+			return overall
+		}
+	}
+
+	return deadline
+}
+
+// capTimeout returns the phase's timeout, it's the max timeout
+// if the phase's timeout isn't set or it's longer
+func capTimeout(timeout, max time.Duration) time.Duration {
+	if timeout <= 0 || max > 0 && timeout > max {
+		return max
+	}
+
+	return timeout
+}
+
+// isTimeout returns true if the error is a timeout
+func isTimeout(err error) bool {
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
+
+// abortOnCancel interrupts the connection's blocked reads and writes
+// once the context is canceled, the returned func stops watching
+func abortOnCancel(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// tlsVersions maps the TLS versions to their names
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// clientCert represents a client certificate which reloaded
+// once the certificate or key file modified on the disk
+type clientCert struct {
+	sync.Mutex
+
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func newClientCert(certFile, keyFile string) (*clientCert, error) {
+	cc := &clientCert{certFile: certFile, keyFile: keyFile}
+	if _, err := cc.get(nil); err != nil {
+		return nil, err
+	}
+
+	return cc, nil
+}
+
+func (cc *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	modTime, err := latestModTime(cc.certFile, cc.keyFile)
+	if err != nil && cc.cert != nil {
+		// keeps the last loaded certificate during the rotation
+		return cc.cert, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if cc.cert != nil && !modTime.After(cc.modTime) {
+		return cc.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+	if err != nil {
+		if cc.cert != nil {
+			return cc.cert, nil
+		}
+		return nil, err
+	}
+
+	cc.cert = &cert
+	cc.modTime = modTime
+
+	return cc.cert, nil
+}
+
+func checkClientCert(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return errors.New("both of TLS client certificate and key are required")
+	}
+
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	return err
+}
+
+// getCertPool returns the certificate pool of the PEM
+// encoded certificate(s) in the given file
+func getCertPool(filename string) (*x509.CertPool, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(b); !ok {
+		return nil, fmt.Errorf("%s: no valid PEM certificate found", filename)
+	}
+
+	return pool, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (c *client) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		InsecureSkipVerify: c.req.insecure,
+		ServerName:         c.serverName(),
+		MinVersion:         c.req.tlsMinVersion,
+		MaxVersion:         c.req.tlsMaxVersion,
+	}
+
+	if c.req.rootCAs != nil {
+		config.RootCAs = c.req.rootCAs
+	}
+
+	if c.req.http2 {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
+	if c.clientCert != nil {
+		config.GetClientCertificate = c.clientCert.get
+	}
+
+	return config
+}
+
+// tlsHandshake performs the TLS handshake over the connection without
+// any request after, it's used by the TLS only and gRPC probes
+func (c *client) tlsHandshake(ctx context.Context, config *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(c.conn, config)
+	tlsConn.SetDeadline(c.tlsDeadline())
+	defer c.conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	end := c.span("tls")
+	t := time.Now()
+	err := tlsConn.Handshake()
+	c.stats.TLSHandshake = time.Since(t).Microseconds()
+	end(err)
+	if err != nil {
+		c.tlsError(err)
+	}
+
+	c.tlsCertStats(tlsConn.ConnectionState())
+	c.tlsVersionStats(tlsConn.ConnectionState())
+
+	return tlsConn, err
+}
+
+// tlsCertStats populates the server's certificate details, the
+// certificates are presented even if they are not verified (insecure)
+func (c *client) tlsCertStats(state tls.ConnectionState) {
+	c.stats.TLSCertChainLen = len(state.PeerCertificates)
+	if len(state.PeerCertificates) < 1 {
+		return
+	}
+
+	leaf := state.PeerCertificates[0]
+	c.stats.TLSCertExpiry = int64(time.Until(leaf.NotAfter).Seconds())
+	c.stats.TLSCertIssuer = leaf.Issuer.String()
+	c.stats.TLSCertSubject = leaf.Subject.String()
+}
+
+func (c *client) tlsVersionStats(state tls.ConnectionState) {
+	if !state.HandshakeComplete {
+		return
+	}
+
+	c.stats.TLSVersion = int(state.Version)
+	c.stats.TLSVersionName = tlsVersions[state.Version]
+	c.stats.TLSCipherSuite = int(state.CipherSuite)
+	c.stats.TLSCipherSuiteName = tls.CipherSuiteName(state.CipherSuite)
+
+	debugf("target: %s, tls: %s, cipher suite: %s, alpn: %q", c.target, c.stats.TLSVersionName,
+		c.stats.TLSCipherSuiteName, state.NegotiatedProtocol)
+}
+
+func getTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	for version, name := range tlsVersions {
+		if "TLS "+v == name {
+			return version, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid TLS version: %s, expected 1.0, 1.1, 1.2 or 1.3", v)
+}
+
+// isTLSVersionError returns true if the client and
+// server couldn't agree on a TLS version
+func isTLSVersionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return strings.Contains(err.Error(), "remote error: tls: protocol version not supported") ||
+		strings.Contains(err.Error(), "server selected unsupported protocol version")
+}
+
+// isTLSClientAuthError returns true if the server rejected
+// the client certificate through a TLS alert
+func isTLSClientAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, alert := range []string{"bad certificate", "certificate required", "unknown certificate authority"} {
+		if strings.Contains(err.Error(), "remote error: tls: "+alert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *client) tlsError(err error) {
+	switch {
+	case isTLSClientAuthError(err):
+		c.stats.TLSClientAuthError++
+	case isTLSVersionError(err):
+		c.stats.TLSVersionError++
+	default:
+		c.stats.TLSHandshakeError++
+	}
+
+	if isTimeout(err) {
+		c.stats.TLSTimeout++
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// topRefresh is the dashboard's refresh interval
+const topRefresh = time.Second
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// top represents the live dashboard of the targets, it renders
+// a row per target from the targets' probe status
+type top struct {
+	sync.Mutex
+	tp     *tp
+	cancel context.CancelFunc
+	sortBy byte
+	paused bool
+	done   chan struct{}
+}
+
+// topRow represents a target's row of the dashboard
+type topRow struct {
+	target  string
+	rtt     uint32
+	avgRtt  float64
+	loss    float64
+	retrans uint32
+	status  int
+	fails   int
+	rtts    []uint32
+}
+
+// topKeys are the sort keys of the columns
+var topKeys = map[byte]string{
+	't': "target",
+	'r': "rtt",
+	'a': "avg",
+	'l': "loss",
+	'f': "fails",
+	's': "status",
+}
+
+func newTop(tp *tp, cancel context.CancelFunc) *top {
+	return &top{tp: tp, cancel: cancel, sortBy: 't', done: make(chan struct{})}
+}
+
+// isTerminal returns true if the stdout is a terminal
+func isTerminal() bool {
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// run renders the dashboard until the context is canceled,
+// the keys are read once the stdin is a terminal
+func (t *top) run(ctx context.Context) {
+	defer close(t.done)
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			errorf("%v", err)
+		} else {
+			defer terminal.Restore(fd, state)
+			go t.keys()
+		}
+	}
+
+	// the alternate screen without the cursor
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	ticker := time.NewTicker(topRefresh)
+	defer ticker.Stop()
+
+	for {
+		if !t.isPaused() {
+			fmt.Print(t.render())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wait waits until the terminal is restored
+func (t *top) wait() {
+	<-t.done
+}
+
+// keys reads the sort keys, the p pauses and the q exits
+func (t *top) keys() {
+	b := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(b); err != nil {
+			return
+		}
+
+		t.Lock()
+		switch k := b[0]; {
+		case k == 'q' || k == 3:
+			t.cancel()
+		case k == 'p' || k == ' ':
+			t.paused = !t.paused
+		case topKeys[k] != "":
+			t.sortBy = k
+		}
+		t.Unlock()
+	}
+}
+
+func (t *top) isPaused() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.paused
+}
+
+// rows returns the targets' rows sorted by the sort key
+func (t *top) rows() []topRow {
+	var rows []topRow
+
+	t.tp.Lock()
+	for key, p := range t.tp.targets {
+		rows = append(rows, p.client.status.row(key))
+	}
+	t.tp.Unlock()
+
+	t.Lock()
+	sortBy := t.sortBy
+	t.Unlock()
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch sortBy {
+		case 'r':
+			return a.rtt > b.rtt
+		case 'a':
+			return a.avgRtt > b.avgRtt
+		case 'l':
+			return a.loss > b.loss
+		case 'f':
+			return a.fails > b.fails
+		case 's':
+			return a.status > b.status
+		}
+		return a.target < b.target
+	})
+
+	return rows
+}
+
+// render returns the dashboard's screen, the lines are ended
+// with the carriage return since the terminal is raw
+func (t *top) render() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("\033[H\033[2J")
+
+	t.Lock()
+	fmt.Fprintf(buf, "tcpprobe %s  sort: %s  [t]arget [r]tt [a]vg [l]oss [f]ails [s]tatus [p]ause [q]uit\r\n\r\n",
+		time.Now().Format("15:04:05"), topKeys[t.sortBy])
+	t.Unlock()
+
+	fmt.Fprintf(buf, "%-40s %10s %10s %7s %8s %6s %6s  %s\r\n",
+		"TARGET", "RTT(us)", "AVG(us)", "LOSS%", "RETRANS", "STATUS", "FAILS", "RTT HISTORY")
+
+	for _, r := range t.rows() {
+		status := "-"
+		if r.status > 0 {
+			status = fmt.Sprint(r.status)
+		}
+
+		fmt.Fprintf(buf, "%-40s %10d %10.0f %7.2f %8d %6s %6d  %s\r\n",
+			truncate(r.target, 40), r.rtt, r.avgRtt, r.loss, r.retrans, status, r.fails, sparkline(r.rtts))
+	}
+
+	return buf.String()
+}
+
+// row returns the target's dashboard row
+func (s *probeStatus) row(target string) topRow {
+	s.Lock()
+	defer s.Unlock()
+
+	r := topRow{
+		target:  target,
+		rtt:     s.rtt,
+		retrans: s.retrans,
+		status:  s.status,
+		fails:   s.fails,
+		rtts:    append([]uint32(nil), s.rtts...),
+	}
+
+	if s.rttN > 0 {
+		r.avgRtt = s.rttSum / float64(s.rttN)
+	}
+
+	if s.sent > 0 {
+		r.loss = float64(s.failed) / float64(s.sent) * 100
+	}
+
+	return r
+}
+
+// sparkline returns the values' sparkline which is
+// scaled between the minimum and the maximum
+func sparkline(values []uint32) string {
+	if len(values) < 1 {
+		return ""
+	}
+
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > min {
+			i = int(uint64(v-min) * uint64(len(sparks)-1) / uint64(max-min))
+		}
+		b.WriteRune(sparks[i])
+	}
+
+	return b.String()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n-1] + "…"
+}
@@ -0,0 +1,325 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	r := &request{
+		timeout:             time.Second,
+		soKeepAlive:         true,
+		soKeepAliveIdle:     30 * time.Second,
+		soKeepAliveInterval: 5 * time.Second,
+		soKeepAliveCount:    3,
+		soUserTimeout:       10 * time.Second,
+	}
+
+	c := newClient(r, ln.Addr().String())
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	defer c.close()
+
+	getOpt := func(level, opt int) int {
+		var v int
+		rawConn, _ := c.conn.(*net.TCPConn).SyscallConn()
+		rawConn.Control(func(fd uintptr) {
+			v, _ = syscall.GetsockoptInt(int(fd), level, opt)
+		})
+		return v
+	}
+
+	assert.Equal(t, 1, getOpt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 30, getOpt(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+	assert.Equal(t, 5, getOpt(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+	assert.Equal(t, 3, getOpt(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+	assert.Equal(t, 10000, getOpt(syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT))
+
+	assert.Error(t, checkKeepAlive(time.Millisecond, 0, 0, 0))
+	assert.Error(t, checkKeepAlive(0, -time.Second, 0, 0))
+	assert.Error(t, checkKeepAlive(0, 0, -1, 0))
+	assert.NoError(t, checkKeepAlive(0, 0, 0, 0))
+
+	// per target config
+	cfgFile, err := ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.NoError(t, err)
+	cfgFile.Write([]byte(`
+targets:
+  - addr: localhost:80
+    keepalive: true
+    keepalive_idle: 10s
+    keepalive_count: 2
+    user_timeout: 3s`))
+	cfg, err := getConfig(cfgFile.Name())
+	assert.NoError(t, err)
+
+	req := cfg.Targets[0].request(r)
+	assert.True(t, req.soKeepAlive)
+	assert.Equal(t, 10*time.Second, req.soKeepAliveIdle)
+	assert.Equal(t, 5*time.Second, req.soKeepAliveInterval)
+	assert.Equal(t, 2, req.soKeepAliveCount)
+	assert.Equal(t, 3*time.Second, req.soUserTimeout)
+
+	cfgFile, err = ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.NoError(t, err)
+	cfgFile.Write([]byte("targets:\n  - addr: localhost:80\n    keepalive_idle: 10"))
+	_, err = getConfig(cfgFile.Name())
+	assert.Error(t, err)
+}
+
+func TestCongestion(t *testing.T) {
+	ctx := context.Background()
+
+	err := checkCongestion("notfound")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not available")
+	assert.NoError(t, checkCongestion(""))
+
+	if err := checkCongestion("bbr"); err != nil {
+		t.Skip(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	c := newClient(&request{timeout: time.Second, soCongestion: "bbr"}, ln.Addr().String())
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.getTCPInfo()
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, "bbr", c.stats.TCPCongesAlg)
+	assert.Greater(t, c.stats.BBRPacingGain, uint32(0))
+	assert.Greater(t, c.stats.BBRCwndGain, uint32(0))
+}
+
+func TestTCPInfo(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	c := newClient(&request{timeout: time.Second}, ln.Addr().String())
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	defer c.close()
+
+	c.conn.Write(bytes.Repeat([]byte("x"), 64*1024))
+	time.Sleep(100 * time.Millisecond)
+
+	// stale value is not kept
+	c.stats.TotalRtoTime = 100
+	err = c.getTCPInfo()
+	assert.NoError(t, err)
+
+	assert.Equal(t, uintptr(248), tcpInfoSize)
+	assert.Equal(t, uint32(0), c.stats.TotalRtoTime)
+	assert.Greater(t, c.stats.MinRtt, uint32(0))
+	assert.Greater(t, c.stats.DeliveryRate, uint64(0))
+	assert.Greater(t, c.stats.BytesSent, uint64(0))
+	assert.Greater(t, c.stats.RcvWnd, uint32(0))
+
+	// the closed connection isn't reported as zero tcp_info
+	c.conn.Close()
+	err = c.getTCPInfo()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "use of closed network connection")
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel, stop := onShutdown()
+	defer cancel()
+
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the context has not been canceled")
+	}
+
+	stop()
+}
+
+func TestNDJSONDiskFull(t *testing.T) {
+	n, err := newNDJSON(&request{outputFile: "/dev/full", outputMaxSize: 4096})
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.run(ctx)
+
+	n.write([]byte(`{"Target":"127.0.0.1:80"}`))
+	cancel()
+	n.wait()
+
+	assert.Equal(t, int64(1), n.getErrors())
+
+	// the writer keeps working after the error
+	n.write([]byte(`{"Target":"127.0.0.1:80"}`))
+	assert.Equal(t, int64(1), n.getErrors())
+}
+
+func TestHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcpprobe")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := dir + "/hook.sh"
+	out := dir + "/out"
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$TP_TARGET $TP_STATE $TP_FAILS $TP_ERROR $TP_LABELS_JSON\" >> "+out+"\n"), 0755)
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	req := &request{
+		failureThreshold:   2,
+		onFailureCmd:       script,
+		onRecoveryCmd:      script,
+		hookTimeout:        time.Second,
+		hookMaxConcurrency: 1,
+	}
+	h := newHook(req)
+
+	c := newClient(req, "127.0.0.1:80")
+	c.hook = h
+	c.labels = map[string]string{"env": "prod"}
+
+	c.record(errors.New("connection refused"))
+	c.record(errors.New("connection refused"))
+	h.wait()
+	c.record(nil)
+	h.wait()
+
+	b, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:80 failing 2 connection refused {\"env\":\"prod\"}\n"+
+		"127.0.0.1:80 recovered 2  {\"env\":\"prod\"}\n", string(b))
+	assert.Contains(t, buf.String(), "exited 0")
+
+	// the running commands are capped and killed after the timeout
+	h.timeout = 100 * time.Millisecond
+	start := time.Now()
+	h.exec("sleep 5", alertEvent{Target: "a:80", State: alertFailing})
+	h.exec("sleep 5", alertEvent{Target: "b:80", State: alertFailing})
+	h.wait()
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.Contains(t, buf.String(), "a:80 failing: sleep timed out")
+	assert.Contains(t, buf.String(), "command dropped: b:80 failing")
+
+	h.exec("false", alertEvent{Target: "c:80", State: alertRecovered})
+	h.wait()
+	assert.Contains(t, buf.String(), "c:80 recovered: false: exit status 1")
+}
+
+func TestPersistent(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	req := &request{timeout: time.Second, quiet: true, maxLoss: -1, persistent: true, delta: true}
+	c := newClient(req, ln.Addr().String())
+	defer c.closePersistent()
+
+	// the probes are over the same connection
+	c.probeOnce(ctx, 0)
+	conn := c.conn
+	segsOut := c.stats.SegsOut
+	c.probeOnce(ctx, 1)
+	assert.Equal(t, conn, c.conn)
+	assert.Less(t, c.stats.SegsOut, segsOut+1)
+
+	// reconnected once the peer closed the connection, the
+	// delta's baseline restarts with the new connection
+	(<-conns).Close()
+	time.Sleep(10 * time.Millisecond)
+	c.probeOnce(ctx, 2)
+	assert.NotEqual(t, conn, c.conn)
+	assert.Equal(t, int64(1), c.stats.Reconnects)
+	assert.Equal(t, c.conn, c.totalsConn)
+	assert.Equal(t, c.totals["SegsOut"], uint64(c.stats.SegsOut))
+	select {
+	case <-conns:
+	case <-time.After(time.Second):
+		t.Error("expected the reconnect")
+	}
+	assert.Len(t, conns, 0)
+
+	// http over the same connection
+	var newConns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c = newClient(&request{timeout: time.Second, timeoutHTTP: time.Second, quiet: true, maxLoss: -1, persistent: true}, ts.URL)
+	for i := 0; i < 3; i++ {
+		c.probeOnce(ctx, i)
+		assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&newConns))
+	assert.Equal(t, int64(0), c.stats.Reconnects)
+
+	// the server closed the idle connection
+	ts.CloseClientConnections()
+	time.Sleep(10 * time.Millisecond)
+	c.probeOnce(ctx, 3)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&newConns))
+	assert.Equal(t, int64(1), c.stats.Reconnects)
+	c.closePersistent()
+
+	_, _, err = getCli([]string{"tcpprobe", "-persistent", "-http2", "127.0.0.1"})
+	assert.Error(t, err)
+}
@@ -1,25 +1,58 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/snappy"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	kafkago "github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -42,7 +75,7 @@ func TestClient(t *testing.T) {
 
 	err := c.connect(ctx)
 	assert.NoError(t, err)
-	err = c.httpGet()
+	err = c.httpGet(context.Background())
 	assert.NoError(t, err)
 	err = c.getTCPInfo()
 	assert.NoError(t, err)
@@ -61,6 +94,8 @@ func TestClient(t *testing.T) {
 	assert.Less(t, uint32(0), c.stats.Rto)
 	assert.Less(t, uint32(0), c.stats.Ato)
 	assert.Less(t, int64(0), c.stats.TLSHandshake)
+	assert.Less(t, int64(0), c.stats.HTTPTTFB)
+	assert.LessOrEqual(t, int64(0), c.stats.HTTPTransfer)
 
 	c.close()
 
@@ -72,7 +107,7 @@ func TestClient(t *testing.T) {
 	c = newClient(&r, ts.URL)
 	err = c.connect(ctx)
 	assert.NoError(t, err)
-	err = c.httpGet()
+	err = c.httpGet(context.Background())
 	assert.NoError(t, err)
 	err = c.getTCPInfo()
 	assert.NoError(t, err)
@@ -114,350 +149,5730 @@ func TestClient(t *testing.T) {
 	assert.False(t, c.isIPv4())
 }
 
+func TestProxy(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, TCPProbe")
+	}))
+	defer ts.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dHA6c2VjcmV0" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		conn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		hj, buf, _ := w.(http.Hijacker).Hijack()
+		buf.Flush()
+		go io.Copy(conn, hj)
+		io.Copy(hj, conn)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := getProxyURL(strings.Replace(proxy.URL, "http://", "http://tp:secret@", 1))
+	assert.NoError(t, err)
+
+	r := request{timeout: time.Second * 2, insecure: true, proxyURL: proxyURL}
+	c := newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	assert.Less(t, int64(0), c.stats.ProxyConnect)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	err = c.getTCPInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, proxy.Listener.Addr().String(), c.addr)
+	c.close()
+
+	// proxy authentication required
+	proxyURL, _ = getProxyURL(proxy.URL)
+	r.proxyURL = proxyURL
+	c = newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), c.stats.ProxyConnectError)
+
+	_, err = getProxyURL("ftp://127.0.0.1:21")
+	assert.Error(t, err)
+	u, err := getProxyURL("http://proxy")
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy:80", u.Host)
+}
+
+func TestSocks5(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, TCPProbe")
+	}))
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	requested := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				b := make([]byte, 512)
+				n, _ := conn.Read(b)
+				if bytes.IndexByte(b[2:n], 0x02) >= 0 {
+					conn.Write([]byte{0x05, 0x02})
+					n, _ = conn.Read(b)
+					ok := string(b[2:4]) == "tp" && string(b[5:n]) == "secret"
+					conn.Write([]byte{0x01, byte(boolToInt(!ok))})
+				} else {
+					conn.Write([]byte{0x05, 0x00})
+				}
+
+				n, _ = conn.Read(b)
+				var host string
+				switch b[3] {
+				case 0x01:
+					host = net.IP(b[4:8]).String()
+				case 0x03:
+					host = string(b[5 : 5+b[4]])
+				}
+				port := int(b[n-2])<<8 | int(b[n-1])
+				requested <- host
+
+				target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+
+	// remote dns with authentication
+	proxyURL, err := getSocks5URL(l.Addr().String(), "tp", "secret", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "socks5h", proxyURL.Scheme)
+
+	target := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	r := request{timeout: time.Second * 2, proxyURL: proxyURL}
+	c := newClient(&r, target)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost", <-requested)
+	assert.Less(t, int64(0), c.stats.ProxyConnect)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	err = c.getTCPInfo()
+	assert.NoError(t, err)
+	c.close()
+
+	// local dns
+	r.proxyURL, _ = getSocks5URL(l.Addr().String(), "", "", false)
+	c = newClient(&r, target)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", <-requested)
+	c.close()
+
+	// connection refused by proxy
+	r.proxyURL, _ = getSocks5URL(l.Addr().String(), "", "", false)
+	c = newClient(&r, "127.0.0.1:1")
+	err = c.connect(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), c.stats.ProxyConnectError)
+
+	// the http proxy can't be combined with socks5
+	_, _, err = getCli([]string{"tcpprobe", "-proxy", "http://127.0.0.1:3128", "-socks5", l.Addr().String(), "127.0.0.1"})
+	assert.EqualError(t, err, "the proxy and socks5 options are mutually exclusive")
+}
+
+func TestClientCert(t *testing.T) {
+	ctx := context.Background()
+	certFile, keyFile := genCert(t, "client", time.Hour)
+	certPEM, _ := ioutil.ReadFile(certFile)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, TCPProbe")
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	ts.StartTLS()
+	defer ts.Close()
+
+	r := request{timeout: time.Second * 2, insecure: true, tlsCert: certFile, tlsKey: keyFile}
+	c := newClient(&r, ts.URL)
+	assert.NotNil(t, c.clientCert)
+	err := c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	c.close()
+
+	// rejected client certificate
+	r = request{timeout: time.Second * 2, insecure: true}
+	c = newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), c.stats.TLSClientAuthError)
+	assert.Equal(t, int64(0), c.stats.TLSHandshakeError)
+	c.close()
+
+	// reload
+	cc, err := newClientCert(certFile, keyFile)
+	assert.NoError(t, err)
+	cert, _ := cc.get(nil)
+	newCertFile, newKeyFile := genCert(t, "rotated", time.Hour)
+	b, _ := ioutil.ReadFile(newCertFile)
+	ioutil.WriteFile(certFile, b, 0600)
+	b, _ = ioutil.ReadFile(newKeyFile)
+	ioutil.WriteFile(keyFile, b, 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	newCert, _ := cc.get(nil)
+	assert.NotEqual(t, cert.Certificate[0], newCert.Certificate[0])
+
+	assert.Error(t, checkClientCert(certFile, ""))
+	assert.Error(t, checkClientCert("notfound", "notfound"))
+	assert.NoError(t, checkClientCert("", ""))
+
+	// per target config
+	tg := target{Addr: "127.0.0.1", TLSCert: certFile, TLSKey: keyFile}
+	assert.Equal(t, certFile, tg.request(&r).tlsCert)
+	assert.Equal(t, "", r.tlsCert)
+}
+
+func TestCAFile(t *testing.T) {
+	ctx := context.Background()
+	certFile, keyFile := genCert(t, "127.0.0.1", time.Hour)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, TCPProbe")
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// bundle with multiple certificates
+	otherCertFile, _ := genCert(t, "other", time.Hour)
+	b1, _ := ioutil.ReadFile(otherCertFile)
+	b2, _ := ioutil.ReadFile(certFile)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(caFile, append(b1, b2...), 0600)
+
+	pool, err := getCertPool(caFile)
+	assert.NoError(t, err)
+
+	r := request{timeout: time.Second * 2, rootCAs: pool}
+	c := newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	c.close()
+
+	// unknown authority
+	r = request{timeout: time.Second * 2}
+	c = newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), c.stats.TLSHandshakeError)
+	c.close()
+
+	_, err = getCertPool("notfound")
+	assert.Error(t, err)
+	_, err = getCertPool(keyFile)
+	assert.Error(t, err)
+
+	// per target config
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: "+ts.URL+"\n    ca_file: "+caFile), 0600)
+	cfg, err := getConfig(cfgFile)
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg.Targets[0].request(&r).rootCAs)
+
+	ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: "+ts.URL+"\n    ca_file: notfound"), 0600)
+	_, err = getConfig(cfgFile)
+	assert.Error(t, err)
+}
+
+func TestTLSCertStats(t *testing.T) {
+	ctx := context.Background()
+	certFile, keyFile := genCert(t, "127.0.0.1", 48*time.Hour)
+	cert, _ := tls.LoadX509KeyPair(certFile, keyFile)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// unverified certificate
+	r := request{timeout: time.Second * 2, insecure: true}
+	c := newClient(&r, ts.URL)
+	err := c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, 1, c.stats.TLSCertChainLen)
+	assert.InDelta(t, 48*3600, c.stats.TLSCertExpiry, 60)
+	assert.Equal(t, "CN=127.0.0.1", c.stats.TLSCertSubject)
+	assert.Equal(t, "CN=127.0.0.1", c.stats.TLSCertIssuer)
+}
+
+func TestTLSVersion(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	r := request{timeout: time.Second * 2, insecure: true}
+	c := newClient(&r, ts.URL)
+	err := c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, tls.VersionTLS12, c.stats.TLSVersion)
+	assert.Equal(t, "TLS 1.2", c.stats.TLSVersionName)
+	assert.NotEqual(t, 0, c.stats.TLSCipherSuite)
+	assert.Equal(t, tls.CipherSuiteName(uint16(c.stats.TLSCipherSuite)), c.stats.TLSCipherSuiteName)
+
+	// minimum version
+	r.tlsMinVersion, err = getTLSVersion("1.3")
+	assert.NoError(t, err)
+	c = newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.Error(t, err)
+	c.close()
+
+	assert.Equal(t, int64(1), c.stats.TLSVersionError)
+	assert.Equal(t, int64(0), c.stats.TLSHandshakeError)
+
+	_, err = getTLSVersion("1.4")
+	assert.Error(t, err)
+}
+
+func TestHTTPRequest(t *testing.T) {
+	ctx := context.Background()
+	sni := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s %d", r.Method, r.Host, r.Header.Get("Authorization"), b, r.ContentLength)
+	}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- hello.ServerName
+		return nil, nil
+	}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	headers, err := getHTTPHeaders([]string{"Authorization: Bearer token", "Host: other.com"})
+	assert.NoError(t, err)
+
+	body := `{"check":true}`
+	r := request{
+		timeout:     time.Second * 2,
+		insecure:    true,
+		serverName:  "example.com",
+		httpMethod:  http.MethodPost,
+		httpHeaders: headers,
+		httpBody:    []byte(body),
+	}
+
+	c := newClient(&r, ts.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	c.close()
+
+	expected := fmt.Sprintf("POST other.com Bearer token %s %d", body, len(body))
+	assert.Equal(t, "example.com", <-sni)
+	assert.Equal(t, int64(len(expected)), c.stats.HTTPRcvdBytes)
+	assert.Less(t, int64(len(body)), c.stats.HTTPSentBytes)
+
+	_, err = getHTTPHeaders([]string{"invalid"})
+	assert.Error(t, err)
+
+	b, err := getHTTPBody("inline", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("inline"), b)
+	_, err = getHTTPBody("", "notfound")
+	assert.Error(t, err)
+
+	// per target config
+	tg := target{HTTPMethod: "put", httpBody: []byte("x")}
+	assert.Equal(t, "PUT", tg.request(&r).httpMethod)
+	assert.Equal(t, []byte("x"), tg.request(&r).httpBody)
+	assert.Equal(t, headers, tg.request(&r).httpHeaders)
+}
+
+func TestHTTPExpectation(t *testing.T) {
+	ctx := context.Background()
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, "status: healthy"+strings.Repeat(".", 100))
+	}))
+	defer ts.Close()
+
+	r := request{
+		timeout:         time.Second * 2,
+		expectStatus:    []int{200, 204},
+		expectBodyRegex: "ok|healthy",
+		expectBodyLimit: 1024,
+	}
+
+	c := newClient(&r, ts.URL)
+	assert.NotNil(t, c.bodyRegex)
+
+	probe := func() {
+		err := c.connect(ctx)
+		assert.NoError(t, err)
+		err = c.httpGet(context.Background())
+		assert.NoError(t, err)
+		c.close()
+	}
+
+	probe()
+	assert.Equal(t, int64(0), c.stats.HTTPExpectationFailed)
+	assert.Equal(t, 0, c.stats.HTTPExpectationMismatch)
+	assert.Equal(t, int64(115), c.stats.HTTPRcvdBytes)
+
+	status = http.StatusInternalServerError
+	probe()
+	assert.Equal(t, int64(1), c.stats.HTTPExpectationFailed)
+	assert.Equal(t, 1, c.stats.HTTPExpectationMismatch)
+
+	// the body match is limited to the first bytes
+	status = http.StatusOK
+	r.expectBodyLimit = 8
+	probe()
+	assert.Equal(t, int64(2), c.stats.HTTPExpectationFailed)
+	assert.Equal(t, 1, c.stats.HTTPExpectationMismatch)
+	assert.Equal(t, int64(115), c.stats.HTTPRcvdBytes)
+
+	r.expectBodyLimit = 1024
+	probe()
+	assert.Equal(t, int64(2), c.stats.HTTPExpectationFailed)
+	assert.Equal(t, 0, c.stats.HTTPExpectationMismatch)
+
+	// per target config
+	tg := target{ExpectStatus: []int{500}, ExpectBodyRegex: "down"}
+	assert.Equal(t, []int{500}, tg.request(&r).expectStatus)
+	assert.Equal(t, "down", tg.request(&r).expectBodyRegex)
+	assert.Equal(t, "ok|healthy", target{}.request(&r).expectBodyRegex)
+}
+
+func TestFollowRedirects(t *testing.T) {
+	ctx := context.Background()
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer final.Close()
+
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/local":
+			http.Redirect(w, r, "/remote", http.StatusFound)
+		default:
+			http.Redirect(w, r, final.URL, http.StatusMovedPermanently)
+		}
+	}))
+	defer first.Close()
+
+	r := request{timeout: time.Second * 2, followRedirects: true, maxRedirects: 3}
+
+	c := newClient(&r, first.URL+"/local")
+	err := c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusAccepted, c.stats.HTTPStatusCode)
+	assert.Equal(t, 2, c.stats.HTTPRedirects)
+	assert.Greater(t, c.stats.HTTPRedirectTime, int64(0))
+	assert.Len(t, c.hopConns, 0)
+
+	// TCP_INFO reflects the first hop's socket not the final host
+	assert.Equal(t, first.Listener.Addr().String(), c.conn.RemoteAddr().String())
+	err = c.getTCPInfo()
+	assert.NoError(t, err)
+	c.close()
+
+	c = newClient(&r, first.URL+"/loop")
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 3, c.stats.HTTPRedirects)
+	c.close()
+
+	// redirects are not followed by default
+	c = newClient(&request{timeout: time.Second * 2}, first.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 0, c.stats.HTTPRedirects)
+	c.close()
+}
+
+func TestHTTP2(t *testing.T) {
+	ctx := context.Background()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	r := request{timeout: time.Second * 2, insecure: true, http2: true}
+
+	c := newClient(&r, h2.URL)
+	err := c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	err = c.getTCPInfo()
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, "h2", c.stats.HTTPProto)
+	assert.Equal(t, 1, c.stats.HTTP2)
+	assert.Equal(t, int64(len("HTTP/2.0")), c.stats.HTTPRcvdBytes)
+	assert.Less(t, int64(0), c.stats.HTTPSentBytes)
+
+	// fallback to HTTP/1.1
+	c = newClient(&r, h1.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, "http/1.1", c.stats.HTTPProto)
+	assert.Equal(t, 0, c.stats.HTTP2)
+	assert.Equal(t, int64(len("HTTP/1.1")), c.stats.HTTPRcvdBytes)
+
+	// h2 is not advertised by default
+	c = newClient(&request{timeout: time.Second * 2, insecure: true}, h2.URL)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	err = c.httpGet(context.Background())
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, "http/1.1", c.stats.HTTPProto)
+}
+
+func TestHTTP3(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	defer ts.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Hello, TCPProbe")
+		}),
+		TLSConfig:  http3.ConfigureTLSConfig(ts.TLS.Clone()),
+		QuicConfig: &quic.Config{Allow0RTT: true},
+	}
+	go srv.Serve(pc)
+	defer srv.Close()
+
+	r := &request{timeout: 2 * time.Second, insecure: true, http3: true}
+	c := newClient(r, "https://"+pc.LocalAddr().String()+"/")
+	assert.NotNil(t, c.standalone())
+
+	err = c.http3Probe(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	assert.Equal(t, "h3", c.stats.HTTPProto)
+	assert.Equal(t, int64(16), c.stats.HTTP3RcvdBytes)
+	assert.Less(t, int64(0), c.stats.QUICHandshake)
+	assert.Less(t, int64(0), c.stats.HTTP3Request)
+	assert.Equal(t, 0, c.stats.QUIC0RTT)
+	assert.Equal(t, uint32(0), c.stats.Rtt)
+
+	// the next probe is resumed by 0-RTT
+	err = c.http3Probe(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c.stats.QUIC0RTT)
+
+	// no answer on UDP
+	pc, _ = net.ListenPacket("udp", "127.0.0.1:0")
+	pc.Close()
+	r = &request{timeout: 200 * time.Millisecond, insecure: true, http3: true, quiet: true}
+	c = newClient(r, "https://"+pc.LocalAddr().String()+"/")
+	c.probeOnce(ctx, 0)
+	assert.Equal(t, int64(1), c.stats.QUICConnectError)
+	assert.True(t, c.output.failed)
+
+	_, _, err = getCli([]string{"tcpprobe", "-http3", "-http2", "https://127.0.0.1"})
+	assert.Error(t, err)
+}
+
+func TestResolver(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	resolver := dnsServer(t, func(string) []net.IP { return []net.IP{net.ParseIP("127.0.0.1")} })
+
+	r := request{timeout: time.Second * 2, resolver: resolver, resolverStrict: true}
+	c := newClient(&r, "tcpprobe.test:"+port)
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	c.close()
+
+	assert.Equal(t, "127.0.0.1", c.stats.ResolvedIP)
+	assert.Equal(t, int64(0), c.stats.DNSResolveError)
+
+	// resolver not available
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	r.resolver = pc.LocalAddr().String()
+	pc.Close()
+
+	c = newClient(&r, "tcpprobe.test:"+port)
+	err = c.connect(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), c.stats.DNSResolveError)
+
+	// ip address target
+	c = newClient(&r, ln.Addr().String())
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	c.close()
+	assert.Equal(t, "127.0.0.1", c.stats.ResolvedIP)
+
+	// the canceled probe cancels its lookup
+	pc, _ = net.ListenPacket("udp", "127.0.0.1:0")
+	defer pc.Close()
+	r = request{timeout: time.Second * 5, resolver: pc.LocalAddr().String()}
+	c = newClient(&r, "tcpprobe.test:"+port)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	t0 := time.Now()
+	err = c.connect(cctx)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(t0).Seconds(), 2.0)
+
+	addr, err := getResolverAddr("10.0.0.53")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.53:53", addr)
+	addr, err = getResolverAddr("[::1]:5353")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:5353", addr)
+	_, err = getResolverAddr("dns.local:53")
+	assert.Error(t, err)
+}
+
+func TestResolveEvery(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var (
+		mu sync.Mutex
+		ip net.IP
+	)
+	setIP := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ip = net.ParseIP(s)
+	}
+	resolver := dnsServer(t, func(string) []net.IP {
+		mu.Lock()
+		defer mu.Unlock()
+		if ip == nil {
+			return nil
+		}
+		return []net.IP{ip}
+	})
+
+	r := request{timeout: time.Second * 2, resolver: resolver, resolverStrict: true, resolveEvery: 2}
+	c := newClient(&r, "tcpprobe.test:"+port)
+	probe := func(expected string) {
+		err := c.connect(ctx)
+		assert.NoError(t, err)
+		c.close()
+		assert.Equal(t, expected, c.stats.ResolvedIP)
+	}
+
+	setIP("127.0.0.1")
+	probe("127.0.0.1")
+
+	// not resolved at the second probe
+	setIP("127.0.0.2")
+	probe("127.0.0.1")
+	assert.Equal(t, int64(0), c.stats.IPChanged)
+
+	probe("127.0.0.2")
+	assert.Equal(t, int64(1), c.stats.IPChanged)
+
+	// the previous address is kept if the resolve failed
+	r.resolveEvery = 1
+	setIP("")
+	probe("127.0.0.2")
+	assert.Equal(t, int64(1), c.stats.DNSResolveError)
+	assert.Equal(t, int64(1), c.stats.IPChanged)
+}
+
+func TestDNSCache(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var queries int32
+	resolver := dnsServer(t, func(string) []net.IP {
+		atomic.AddInt32(&queries, 1)
+		return []net.IP{net.ParseIP("127.0.0.1")}
+	})
+
+	hits := testutil.ToFloat64(selfMetrics.dnsCache.WithLabelValues("hit"))
+	r := request{timeout: time.Second * 2, resolver: resolver, resolverStrict: true, dnsCacheMax: 10, dnsMaxTTL: time.Minute}
+	c := newClient(&r, "tcpprobe.test:"+port)
+	probe := func() {
+		err := c.connect(ctx)
+		assert.NoError(t, err)
+		c.close()
+		assert.Equal(t, "127.0.0.1", c.stats.ResolvedIP)
+	}
+
+	// the A and AAAA queries at the first probe
+	probe()
+	assert.Equal(t, 0, c.stats.DNSCacheHit)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	probe()
+	assert.Equal(t, 1, c.stats.DNSCacheHit)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+	assert.Equal(t, hits+1, testutil.ToFloat64(selfMetrics.dnsCache.WithLabelValues("hit")))
+
+	// bypass the cache
+	r.dnsNoCache = true
+	probe()
+	assert.Equal(t, 0, c.stats.DNSCacheHit)
+	assert.Greater(t, atomic.LoadInt32(&queries), int32(2))
+
+	// the TTL is clamped by the max TTL
+	r.dnsNoCache = false
+	r.resolver = dnsServer(t, func(string) []net.IP { return []net.IP{net.ParseIP("127.0.0.1")} })
+	r.dnsMaxTTL = 100 * time.Millisecond
+	probe()
+	time.Sleep(150 * time.Millisecond)
+	probe()
+	assert.Equal(t, 0, c.stats.DNSCacheHit)
+
+	// the system resolver's fallback is cached by the min TTL
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	r = request{timeout: time.Second, resolver: pc.LocalAddr().String(), dnsCacheMax: 10, dnsMinTTL: time.Minute}
+	pc.Close()
+	c = newClient(&r, "localhost:"+port)
+	_, err = c.lookupHost(ctx, "localhost")
+	assert.NoError(t, err)
+	_, ok := resolverCache.get(r.resolver + "/localhost")
+	assert.True(t, ok)
+
+	// the soonest to expire is evicted once the cache is full
+	cache := newDNSCache()
+	cache.set("a", []string{"10.0.0.1"}, time.Second, 2)
+	cache.set("b", []string{"10.0.0.2"}, time.Minute, 2)
+	cache.set("c", []string{"10.0.0.3"}, time.Minute, 2)
+	_, ok = cache.get("a")
+	assert.False(t, ok)
+	addrs, ok := cache.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"10.0.0.3"}, addrs)
+
+	assert.Equal(t, 30*time.Second, clampTTL(0, 30*time.Second, time.Minute))
+	assert.Equal(t, time.Minute, clampTTL(time.Hour, 0, time.Minute))
+	assert.Equal(t, time.Hour, clampTTL(time.Hour, 0, 0))
+
+	assert.NoError(t, checkDNSCache(10000, 0, 5*time.Minute))
+	assert.Error(t, checkDNSCache(-1, 0, 0))
+	assert.Error(t, checkDNSCache(10, time.Minute, time.Second))
+}
+
+func TestFanout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the ip label must not leak into the other tests' metrics
+	registerer := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	defer func() { prometheus.DefaultRegisterer = registerer }()
+	ln, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var (
+		mu  sync.Mutex
+		ips = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}
+	)
+	resolver := dnsServer(t, func(string) []net.IP {
+		mu.Lock()
+		defer mu.Unlock()
+		return ips
+	})
+
+	r := &request{
+		timeout:        time.Second,
+		interval:       50 * time.Millisecond,
+		quiet:          true,
+		resolver:       resolver,
+		resolverStrict: true,
+		allIPs:         true,
+		allIPsRefresh:  100 * time.Millisecond,
+	}
+
+	target := "tcpprobe.test:" + port
+	tp := &tp{targets: make(map[string]prop)}
+	done := make(chan struct{})
+	go func() {
+		tp.run(ctx, target, r)
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, tp.isExist(target+"@127.0.0.1"))
+	assert.True(t, tp.isExist(target+"@127.0.0.2"))
+
+	mu.Lock()
+	ips = ips[1:]
+	mu.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, tp.isExist(target+"@127.0.0.1"))
+	assert.True(t, tp.isExist(target+"@127.0.0.2"))
+
+	tp.Lock()
+	c := tp.targets[target+"@127.0.0.2"].client
+	tp.Unlock()
+	assert.Equal(t, "127.0.0.2", c.ip)
+
+	cancel()
+	<-done
+	assert.Len(t, tp.targets, 0)
+}
+
+func TestFamily(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	resolver := dnsServer(t, func(string) []net.IP { return []net.IP{net.ParseIP("127.0.0.1")} })
+
+	r := request{timeout: time.Second, resolver: resolver, resolverStrict: true, ipv4: true}
+	c := newClient(&r, "tcpprobe.test:"+port)
+	assert.Equal(t, "tcp4", c.network())
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	c.close()
+
+	// no ipv6 address
+	r = request{timeout: time.Second, resolver: resolver, resolverStrict: true, ipv6: true}
+	c = newClient(&r, "tcpprobe.test:"+port)
+	assert.Equal(t, "tcp6", c.network())
+	err = c.connect(ctx)
+	assert.EqualError(t, err, "tcpprobe.test: ipv6 address not available")
+	assert.Equal(t, int64(1), c.stats.DNSResolveError)
+
+	// ipv4 address with ipv6 family
+	c = newClient(&r, ln.Addr().String())
+	err = c.connect(ctx)
+	assert.Error(t, err)
+
+	// per target config
+	tg := target{Family: "ipv6"}
+	req := tg.request(&request{ipv4: true})
+	assert.True(t, req.ipv6)
+	assert.False(t, req.ipv4)
+	assert.Equal(t, "ipv6", req.family())
+
+	ctx = withFamily(ctx, req)
+	assert.Equal(t, "ipv6", getLabels(ctx, "localhost")["family"])
+	assert.Equal(t, "localhost/ipv6", getTargetKey(ctx, "localhost"))
+	assert.Equal(t, "localhost", getTargetKey(withFamily(context.Background(), &request{}), "localhost"))
+}
+
+func TestInterface(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	assert.NoError(t, checkInterface("lo"))
+	assert.NoError(t, checkInterface(""))
+	assert.Error(t, checkInterface("notfound0"))
+
+	addr, err := getInterfaceAddr("lo", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:0", addr.String())
+	_, err = getInterfaceAddr("notfound0", false)
+	assert.Error(t, err)
+
+	c := newClient(&request{timeout: time.Second, iface: "lo"}, ln.Addr().String())
+	if !c.bindDevice {
+		assert.NotNil(t, c.ifaceAddr)
+	}
+	err = c.connect(ctx)
+	assert.NoError(t, err)
+	c.close()
+
+	// the source address has priority over the interface's address
+	c = &client{req: &request{srcAddr: "127.0.0.2"}, ifaceAddr: addr}
+	assert.Equal(t, "127.0.0.2:0", c.localAddr().String())
+	c.req.srcAddr = ""
+	assert.Equal(t, addr, c.localAddr())
+}
+
+func TestIPOptions(t *testing.T) {
+	ctx := context.Background()
+
+	tos, err := getDSCP("ef")
+	assert.NoError(t, err)
+	assert.Equal(t, 0xb8, tos)
+	tos, err = getDSCP("AF41")
+	assert.NoError(t, err)
+	assert.Equal(t, 136, tos)
+	tos, err = getDSCP("46")
+	assert.NoError(t, err)
+	assert.Equal(t, 0xb8, tos)
+	_, err = getDSCP("64")
+	assert.Error(t, err)
+	_, err = getDSCP("gold")
+	assert.Error(t, err)
+
+	assert.NoError(t, checkIPOptions(0xb8, 64))
+	assert.Error(t, checkIPOptions(256, 64))
+	assert.Error(t, checkIPOptions(0, -1))
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, network := range []string{"tcp4", "tcp6"} {
+		ln, err := net.Listen(network, "localhost:0")
+		if err != nil {
+			continue
+		}
+
+		buf.Reset()
+		c := newClient(&request{timeout: time.Second, soIPTOS: 0xb8, soIPTTL: 10, verbose: true}, ln.Addr().String())
+		err = c.connect(ctx)
+		assert.NoError(t, err)
+		c.close()
+		ln.Close()
+
+		assert.Contains(t, buf.String(), "tos: 0xb8 (dscp 46) ttl: 10", network)
+	}
+
+	c := &client{addr: "127.0.0.1:80"}
+	assert.True(t, c.isIPv4())
+	c.addr = "[::1]:80"
+	assert.False(t, c.isIPv4())
+}
+
+func TestDelta(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	c := newClient(&request{timeout: time.Second, delta: true}, ln.Addr().String())
+	send := func(n int) {
+		c.conn.Write(bytes.Repeat([]byte("x"), n))
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, c.getTCPInfo())
+	}
+
+	// the first sample after connect is absolute
+	assert.NoError(t, c.connect(ctx))
+	send(1024)
+	assert.Equal(t, uint64(1024), c.stats.BytesSent)
+
+	send(2048)
+	assert.Equal(t, uint64(2048), c.stats.BytesSent)
+	assert.Equal(t, uint64(3072), c.totals["BytesSent"])
+	c.close()
+
+	// reconnect resets the baseline
+	assert.NoError(t, c.connect(ctx))
+	defer c.close()
+	send(512)
+	assert.Equal(t, uint64(512), c.stats.BytesSent)
+	assert.Equal(t, uint64(512), c.totals["BytesSent"])
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	c.printJSON(0, false)
+	w.Close()
+	os.Stdout = stdout
+
+	m := map[string]interface{}{}
+	b, _ := ioutil.ReadAll(r)
+	assert.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, float64(512), m["BytesSent"])
+	assert.Equal(t, float64(512), m["BytesSent_total"])
+	assert.Contains(t, m, "SegsOut_total")
+	assert.NotContains(t, m, "Rtt_total")
+}
+
+func TestTCPMode(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	rcvd := make(chan int, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				n, _ := io.Copy(ioutil.Discard, conn)
+				rcvd <- int(n)
+			}()
+		}
+	}()
+
+	// tcp scheme
+	c := newClient(&request{timeout: time.Second, count: 1, quiet: true, hold: 100 * time.Millisecond},
+		"tcp://"+ln.Addr().String())
+	ts := time.Now()
+	c.probe(ctx)
+	assert.GreaterOrEqual(t, int64(time.Since(ts)), int64(100*time.Millisecond))
+	assert.Greater(t, c.stats.TCPConnect, int64(0))
+	assert.Greater(t, c.stats.Rtt, uint32(0))
+	assert.Equal(t, 0, c.stats.HTTPStatusCode)
+	assert.Equal(t, int64(0), c.stats.HTTPResponse)
+	assert.Equal(t, 0, <-rcvd)
+
+	// no-http with http target
+	c = newClient(&request{timeout: time.Second, count: 1, quiet: true, noHTTP: true},
+		"http://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.TCPConnect, int64(0))
+	assert.Equal(t, int64(0), c.stats.HTTPSentBytes)
+	assert.Equal(t, 0, <-rcvd)
+
+	// tcp scheme requires port
+	c = newClient(&request{}, "tcp://127.0.0.1")
+	_, _, err = c.getHostPort()
+	assert.Error(t, err)
+
+	// per target config
+	cfgFile, err := ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.NoError(t, err)
+	cfgFile.Write([]byte("targets:\n  - addr: http://localhost\n    mode: tcp\n    hold: 1s"))
+	cfg, err := getConfig(cfgFile.Name())
+	assert.NoError(t, err)
+
+	req := cfg.Targets[0].request(&request{})
+	assert.True(t, req.noHTTP)
+	assert.Equal(t, time.Second, req.hold)
+}
+
+func TestAppProbe(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64)
+				n, _ := conn.Read(buf)
+				if string(buf[:n]) == "PING\r\n" {
+					conn.Write([]byte("+PONG\r\n"))
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	payload, err := getPayload("50494e470d0a", "")
+	assert.NoError(t, err)
+	expect, err := getExpectation("", "+PONG")
+	assert.NoError(t, err)
+
+	r := &request{timeout: time.Second, count: 2, quiet: true, sendPayload: payload, expectPayload: expect}
+	c := newClient(r, "tcp://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.AppRtt, int64(0))
+	assert.Equal(t, int64(7), c.stats.AppRcvdBytes)
+	assert.Equal(t, int64(0), c.stats.AppMismatch)
+	assert.Equal(t, 0, c.summary.failed)
+
+	c.req.expectPayload, _ = getExpectation("2d455252", "")
+	c.probe(ctx)
+	assert.Equal(t, int64(2), c.stats.AppMismatch)
+
+	// no response
+	c.req.sendPayload = []byte("QUIT\r\n")
+	c.req.timeout = 100 * time.Millisecond
+	c.req.count = 1
+	c.probe(ctx)
+	assert.Equal(t, int64(0), c.stats.AppRtt)
+	assert.Equal(t, int64(3), c.stats.AppMismatch)
+	assert.Equal(t, 1, c.summary.failed)
+
+	_, err = getPayload("zz", "")
+	assert.Error(t, err)
+	_, err = getPayload("00", "payload.bin")
+	assert.Error(t, err)
+	_, err = getExpectation("00", "+OK")
+	assert.Error(t, err)
+
+	// per target config
+	cfgFile, err := ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.NoError(t, err)
+	cfgFile.Write([]byte(`
+targets:
+  - addr: tcp://localhost:6379
+    send_hex: 0x50 49 4e 47 0d 0a
+    expect_prefix: +PONG`))
+	cfg, err := getConfig(cfgFile.Name())
+	assert.NoError(t, err)
+
+	req := cfg.Targets[0].request(&request{})
+	assert.Equal(t, []byte("PING\r\n"), req.sendPayload)
+	assert.Equal(t, []byte("+PONG"), req.expectPayload)
+}
+
+func TestBanner(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("SSH-2.0-OpenSSH_8.4\r\n"))
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	r := &request{timeout: time.Second, count: 2, quiet: true, maxLoss: -1, readBanner: true, expectBannerRegex: `^SSH-2\.0-`}
+	c := newClient(r, "tcp://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Equal(t, `SSH-2.0-OpenSSH_8.4\r\n`, c.stats.Banner)
+	assert.Equal(t, int64(0), c.stats.BannerMismatch)
+	assert.Equal(t, 0, c.summary.failed)
+
+	r.expectBannerRegex = "ESMTP"
+	c = newClient(r, "tcp://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Equal(t, int64(2), c.stats.BannerMismatch)
+
+	// the server doesn't speak first
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	r = &request{timeout: 100 * time.Millisecond, count: 1, quiet: true, maxLoss: -1, readBanner: true}
+	c = newClient(r, "tcp://"+silent.Addr().String())
+	c.probe(ctx)
+	assert.Equal(t, "", c.stats.Banner)
+	assert.Equal(t, 1, c.summary.failed)
+
+	// the HTTP target is skipped unless it's enabled explicitly
+	c = newClient(r, "http://"+silent.Addr().String())
+	assert.False(t, c.readsBanner())
+	r.forceBanner = true
+	assert.True(t, c.readsBanner())
+
+	assert.Equal(t, `220 \x00\xff\t`, sanitizeBanner([]byte("220 \x00\xff\t")))
+
+	// per target config
+	enabled := true
+	req := target{Banner: &enabled, ExpectBannerRegex: "^220 "}.request(&request{})
+	assert.True(t, req.readBanner)
+	assert.True(t, req.forceBanner)
+	assert.Equal(t, "^220 ", req.expectBannerRegex)
+	tg := target{Addr: "localhost:25", ExpectBannerRegex: "("}
+	assert.Error(t, tg.parse())
+}
+
+func TestStartTLS(t *testing.T) {
+	ctx := context.Background()
+	certFile, keyFile := genCert(t, "mail.test", time.Hour)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NoError(t, err)
+
+	// the servers' plaintext exchange, false refuses the upgrade
+	exchanges := map[string]func(*textproto.Conn) bool{
+		"smtp": func(conn *textproto.Conn) bool {
+			conn.PrintfLine("220 mail.test ESMTP")
+			conn.ReadLine()
+			conn.PrintfLine("250-mail.test")
+			conn.PrintfLine("250 STARTTLS")
+			cmd, _ := conn.ReadLine()
+			conn.PrintfLine("220 ready")
+			return cmd == "STARTTLS"
+		},
+		"imap": func(conn *textproto.Conn) bool {
+			conn.PrintfLine("* OK IMAP4rev1 ready")
+			cmd, _ := conn.ReadLine()
+			conn.PrintfLine("* CAPABILITY IMAP4rev1")
+			conn.PrintfLine("a1 OK begin TLS")
+			return cmd == "a1 STARTTLS"
+		},
+		"pop3": func(conn *textproto.Conn) bool {
+			conn.PrintfLine("+OK POP3 ready")
+			cmd, _ := conn.ReadLine()
+			if cmd != "STLS" {
+				conn.PrintfLine("-ERR unknown command")
+				return false
+			}
+			conn.PrintfLine("+OK begin TLS")
+			return true
+		},
+	}
+
+	for proto, exchange := range exchanges {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer ln.Close()
+
+		go func(exchange func(*textproto.Conn) bool) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				if exchange(textproto.NewConn(conn)) {
+					tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+				}
+				conn.Close()
+			}
+		}(exchange)
+
+		r := &request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1, insecure: true, starttls: proto}
+		c := newClient(r, ln.Addr().String())
+		assert.False(t, c.isHTTP())
+		c.probe(ctx)
+		assert.Greater(t, c.stats.StartTLS, int64(0), proto)
+		assert.Greater(t, c.stats.TLSHandshake, int64(0), proto)
+		assert.Equal(t, "CN=mail.test", c.stats.TLSCertSubject, proto)
+		assert.Greater(t, c.stats.TLSCertExpiry, int64(0), proto)
+		assert.Equal(t, int64(0), c.stats.StartTLSError, proto)
+		assert.Equal(t, 0, c.summary.failed, proto)
+	}
+
+	// the plaintext phase isn't answered
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	r := &request{timeout: 100 * time.Millisecond, count: 1, quiet: true, maxLoss: -1, starttls: "smtp"}
+	c := newClient(r, silent.Addr().String())
+	start := time.Now()
+	c.probe(ctx)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, int64(1), c.stats.StartTLSError)
+	assert.Equal(t, int64(0), c.stats.TLSHandshakeError)
+	assert.Equal(t, 1, c.summary.failed)
+
+	_, err = getStartTLS("ftp")
+	assert.Error(t, err)
+	proto, err := getStartTLS("SMTP")
+	assert.NoError(t, err)
+	assert.Equal(t, "smtp", proto)
+
+	// per target config
+	tg := target{Addr: "mail.test:143", StartTLS: "imap"}
+	assert.NoError(t, tg.parse())
+	assert.Equal(t, "imap", tg.request(&request{tlsOnly: true}).starttls)
+	assert.False(t, tg.request(&request{tlsOnly: true}).tlsOnly)
+	tg.StartTLS = "ftp"
+	assert.Error(t, tg.parse())
+}
+
+func TestDatabase(t *testing.T) {
+	ctx := context.Background()
+	listen := func(serve func(net.Conn)) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				serve(conn)
+				conn.Close()
+			}
+		}()
+
+		return ln.Addr().String()
+	}
+
+	postgres := func(sslResponse byte) string {
+		return listen(func(conn net.Conn) {
+			b := make([]byte, 8)
+			io.ReadFull(conn, b)
+			if binary.BigEndian.Uint32(b[4:]) == pgSSLRequest {
+				conn.Write([]byte{sslResponse})
+			}
+		})
+	}
+
+	// postgres accepts TLS
+	r := &request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1}
+	c := newClient(r, "postgres://"+postgres('S'))
+	assert.False(t, c.isHTTP())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.DBRtt, int64(0))
+	assert.Equal(t, 1, c.stats.DBTLS)
+	assert.Equal(t, "", c.stats.DBVersion)
+	assert.Equal(t, 0, c.summary.failed)
+
+	c = newClient(r, "postgres://"+postgres('N'))
+	c.probe(ctx)
+	assert.Equal(t, 0, c.stats.DBTLS)
+	assert.Equal(t, int64(0), c.stats.DBError)
+
+	// mysql greeting with the TLS capability
+	greeting := []byte{10}
+	greeting = append(greeting, "8.0.36\x00"...)
+	greeting = append(greeting, 1, 0, 0, 0)
+	greeting = append(greeting, make([]byte, 9)...)
+	greeting = append(greeting, 0xff, 0xff)
+	addr := listen(func(conn net.Conn) {
+		conn.Write(append([]byte{byte(len(greeting)), 0, 0, 0}, greeting...))
+	})
+
+	c = newClient(r, "mysql://"+addr)
+	c.probe(ctx)
+	assert.Equal(t, "8.0.36", c.stats.DBVersion)
+	assert.Equal(t, 1, c.stats.DBTLS)
+	assert.Equal(t, 0, c.summary.failed)
+
+	// mysql refuses the client
+	refusal := append([]byte{0xff, 0x6a, 0x04}, "Host is not allowed to connect"...)
+	addr = listen(func(conn net.Conn) {
+		conn.Write(append([]byte{byte(len(refusal)), 0, 0, 0}, refusal...))
+	})
+
+	c = newClient(r, "mysql://"+addr)
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.DBError)
+	assert.Equal(t, 1, c.summary.failed)
+
+	_, _, err := parseMySQLGreeting(refusal)
+	assert.EqualError(t, err, "mysql error 1130: Host is not allowed to connect")
+
+	// the default ports
+	_, port, _ := newClient(r, "postgres://db.local").getHostPort()
+	assert.Equal(t, "5432", port)
+	_, port, _ = newClient(r, "mysql://db.local").getHostPort()
+	assert.Equal(t, "3306", port)
+}
+
+func TestKVStore(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	// redis requires the password, memcached answers the version
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				authenticated := false
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch {
+					case line == "*2\r\n":
+						r.ReadString('\n')
+						r.ReadString('\n')
+						r.ReadString('\n')
+						password, _ := r.ReadString('\n')
+						authenticated = password == "secret\r\n"
+						conn.Write([]byte("+OK\r\n"))
+					case line == "PING\r\n" && authenticated:
+						conn.Write([]byte("+PONG\r\n"))
+					case line == "PING\r\n":
+						conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+					case line == "version\r\n":
+						conn.Write([]byte("VERSION 1.6.21\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	r := &request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1, redisPassword: "secret"}
+	c := newClient(r, "redis://"+ln.Addr().String())
+	assert.False(t, c.isHTTP())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.AppRtt, int64(0))
+	assert.Equal(t, int64(7), c.stats.AppRcvdBytes)
+	assert.Equal(t, int64(0), c.stats.AppMismatch)
+	assert.Equal(t, 0, c.summary.failed)
+
+	c = newClient(r, "memcached://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.AppRtt, int64(0))
+	assert.Equal(t, int64(0), c.stats.AppMismatch)
+	assert.Equal(t, 0, c.summary.failed)
+
+	// the protocol error isn't a connect error
+	r.redisPassword = ""
+	c = newClient(r, "redis://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.AppMismatch)
+	assert.Equal(t, int64(0), c.stats.TCPConnectError)
+	assert.Equal(t, 1, c.summary.failed)
+
+	_, port, _ := newClient(r, "redis://cache.local").getHostPort()
+	assert.Equal(t, "6379", port)
+	_, port, _ = newClient(r, "memcached://cache.local").getHostPort()
+	assert.Equal(t, "11211", port)
+
+	// per target config
+	assert.Equal(t, "secret", target{RedisPassword: "secret"}.request(&request{}).redisPassword)
+}
+
+func TestWebSocket(t *testing.T) {
+	ctx := context.Background()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" || r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		accept := wsAccept(r.Header.Get("Sec-WebSocket-Key"))
+		if r.URL.Path == "/bad" {
+			accept = "invalid"
+		}
+
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		rw.Flush()
+
+		// the client's control frames are masked and tiny
+		for {
+			header := make([]byte, 6)
+			if _, err := io.ReadFull(rw, header); err != nil {
+				return
+			}
+			payload := make([]byte, header[1]&0x7f)
+			io.ReadFull(rw, payload)
+			for i := range payload {
+				payload[i] ^= header[2+i%4]
+			}
+
+			switch header[0] & 0x0f {
+			case wsOpPing:
+				if r.URL.Path != "/silent" {
+					conn.Write(append([]byte{0x8a, byte(len(payload))}, payload...))
+				}
+			case wsOpClose:
+				conn.Write([]byte{0x88, 0x00})
+				return
+			}
+		}
+	})
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	r := &request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1, wsPing: true}
+	c := newClient(r, "ws://"+addr+"/ok")
+	assert.False(t, c.isHTTP())
+	c.probe(ctx)
+	assert.Equal(t, http.StatusSwitchingProtocols, c.stats.HTTPStatusCode)
+	assert.Greater(t, c.stats.WSUpgrade, int64(0))
+	assert.Greater(t, c.stats.WSPongRtt, int64(0))
+	assert.Equal(t, 0, c.summary.failed)
+
+	c = newClient(r, "ws://"+addr+"/reject")
+	c.probe(ctx)
+	assert.Equal(t, http.StatusForbidden, c.stats.HTTPStatusCode)
+	assert.Equal(t, int64(1), c.stats.WSRejected)
+	assert.Equal(t, 1, c.summary.failed)
+
+	c = newClient(r, "ws://"+addr+"/bad")
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.WSBadAccept)
+	assert.Equal(t, 1, c.summary.failed)
+
+	r.timeout = 100 * time.Millisecond
+	c = newClient(r, "ws://"+addr+"/silent")
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.WSPongTimeout)
+	assert.Equal(t, 1, c.summary.failed)
+
+	// wss upgrade over TLS
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	r = &request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1, insecure: true}
+	c = newClient(r, "wss://"+strings.TrimPrefix(secure.URL, "https://")+"/ok")
+	c.probe(ctx)
+	assert.Greater(t, c.stats.TLSHandshake, int64(0))
+	assert.Equal(t, http.StatusSwitchingProtocols, c.stats.HTTPStatusCode)
+	assert.Equal(t, int64(0), c.stats.WSPongRtt)
+	assert.Equal(t, 0, c.summary.failed)
+
+	_, port, _ := newClient(r, "wss://gateway.local/ws").getHostPort()
+	assert.Equal(t, "443", port)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", wsAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+	listen := func(serve func(net.Conn)) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				serve(conn)
+				conn.Close()
+			}
+		}()
+
+		return ln.Addr().String()
+	}
+
+	// the mqtt broker accepts the user and waits for the DISCONNECT
+	disconnected := make(chan bool, 1)
+	mqtt := listen(func(conn net.Conn) {
+		b := make([]byte, 2)
+		io.ReadFull(conn, b)
+		connect := make([]byte, b[1])
+		io.ReadFull(conn, connect)
+		var rc byte
+		if !bytes.Contains(connect, []byte("secret")) {
+			rc = 5
+		}
+		conn.Write([]byte{0x20, 0x02, 0x00, rc})
+		if rc == 0 {
+			io.ReadFull(conn, b)
+			disconnected <- b[0] == 0xe0
+		}
+	})
+
+	r := &request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1, mqttClientID: "probe-1", mqttUsername: "probe", mqttPassword: "secret"}
+	c := newClient(r, "mqtt://"+mqtt)
+	assert.False(t, c.isHTTP())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.AppRtt, int64(0))
+	assert.Equal(t, 0, c.stats.MQTTReturnCode)
+	assert.Equal(t, 0, c.summary.failed)
+	assert.True(t, <-disconnected)
+
+	// not authorized
+	c = newClient(&request{timeout: time.Second, count: 1, quiet: true, maxLoss: -1}, "mqtt://"+mqtt)
+	c.probe(ctx)
+	assert.Equal(t, 5, c.stats.MQTTReturnCode)
+	assert.Equal(t, int64(1), c.stats.AppMismatch)
+	assert.Equal(t, 1, c.summary.failed)
+
+	// nats answers the PING after the INFO
+	nats := listen(func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"server_id\":\"test\",\"version\":\"2.10.0\"}\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "PING\r\n" {
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	})
+
+	c = newClient(r, "nats://"+nats)
+	c.probe(ctx)
+	assert.Greater(t, c.stats.AppRtt, int64(0))
+	assert.Equal(t, int64(0), c.stats.AppMismatch)
+	assert.Equal(t, 0, c.summary.failed)
+
+	refused := listen(func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+	})
+
+	c = newClient(r, "nats://"+refused)
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.AppMismatch)
+	assert.Equal(t, 1, c.summary.failed)
+
+	assert.Equal(t, []byte{0x10, 0x13, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x07,
+		't', 'c', 'p', 'p', 'r', 'o', 'b'}, mqttConnect("tcpprob", "", "secret")[:21])
+
+	for scheme, port := range map[string]string{"mqtt": "1883", "mqtts": "8883", "nats": "4222"} {
+		_, p, _ := newClient(r, scheme+"://broker.local").getHostPort()
+		assert.Equal(t, port, p)
+	}
+
+	// per target config
+	enabled := true
+	req := target{TLS: &enabled, MQTTClientID: "probe-2"}.request(&request{})
+	assert.True(t, req.brokerTLS)
+	assert.Equal(t, "probe-2", req.mqttClientID)
+}
+
+func TestTLSOnly(t *testing.T) {
+	ctx := context.Background()
+	requests := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	addr := strings.TrimPrefix(ts.URL, "https://")
+	r := &request{timeout: time.Second, count: 1, quiet: true, insecure: true, expectStatus: []int{200}}
+	c := newClient(r, "tls://"+addr)
+	c.probe(ctx)
+
+	assert.Greater(t, c.stats.TLSHandshake, int64(0))
+	assert.Greater(t, c.stats.TLSVersion, 0)
+	assert.Greater(t, c.stats.TLSCertChainLen, 0)
+	assert.Equal(t, 0, c.stats.HTTPStatusCode)
+	assert.Equal(t, 0, c.summary.failed)
+	assert.Len(t, c.violations(), 0)
+
+	// tls-only with https target
+	r.tlsOnly = true
+	c = newClient(r, ts.URL)
+	c.probe(ctx)
+	assert.Greater(t, c.stats.TLSHandshake, int64(0))
+	assert.Equal(t, int64(0), c.stats.HTTPResponse)
+	assert.Equal(t, 0, requests)
+
+	// handshake failure
+	c = newClient(&request{timeout: time.Second, count: 1, quiet: true}, "tls://"+addr)
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.TLSHandshakeError)
+	assert.Equal(t, 1, c.summary.failed)
+
+	c = newClient(&request{}, "tls://127.0.0.1")
+	_, _, err := c.getHostPort()
+	assert.Error(t, err)
+}
+
+func TestGRPCHealth(t *testing.T) {
+	ctx := context.Background()
+
+	hs := health.NewServer()
+	hs.SetServingStatus("tcpprobe", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go s.Serve(ln)
+	defer s.Stop()
+
+	r := &request{timeout: time.Second, count: 1, quiet: true}
+	c := newClient(r, "grpc://"+ln.Addr().String())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.GRPCCheck, int64(0))
+	assert.Equal(t, 1, c.stats.GRPCStatus)
+	assert.Greater(t, c.stats.Rtt, uint32(0))
+	assert.Equal(t, 0, c.summary.failed)
+
+	r.grpcService = "tcpprobe"
+	c.probe(ctx)
+	assert.Equal(t, 2, c.stats.GRPCStatus)
+	assert.Equal(t, int64(0), c.stats.GRPCError)
+	assert.Equal(t, 1, c.summary.failed)
+
+	r.grpcService = "notfound"
+	c.probe(ctx)
+	assert.Equal(t, 0, c.stats.GRPCStatus)
+	assert.Equal(t, int64(1), c.stats.GRPCError)
+
+	// over TLS
+	certFile, keyFile := genCert(t, "localhost", time.Hour)
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	assert.NoError(t, err)
+
+	lnTLS, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	sTLS := grpc.NewServer(grpc.Creds(creds))
+	grpc_health_v1.RegisterHealthServer(sTLS, hs)
+	go sTLS.Serve(lnTLS)
+	defer sTLS.Stop()
+
+	r = &request{timeout: time.Second, count: 1, quiet: true, grpcTLS: true, insecure: true}
+	c = newClient(r, "grpc://"+lnTLS.Addr().String())
+	c.probe(ctx)
+	assert.Greater(t, c.stats.TLSHandshake, int64(0))
+	assert.Greater(t, c.stats.TLSVersion, 0)
+	assert.Equal(t, 1, c.stats.GRPCStatus)
+
+	// per target config
+	cfgFile, err := ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.NoError(t, err)
+	cfgFile.Write([]byte("targets:\n  - addr: grpc://localhost:50051\n    grpc_service: tcpprobe\n    tls: true"))
+	cfg, err := getConfig(cfgFile.Name())
+	assert.NoError(t, err)
+
+	req := cfg.Targets[0].request(&request{})
+	assert.Equal(t, "tcpprobe", req.grpcService)
+	assert.True(t, req.grpcTLS)
+}
+
+func TestDNSProbe(t *testing.T) {
+	ctx := context.Background()
+
+	reply := func(req []byte, udp bool) []byte {
+		var p dnsmessage.Parser
+		h, err := p.Start(req)
+		if err != nil {
+			return nil
+		}
+		q, err := p.Question()
+		if err != nil {
+			return nil
+		}
+
+		n := map[string]int{"ok.test.": 2, "big.test.": 40}[q.Name.String()]
+		h.Response = true
+		if n == 0 {
+			h.RCode = dnsmessage.RCodeNameError
+		}
+		if udp && n > 30 {
+			h.Truncated = true
+			n = 0
+		}
+
+		b := dnsmessage.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		for i := 0; i < n; i++ {
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 1},
+				dnsmessage.AResource{A: [4]byte{127, 0, 0, byte(i)}})
+		}
+		msg, _ := b.Finish()
+		return msg
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(reply(buf[:n], true), addr)
+		}
+	}()
+
+	var tcpQueries int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&tcpQueries, 1)
+			b := make([]byte, 2)
+			io.ReadFull(conn, b)
+			req := make([]byte, int(b[0])<<8|int(b[1]))
+			io.ReadFull(conn, req)
+			resp := reply(req, false)
+			conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			conn.Close()
+		}
+	}()
+
+	server := pc.LocalAddr().String()
+	r := &request{timeout: time.Second, count: 1, quiet: true}
+
+	// udp
+	c := newClient(r, "dns://"+server+"/ok.test?type=a")
+	c.probe(ctx)
+	assert.Equal(t, 2, c.stats.DNSAnswerCount)
+	assert.Greater(t, c.stats.DNSRtt, int64(0))
+	assert.Equal(t, 0, c.summary.failed)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tcpQueries))
+
+	// rcode
+	c = newClient(r, "dns://"+server+"/nx.test")
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.DNSRcodeError)
+	assert.Equal(t, 1, c.summary.failed)
+
+	// truncated falls back to tcp
+	c = newClient(r, "dns://"+server+"/big.test")
+	c.probe(ctx)
+	assert.Equal(t, 40, c.stats.DNSAnswerCount)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpQueries))
+	assert.Greater(t, c.stats.TCPConnect, int64(0))
+
+	// tcp
+	c = newClient(r, "dns://"+server+"/ok.test?proto=tcp")
+	c.probe(ctx)
+	assert.Equal(t, 2, c.stats.DNSAnswerCount)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&tcpQueries))
+	assert.Greater(t, c.stats.Rtt, uint32(0))
+
+	for _, target := range []string{"dns://127.0.0.1", "dns://127.0.0.1/a.test?type=ANY", "dns://127.0.0.1/a.test?proto=dot"} {
+		u, _ := url.Parse(target)
+		_, err = getDNSQuery(u)
+		assert.Error(t, err, target)
+	}
+
+	c = newClient(r, "dns://127.0.0.1/ok.test")
+	_, port, _ := c.getHostPort()
+	assert.Equal(t, "53", port)
+}
+
+func TestUDPProbe(t *testing.T) {
+	ctx := context.Background()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte("+"), buf[:n]...), addr)
+		}
+	}()
+
+	r := &request{timeout: time.Second, count: 1, quiet: true, udpReply: true, expectPayload: []byte("+")}
+	c := newClient(r, "udp://"+pc.LocalAddr().String())
+	c.probe(ctx)
+	assert.Equal(t, 1, c.stats.UDPReplyReceived)
+	assert.Greater(t, c.stats.UDPRtt, int64(0))
+	assert.Equal(t, int64(0), c.stats.AppMismatch)
+	assert.Equal(t, 0, c.summary.failed)
+
+	// port unreachable
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed.Close()
+
+	c = newClient(r, "udp://"+closed.LocalAddr().String())
+	c.probe(ctx)
+	assert.Equal(t, 0, c.stats.UDPReplyReceived)
+	assert.Equal(t, 1, c.stats.UDPUnreachable)
+	assert.Equal(t, 1, c.summary.failed)
+
+	// no reply wait
+	c = newClient(&request{timeout: time.Second, count: 1, quiet: true}, "udp://"+closed.LocalAddr().String())
+	c.probe(ctx)
+	assert.Equal(t, 0, c.summary.failed)
+	assert.Equal(t, int64(0), c.stats.UDPSendError)
+	assert.Equal(t, int64(0), c.stats.TCPConnectError)
+
+	c = newClient(r, "udp://127.0.0.1")
+	_, _, err = c.getHostPort()
+	assert.Error(t, err)
+}
+
+func TestICMPProbe(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := getICMPNetwork(false); err != nil {
+		t.Skip(err)
+	}
+	assert.NoError(t, checkICMP("icmp://127.0.0.1", false))
+	assert.NoError(t, checkICMP("127.0.0.1:80", false))
+
+	c := newClient(&request{timeout: time.Second, count: 2, quiet: true}, "icmp://127.0.0.1")
+	c.probe(ctx)
+	assert.Greater(t, c.stats.Rtt, uint32(0))
+	assert.Equal(t, 64, c.stats.ICMPReplyTTL)
+	assert.Equal(t, int64(2), c.stats.ICMPSent)
+	assert.Equal(t, int64(0), c.stats.ICMPLost)
+	assert.Equal(t, 0, c.summary.failed)
+	assert.Equal(t, "127.0.0.1:0", c.addr)
+}
+
+func TestUnixSocket(t *testing.T) {
+	ctx := context.Background()
+	socket := filepath.Join(t.TempDir(), "app.sock")
+
+	ln, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+
+	var host, path string
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path = r.Host, r.URL.Path
+		w.Write([]byte("ok"))
+	})}
+	go s.Serve(ln)
+	defer s.Close()
+
+	r := &request{timeout: time.Second, timeoutHTTP: time.Second, count: 1, quiet: true}
+	c := newClient(r, "unix://"+socket)
+	c.probe(ctx)
+
+	assert.Equal(t, socket, c.addr)
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	assert.Greater(t, c.stats.HTTPResponse, int64(0))
+	assert.Equal(t, int64(2), c.stats.HTTPRcvdBytes)
+	assert.Equal(t, uint32(0), c.stats.Rtt)
+	assert.Equal(t, "localhost", host)
+	assert.Equal(t, "/", path)
+	assert.Equal(t, 0, c.summary.failed)
+
+	// http+unix with request path and host header
+	r.httpHeaders = http.Header{"Host": []string{"app.local"}}
+	c = newClient(r, "http+unix://"+url.PathEscape(socket)+"/health")
+	c.probe(ctx)
+
+	assert.Equal(t, 200, c.stats.HTTPStatusCode)
+	assert.Equal(t, "app.local", host)
+	assert.Equal(t, "/health", path)
+
+	// missing socket file
+	c = newClient(r, "unix://"+socket+".missing")
+	c.probe(ctx)
+	assert.Equal(t, int64(1), c.stats.TCPConnectError)
+	assert.Equal(t, 1, c.summary.failed)
+}
+
+func TestTraceOnFailure(t *testing.T) {
+	ctx := context.Background()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	r := &request{timeout: time.Second, quiet: true, traceOnFailure: 2, traceInterval: time.Minute}
+	c := newClient(r, "tcp://"+ln.Addr().String())
+
+	c.connectFailures = 1
+	assert.False(t, c.traceOnFailure(ctx))
+
+	c.connectFailures = 2
+	assert.True(t, c.traceOnFailure(ctx))
+	assert.Equal(t, 1, c.stats.TraceHops)
+	assert.Equal(t, "127.0.0.1", c.traceHops[0].addr)
+	assert.Equal(t, int64(0), c.stats.PathChanged)
+
+	// rate limited
+	assert.False(t, c.traceOnFailure(ctx))
+
+	c.traceLast = time.Time{}
+	c.traceHops = []traceHop{{ttl: 1, addr: "10.0.0.1"}}
+	assert.True(t, c.traceOnFailure(ctx))
+	assert.Equal(t, int64(1), c.stats.PathChanged)
+
+	// refused connections
+	addr := ln.Addr().String()
+	ln.Close()
+	r.count = 3
+	c = newClient(r, "tcp://"+addr)
+	c.probe(ctx)
+	assert.Equal(t, 3, c.connectFailures)
+	assert.Equal(t, 1, c.stats.TraceHops)
+	assert.Equal(t, int64(3), c.stats.TCPConnectError)
+
+	assert.True(t, isSamePath([]traceHop{{ttl: 1}, {ttl: 2, addr: "10.0.0.2"}},
+		[]traceHop{{ttl: 1, addr: "10.0.0.1"}, {ttl: 2, addr: "10.0.0.2"}}))
+	assert.False(t, isSamePath([]traceHop{{ttl: 1, addr: "10.0.0.1"}}, nil))
+}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var running, maxRunning int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	s := newScheduler(ctx, 2)
+	r := &request{timeout: time.Second, timeoutHTTP: time.Second, interval: 10 * time.Millisecond, count: 3, quiet: true}
+
+	var clients []*client
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		c := newClient(r, ts.URL)
+		c.scheduler = s
+		clients = append(clients, c)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.probe(ctx)
+		}()
+	}
+	wg.Wait()
+
+	for _, c := range clients {
+		assert.Equal(t, 3, c.summary.sent)
+		assert.Equal(t, 0, c.summary.failed)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+	assert.Equal(t, 0, s.queueDepth())
+
+	// unlimited count stops by the context
+	r = &request{timeout: time.Second, timeoutHTTP: time.Second, interval: time.Hour, quiet: true}
+	c := newClient(r, ts.URL)
+	c.scheduler = s
+	pctx, pcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer pcancel()
+	c.probe(pctx)
+	assert.Equal(t, 1, c.summary.sent)
+}
+
+func TestSplay(t *testing.T) {
+	v, err := getSplay("20%")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.2, v)
+
+	v, err = getSplay("50")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, v)
+
+	for _, s := range []string{"-1%", "101%", "abc"} {
+		_, err = getSplay(s)
+		assert.Error(t, err, s)
+	}
+
+	interval := 10 * time.Second
+	r := &request{splay: 0.2, splayStable: true}
+	c1 := newClient(r, "127.0.0.1:80")
+	c2 := newClient(r, "127.0.0.1:80")
+	offset := c1.splayOffset(interval)
+	assert.Equal(t, offset, c2.splayOffset(interval))
+	assert.True(t, offset >= 0 && offset <= 2*time.Second)
+
+	// jitter is disabled by default
+	assert.Equal(t, interval, c1.nextInterval(interval))
+
+	r.splayJitter = true
+	for i := 0; i < 100; i++ {
+		d := c1.nextInterval(interval)
+		assert.True(t, d >= 8*time.Second && d <= 12*time.Second, d)
+	}
+
+	c := newClient(&request{}, "127.0.0.1:80")
+	assert.Equal(t, time.Duration(0), c.splayOffset(interval))
+	assert.Equal(t, interval, c.nextInterval(interval))
+
+	// the first probe is delayed by the offset
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	r = &request{timeout: time.Second, interval: 200 * time.Millisecond, count: 1, quiet: true,
+		splay: 1, splayStable: true}
+	target := "tcp://" + ln.Addr().String()
+	offset = newClient(r, target).splayOffset(r.interval)
+
+	c = newClient(r, target)
+	start := time.Now()
+	c.probe(context.Background())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(offset))
+	assert.Equal(t, 1, c.summary.sent)
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	r := &request{timeout: time.Second, count: 1, quiet: true, retries: 2, retryBackoff: 10 * time.Millisecond}
+	c := newClient(r, "tcp://"+addr)
+	start := time.Now()
+	c.probe(ctx)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(30*time.Millisecond))
+	assert.Equal(t, int64(3), c.stats.TCPConnectError)
+	assert.Equal(t, int64(1), c.stats.ProbeFailed)
+	assert.Equal(t, 1, c.summary.failed)
+
+	// the retries are limited by the timeout
+	r = &request{timeout: 250 * time.Millisecond, count: 1, quiet: true, retries: 10, retryBackoff: 100 * time.Millisecond}
+	c = newClient(r, "tcp://"+addr)
+	start = time.Now()
+	c.probe(ctx)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.LessOrEqual(t, c.stats.TCPConnectError, int64(3))
+	assert.Equal(t, int64(1), c.stats.ProbeFailed)
+
+	// succeeded after retry
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		if ln, err := net.Listen("tcp", addr); err == nil {
+			time.Sleep(time.Second)
+			ln.Close()
+		}
+	}()
+
+	r = &request{timeout: time.Second, count: 1, quiet: true, retries: 5, retryBackoff: 20 * time.Millisecond}
+	c = newClient(r, "tcp://"+addr)
+	c.probe(ctx)
+	assert.Greater(t, c.stats.TCPConnectError, int64(0))
+	assert.Equal(t, int64(0), c.stats.ProbeFailed)
+	assert.Equal(t, 0, c.summary.failed)
+}
+
+func TestHideUnsupported(t *testing.T) {
+	c := newClient(&request{hideUnsupported: true}, "127.0.0.1:80")
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	c.printJSON(0, false)
+	c.printText(0)
+	w.Close()
+	os.Stdout = stdout
+
+	m := map[string]interface{}{}
+	b, _ := ioutil.ReadAll(r)
+	lines := strings.SplitN(string(b), "\n", 2)
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &m))
+
+	assert.Contains(t, m, "Rtt")
+	assert.Contains(t, lines[1], "Rtt:")
+
+	_, ok := m["CaState"]
+	assert.Equal(t, runtime.GOOS == "linux", ok)
+	assert.Equal(t, runtime.GOOS == "linux", strings.Contains(lines[1], "CaState:"))
+
+	_, ok = m["RcvOooBytes"]
+	assert.Equal(t, runtime.GOOS == "darwin", ok)
+
+	_, ok = m["MinRtt"]
+	assert.Equal(t, runtime.GOOS == "linux" || runtime.GOOS == "windows", ok)
+}
+
 func TestCli(t *testing.T) {
 	stdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
-	args := []string{"tcpprobe", "-metrics"}
-	_, m, err := getCli(args)
+	args := []string{"tcpprobe", "-metrics"}
+	_, m, err := getCli(args)
+	assert.NoError(t, err)
+	assert.Len(t, m, 0)
+	buf := new(bytes.Buffer)
+	go io.CopyN(buf, r, 7)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "metrics", buf.String())
+
+	r, w, _ = os.Pipe()
+	os.Stdout = w
+	args = []string{"tcpprobe"}
+	_, m, err = getCli(args)
+	assert.Error(t, err)
+	assert.Len(t, m, 0)
+	buf.Reset()
+
+	go io.CopyN(buf, r, 5)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "usage", buf.String())
+
+	args = []string{"tcpprobe", "127.0.0.1"}
+	_, m, err = getCli(args)
+	assert.NoError(t, err)
+	assert.Len(t, m, 1)
+
+	// the help has nothing to run
+	r, w, _ = os.Pipe()
+	os.Stdout = w
+	go io.Copy(ioutil.Discard, r)
+	hr, _, err := getCli([]string{"tcpprobe", "-h"})
+	assert.NoError(t, err)
+	assert.Nil(t, hr)
+	w.Close()
+	os.Stdout = stdout
+
+	// add
+	args = []string{"tcpprobe", "add", "127.0.0.2:8080"}
+	req, _, err := getCli(args)
+	assert.NoError(t, err)
+	assert.Equal(t, req.cmd.cmd, "add")
+
+	args = []string{"tcpprobe", "add"}
+	req, _, err = getCli(args)
+	assert.Error(t, err)
+
+	// del
+	args = []string{"tcpprobe", "del", "127.0.0.2:8080"}
+	req, _, err = getCli(args)
+	assert.NoError(t, err)
+	assert.Equal(t, req.cmd.cmd, "del")
+
+	args = []string{"tcpprobe", "del"}
+	req, _, err = getCli(args)
+	assert.Error(t, err)
+}
+
+func TestPrometheus(t *testing.T) {
+	c := &client{target: "collector", req: &request{}}
+	c.prometheus(context.Background())
+	defer c.deprometheus(context.Background())
+
+	// a collector per target
+	assert.Len(t, c.collectors, 1)
+
+	c.stats.Rtt = 100
+	c.stats.ICMPSent = 3
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+
+	types := map[string]string{}
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "target" && l.GetValue() == "collector" {
+					types[mf.GetName()] = mf.GetType().String()
+					if mf.GetType().String() == "COUNTER" {
+						values[mf.GetName()] = m.GetCounter().GetValue()
+					} else {
+						values[mf.GetName()] = m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+	}
+
+	v := reflect.ValueOf(&c.stats).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+
+		if f.Tag.Get("unexported") == "true" || f.Type.Kind() == reflect.String {
+			continue
+		}
+
+		name := "tp_" + f.Tag.Get("name")
+		if f.Tag.Get("kind") == "counter" {
+			assert.Equal(t, "COUNTER", types[name], name)
+		} else {
+			assert.Equal(t, "GAUGE", types[name], name)
+		}
+	}
+
+	assert.Equal(t, float64(100), values["tp_tcpinfo_rtt"])
+	assert.Equal(t, float64(3), values["tp_icmp_sent"])
+}
+
+func TestDeprometheus(t *testing.T) {
+	ctx := context.Background()
+	registered := func(target string) bool {
+		mfs, _ := prometheus.DefaultGatherer.Gather()
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "target" && l.GetValue() == target {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+
+	c := &client{target: "removed", req: &request{}}
+	c.prometheus(ctx)
+	assert.NotEmpty(t, c.collectors)
+	assert.True(t, registered("removed"))
+
+	c.deprometheus(ctx)
+	assert.Empty(t, c.collectors)
+	assert.False(t, registered("removed"))
+
+	// re-appeared target
+	c = &client{target: "removed", req: &request{}}
+	c.prometheus(ctx)
+	assert.NotEmpty(t, c.collectors)
+
+	// the registered collectors aren't replaced by the duplicate
+	c2 := &client{target: "removed", req: &request{}}
+	c2.prometheus(ctx)
+	assert.Empty(t, c2.collectors)
+	assert.Error(t, c2.register(newStatsCollector(&c2.stats, getLabels(ctx, c2.target), nil, "", nil)))
+
+	c2.deprometheus(ctx)
+	assert.True(t, registered("removed"))
+	c.deprometheus(ctx)
+	assert.False(t, registered("removed"))
+}
+
+func TestPromServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := &request{promAddr: "127.0.0.1:8086", promPath: "/custom"}
+	err := promServer(ctx, req, nil)
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://127.0.0.1:8086/custom")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	// address in use
+	err = promServer(ctx, req, nil)
+	assert.Error(t, err)
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	_, err = http.Get("http://127.0.0.1:8086/custom")
+	assert.Error(t, err)
+
+	// tls
+	certFile, keyFile := genCert(t, "localhost", time.Hour)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	req = &request{promAddr: "127.0.0.1:8087", promPath: "/metrics", promTLSCert: certFile, promTLSKey: keyFile}
+	err = promServer(ctx, req, nil)
+	assert.NoError(t, err)
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err = httpClient.Get("https://127.0.0.1:8087/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	req = &request{promAddr: "127.0.0.1:8088", promTLSCert: certFile}
+	err = promServer(ctx, req, nil)
+	assert.Error(t, err)
+}
+
+func TestPrometheusHistograms(t *testing.T) {
+	ctx := context.Background()
+	c := &client{target: "histogram", req: &request{promHistograms: true, promBuckets: []float64{0.001, 0.01}}}
+	c.prometheus(ctx)
+	assert.Len(t, c.histograms, 3)
+
+	c.stats.Rtt = 5000
+	c.observe()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "tp_rtt_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == "histogram" {
+				found = true
+				assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+				assert.Equal(t, 0.005, m.GetHistogram().GetSampleSum())
+			}
+		}
+	}
+	assert.True(t, found)
+
+	c.deprometheus(ctx)
+	assert.True(t, prometheus.Register(c.histograms["Rtt"]) == nil)
+	prometheus.Unregister(c.histograms["Rtt"])
+
+	b, err := getBuckets("0.001, 0.5")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.001, 0.5}, b)
+	_, err = getBuckets("0.1,x")
+	assert.Error(t, err)
+	_, err = getBuckets("1,0.5")
+	assert.EqualError(t, err, "invalid prometheus bucket: 0.5, the buckets must be strictly increasing")
+	_, err = getBuckets("0.1,0.1")
+	assert.Error(t, err)
+	_, err = getBuckets("0.1,NaN")
+	assert.Error(t, err)
+	_, err = getBuckets("0.1,+Inf")
+	assert.Error(t, err)
+}
+
+func TestServerName(t *testing.T) {
+	r := request{
+		serverName: "myserver",
+	}
+
+	c := newClient(&r, "target")
+	assert.Equal(t, "myserver", c.serverName())
+
+	c = newClient(&request{}, "target")
+	assert.Equal(t, "target", c.serverName())
+}
+
+func TestGetSrcAddr(t *testing.T) {
+	addr := getSrcAddr("")
+	assert.Nil(t, addr)
+
+	addr = getSrcAddr("192.168.1.1")
+	assert.Equal(t, &net.TCPAddr{
+		IP:   net.ParseIP("192.168.1.1"),
+		Port: 0, Zone: "",
+	}, addr)
+}
+
+func TestPrintText(t *testing.T) {
+	buf := new(bytes.Buffer)
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c := &client{stats: stats{Rtt: 5}, req: &request{filter: "rtt"}, timestamp: 1609558015}
+	c.printer(0)
+
+	go io.Copy(buf, r)
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, buf.String(), "Rtt:5")
+
+	os.Stdout = stdout
+}
+
+func TestPrintJsonPretty(t *testing.T) {
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c := &client{stats: stats{}, req: &request{jsonPretty: true, filter: "rtt"}}
+	c.printer(0)
+
+	buf := make([]byte, 35)
+	n, _ := io.ReadFull(r, buf)
+	assert.Equal(t, 35, n)
+	assert.Equal(t, "{\n \"Rtt\": 0,\n \"schema_version\": 1\n}", string(buf))
+
+	os.Stdout = stdout
+}
+
+func TestPrintJson(t *testing.T) {
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c := &client{stats: stats{}, req: &request{json: true, filter: "rtt"}}
+	c.printer(0)
+
+	buf := make([]byte, 28)
+	n, _ := io.ReadFull(r, buf)
+	assert.Equal(t, 28, n)
+	assert.Equal(t, `{"Rtt":0,"schema_version":1}`, string(buf))
+
+	os.Stdout = stdout
+}
+
+func TestPrintCSV(t *testing.T) {
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c := &client{target: "a,b", stats: stats{Rtt: 5}, req: &request{csv: true, filter: "rtt"}, timestamp: 1609558015}
+	c.printer(0)
+	c.printer(1)
+	w.Close()
+
+	b, _ := ioutil.ReadAll(r)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "Timestamp,Target,Seq,Labels,Rtt", lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], `,"a,b",0,,5`))
+	assert.True(t, strings.HasSuffix(lines[2], `,"a,b",1,,5`))
+
+	os.Stdout = stdout
+}
+
+func TestSummary(t *testing.T) {
+	s := newSummary()
+	s.record(&stats{Rtt: 100, TCPConnect: 10}, false)
+	s.record(&stats{Rtt: 300, TCPConnect: 30}, false)
+	s.record(&stats{}, true)
+	assert.Equal(t, 3, s.sent)
+	assert.Equal(t, 1, s.failed)
+	assert.InDelta(t, 66.66, s.success(), 0.01)
+	assert.Equal(t, 100.0, s.metrics["Rtt"].Min)
+	assert.Equal(t, 200.0, s.metrics["Rtt"].Avg)
+	assert.Equal(t, 300.0, s.metrics["Rtt"].Max)
+	assert.Equal(t, 100.0, s.metrics["Rtt"].Stddev)
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c := &client{target: "127.0.0.1:80", summary: s, req: &request{}}
+	c.printSummary()
+	c.req.json = true
+	c.printSummary()
+	w.Close()
+
+	b, _ := ioutil.ReadAll(r)
+	assert.Contains(t, string(b), "3 probes sent, 1 failed, 66.67% success")
+	assert.Contains(t, string(b), "Rtt min/avg/max/stddev = 100/200/300/100 us")
+	assert.Contains(t, string(b), `{"Target":"127.0.0.1:80","summary":true,"Sent":3,"Failed":1,`)
+
+	// the summary's write error is counted
+	errs := testutil.ToFloat64(selfMetrics.outputErrors)
+	r, w, _ = os.Pipe()
+	r.Close()
+	os.Stdout = w
+	c.printSummary()
+	w.Close()
+	assert.Greater(t, testutil.ToFloat64(selfMetrics.outputErrors), errs)
+
+	os.Stdout = stdout
+
+	// the probe is summarized by its own tcp_info
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	c = newClient(&request{quiet: true, timeout: time.Second}, ln.Addr().String())
+	c.probeOnce(context.Background(), 1)
+	assert.Less(t, uint32(0), c.stats.Rtt)
+	assert.Equal(t, float64(c.stats.Rtt), c.summary.metrics["Rtt"].Max)
+}
+
+func TestThresholds(t *testing.T) {
+	c := newClient(&request{maxRtt: time.Millisecond, maxLoss: 0, expectStatus: []int{200, 204}}, "http://127.0.0.1")
+	c.stats = stats{Rtt: 1500, HTTPStatusCode: 500}
+	c.checkThresholds()
+	c.stats = stats{Rtt: 500, HTTPStatusCode: 204}
+	c.checkThresholds()
+	c.summary.record(&c.stats, false)
+	c.summary.record(&c.stats, true)
+
+	v := c.violations()
+	assert.Len(t, v, 3)
+	assert.Equal(t, "max-rtt: 1 probe(s) exceeded 1ms, worst 1.5ms (+500µs)", v[0])
+	assert.Equal(t, "max-loss: 50.00% loss exceeded 0.00% (+50.00%)", v[1])
+	assert.Equal(t, "expect-status: 1 probe(s) unexpected status, last 500", v[2])
+
+	c = newClient(&request{maxLoss: -1}, "127.0.0.1")
+	c.summary.record(&c.stats, true)
+	assert.Len(t, c.violations(), 0)
+
+	// the first probe is checked by its own Rtt
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	c = newClient(&request{quiet: true, timeout: time.Second, maxRtt: time.Nanosecond, maxLoss: -1}, ln.Addr().String())
+	c.probeOnce(context.Background(), 1)
+	assert.Equal(t, 1, c.threshold.rttExceeded)
+
+	codes, err := getStatusCodes("200, 301")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{200, 301}, codes)
+	_, err = getStatusCodes("2000")
+	assert.Error(t, err)
+
+	// continuous mode
+	osExiter, errWriter := cli.OsExiter, cli.ErrWriter
+	cli.OsExiter, cli.ErrWriter = func(int) {}, ioutil.Discard
+	defer func() { cli.OsExiter, cli.ErrWriter = osExiter, errWriter }()
+
+	_, _, err = getCli([]string{"tcpprobe", "-max-rtt", "50ms", "127.0.0.1"})
+	assert.Error(t, err)
+	req, _, err := getCli([]string{"tcpprobe", "-c", "1", "-max-rtt", "50ms", "-max-loss", "0", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 50*time.Millisecond, req.maxRtt)
+	assert.Equal(t, 0.0, req.maxLoss)
+}
+
+func TestBoolToInt(t *testing.T) {
+	assert.Equal(t, 1, boolToInt(true))
+	assert.Equal(t, 0, boolToInt(false))
+}
+
+func TestNoRedirect(t *testing.T) {
+	c := &client{}
+	assert.Error(t, c.noRedirect(nil, nil))
+}
+
+func TestMain(t *testing.T) {
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, TCPProbe")
+	}))
+	os.Args = []string{"tcpprobe", "-c", "1", "-insecure", ts.URL}
+	main()
+
+	buf := new(bytes.Buffer)
+	go io.Copy(buf, r)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Contains(t, buf.String(), "target: https://127.0.0.1")
+	assert.Contains(t, buf.String(), "HTTPStatusCode:200")
+
+	os.Stdout = stdout
+}
+
+func TestGetLabels(t *testing.T) {
+	labels := map[string]string{"key": "value"}
+	b, _ := json.Marshal(labels)
+	ctx := context.WithValue(context.Background(), labelsKey, b)
+	l := getLabels(ctx, "127.0.0.1")
+	assert.Contains(t, l, "key")
+	assert.Contains(t, l, "target")
+
+	ctx = context.WithValue(context.Background(), labelsKey, []byte(""))
+	getLabels(ctx, "127.0.0.1")
+	assert.Contains(t, l, "target")
+
+	ctx = context.WithValue(context.Background(), ipKey, "127.0.0.2")
+	l = getLabels(ctx, "localhost")
+	assert.Equal(t, "127.0.0.2", l["ip"])
+	assert.Equal(t, "localhost@127.0.0.2", getTargetKey(ctx, "localhost"))
+}
+
+func TestK8SStart(t *testing.T) {
+	ctx := context.Background()
+	tp := &tp{targets: make(map[string]prop)}
+	req := &request{namespace: "default"}
+
+	samplePod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fake",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"tcpprobe/targets":  "faketarget",
+				"tcpprobe/interval": "6s",
+				"tcpprobe/labels":   "{\"mykey\":\"myvalue\"}",
+			},
+		},
+		Status: v1.PodStatus{Phase: "Running"},
+	}
+
+	clientset := fake.NewSimpleClientset(samplePod)
+	k := k8s{clientset: clientset, pods: sync.Map{}, resync: time.Second}
+	k.start(ctx, tp, req)
+	time.Sleep(time.Second)
+	assert.Contains(t, tp.targets, "faketarget")
+	clientset.CoreV1().Pods("default").Delete(context.TODO(), "fake", metav1.DeleteOptions{})
+	time.Sleep(time.Second)
+	assert.NotContains(t, tp.targets, "faketarget")
+}
+
+func TestK8SSelector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tpAll := &tp{targets: make(map[string]prop)}
+	tp := &tp{targets: make(map[string]prop)}
+	req := &request{kubeNamespaces: []string{"ns1", "ns2"}, kubeSelector: "probe=true,tier!=batch"}
+
+	newPod := func(name, namespace string, labels map[string]string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      labels,
+				Annotations: map[string]string{"tcpprobe/targets": name + "target", "tcpprobe/interval": "1h"},
+			},
+			Status: v1.PodStatus{Phase: "Running"},
+		}
+	}
+
+	pod1 := newPod("pod1", "ns1", map[string]string{"probe": "true"})
+	pod2 := newPod("pod2", "ns2", map[string]string{"probe": "true", "tier": "batch"})
+	pod3 := newPod("pod3", "ns2", nil)
+	pod4 := newPod("pod4", "ns3", map[string]string{"probe": "true"})
+
+	clientset := fake.NewSimpleClientset(pod1, pod2, pod3, pod4)
+	k := k8s{clientset: clientset, pods: sync.Map{}, resync: 100 * time.Millisecond}
+	k.start(ctx, tp, req)
+	time.Sleep(time.Second)
+	assert.True(t, tp.isExist("pod1target"))
+	assert.False(t, tp.isExist("pod2target"))
+	assert.False(t, tp.isExist("pod3target"))
+	assert.False(t, tp.isExist("pod4target"))
+
+	pod1.Labels = nil
+	clientset.CoreV1().Pods("ns1").Update(ctx, pod1, metav1.UpdateOptions{})
+	time.Sleep(time.Second)
+	assert.False(t, tp.isExist("pod1target"))
+
+	// all the namespaces
+	req = &request{kubeNamespaces: []string{""}, kubeSelector: "probe=true"}
+	kAll := k8s{clientset: clientset, pods: sync.Map{}, resync: 100 * time.Millisecond}
+	kAll.start(ctx, tpAll, req)
+	time.Sleep(time.Second)
+	assert.True(t, tpAll.isExist("pod2target"))
+	assert.True(t, tpAll.isExist("pod4target"))
+	assert.False(t, tpAll.isExist("pod3target"))
+
+	r, _, err := getCli([]string{"tcpprobe", "-k8s", "-kube-namespaces", "ns1, ns2", "-kube-selector", "probe=true"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ns1", "ns2"}, r.kubeNamespaces)
+	assert.Equal(t, "probe=true", r.kubeSelector)
+	r, _, err = getCli([]string{"tcpprobe", "-k8s", "-kube-namespaces", ""})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, r.kubeNamespaces)
+	_, _, err = getCli([]string{"tcpprobe", "-k8s", "-kube-selector", "probe in (a"})
+	assert.Error(t, err)
+}
+
+func TestK8SPodTemplate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp := &tp{targets: make(map[string]prop)}
+	req := &request{namespace: "default"}
+
+	samplePod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fake",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"tcpprobe/targets":  "http://{podIP}:8080/healthz;;{podName}.{namespace}:80",
+				"tcpprobe/interval": "1h",
+				"tcpprobe/labels":   `{"node":"{nodeName}"}`,
+			},
+		},
+		Spec:   v1.PodSpec{NodeName: "node1"},
+		Status: v1.PodStatus{Phase: "Running", PodIP: "127.0.0.1"},
+	}
+
+	assert.Equal(t, []string{"http://127.0.0.1:8080/healthz", "fake.default:80"}, getTargets(samplePod))
+	assert.Equal(t, `{"node":"node1"}`, expandPod(samplePod, samplePod.Annotations["tcpprobe/labels"]))
+	assert.Equal(t, "127.0.0.1:80", expandPod(samplePod, "PODIP:80"))
+
+	clientset := fake.NewSimpleClientset(samplePod)
+	k := k8s{clientset: clientset, pods: sync.Map{}, resync: 100 * time.Millisecond}
+	k.start(ctx, tp, req)
+	time.Sleep(time.Second)
+	assert.True(t, tp.isExist("http://127.0.0.1:8080/healthz"))
+	assert.True(t, tp.isExist("fake.default:80"))
+
+	// restarted with the same name
+	samplePod.Status.PodIP = "127.0.0.2"
+	clientset.CoreV1().Pods("default").Update(ctx, samplePod, metav1.UpdateOptions{})
+	time.Sleep(time.Second)
+	assert.False(t, tp.isExist("http://127.0.0.1:8080/healthz"))
+	assert.True(t, tp.isExist("http://127.0.0.2:8080/healthz"))
+	assert.True(t, tp.isExist("fake.default:80"))
+}
+
+func TestK8SPodModified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp := &tp{targets: make(map[string]prop)}
+	req := &request{namespace: "default"}
+
+	samplePod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fake",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"tcpprobe/targets":  "127.0.0.1:1;;127.0.0.1:2",
+				"tcpprobe/interval": "1h",
+			},
+		},
+		Status: v1.PodStatus{Phase: "Running", PodIP: "127.0.0.1"},
+	}
+
+	clientset := fake.NewSimpleClientset(samplePod)
+	k := k8s{clientset: clientset, pods: sync.Map{}, resync: time.Hour}
+	k.start(ctx, tp, req)
+	time.Sleep(time.Second)
+	assert.True(t, tp.isExist("127.0.0.1:1"))
+	assert.True(t, tp.isExist("127.0.0.1:2"))
+	goroutines := runtime.NumGoroutine()
+
+	// the informer applies the modified annotations
+	samplePod.Annotations["tcpprobe/targets"] = "127.0.0.1:2;;127.0.0.1:3"
+	clientset.CoreV1().Pods("default").Update(ctx, samplePod, metav1.UpdateOptions{})
+	time.Sleep(time.Second)
+	assert.False(t, tp.isExist("127.0.0.1:1"))
+	assert.True(t, tp.isExist("127.0.0.1:2"))
+	assert.True(t, tp.isExist("127.0.0.1:3"))
+
+	samplePod.Annotations["tcpprobe/interval"] = "30m"
+	clientset.CoreV1().Pods("default").Update(ctx, samplePod, metav1.UpdateOptions{})
+	time.Sleep(time.Second)
+	assert.True(t, tp.isExist("127.0.0.1:2"))
+	assert.True(t, tp.isExist("127.0.0.1:3"))
+
+	tp.Lock()
+	assert.Len(t, tp.targets, 2)
+	tp.Unlock()
+
+	v, ok := k.pods.Load("default/fake")
+	assert.True(t, ok)
+	assert.Equal(t, "30m", v.(*kubePod).interval)
+	assert.Len(t, v.(*kubePod).targets, 2)
+
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+}
+
+func TestK8SServices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp := &tp{targets: make(map[string]prop)}
+	req := &request{namespace: "default", kubeServices: true}
+
+	node := "node1"
+	sampleService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "fakesvc",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"tcpprobe/targets":  "ENDPOINT",
+				"tcpprobe/interval": "1h",
+				"tcpprobe/labels":   "{\"mykey\":\"myvalue\"}",
+			},
+		},
+	}
+	sampleEndpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "fakesvc", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{
+				{IP: "127.0.0.10", NodeName: &node, TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod1"}},
+				{IP: "127.0.0.11", NodeName: &node, TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod2"}},
+			},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "127.0.0.12"}},
+			Ports:             []v1.EndpointPort{{Port: 8080}},
+		}},
+	}
+
+	endpoints := getEndpointTargets(sampleService, sampleEndpoints)
+	assert.Len(t, endpoints, 2)
+	assert.Equal(t, "127.0.0.10:8080", endpoints[0].target)
+	assert.Equal(t, "1h", endpoints[0].interval)
+	assert.JSONEq(t, `{"mykey":"myvalue","service":"fakesvc","pod":"pod1","node":"node1"}`, string(endpoints[0].labels))
+
+	clientset := fake.NewSimpleClientset(sampleService, sampleEndpoints)
+	k := k8s{clientset: clientset, pods: sync.Map{}, resync: 100 * time.Millisecond}
+	k.start(ctx, tp, req)
+	time.Sleep(time.Second)
+	assert.True(t, tp.isExist("127.0.0.10:8080"))
+	assert.True(t, tp.isExist("127.0.0.11:8080"))
+	assert.False(t, tp.isExist("127.0.0.12:8080"))
+
+	sampleEndpoints.Subsets[0].Addresses = sampleEndpoints.Subsets[0].Addresses[:1]
+	clientset.CoreV1().Endpoints("default").Update(ctx, sampleEndpoints, metav1.UpdateOptions{})
+	time.Sleep(time.Second)
+	assert.True(t, tp.isExist("127.0.0.10:8080"))
+	assert.False(t, tp.isExist("127.0.0.11:8080"))
+}
+
+func TestK8SProbeTargets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	newProbeTarget := func(name string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "tcpprobe.io/v1alpha1",
+			"kind":       "ProbeTarget",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+			"spec":       spec,
+		}}
+	}
+
+	pt1 := newProbeTarget("pt1", map[string]interface{}{
+		"addr":     ln.Addr().String(),
+		"interval": "100ms",
+		"labels":   map[string]interface{}{"vip": "true"},
+	})
+	pt2 := newProbeTarget("pt2", map[string]interface{}{"interval": "1s"})
+
+	tp := &tp{targets: make(map[string]prop)}
+	dc := dynamicfake.NewSimpleDynamicClient(k8sruntime.NewScheme(), pt1, pt2)
+	k := k8s{dynamic: dc, resync: time.Hour, statusInterval: 200 * time.Millisecond}
+	go k.watchProbeTargets(ctx, tp, &request{timeout: time.Second})
+
+	assert.Eventually(t, func() bool { return tp.isExist(ln.Addr().String()) }, 2*time.Second, 50*time.Millisecond)
+
+	// status
+	resource := dc.Resource(probeTargetResource).Namespace("default")
+	assert.Eventually(t, func() bool {
+		u, err := resource.Get(ctx, "pt1", metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+		last, _, _ := unstructured.NestedString(u.Object, "status", "lastProbeTime")
+		ratio, _, _ := unstructured.NestedFloat64(u.Object, "status", "successRatio")
+		return last != "" && ratio == 100
+	}, 3*time.Second, 100*time.Millisecond)
+
+	u, err := resource.Get(ctx, "pt2", metav1.GetOptions{})
+	assert.NoError(t, err)
+	lastErr, _, _ := unstructured.NestedString(u.Object, "status", "lastError")
+	assert.Contains(t, lastErr, "missing addr")
+
+	// update
+	u, err = resource.Get(ctx, "pt1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	unstructured.SetNestedField(u.Object, "127.0.0.1:1", "spec", "addr")
+	_, err = resource.Update(ctx, u, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return tp.isExist("127.0.0.1:1") && !tp.isExist(ln.Addr().String())
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// delete
+	assert.NoError(t, resource.Delete(ctx, "pt1", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool { return !tp.isExist("127.0.0.1:1") }, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestLeader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := newLeader("replica1")
+	called := make(chan context.Context, 1)
+	done := make(chan struct{})
+	go func() {
+		l.do(ctx, func(ctx context.Context) {
+			called <- ctx
+			<-ctx.Done()
+		})
+		close(done)
+	}()
+
+	// standby
+	select {
+	case <-called:
+		t.Fatal("unexpected call by the standby")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, l.isLeader())
+
+	term, lost := context.WithCancel(ctx)
+	l.set(term)
+	assert.True(t, l.isLeader())
+	fctx := <-called
+
+	// the leadership is lost
+	lost()
+	l.set(nil)
+	<-fctx.Done()
+	assert.False(t, l.isLeader())
+
+	// the next term
+	term, lost = context.WithCancel(ctx)
+	defer lost()
+	l.set(term)
+	<-called
+	cancel()
+	<-done
+
+	// election
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ctx1, cancel1 := context.WithCancel(ctx)
+
+	req := &request{namespace: "default", kubeLeaseName: "tcpprobe"}
+	clientset := fake.NewSimpleClientset()
+	l1, l2 := newLeader("replica1"), newLeader("replica2")
+	for _, l := range []*leader{l1, l2} {
+		l.leaseDuration, l.renewDeadline, l.retryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+	}
+
+	go l1.run(ctx1, clientset, req)
+	assert.Eventually(t, l1.isLeader, 2*time.Second, 50*time.Millisecond)
+
+	go l2.run(ctx, clientset, req)
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, l2.isLeader())
+
+	cancel1()
+	assert.Eventually(t, l2.isLeader, 3*time.Second, 50*time.Millisecond)
+	assert.False(t, l1.isLeader())
+}
+
+func TestAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	tp := &tp{targets: make(map[string]prop)}
+	tp.admin = newAdmin(ctx, tp, &request{timeout: time.Second})
+	srv := httptest.NewServer(tp.admin)
+	defer srv.Close()
+
+	body := fmt.Sprintf(`{"addr":"%s","interval":"100ms","labels":{"adhoc":"true"}}`, ln.Addr())
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL, "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL, "application/json", strings.NewReader(`{"interval":"1s"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"?persist=false", "application/json", strings.NewReader(`{"addr":"127.0.0.1:1","interval":"1h"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var targets []adminTargetStatus
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		targets = nil
+		json.NewDecoder(resp.Body).Decode(&targets)
+		return len(targets) == 2 && targets[1].LastProbe != ""
+	}, 2*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, "127.0.0.1:1", targets[0].Target)
+	assert.Contains(t, targets[0].LastError, "connection refused")
+	assert.Equal(t, ln.Addr().String(), targets[1].Target)
+	assert.True(t, targets[1].Ephemeral)
+	assert.Equal(t, 100.0, targets[1].Success)
+
+	// reload
+	tp.admin.reload()
+	assert.False(t, tp.isExist("127.0.0.1:1"))
+	assert.True(t, tp.isExist(ln.Addr().String()))
+
+	r, _ := http.NewRequest(http.MethodDelete, srv.URL+"?target="+ln.Addr().String(), nil)
+	resp, err = http.DefaultClient.Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.False(t, tp.isExist(ln.Addr().String()))
+
+	resp, err = http.DefaultClient.Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	r, _ = http.NewRequest(http.MethodPut, srv.URL, nil)
+	resp, err = http.DefaultClient.Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestProber(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}))
+	defer ts.Close()
+
+	p, err := newProber(&request{timeout: time.Second, timeoutHTTP: time.Second, probeMaxConcurrency: 1})
+	assert.NoError(t, err)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?target=" + url.QueryEscape(ts.URL) + "&timeout=3s")
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(b), "tp_probe_success 1")
+	assert.Contains(t, string(b), fmt.Sprintf(`tp_http_status_code{target="%s"} 200`, ts.URL))
+	assert.Contains(t, string(b), "tp_probe_duration_seconds")
+
+	// the global registry is untouched
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				assert.NotEqual(t, ts.URL, l.GetValue())
+			}
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "?target=127.0.0.1:1")
+	assert.NoError(t, err)
+	b, _ = ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(b), "tp_probe_success 0")
+
+	resp, err = http.Get(srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "?target=127.0.0.1:1&timeout=-1s")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// concurrency
+	p.sem <- struct{}{}
+	resp, err = http.Get(srv.URL + "?target=127.0.0.1:1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	<-p.sem
+
+	// deny and allow lists
+	p, err = newProber(&request{timeout: time.Second, probeMaxConcurrency: 1, probeDeny: "127.0.0.0/8"})
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target="+url.QueryEscape(ts.URL), nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target=unix:///tmp/tp.sock", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	p, err = newProber(&request{probeMaxConcurrency: 1, probeAllow: "10.0.0.0/8"})
+	assert.NoError(t, err)
+	assert.True(t, p.isAllowed(net.ParseIP("10.1.2.3")))
+	assert.False(t, p.isAllowed(net.ParseIP("192.168.1.1")))
+
+	_, err = newProber(&request{probeMaxConcurrency: 1, probeDeny: "10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestReadiness(t *testing.T) {
+	tp := &tp{targets: make(map[string]prop)}
+	k := &k8s{}
+	r := newReadiness(tp, k, &request{kubeWatchThreshold: 100 * time.Millisecond})
+
+	rec := httptest.NewRecorder()
+	r.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "the config has not been loaded")
+	assert.Contains(t, rec.Body.String(), "the k8s watch is disconnected")
+
+	r.setConfig(nil)
+	k.watch.update(nil)
+	assert.Empty(t, r.check())
+	assert.True(t, k.watch.isConnected())
+
+	// a target which hasn't been probed
+	c := newClient(&request{}, "127.0.0.1:1")
+	tp.targets["127.0.0.1:1"] = prop{client: c}
+	assert.Equal(t, []string{"no probe has been completed"}, r.check())
+	c.status.update(nil)
+	assert.Empty(t, r.check())
+
+	// the config reload failed
+	r.setConfig(errors.New("bad config"))
+	assert.Equal(t, []string{"the config reload failed: bad config"}, r.check())
+	r.setConfig(nil)
+
+	// the watch is disconnected
+	k.watch.update(errors.New("connection refused"))
+	assert.False(t, k.watch.isConnected())
+	assert.Empty(t, r.check())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, []string{"the k8s watch is disconnected"}, r.check())
+
+	rec = httptest.NewRecorder()
+	r.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	k.watch.update(nil)
+	rec = httptest.NewRecorder()
+	r.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestDrain(t *testing.T) {
+	// drain
+	wg := &sync.WaitGroup{}
+	tp := &tp{targets: make(map[string]prop)}
+	tp.targets["127.0.0.1:1"] = prop{}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tp.Lock()
+		delete(tp.targets, "127.0.0.1:1")
+		tp.Unlock()
+	}()
+	assert.True(t, tp.drain(wg, time.Second))
+
+	wg.Add(1)
+	assert.False(t, tp.drain(wg, 50*time.Millisecond))
+	wg.Done()
+
+	// exit code
+	assert.Equal(t, 0, tp.exitCode())
+	tp.failed = true
+	assert.Equal(t, exitFailure, tp.exitCode())
+	tp.violated = true
+	assert.Equal(t, exitThreshold, tp.exitCode())
+}
+
+func TestGetConfig(t *testing.T) {
+	cfgFile, err := ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.Equal(t, nil, err)
+
+	content := `
+  targets:
+    - addr: https://www.google.com
+      interval: 10s
+      labels:
+        pop: bur`
+
+	cfgFile.Write([]byte(content))
+	cfg, err := getConfig(cfgFile.Name())
+	assert.Equal(t, nil, err)
+	assert.Len(t, cfg.Targets, 1)
+	assert.Equal(t, "https://www.google.com", cfg.Targets[0].Addr)
+	assert.Equal(t, "10s", cfg.Targets[0].Interval)
+	assert.Equal(t, map[string]string{"pop": "bur"}, cfg.Targets[0].Labels)
+
+	_, err = getConfig("notfound")
+	assert.NotNil(t, err)
+
+	cfgFile, err = ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.Equal(t, nil, err)
+	cfgFile.Write([]byte("wrongyaml"))
+	_, err = getConfig(cfgFile.Name())
+	assert.NotNil(t, err)
+
+	cfgFile, err = ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.Equal(t, nil, err)
+	cfgFile.Write([]byte("targets:\n  - addr: localhost:80\n    family: ipv5"))
+	_, err = getConfig(cfgFile.Name())
+	assert.NotNil(t, err)
+
+	cfgFile, err = ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.Equal(t, nil, err)
+	cfgFile.Write([]byte("targets:\n  - addr: localhost:80\n    mode: udp"))
+	_, err = getConfig(cfgFile.Name())
+	assert.NotNil(t, err)
+
+	cfgFile, err = ioutil.TempFile(t.TempDir(), "config.yml")
+	assert.Equal(t, nil, err)
+	cfgFile.Write([]byte("targets:\n  - addr: localhost:80\n    splay: 120%"))
+	_, err = getConfig(cfgFile.Name())
+	assert.NotNil(t, err)
+}
+
+func TestTargetOverrides(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+targets:
+  - addr: https://legacy.example.com
+    timeout: 10s
+    http_timeout: 1m
+    count: 3
+    source_addr: 10.0.0.1
+    server_name: legacy.local
+    insecure: true
+    filter: Rtt;HTTPStatusCode
+    expect_status: [200, 204]
+    expect_body_limit: 1024
+    follow_redirects: true
+    max_redirects: 2
+  - addr: https://www.example.com`
+
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(content), 0644))
+	cfg, err := getConfig(cfgFile)
+	assert.NoError(t, err)
+
+	req := &request{timeout: 2 * time.Second, timeoutHTTP: 30 * time.Second, count: 1,
+		filter: "Rtt", maxRedirects: 10, expectBodyLimit: 65536}
+
+	r := cfg.Targets[0].request(req)
+	assert.Equal(t, 10*time.Second, r.timeout)
+	assert.Equal(t, time.Minute, r.timeoutHTTP)
+	assert.Equal(t, 3, r.count)
+	assert.Equal(t, "10.0.0.1", r.srcAddr)
+	assert.Equal(t, "legacy.local", r.serverName)
+	assert.True(t, r.insecure)
+	assert.Equal(t, "Rtt;HTTPStatusCode", r.filter)
+	assert.Equal(t, []int{200, 204}, r.expectStatus)
+	assert.Equal(t, int64(1024), r.expectBodyLimit)
+	assert.True(t, r.followRedirects)
+	assert.Equal(t, 2, r.maxRedirects)
+
+	// inherited from the command line
+	r = cfg.Targets[1].request(req)
+	assert.Equal(t, 2*time.Second, r.timeout)
+	assert.Equal(t, 30*time.Second, r.timeoutHTTP)
+	assert.Equal(t, 1, r.count)
+	assert.Equal(t, "Rtt", r.filter)
+	assert.False(t, r.insecure)
+	assert.Equal(t, 10, r.maxRedirects)
+
+	for _, invalid := range []string{"timeout: 10", "http_timeout: abc", "count: -1", "source_addr: host"} {
+		assert.NoError(t, ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: slow:80\n    "+invalid), 0644))
+		_, err = getConfig(cfgFile)
+		if assert.Error(t, err, invalid) {
+			assert.Contains(t, err.Error(), "target slow:80")
+		}
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	os.Setenv("TP_REGION", "us-west")
+	defer os.Unsetenv("TP_REGION")
+
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+defaults:
+  interval: 10s
+  timeout: 2s
+  labels:
+    region: ${TP_REGION}
+    env: ${TP_ENV:-prod}
+targets:
+  - addr: https://www.example.com
+  - addr: https://legacy.example.com
+    interval: 30s
+    timeout: 10s
+    labels:
+      env: staging
+      pop: bur`
+
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(content), 0644))
+	cfg, err := getConfig(cfgFile)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "10s", cfg.Targets[0].Interval)
+	assert.Equal(t, 2*time.Second, cfg.Targets[0].timeout)
+	assert.Equal(t, map[string]string{"region": "us-west", "env": "prod"}, cfg.Targets[0].Labels)
+
+	assert.Equal(t, "30s", cfg.Targets[1].Interval)
+	assert.Equal(t, 10*time.Second, cfg.Targets[1].timeout)
+	assert.Equal(t, map[string]string{"region": "us-west", "env": "staging", "pop": "bur"}, cfg.Targets[1].Labels)
+
+	// undefined variable without fallback
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: ${TP_UNDEFINED}:80"), 0644))
+	_, err = getConfig(cfgFile)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: undefined environment variable TP_UNDEFINED")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+defaults:
+  interval: 10s
+targets:
+  - addr: https://www.example.com
+    labels:
+      pop-1: bur
+  - addr: tcp://db.local
+    intervall: 5s
+  - addr: 10.0.0.1:80
+    interval: 10
+    labels:
+      1bad: x
+  - addr: unix:///var/run/app.sock
+  - interval: 5s`
+
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(content), 0644))
+	assert.Equal(t, []string{
+		"line 9: field intervall not found in type main.target",
+		"line 8: target #2 tcp://db.local: missing port in address",
+		"line 10: target #3 10.0.0.1:80: invalid interval: time: missing unit in duration \"10\"",
+		"line 10: target #3 10.0.0.1:80: invalid label name: \"1bad\"",
+		"line 15: target #5: missing addr",
+	}, checkConfig(cfgFile))
+
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: tcp://127.0.0.1:80"), 0644))
+	assert.Len(t, checkConfig(cfgFile), 0)
+
+	assert.Len(t, checkConfig("notfound"), 1)
+}
+
+func TestTargetsFile(t *testing.T) {
+	content := `
+# inventory
+10.0.0.1:443 pop=bur role=edge
+https://www.example.com   # no labels
+
+tcp://db.local:5432 role=db`
+
+	targets, err := readTargets(strings.NewReader(content))
+	assert.NoError(t, err)
+	assert.Len(t, targets, 3)
+	assert.Equal(t, "10.0.0.1:443", targets[0].Addr)
+	assert.Equal(t, map[string]string{"pop": "bur", "role": "edge"}, targets[0].Labels)
+	assert.Equal(t, "https://www.example.com", targets[1].Addr)
+	assert.Nil(t, targets[1].Labels)
+	assert.Equal(t, map[string]string{"role": "db"}, targets[2].Labels)
+
+	_, err = readTargets(strings.NewReader("10.0.0.1:443\n10.0.0.2:443 pop"))
+	assert.EqualError(t, err, "line 2: invalid label: pop, expected key=value")
+
+	_, err = readTargets(strings.NewReader("tcp://db.local"))
+	assert.Error(t, err)
+
+	// the targets file with the config
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yml")
+	targetsFile := filepath.Join(dir, "hosts.txt")
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: tcp://127.0.0.1:80"), 0644))
+	assert.NoError(t, ioutil.WriteFile(targetsFile, []byte("127.0.0.1:81 pop=bur\n"), 0644))
+
+	req := &request{config: cfgFile, targetsFile: targetsFile}
+	tp := &tp{targets: make(map[string]prop)}
+	cfg, err := tp.getTargets(req)
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Targets, 2)
+	assert.Equal(t, "127.0.0.1:81", cfg.Targets[1].Addr)
+	assert.Equal(t, []string{cfgFile, targetsFile}, req.configFiles())
+
+	state := getFilesState(req.configFiles())
+	assert.NoError(t, ioutil.WriteFile(targetsFile, []byte("127.0.0.1:81 pop=bur\n127.0.0.1:82\n"), 0644))
+	assert.NotEqual(t, state, getFilesState(req.configFiles()))
+}
+
+func TestRemoteConfig(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu     sync.Mutex
+		body   = "targets:\n  - addr: tcp://127.0.0.1:80\n"
+		etag   = `"v1"`
+		status = http.StatusOK
+	)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	update := func(b, e string, s int) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, etag, status = b, e, s
+	}
+
+	req := &request{configURL: ts.URL, timeoutHTTP: time.Second, configInsecure: true}
+	rc, err := newRemoteConfig(req)
+	assert.NoError(t, err)
+
+	assert.True(t, rc.refresh(ctx))
+	assert.Len(t, rc.config.Targets, 1)
+
+	// not modified
+	assert.False(t, rc.refresh(ctx))
+
+	update("targets:\n  - addr: tcp://127.0.0.1:80\n  - addr: tcp://127.0.0.1:81\n", `"v2"`, http.StatusOK)
+	assert.True(t, rc.refresh(ctx))
+	assert.Len(t, rc.config.Targets, 2)
+
+	tp := &tp{targets: make(map[string]prop), remote: rc}
+	cfg, err := tp.getTargets(&request{})
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Targets, 2)
+
+	// the last good config is kept
+	update("targets:\n  - addr: localhost:80\n    family: ipv5\n", `"v3"`, http.StatusOK)
+	assert.False(t, rc.refresh(ctx))
+	assert.Len(t, rc.config.Targets, 2)
+	assert.Equal(t, int64(1), rc.fetchErrors)
+
+	update("", "", http.StatusInternalServerError)
+	assert.False(t, rc.refresh(ctx))
+	assert.Equal(t, int64(2), rc.fetchErrors)
+
+	// the certificate isn't trusted
+	rc, err = newRemoteConfig(&request{configURL: ts.URL, timeoutHTTP: time.Second})
+	assert.NoError(t, err)
+	assert.False(t, rc.refresh(ctx))
+	assert.Nil(t, rc.config)
+}
+
+func TestReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer ln.Close()
+		addrs = append(addrs, "tcp://"+ln.Addr().String())
+	}
+
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	write := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(content), 0644))
+	}
+
+	write(fmt.Sprintf("targets:\n  - addr: %s\n    interval: 1h\n  - addr: %s\n    interval: 1h\n",
+		addrs[0], addrs[1]))
+
+	req := &request{config: cfgFile, timeout: time.Second, interval: time.Hour, quiet: true}
+	tp := &tp{targets: make(map[string]prop)}
+	wg := &sync.WaitGroup{}
+
+	client := func(addr string) *client {
+		tp.Lock()
+		defer tp.Unlock()
+		if p, ok := tp.targets[addr]; ok {
+			return p.client
+		}
+		return nil
+	}
+
+	tp.reload(ctx, wg, req)
+	assert.Eventually(t, func() bool {
+		return client(addrs[0]) != nil && client(addrs[1]) != nil
+	}, time.Second, 10*time.Millisecond)
+	c0, c1 := client(addrs[0]), client(addrs[1])
+
+	// delete the first, change the second and add the third
+	write(fmt.Sprintf("targets:\n  - addr: %s\n    interval: 2h\n  - addr: %s\n    interval: 1h\n",
+		addrs[1], addrs[2]))
+	tp.reload(ctx, wg, req)
+	assert.Eventually(t, func() bool {
+		return client(addrs[2]) != nil && client(addrs[1]) != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, client(addrs[0]))
+	assert.NotSame(t, c1, client(addrs[1]))
+	assert.NotNil(t, c0)
+	c1, c2 := client(addrs[1]), client(addrs[2])
+
+	// the malformed config is rejected
+	write("targets:\n  - addr: localhost:80\n    family: ipv5")
+	tp.reload(ctx, wg, req)
+	assert.Same(t, c1, client(addrs[1]))
+	assert.Same(t, c2, client(addrs[2]))
+	assert.Len(t, tp.config, 2)
+
+	cancel()
+	wg.Wait()
+}
+func TestIsIPAddr(t *testing.T) {
+	assert.True(t, isIPAddr("8.8.8.8"))
+	assert.False(t, isIPAddr("www.yahoo.com"))
+}
+
+func TestPubSub(t *testing.T) {
+	var s *stats
+
+	c := &client{
+		mu: &sync.Mutex{},
+	}
+
+	ch := make(chan *stats, 1)
+	c.subscribe(ch)
+	c.stats.RcvMss = 1460
+	c.publish()
+	select {
+	case s = <-ch:
+	default:
+	}
+
+	assert.Len(t, c.subCh, 1)
+	assert.Equal(t, uint32(1460), s.RcvMss)
+
+	c.unsubscribe(ch)
+	assert.Len(t, c.subCh, 0)
+}
+
+func TestGrpc(t *testing.T) {
+	tp := &tp{targets: make(map[string]prop)}
+
+	req := &request{
+		grpcAddr: "127.0.0.1:8085",
+		cmd: &cmdReq{
+			cmd:      "add",
+			addr:     "127.0.0.1:8085",
+			interval: "5s",
+			insecure: true,
+			args:     []string{"127.0.0.1:8085"},
+		},
+	}
+	grpcServer(tp, req)
+
+	// add
+	grpcClient(req)
+	time.Sleep(time.Millisecond * 300)
+	assert.Contains(t, tp.targets, "127.0.0.1:8085")
+
+	req.cmd = &cmdReq{
+		cmd:      "del",
+		addr:     "127.0.0.1:8085",
+		insecure: true,
+		args:     []string{"127.0.0.1:8085"},
+	}
+
+	// del
+	grpcClient(req)
+	time.Sleep(time.Millisecond * 300)
+	assert.NotContains(t, tp.targets, "127.0.0.1:8085")
+}
+
+func TestStats2pbStruct(t *testing.T) {
+	s := &stats{State: 1, Rtt: 55, TCPCongesAlg: "reno"}
+	pbs := stats2pbStruct(s)
+	v := pbs.Fields["State"].GetNumberValue()
+	assert.Equal(t, 1.0, v)
+	v = pbs.Fields["Rtt"].GetNumberValue()
+	assert.Equal(t, 55.0, v)
+	vs := pbs.Fields["TCPCongesAlg"].GetStringValue()
+	assert.Equal(t, "reno", vs)
+}
+
+func TestInflux(t *testing.T) {
+	ch := make(chan string, 1)
+	status := []int{http.StatusNoContent, http.StatusInternalServerError}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		user, _, _ := r.BasicAuth()
+		w.WriteHeader(status[0])
+		status = status[1:]
+		ch <- user + " " + string(b)
+	}))
+	defer ts.Close()
+
+	req := &request{
+		influxURL:           ts.URL,
+		influxUsername:      "tp",
+		influxBatchSize:     1,
+		influxFlushInterval: time.Second,
+		timeoutHTTP:         time.Second,
+	}
+
+	i := newInflux(req)
+	ctx, cancel := context.WithCancel(context.Background())
+	go i.run(ctx)
+
+	b, _ := json.Marshal(map[string]string{"pop": "a b,c"})
+	c := &client{target: "127.0.0.1:80", stats: stats{Rtt: 5, TCPCongesAlg: "cubic"}}
+	i.write(context.WithValue(ctx, labelsKey, b), c)
+
+	line := <-ch
+	assert.True(t, strings.HasPrefix(line, `tp tcpprobe,pop=a\ b\,c,target=127.0.0.1:80 `))
+	assert.Contains(t, line, ",Rtt=5i,")
+	assert.Contains(t, line, `TCPCongesAlg="cubic"`)
+	assert.Equal(t, int64(0), c.stats.InfluxWriteError)
+
+	// the failed write is counted by the target and the prober's metrics
+	dropped := testutil.ToFloat64(selfMetrics.influxDropped)
+	i.write(ctx, c)
+	<-ch
+	cancel()
+	i.wait()
+	assert.Equal(t, dropped+1, testutil.ToFloat64(selfMetrics.influxDropped))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&c.influxErrors))
+
+	// the stats are updated on report
+	c = newClient(&request{quiet: true}, "127.0.0.1:80")
+	c.influx = i
+	atomic.StoreInt64(&c.influxErrors, 3)
+	c.report(context.Background(), 0)
+	assert.Equal(t, int64(3), c.stats.InfluxWriteError)
+
+	// the full queue
+	i = newInflux(&request{influxBatchSize: 1})
+	for n := 0; n < cap(i.ch)+1; n++ {
+		i.write(ctx, c)
+	}
+	assert.Equal(t, int64(4), atomic.LoadInt64(&c.influxErrors))
+	assert.Equal(t, dropped+2, testutil.ToFloat64(selfMetrics.influxDropped))
+}
+
+func TestStatsd(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	s, err := newStatsd(&request{statsdAddr: l.LocalAddr().String(), statsdPrefix: "tcpprobe."})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	c := &client{target: "127.0.0.1:80", stats: stats{Rtt: 1500, SndCwnd: 10, TCPConnectError: 2}}
+	s.send(ctx, c)
+
+	var packets string
+	buf := make([]byte, statsdMaxPacket)
+	l.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		assert.LessOrEqual(t, n, statsdMaxPacket)
+		packets += string(buf[:n]) + "\n"
+	}
+	assert.Contains(t, packets, "tcpprobe.tcpinfo_rtt:1.5|ms|#target:127.0.0.1_80\n")
+	assert.Contains(t, packets, "tcpprobe.tcpinfo_snd_cwnd:10|g|#target:127.0.0.1_80\n")
+	assert.Contains(t, packets, "tcpprobe.tcp_connect_error:2|c|#target:127.0.0.1_80\n")
+
+	// counters are sent as increments
+	c.stats.TCPConnectError = 3
+	m := statsdMetrics(c, "", nil)
+	assert.Contains(t, m, "tcp_connect_error:1|c")
+	m = statsdMetrics(c, "", nil)
+	assert.NotContains(t, m, "tcp_connect_error:1|c")
+
+	m = []string{"a:1|g", "b:1|g"}
+	assert.Equal(t, []string{"a:1|g\nb:1|g"}, statsdPackets(m))
+	assert.Len(t, statsdPackets(append(m, strings.Repeat("x", statsdMaxPacket))), 2)
+}
+
+func TestOTLP(t *testing.T) {
+	ch := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		b, _ := ioutil.ReadAll(r.Body)
+		ch <- b
+	}))
+	defer ts.Close()
+
+	o := newOTLP(&request{otlpEndpoint: ts.URL, otlpInterval: time.Minute, timeoutHTTP: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	go o.run(ctx)
+
+	c := &client{target: "127.0.0.1:80", stats: stats{Rtt: 5, TCPConnectError: 1}}
+	o.record(ctx, c)
+	cancel()
+	o.wait()
+
+	b := <-ch
+	assert.Contains(t, string(b), `{"name":"tp_tcpinfo_rtt","description":"smoothed round trip time","unit":"us","gauge":{"dataPoints":[{"attributes":[{"key":"target","value":{"stringValue":"127.0.0.1:80"}}]`)
+	assert.Contains(t, string(b), `"asInt":"5"`)
+	assert.Contains(t, string(b), `"aggregationTemporality":2,"isMonotonic":true`)
+
+	// the metric prefix applies
+	metricPrefix = "tcpprobe"
+	defer func() { metricPrefix = "tp" }()
+	m := o.metrics()
+	assert.NotEmpty(t, m)
+	for _, metric := range m {
+		assert.True(t, strings.HasPrefix(metric.Name, "tcpprobe_"), metric.Name)
+	}
+
+	o.remove(c.target)
+	assert.Len(t, o.metrics(), 0)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var status, attempts int32 = http.StatusNoContent, 0
+	ch := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		code := int(atomic.LoadInt32(&status))
+		if code == http.StatusNoContent {
+			b, _ := ioutil.ReadAll(r.Body)
+			ch <- b
+		}
+		w.WriteHeader(code)
+	}))
+	defer ts.Close()
+
+	rw := newRemoteWrite(&request{remoteWriteURL: ts.URL, remoteWriteBearerToken: "secret", remoteWriteInterval: time.Minute})
+	rw.backoff = time.Millisecond
+
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "tp_rw_test", ConstLabels: prometheus.Labels{"target": "127.0.0.1:80"}})
+	g.Set(5)
+
+	// written
+	rw.keep([]prometheus.Collector{g})
+	rw.flush()
+	b, err := snappy.Decode(nil, <-ch)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "__name__")
+	assert.Contains(t, string(b), "tp_rw_test")
+	assert.Contains(t, string(b), "127.0.0.1:80")
+	assert.Len(t, rw.pending, 0)
+
+	// retried on 5xx and kept pending
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	atomic.StoreInt32(&attempts, 0)
+	rw.keep([]prometheus.Collector{g})
+	rw.flush()
+	assert.Equal(t, int32(remoteWriteRetries+1), atomic.LoadInt32(&attempts))
+	assert.Len(t, rw.pending, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(selfMetrics.remoteWritePending))
+
+	// dropped on 4xx
+	dropped := testutil.ToFloat64(selfMetrics.remoteWriteDropped)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	atomic.StoreInt32(&attempts, 0)
+	rw.flush()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	assert.Len(t, rw.pending, 0)
+	assert.Equal(t, dropped+1, testutil.ToFloat64(selfMetrics.remoteWriteDropped))
+
+	// the histogram is expanded to its series
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "tp_rw_hist", Buckets: []float64{1}})
+	h.Observe(0.5)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(h)
+	families, _ := registry.Gather()
+	samples := rwSamples(families, 1)
+	assert.Len(t, samples, 4)
+	assert.Equal(t, []rwLabel{{"__name__", "tp_rw_hist_bucket"}, {"le", "+Inf"}}, samples[1].labels)
+
+	_, err = getRemoteWriteURL("mimir:8080/api/v1/push")
+	assert.Error(t, err)
+}
+
+func TestKafka(t *testing.T) {
+	r := &request{
+		kafkaBrokers:       []string{"127.0.0.1:9092"},
+		kafkaTopic:         "tcpprobe",
+		kafkaAcks:          -1,
+		kafkaQueueSize:     10,
+		kafkaSASLMechanism: "scram-sha-512",
+		kafkaUsername:      "user",
+		kafkaPassword:      "secret",
+		kafkaTLS:           true,
+		shutdownGrace:      time.Second,
+	}
+	k, err := newKafka(r)
+	assert.NoError(t, err)
+
+	w := k.writer.(*kafkago.Writer)
+	assert.Equal(t, "tcpprobe", w.Topic)
+	assert.Equal(t, kafkago.RequireAll, w.RequiredAcks)
+	assert.IsType(t, &kafkago.Murmur2Balancer{}, w.Balancer)
+	assert.NotNil(t, w.Transport.(*kafkago.Transport).TLS)
+	assert.Equal(t, "SCRAM-SHA-512", w.Transport.(*kafkago.Transport).SASL.Name())
+
+	// the records are keyed by the target
+	kw := &kafkaTestWriter{}
+	k.writer = kw
+	ctx, cancel := context.WithCancel(context.Background())
+	go k.run(ctx)
+
+	for _, target := range []string{"127.0.0.1:80", "127.0.0.2:443"} {
+		k.produce(&client{target: target, req: r, stats: stats{Rtt: 5}}, 1)
+	}
+	cancel()
+	k.wait()
+
+	assert.True(t, kw.closed)
+	assert.Len(t, kw.msgs, 2)
+	for _, m := range kw.msgs {
+		assert.Contains(t, string(m.Value), `"Target":"`+string(m.Key)+`"`)
+		assert.Contains(t, string(m.Value), `"Rtt":5`)
+	}
+
+	// the failed connect is produced and exported
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	kw = &kafkaTestWriter{}
+	k, _ = newKafka(r)
+	k.writer = kw
+	o := newOTLP(&request{otlpEndpoint: "http://127.0.0.1", otlpInterval: time.Minute})
+	c := newClient(&request{quiet: true, timeout: time.Second}, addr)
+	c.kafka, c.otlp = k, o
+	c.probeOnce(context.Background(), 0)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	k.run(ctx)
+
+	assert.Len(t, kw.msgs, 1)
+	assert.Contains(t, string(kw.msgs[0].Value), `"TCPConnectError":1`)
+	assert.Equal(t, int64(1), o.targets[addr].stats.TCPConnectError)
+
+	// the failed produce is dropped and counted
+	dropped := testutil.ToFloat64(selfMetrics.kafkaDropped)
+	k, _ = newKafka(r)
+	k.writer = &kafkaTestWriter{err: kafkago.WriteErrors{nil, errors.New("failed")}}
+	k.produce(&client{target: "127.0.0.1:80", req: r}, 1)
+	k.produce(&client{target: "127.0.0.2:80", req: r}, 1)
+	k.run(ctx)
+	assert.Equal(t, dropped+1, testutil.ToFloat64(selfMetrics.kafkaDropped))
+
+	// the queue is full
+	k, _ = newKafka(&request{kafkaQueueSize: 1})
+	for i := 0; i < 2; i++ {
+		k.produce(&client{target: "127.0.0.1:80", req: r}, 1)
+	}
+	assert.Equal(t, dropped+2, testutil.ToFloat64(selfMetrics.kafkaDropped))
+
+	// the java client's partitions by the key's murmur2
+	partitions := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	for key, partition := range map[string]int{"foobar": 6, "abc": 7} {
+		assert.Equal(t, partition, w.Balancer.Balance(kafkago.Message{Key: []byte(key)}, partitions...), key)
+	}
+
+	acks, err := getKafkaAcks("all")
+	assert.NoError(t, err)
+	assert.Equal(t, int16(-1), acks)
+	_, err = getKafkaAcks("2")
+	assert.Error(t, err)
+
+	_, err = getKafkaSASL("gssapi", "user", "secret")
+	assert.Error(t, err)
+
+	assert.Error(t, checkKafkaBrokers([]string{"127.0.0.1"}))
+}
+
+// kafkaTestWriter keeps the produced messages
+type kafkaTestWriter struct {
+	msgs   []kafkago.Message
+	err    error
+	closed bool
+}
+
+func (w *kafkaTestWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *kafkaTestWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+
+	s := newSyslog(&request{syslogNetwork: "udp", syslogAddr: pc.LocalAddr().String(), syslogFacility: 16, syslogTag: "tcpprobe"})
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.run(ctx)
+
+	c := &client{
+		target: "127.0.0.1:80",
+		req:    &request{syslogOnly: true},
+		labels: map[string]string{"env": "prod", "bad name": `a"b`},
+		syslog: s,
+	}
+	c.output.update(true, time.Now())
+	c.report(ctx, 1)
+	cancel()
+	s.wait()
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^<131>1 \S+ \S+ tcpprobe \d+ down \[tcpprobe@32473 target="127.0.0.1:80"\]\[labels@32473 bad_name="a\\"b" env="prod"\] \{.*"State":"down"`, string(buf[:n]))
+
+	n, _, err = pc.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^<132>1 \S+ \S+ tcpprobe \d+ probe \[tcpprobe@32473 target="127.0.0.1:80" seq="1"\]`, string(buf[:n]))
+
+	// the failed connect is sent regardless of the output mode
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s = newSyslog(&request{syslogNetwork: "udp", syslogAddr: pc.LocalAddr().String(), syslogFacility: 16, syslogTag: "tcpprobe"})
+	ctx, cancel = context.WithCancel(context.Background())
+	go s.run(ctx)
+
+	c = newClient(&request{quiet: true, timeout: time.Second}, addr)
+	c.syslog = s
+	c.probeOnce(ctx, 0)
+	cancel()
+	s.wait()
+
+	for _, msgID := range []string{"down", "probe"} {
+		n, _, err = pc.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Contains(t, string(buf[:n]), " "+msgID+" [tcpprobe@32473 target=\""+addr+"\"")
+	}
+
+	// the stream is framed by the octet counting
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	s = newSyslog(&request{syslogNetwork: "tcp", syslogAddr: ln.Addr().String(), syslogFacility: 3, syslogTag: "tcpprobe"})
+	s.write(s.message(time.Now(), syslogInfo, "probe", "-", []byte("hello")))
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	size, err := r.ReadString(' ')
+	assert.NoError(t, err)
+	msg := make([]byte, len(s.message(time.Now(), syslogInfo, "probe", "-", []byte("hello"))))
+	_, err = io.ReadFull(r, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(len(msg))+" ", size)
+	assert.True(t, bytes.HasSuffix(msg, []byte(" probe - hello")))
+	conn.Close()
+
+	// the unreachable daemon, the reconnect is postponed
+	dropped := testutil.ToFloat64(selfMetrics.syslogDropped)
+	s = newSyslog(&request{syslogNetwork: "tcp", syslogAddr: ln.Addr().String(), syslogFacility: 3, syslogTag: "tcpprobe"})
+	ln.Close()
+	s.write([]byte("a"))
+	s.write([]byte("b"))
+	assert.Nil(t, s.conn)
+	assert.Equal(t, 2*time.Second, s.backoff)
+	assert.Equal(t, dropped+2, testutil.ToFloat64(selfMetrics.syslogDropped))
+
+	// the queue is full
+	for i := 0; i <= syslogQueue; i++ {
+		s.send(c.meta(1), syslogInfo, "probe", nil)
+	}
+	assert.Equal(t, dropped+3, testutil.ToFloat64(selfMetrics.syslogDropped))
+
+	_, err = getSyslogFacility("local8")
+	assert.Error(t, err)
+	addr, err = getSyslogAddr("unix", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/log", addr)
+	_, err = getSyslogAddr("tls", "")
+	assert.Error(t, err)
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	h, err := newHistory(&request{sqlite: path, retention: time.Hour})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	now := time.Now()
+	for i, probed := range []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute), now} {
+		h.write(&client{
+			target: "127.0.0.1:80",
+			addr:   "127.0.0.1:80",
+			labels: map[string]string{"env": "prod"},
+			probed: probed,
+			stats:  stats{Rtt: uint32(i + 1), HTTPProto: "h2", TCPConnectError: int64(i)},
+		}, i)
+	}
+	h.write(&client{target: "127.0.0.2:80", probed: now}, 0)
+
+	// the rows are inserted before the expired ones are pruned
+	h.flush()
+	go h.run(ctx)
+	cancel()
+	h.wait()
+
+	rows, err := readHistory(path, "127.0.0.1:80", 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, uint32(2), rows[0].stats.Rtt)
+	assert.Equal(t, "h2", rows[0].stats.HTTPProto)
+	assert.Equal(t, int64(2), rows[1].stats.TCPConnectError)
+	assert.Equal(t, map[string]string{"env": "prod"}, rows[1].labels)
+	assert.Equal(t, now.UnixNano(), rows[1].timestamp)
+
+	rows, err = readHistory(path, "", 30*time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+
+	// the history command prints by the printers
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err = printHistory(&historyReq{path: path, target: "127.0.0.2:80", since: time.Hour, json: true, filter: "Rtt"})
+	w.Close()
+	os.Stdout = stdout
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, `{"Rtt":0,"schema_version":1}`, strings.TrimSpace(string(b)))
+
+	// the failed connect is written
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	h, err = newHistory(&request{sqlite: path, retention: time.Hour})
+	assert.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	go h.run(ctx)
+
+	c := newClient(&request{quiet: true, timeout: time.Second}, addr)
+	c.history = h
+	c.probeOnce(ctx, 0)
+	cancel()
+	h.wait()
+
+	rows, err = readHistory(path, addr, time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, int64(1), rows[0].stats.TCPConnectError)
+
+	_, err = readHistory(filepath.Join(t.TempDir(), "none.db"), "", time.Hour)
+	assert.Error(t, err)
+
+	d, err := getDaysDuration("7d")
+	assert.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, d)
+}
+
+func TestHistoryMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	// the older database which doesn't have the new stats' columns
+	db, err := openHistory(path)
+	assert.NoError(t, err)
+	for _, query := range []string{
+		historyMigrations[0],
+		`ALTER TABLE probes ADD COLUMN "Rtt" INTEGER NOT NULL DEFAULT 0`,
+		`INSERT INTO probes (target, timestamp, seq, "Rtt") VALUES ('127.0.0.1:80', ` + strconv.FormatInt(time.Now().UnixNano(), 10) + `, 1, 5)`,
+		`PRAGMA user_version = 1`,
+	} {
+		_, err = db.Exec(query)
+		assert.NoError(t, err)
+	}
+
+	var mode string
+	assert.NoError(t, db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+	db.Close()
+
+	rows, err := readHistory(path, "", time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, uint32(5), rows[0].stats.Rtt)
+
+	h, err := newHistory(&request{sqlite: path, retention: time.Hour})
+	assert.NoError(t, err)
+	defer h.db.Close()
+
+	var version int
+	assert.NoError(t, h.db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(historyMigrations), version)
+
+	columns, err := tableColumns(h.db)
+	assert.NoError(t, err)
+	assert.True(t, columns["httpproto"])
+	assert.True(t, columns["rtt"])
+}
+
+func TestCheckUpdate(t *testing.T) {
+	version = "1.1.1"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://fake/v1.1.1", http.StatusFound)
+	}))
+
+	ok, _ := checkUpdate(ts.URL)
+	assert.Equal(t, false, ok)
+	version = "1.1.0"
+	ok, newVersion := checkUpdate(ts.URL)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "v1.1.1", newVersion)
+
+	ts.Close()
+	ok, newVersion = checkUpdate(ts.URL)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, "", newVersion)
+
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "nothing")
+	}))
+	ok, newVersion = checkUpdate(ts.URL)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, "", newVersion)
+
+}
+
+// genCert generates a self-signed certificate and its key as PEM files
+func genCert(t *testing.T, cn string, validity time.Duration) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		Issuer:                pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
+
+// dnsServer runs a DNS server which answers the A queries
+// by the given function, it returns the server's address
+func dnsServer(t *testing.T, answer func(name string) []net.IP) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			h.Response = true
+			b := dnsmessage.NewBuilder(nil, h)
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			for _, ip := range answer(q.Name.String()) {
+				if q.Type != dnsmessage.TypeA {
+					break
+				}
+				var a [4]byte
+				copy(a[:], ip.To4())
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 1}, dnsmessage.AResource{A: a})
+			}
+			msg, _ := b.Finish()
+			pc.WriteTo(msg, addr)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	defer logs.set(levelInfo, "text")
+
+	logs.set(levelWarn, "json")
+	infof("target: %s has been added", "127.0.0.1:80")
+	assert.Equal(t, "", buf.String())
+
+	warnf("threshold violated: %s", "127.0.0.1:80")
+	r := logRecord{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &r))
+	assert.Equal(t, "warn", r.Level)
+	assert.Equal(t, "threshold violated: 127.0.0.1:80", r.Msg)
+
+	// debug logs the connection details
+	buf.Reset()
+	logs.set(levelDebug, "text")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	c := newClient(&request{timeout: time.Second}, ln.Addr().String())
+	assert.NoError(t, c.connect(context.Background()))
+	c.close()
+	assert.Contains(t, buf.String(), "debug: target: "+ln.Addr().String())
+	assert.Contains(t, buf.String(), "local: 127.0.0.1:")
+
+	level, err := getLogLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, levelWarn, level)
+	_, err = getLogLevel("trace")
+	assert.Error(t, err)
+
+	assert.Equal(t, levelInfo, (&request{}).logLevel)
+}
+
+func TestOutputModes(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	// on-change
+	c := newClient(&request{timeout: time.Second, onChange: true, json: true, filter: "Rtt"}, addr)
+	c.probeOnce(ctx, 0)
+	c.probeOnce(ctx, 1)
+	ln.Close()
+	c.probeOnce(ctx, 2)
+	c.probeOnce(ctx, 3)
+	time.Sleep(10 * time.Millisecond)
+	ln, err = net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	c.probeOnce(ctx, 4)
+
+	// quiet-success
+	c = newClient(&request{timeout: time.Second, quietSuccess: true, json: true, filter: "Rtt"}, addr)
+	c.probeOnce(ctx, 0)
+	ln.Close()
+	c.probeOnce(ctx, 1)
+
+	w.Close()
+	os.Stdout = stdout
+
+	b, _ := ioutil.ReadAll(r)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 7)
+
+	var states []string
+	for _, line := range lines {
+		m := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		if state, ok := m["State"]; ok {
+			states = append(states, state.(string))
+		}
+	}
+	assert.Equal(t, []string{"up", "down", "up"}, states)
+
+	m := map[string]interface{}{}
+	json.Unmarshal([]byte(lines[4]), &m)
+	assert.Greater(t, m["Downtime"], float64(10000))
+
+	// the failed probe is printed only
+	assert.Contains(t, lines[6], "Rtt")
+
+	// the unexpected HTTP status is printed by the quiet-success
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	r, w, _ = os.Pipe()
+	os.Stdout = w
+	for _, req := range []struct {
+		url    string
+		expect []int
+	}{
+		{ts.URL, nil},
+		{ts.URL + "/missing", nil},
+		{ts.URL, []int{http.StatusNoContent}},
+	} {
+		c = newClient(&request{timeout: time.Second, quietSuccess: true, json: true, filter: "HTTPStatusCode", expectStatus: req.expect}, req.url)
+		c.probeOnce(ctx, 0)
+	}
+	w.Close()
+	os.Stdout = stdout
+
+	b, _ = ioutil.ReadAll(r)
+	lines = strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"HTTPStatusCode":404`)
+	assert.Contains(t, lines[1], `"HTTPStatusCode":200`)
+
+	s := outputState{}
+	s.update(true, time.Now())
+	assert.True(t, s.changed)
+	s.update(true, time.Now())
+	assert.False(t, s.changed)
+	s.update(false, s.since.Add(time.Minute))
+	assert.Equal(t, time.Minute, s.downtime)
+}
+
+func TestFieldFilter(t *testing.T) {
+	f := newFieldFilter("rtt, rttvar;HTTP*")
+	assert.True(t, f.match("Rtt"))
+	assert.True(t, f.match("Rttvar"))
+	assert.True(t, f.match("HTTPResponse"))
+	assert.False(t, f.match("MinRtt"))
+
+	f = newFieldFilter("!Ca*")
+	assert.False(t, f.match("CaState"))
+	assert.True(t, f.match("Rtt"))
+
+	f = newFieldFilter("")
+	assert.True(t, f.match("Rtt"))
+
+	assert.NoError(t, checkFilter("rtt,HTTP*,!Ca*"))
+	err := checkFilter("rtt,foo,!bar*,[")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "foo, !bar*, [")
+	assert.Contains(t, err.Error(), "Rttvar")
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c := &client{stats: stats{Rtt: 5, Rttvar: 2, HTTPStatusCode: 200}, req: &request{filter: "rtt*,http*,!*bytes"}}
+	c.printText(0)
+	c.printJSON(0, false)
+	c.req.csv = true
+	c.printCSV(0)
+	w.Close()
+	os.Stdout = stdout
+
+	b, _ := ioutil.ReadAll(r)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[1], "Rttvar:2 ")
+	assert.Contains(t, lines[1], "HTTPStatusCode:200 ")
+	assert.NotContains(t, lines[1], "HTTPRcvdBytes")
+	assert.NotContains(t, lines[1], "MinRtt")
+
+	m := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &m))
+	assert.Contains(t, m, "HTTPResponse")
+	assert.NotContains(t, m, "HTTPSentBytes")
+	assert.NotContains(t, m, "Target")
+
+	// the csv header is printed once
+	assert.Len(t, strings.Split(lines[3], ","), len(strings.Fields(lines[1]))+4)
+}
+
+func TestRecordMeta(t *testing.T) {
+	ctx := context.WithValue(context.Background(), labelsKey, []byte(`{"env":"prod","app":"web"}`))
+	c := &client{
+		target:    "127.0.0.1:80",
+		addr:      "127.0.0.1:80",
+		stats:     stats{Rtt: 5},
+		req:       &request{filter: "rtt"},
+		probed:    time.Unix(1609558015, 123456789).UTC(),
+		timestamp: 1609558015,
+		labels:    getRecordLabels(ctx),
+	}
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c.printText(7)
+	c.req.json = true
+	c.printJSON(7, false)
+	c.req.noTimestamp = true
+	c.printText(8)
+	c.printJSON(8, false)
+	w.Close()
+	os.Stdout = stdout
+
+	b, _ := ioutil.ReadAll(r)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 6)
+	assert.Equal(t, "2021-01-02T03:26:55.123456789Z target: 127.0.0.1:80 (127.0.0.1) seq: 7 labels: app=web,env=prod", lines[0])
+	assert.Equal(t, "target: 127.0.0.1:80 (127.0.0.1) seq: 8 labels: app=web,env=prod", lines[3])
+
+	c.req.filter = ""
+	c.req.noTimestamp = false
+	m := map[string]interface{}{}
+	b, _ = json.Marshal(struct {
+		recordMeta
+		stats
+	}{c.meta(7), c.stats})
+	assert.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, float64(jsonSchemaVersion), m["schema_version"])
+	assert.Equal(t, "2021-01-02T03:26:55.123456789Z", m["Time"])
+	assert.Equal(t, float64(7), m["Seq"])
+	assert.Equal(t, map[string]interface{}{"app": "web", "env": "prod"}, m["Labels"])
+
+	m = map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[5]), &m))
+	assert.Equal(t, map[string]interface{}{"Rtt": float64(5), "schema_version": float64(1)}, m)
+}
+
+func TestNDJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcpprobe.ndjson")
+	req := &request{outputFile: path, outputMaxSize: 4096, outputMaxFiles: 2}
+
+	n, err := newNDJSON(req)
 	assert.NoError(t, err)
-	assert.Len(t, m, 0)
-	buf := new(bytes.Buffer)
-	go io.CopyN(buf, r, 7)
-	time.Sleep(100 * time.Millisecond)
-	assert.Equal(t, "metrics", buf.String())
 
-	r, w, _ = os.Pipe()
-	os.Stdout = w
-	args = []string{"tcpprobe"}
-	_, m, err = getCli(args)
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.run(ctx)
+
+	c := newClient(req, "127.0.0.1:80")
+	c.ndjson = n
+	for i := 0; i < 40; i++ {
+		c.printer(i)
+	}
+
+	cancel()
+	n.wait()
+
+	rotated, _ := filepath.Glob(path + ".*.gz")
+	assert.Len(t, rotated, 2)
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(b), 4096)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		m := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		assert.Equal(t, "127.0.0.1:80", m["Target"])
+	}
+
+	size, err := getByteSize("100MB")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100<<20), size)
+	size, err = getByteSize("512")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(512), size)
+	_, err = getByteSize("10TB")
 	assert.Error(t, err)
-	assert.Len(t, m, 0)
-	buf.Reset()
+}
 
-	go io.CopyN(buf, r, 5)
-	time.Sleep(100 * time.Millisecond)
-	assert.Equal(t, "usage", buf.String())
+func TestFormat(t *testing.T) {
+	ctx := context.WithValue(context.Background(), labelsKey, []byte(`{"env":"prod"}`))
+	c := &client{
+		target:    "127.0.0.1:80",
+		addr:      "127.0.0.1:80",
+		stats:     stats{Rtt: 5, HTTPStatusCode: 200},
+		req:       &request{hideUnsupported: true},
+		timestamp: 1609558015,
+		labels:    getRecordLabels(ctx),
+	}
 
-	args = []string{"tcpprobe", "127.0.0.1"}
-	_, m, err = getCli(args)
+	// the text format
+	text := "{{.Time}} target: {{.Target}} ({{.IP}}) seq: {{.Seq}}{{if .Labels}} labels: {{labels .Labels}}{{end}}\n" +
+		"{{range .Fields}}{{.Name}}:{{.Value}} {{end}}"
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	c.printText(3)
+	format, err := getFormat(text)
 	assert.NoError(t, err)
-	assert.Len(t, m, 1)
+	c.req.format = format
+	c.printFormat(3)
+
+	format, err = getFormat("{{.Target}} rtt={{.Stats.Rtt}}us status={{.Stats.HTTPStatusCode}} env={{.Labels.env}}")
+	assert.NoError(t, err)
+	c.req.format = format
+	c.printer(4)
+
+	// the missing label
+	format, err = getFormat("{{.Labels.zone}}")
+	assert.NoError(t, err)
+	c.req.format = format
+	c.printer(5)
+
+	w.Close()
 	os.Stdout = stdout
 
-	// add
-	args = []string{"tcpprobe", "add", "127.0.0.2:8080"}
-	req, _, err := getCli(args)
+	b, _ := ioutil.ReadAll(r)
+	lines := strings.Split(string(b), "\n")
+	assert.Len(t, lines, 6)
+	assert.Equal(t, lines[0:2], lines[2:4])
+	assert.Equal(t, "127.0.0.1:80 rtt=5us status=200 env=prod", lines[4])
+
+	_, err = getFormat("{{.Target")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "format:1")
+
+	_, err = getFormat("{{.Stats.Foo}}")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Foo")
+
+	_, err = getFormat("{{.Target}}\n{{.Bar}}")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "format:2:")
+}
+
+func TestColor(t *testing.T) {
+	assert.Equal(t, rttOK, getRttLevel(900, time.Millisecond, 2*time.Millisecond))
+	assert.Equal(t, rttWarn, getRttLevel(1500, time.Millisecond, 2*time.Millisecond))
+	assert.Equal(t, rttCrit, getRttLevel(2500, time.Millisecond, 2*time.Millisecond))
+	assert.Equal(t, rttOK, getRttLevel(2500, 0, 0))
+
+	assert.True(t, useColor("always"))
+	assert.False(t, useColor("never"))
+	// the stdout isn't a terminal
+	assert.False(t, useColor("auto"))
+
+	os.Setenv("NO_COLOR", "1")
+	assert.False(t, useColor("auto"))
+	os.Unsetenv("NO_COLOR")
+
+	c := &client{
+		stats: stats{Rtt: 1500, HTTPStatusCode: 503, TCPConnectError: 1, SndMss: 1448},
+		req:   &request{warnRtt: time.Millisecond, critRtt: 2 * time.Millisecond},
+	}
+
+	field := func(name string) string {
+		f, _ := reflect.TypeOf(c.stats).FieldByName(name)
+		return c.colorField(f, reflect.ValueOf(c.stats).FieldByName(name))
+	}
+
+	assert.Equal(t, colorYellow+"Rtt:1500"+colorReset, field("Rtt"))
+	assert.Equal(t, colorRed+"HTTPStatusCode:503"+colorReset, field("HTTPStatusCode"))
+	assert.Equal(t, colorRed+"TCPConnectError:1"+colorReset, field("TCPConnectError"))
+	assert.Equal(t, colorDim+"DNSResolveError:0"+colorReset, field("DNSResolveError"))
+	assert.Equal(t, "SndMss:1448", field("SndMss"))
+
+	c.stats.Rtt = 500
+	c.stats.HTTPStatusCode = 200
+	assert.Equal(t, colorGreen+"Rtt:500"+colorReset, field("Rtt"))
+	assert.Equal(t, "HTTPStatusCode:200", field("HTTPStatusCode"))
+
+	_, _, err := getCli([]string{"tcpprobe", "-color", "rainbow", "127.0.0.1"})
+	assert.Error(t, err)
+	_, _, err = getCli([]string{"tcpprobe", "-warn-rtt", "2ms", "-crit-rtt", "1ms", "127.0.0.1"})
+	assert.Error(t, err)
+}
+
+func TestTop(t *testing.T) {
+	assert.Equal(t, "▁▄█", sparkline([]uint32{100, 150, 200}))
+	assert.Equal(t, "▁▁", sparkline([]uint32{100, 100}))
+	assert.Equal(t, "", sparkline(nil))
+
+	a := newClient(&request{}, "a:80")
+	a.status.update(nil)
+	a.status.sample(&stats{Rtt: 300, HTTPStatusCode: 200}, false)
+	b := newClient(&request{}, "b:80")
+	b.status.update(nil)
+	b.status.sample(&stats{Rtt: 100}, false)
+	b.status.update(errors.New("connection refused"))
+	b.status.sample(&stats{}, true)
+	b.status.update(errors.New("connection refused"))
+	b.status.sample(&stats{}, true)
+
+	tp := &tp{targets: map[string]prop{"a:80": {client: a}, "b:80": {client: b}}}
+	top := newTop(tp, func() {})
+
+	rows := top.rows()
+	assert.Equal(t, "a:80", rows[0].target)
+	assert.Equal(t, uint32(300), rows[0].rtt)
+
+	top.sortBy = 'f'
+	rows = top.rows()
+	assert.Equal(t, "b:80", rows[0].target)
+	assert.Equal(t, 2, rows[0].fails)
+	assert.InDelta(t, 66.67, rows[0].loss, 0.01)
+	assert.Equal(t, float64(100), rows[0].avgRtt)
+
+	screen := top.render()
+	assert.Contains(t, screen, "sort: fails")
+	assert.Contains(t, screen, "a:80")
+	assert.Contains(t, screen, " 200 ")
+
+	// the stdout isn't a terminal
+	_, _, err := getCli([]string{"tcpprobe", "-top", "127.0.0.1"})
+	assert.Error(t, err)
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+		posts  int
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+
+		// the first post is retried
+		if posts++; posts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		bodies = append(bodies, string(b))
+	}))
+	defer srv.Close()
+
+	req := &request{failureThreshold: 2, webhookURL: srv.URL, webhookRetries: 1, webhookTimeout: time.Second}
+	wh := newWebhook(req)
+	wh.backoff = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go wh.run(ctx)
+
+	c := newClient(req, "127.0.0.1:80")
+	c.webhook = wh
+	c.labels = map[string]string{"env": "prod"}
+
+	c.record(errors.New("connection refused"))
+	c.record(errors.New("connection refused"))
+	c.record(errors.New("connection refused"))
+	c.record(nil)
+	c.record(nil)
+
+	// the retry is abandoned once the context is canceled
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return posts == 3
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	wh.wait()
+
+	assert.Equal(t, 3, posts)
+	assert.Len(t, bodies, 2)
+
+	e := alertEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(bodies[0]), &e))
+	assert.Equal(t, alertFailing, e.State)
+	assert.Equal(t, "connection refused", e.Error)
+	assert.Equal(t, 2, e.Failures)
+	assert.Equal(t, "prod", e.Labels["env"])
+
+	e = alertEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(bodies[1]), &e))
+	assert.Equal(t, alertRecovered, e.State)
+	assert.Equal(t, 3, e.Failures)
+	assert.NotEmpty(t, e.Downtime)
+
+	// slack compatible body
+	tmpl, err := getWebhookTemplate(`{"text": {{json (printf "%s is %s" .Target .State)}}}`)
 	assert.NoError(t, err)
-	assert.Equal(t, req.cmd.cmd, "add")
+	wh.template = tmpl
+	b, err := wh.body(alertEvent{Target: `"a":80`, State: alertFailing})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"text": "\"a\":80 is failing"}`, string(b))
 
-	args = []string{"tcpprobe", "add"}
-	req, _, err = getCli(args)
+	_, err = getWebhookTemplate("{{.Target")
 	assert.Error(t, err)
+}
 
-	// del
-	args = []string{"tcpprobe", "del", "127.0.0.2:8080"}
-	req, _, err = getCli(args)
+func TestAlertmanager(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		alerts [][]amAlert
+	)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/alerts", r.URL.Path)
+		var a []amAlert
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&a))
+		mu.Lock()
+		alerts = append(alerts, a)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	urls, err := getAlertmanagerURLs(down.URL + ", " + srv.URL + "/")
 	assert.NoError(t, err)
-	assert.Equal(t, req.cmd.cmd, "del")
+	assert.Equal(t, []string{down.URL, srv.URL}, urls)
 
-	args = []string{"tcpprobe", "del"}
-	req, _, err = getCli(args)
+	req := &request{
+		failureThreshold:    1,
+		alertmanagerURLs:    urls,
+		alertmanagerResend:  50 * time.Millisecond,
+		alertmanagerTimeout: time.Second,
+	}
+	am := newAlertmanager(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go am.run(ctx)
+
+	c := newClient(req, "127.0.0.1:80")
+	c.alertmanager = am
+	c.labels = map[string]string{"env": "prod"}
+
+	c.record(errors.New("connection refused"))
+
+	// the firing alert is resent
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(alerts) >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	c.record(nil)
+
+	cancel()
+	am.wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	firing := alerts[0][0]
+	assert.Equal(t, map[string]string{"alertname": "TCPProbeTargetDown", "target": "127.0.0.1:80", "env": "prod"}, firing.Labels)
+	assert.Contains(t, firing.Annotations["description"], "connection refused")
+	assert.True(t, firing.EndsAt.After(time.Now()))
+
+	resolved := alerts[len(alerts)-1][0]
+	assert.Equal(t, firing.Labels, resolved.Labels)
+	assert.Equal(t, firing.StartsAt.Unix(), resolved.StartsAt.Unix())
+	assert.False(t, resolved.EndsAt.After(time.Now()))
+	assert.Len(t, am.alerts, 0)
+
+	// the recovered target without the alert isn't sent
+	am.send(alertEvent{Target: "a:80", State: alertRecovered})
+	assert.Len(t, am.ch, 0)
+
+	_, err = getAlertmanagerURLs("am:9093")
 	assert.Error(t, err)
 }
 
-func TestPrometheus(t *testing.T) {
-	c := &client{}
+func TestPushgateway(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushes []string
+		posts  int
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+
+		// the first push is retried
+		if posts++; posts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "/metrics/job/tcpprobe/env/prod", r.URL.Path)
+		pushes = append(pushes, string(b))
+	}))
+	defer srv.Close()
+
+	grouping, err := getPushGrouping([]string{"env=prod"})
+	assert.NoError(t, err)
+
+	req := &request{pushgatewayURL: srv.URL, pushJob: "tcpprobe", pushGrouping: grouping}
+	p := newPushgateway(req)
+	p.backoff = 10 * time.Millisecond
+
+	// the finished target's metrics
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "tp_push_test_rtt", ConstLabels: prometheus.Labels{"target": "a:80"}})
+	g.Set(100)
+	p.keep("a:80", []prometheus.Collector{g})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go p.run(ctx)
+	cancel()
+	p.wait()
+
+	assert.Equal(t, 2, posts)
+	assert.Len(t, pushes, 1)
+	assert.Contains(t, pushes[0], "tp_push_test_rtt")
+	assert.False(t, p.failed())
+
+	// the restarted target's metrics are collected by the default registry
+	p.forget("a:80")
+	assert.Len(t, p.finished, 0)
+
+	// all retries failed
+	srv.Close()
+	p.push()
+	assert.True(t, p.failed())
+
+	for _, v := range []string{"env", "=prod", "job=a", "a-b=c"} {
+		_, err = getPushGrouping([]string{v})
+		assert.Error(t, err, v)
+	}
+
+	_, err = getPushgatewayURL("pgw:9091")
+	assert.Error(t, err)
+}
+
+func TestMetricPrefix(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	content := `
+defaults:
+  metric_prefix: probe
+  metric_labels:
+    region: us-west
+    env: prod
+targets:
+  - addr: 127.0.0.1:80`
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(content), 0644))
+
+	// the flags take precedence over the config
+	req, _, err := getCli([]string{"tcpprobe", "-config", cfgFile, "-metric-label", "region=eu-west-1", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.NoError(t, setMetrics(req))
+	defer func() { metricPrefix, metricLabels = "tp", nil }()
+
+	assert.Equal(t, "probe_tcpinfo_rtt", metricName("tcpinfo_rtt"))
+	assert.Equal(t, prometheus.Labels{"region": "eu-west-1", "env": "prod", "target": "a:80"},
+		constLabels(prometheus.Labels{"target": "a:80"}))
+
+	c := &client{target: "prefixed", req: &request{}}
 	c.prometheus(context.Background())
+	defer c.deprometheus(context.Background())
 
-	v := reflect.ValueOf(&c.stats).Elem()
-	for i := 0; i < v.NumField(); i++ {
-		f := v.Type().Field(i)
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
 
-		if f.Tag.Get("unexported") == "true" {
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "probe_tcpinfo_rtt" {
 			continue
 		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["target"] == "prefixed" {
+				found = true
+				assert.Equal(t, "eu-west-1", labels["region"])
+			}
+		}
+	}
+	assert.True(t, found)
 
-		req := prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "tp_" + f.Tag.Get("name"),
-			Help:        f.Tag.Get("help"),
-			ConstLabels: prometheus.Labels{"target": c.target},
-		})
+	req, _, err = getCli([]string{"tcpprobe", "-metric-prefix", "tcpprobe", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tcpprobe", req.metricPrefix)
+
+	for _, args := range [][]string{
+		{"tcpprobe", "-metric-prefix", "tcp-probe", "127.0.0.1"},
+		{"tcpprobe", "-metric-label", "aws-region=eu", "127.0.0.1"},
+		{"tcpprobe", "-metric-label", "region", "127.0.0.1"},
+	} {
+		_, _, err = getCli(args)
+		assert.EqualError(t, err, "invalid "+strings.TrimPrefix(args[1], "-")+": "+args[2])
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	defer func(m *telemetry) { selfMetrics = m }(selfMetrics)
+	selfMetrics = newTelemetry()
 
-		if err := prometheus.Register(req); err != nil {
-			_, ok := err.(prometheus.AlreadyRegisteredError)
-			assert.True(t, ok)
+	tp := &tp{targets: map[string]prop{"a:80": {}, "b:80": {}}}
+	selfMetrics.register(tp)
+
+	// the metrics exist before any probe
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+		if mf.GetName() == "tp_targets_configured" {
+			assert.Equal(t, float64(2), mf.GetMetric()[0].GetGauge().GetValue())
 		}
 	}
+	for _, name := range []string{"tp_targets_configured", "tp_probes_total", "tp_probe_duration_seconds",
+		"tp_config_reloads_total", "tp_k8s_watch_events_total", "tp_output_write_errors_total"} {
+		assert.True(t, names[name], name)
+	}
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(selfMetrics.probes.WithLabelValues("error")))
+
+	c := newClient(&request{}, "127.0.0.1:80")
+	c.started = time.Now()
+	c.record(nil)
+	c.record(errors.New("connection refused"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(selfMetrics.probes.WithLabelValues("ok")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(selfMetrics.probes.WithLabelValues("error")))
+
+	// the malformed config
+	cfgFile := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte("targets:\n  - addr: localhost:80\n    family: ipv5"), 0644))
+	tp.reload(context.Background(), &sync.WaitGroup{}, &request{config: cfgFile})
+	assert.Equal(t, float64(1), testutil.ToFloat64(selfMetrics.reloads.WithLabelValues("error")))
+
+	// the records' write error
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	r.Close()
+	os.Stdout = w
+	c.printText(0)
+	os.Stdout = stdout
+	w.Close()
+	assert.Greater(t, testutil.ToFloat64(selfMetrics.outputErrors), float64(0))
 }
 
-func TestServerName(t *testing.T) {
-	r := request{
-		serverName: "myserver",
+func TestAvailability(t *testing.T) {
+	failure, err := getAvailFailure("error,status")
+	assert.NoError(t, err)
+	assert.Equal(t, availError|availStatus, failure)
+
+	_, err = getAvailFailure("error,timeout")
+	assert.Error(t, err)
+
+	c := newClient(&request{availFailure: failure, maxRtt: time.Millisecond}, "127.0.0.1:80")
+
+	c.account(nil)
+	assert.Equal(t, int64(1), c.stats.AvailProbes)
+	assert.NotZero(t, c.stats.AvailLastChange)
+
+	// the unexpected status
+	c.stats.HTTPExpectationMismatch = 1
+	c.account(nil)
+	c.stats.HTTPExpectationMismatch = 0
+	c.account(errors.New("connection refused"))
+	assert.Equal(t, int64(2), c.stats.AvailFailed)
+	assert.Equal(t, int64(2), c.stats.AvailConsecutiveFailures)
+
+	// the downtime until the recovery
+	c.avail.last = c.avail.last.Add(-3 * time.Second)
+	c.account(nil)
+	assert.Equal(t, int64(0), c.stats.AvailConsecutiveFailures)
+	assert.Equal(t, int64(3), c.stats.AvailDowntime)
+	assert.Equal(t, float64(50), c.availabilityRatio())
+
+	// the max-rtt breach isn't a failure unless it's requested
+	c.stats.Rtt = 2000
+	c.account(nil)
+	assert.Equal(t, int64(2), c.stats.AvailFailed)
+
+	c.req.availFailure = availThreshold
+	c.account(nil)
+	assert.Equal(t, int64(3), c.stats.AvailFailed)
+
+	req, _, err := getCli([]string{"tcpprobe", "-availability-failure", "error,threshold", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, availError|availThreshold, req.availFailure)
+}
+
+func TestRttWindow(t *testing.T) {
+	w := newRttWindow(4)
+	st := &stats{}
+
+	w.update(st)
+	assert.Equal(t, uint32(0), st.RttP50)
+
+	for _, rtt := range []uint32{100, 300, 200} {
+		w.add(rtt)
+	}
+	w.update(st)
+	assert.Equal(t, uint32(150), st.RttJitter)
+	assert.Equal(t, uint32(200), st.RttP50)
+	assert.Equal(t, uint32(300), st.RttP99)
+	assert.Equal(t, uint32(100), st.RttMin)
+
+	// the oldest RTT is dropped
+	w.add(400)
+	w.add(500)
+	assert.Equal(t, []uint32{300, 200, 400, 500}, w.values())
+	w.update(st)
+	assert.Equal(t, uint32(200), st.RttMin)
+	assert.Equal(t, uint32(500), st.RttMax)
+	assert.Equal(t, uint32(300), st.RttP50)
+	assert.Equal(t, uint32(500), st.RttP95)
+	assert.Equal(t, uint32(133), st.RttJitter)
+
+	w.reset()
+	assert.Len(t, w.values(), 0)
+
+	// the failed probe's RTT isn't sampled
+	c := newClient(&request{rttWindow: 10}, "127.0.0.1:80")
+	c.stats.Rtt = 1000
+	c.sampleRtt(nil)
+	c.stats.Rtt = 5000
+	c.sampleRtt(errors.New("timeout"))
+	assert.Equal(t, uint32(1000), c.stats.RttMax)
+
+	_, _, err := getCli([]string{"tcpprobe", "-rtt-window", "0", "127.0.0.1"})
+	assert.Error(t, err)
+}
+
+func TestDownThreshold(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	req := &request{timeout: time.Second, json: true, filter: "TargetDown", downThreshold: 2, downInterval: 30 * time.Second}
+	c := newClient(req, addr)
+	c.probeOnce(ctx, 0)
+	assert.Equal(t, 10*time.Millisecond, c.cadence(10*time.Millisecond))
+
+	// the target is down after the consecutive failures
+	ln.Close()
+	c.probeOnce(ctx, 1)
+	assert.Equal(t, 0, c.stats.TargetDown)
+	c.probeOnce(ctx, 2)
+	assert.Equal(t, 1, c.stats.TargetDown)
+	assert.Equal(t, 30*time.Second, c.cadence(10*time.Millisecond))
+	c.probeOnce(ctx, 3)
+
+	// recovered
+	time.Sleep(10 * time.Millisecond)
+	ln, err = net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	defer ln.Close()
+	c.probeOnce(ctx, 4)
+	assert.Equal(t, 0, c.stats.TargetDown)
+	assert.Equal(t, 10*time.Millisecond, c.cadence(10*time.Millisecond))
+
+	w.Close()
+	os.Stdout = stdout
+
+	b, _ := ioutil.ReadAll(r)
+	var (
+		states   []string
+		downtime float64
+	)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		m := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		if state, ok := m["State"]; ok {
+			states = append(states, state.(string))
+			if d, ok := m["Downtime"]; ok {
+				downtime = d.(float64)
+			}
+		}
+	}
+	assert.Equal(t, []string{"down", "up"}, states)
+	assert.Greater(t, downtime, float64(10000))
+
+	// disabled
+	c = newClient(&request{}, addr)
+	c.checkDown(errors.New("connection refused"))
+	assert.False(t, c.downState.down)
+
+	_, _, err = getCli([]string{"tcpprobe", "-down-threshold", "-1", "127.0.0.1"})
+	assert.Error(t, err)
+}
+
+func TestStopConditions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	closed.Close()
+
+	// the first failure stops all the targets
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp := &tp{targets: make(map[string]prop), cancel: cancel}
+	req := &request{timeout: time.Second, interval: 10 * time.Millisecond, maxLoss: -1, quiet: true, stopOnFailure: true}
+	wg := &sync.WaitGroup{}
+	for _, target := range []string{ln.Addr().String(), closed.Addr().String()} {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			tp.run(ctx, target, req)
+		}(target)
+	}
+
+	assert.True(t, tp.drain(wg, 5*time.Second))
+	assert.Error(t, ctx.Err())
+	assert.Equal(t, exitFailure, tp.exitCode())
+
+	// the duration and the count
+	_, _, err = getCli([]string{"tcpprobe", "-duration", "5m", "-c", "3", "127.0.0.1"})
+	assert.Error(t, err)
+
+	req, _, err = getCli([]string{"tcpprobe", "-duration", "5m", "-max-rtt", "10ms", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, req.duration)
+}
+
+func TestWarmup(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	req := &request{timeout: time.Second, json: true, filter: "Rtt", maxLoss: -1, warmup: 2}
+	c := newClient(req, ln.Addr().String())
+	for i := 0; i < 3; i++ {
+		assert.True(t, c.isWarmingUp())
+		c.probeOnce(ctx, i)
+	}
+	assert.False(t, c.isWarmingUp())
+
+	w.Close()
+	os.Stdout = stdout
+
+	// the warm-up probes aren't summarized or accounted
+	assert.Equal(t, 1, c.summary.sent)
+	assert.Equal(t, int64(1), c.stats.AvailProbes)
+	assert.Len(t, c.window.values(), 1)
+
+	b, _ := ioutil.ReadAll(r)
+	var warmups []bool
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		m := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		_, ok := m["Warmup"]
+		warmups = append(warmups, ok)
 	}
+	assert.Equal(t, []bool{true, true, false}, warmups)
 
-	c := newClient(&r, "target")
-	assert.Equal(t, "myserver", c.serverName())
+	// the text header has the marker
+	c.warming = true
+	assert.True(t, strings.HasSuffix(c.textHeader(0), " warmup=true"))
 
-	c = newClient(&request{}, "target")
-	assert.Equal(t, "target", c.serverName())
-}
+	// the metrics are suppressed or labeled during the warm-up
+	warming := true
+	isWarming := func() bool { return warming }
+	sc := newStatsCollector(&c.stats, nil, isWarming, warmupSuppress, nil)
+	assert.Equal(t, 0, testutil.CollectAndCount(sc))
+	warming = false
+	assert.Greater(t, testutil.CollectAndCount(sc), 0)
 
-func TestGetSrcAddr(t *testing.T) {
-	addr := getSrcAddr("")
-	assert.Nil(t, addr)
+	sc = newStatsCollector(&c.stats, nil, isWarming, warmupLabel, nil)
+	assert.NoError(t, testutil.CollectAndCompare(sc, strings.NewReader(`
+# HELP tp_target_down target is down by the down-threshold consecutive failed probes
+# TYPE tp_target_down gauge
+tp_target_down{warmup="false"} 0
+`), "tp_target_down"))
 
-	addr = getSrcAddr("192.168.1.1")
-	assert.Equal(t, &net.TCPAddr{
-		IP:   net.ParseIP("192.168.1.1"),
-		Port: 0, Zone: "",
-	}, addr)
+	_, _, err = getCli([]string{"tcpprobe", "-warmup-metrics", "drop", "127.0.0.1"})
+	assert.Error(t, err)
 }
 
-func TestPrintText(t *testing.T) {
-	buf := new(bytes.Buffer)
+func TestParallel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
 	stdout := os.Stdout
 	r, w, _ := os.Pipe()
 	os.Stdout = w
 
-	c := &client{stats: stats{Rtt: 5}, req: &request{filter: "rtt"}, timestamp: 1609558015}
-	c.printer(0)
-
-	go io.Copy(buf, r)
-	time.Sleep(100 * time.Millisecond)
-	assert.Contains(t, buf.String(), "Rtt:5")
+	tp := &tp{targets: make(map[string]prop)}
+	req := &request{timeout: time.Second, interval: 10 * time.Millisecond, count: 2, maxLoss: -1, json: true, parallel: 3}
+	tp.run(context.Background(), ln.Addr().String(), req)
 
+	w.Close()
 	os.Stdout = stdout
-}
 
-func TestPrintJsonPretty(t *testing.T) {
-	stdout := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	b, _ := ioutil.ReadAll(r)
+	var (
+		conns   = map[string]int{}
+		summary parallelSummary
+	)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		m := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		if _, ok := m["parallel"]; ok {
+			assert.NoError(t, json.Unmarshal([]byte(line), &summary))
+		} else if labels, ok := m["Labels"].(map[string]interface{}); ok {
+			conns[labels["conn"].(string)]++
+		}
+	}
 
-	c := &client{stats: stats{}, req: &request{jsonPretty: true, filter: "rtt"}}
-	c.printer(0)
+	// each connection has its own records and the aggregate summary
+	assert.Equal(t, map[string]int{"0": 2, "1": 2, "2": 2}, conns)
+	assert.Equal(t, 3, summary.Connections)
+	assert.Equal(t, 3, summary.Connected)
+	assert.Equal(t, map[string]int{"127.0.0.1": 3}, summary.Backends)
+	assert.Greater(t, summary.Rtt.Max, float64(0))
+	assert.Len(t, tp.targets, 0)
 
-	buf := make([]byte, 13)
-	n, _ := io.ReadFull(r, buf)
-	assert.Equal(t, 13, n)
-	assert.Equal(t, "{\n \"Rtt\": 0\n}", string(buf))
+	// the open files limit
+	assert.Error(t, checkFileLimit(1<<30))
 
-	os.Stdout = stdout
+	_, _, err = getCli([]string{"tcpprobe", "-parallel", "5", "-all-ips", "127.0.0.1"})
+	assert.Error(t, err)
 }
 
-func TestPrintJson(t *testing.T) {
-	stdout := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+func TestDownload(t *testing.T) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/speedtest":
+			w.Write(body)
+		case "/health":
+			w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
 
-	c := &client{stats: stats{}, req: &request{json: true, filter: "rtt"}}
-	c.printer(0)
+	// the probe's response body
+	req := &request{timeout: time.Second, timeoutHTTP: 5 * time.Second, quiet: true, maxLoss: -1, downloadBytes: 64 << 10}
+	c := newClient(req, ts.URL+"/speedtest")
+	c.probeOnce(ctx, 0)
+	assert.Equal(t, int64(64<<10), c.stats.DownloadBytes)
+	assert.Equal(t, int64(64<<10), c.stats.HTTPRcvdBytes)
+	assert.Greater(t, c.stats.DownloadRate, int64(0))
 
-	buf := make([]byte, 9)
-	n, _ := io.ReadFull(r, buf)
-	assert.Equal(t, 9, n)
-	assert.Equal(t, `{"Rtt":0}`, string(buf))
+	// the download url by a separate connection
+	req = &request{timeout: time.Second, timeoutHTTP: 5 * time.Second, quiet: true, maxLoss: -1, downloadBytes: 10 << 20,
+		downloadURL: ts.URL + "/speedtest"}
+	c = newClient(req, ts.URL+"/health")
+	c.probeOnce(ctx, 0)
+	assert.Equal(t, int64(2), c.stats.HTTPRcvdBytes)
+	assert.Equal(t, int64(1<<20), c.stats.DownloadBytes)
+	assert.Greater(t, c.stats.DownloadTime, int64(0))
+	assert.Equal(t, int64(0), c.stats.DownloadError)
 
-	os.Stdout = stdout
-}
+	req.downloadURL = ts.URL + "/missing"
+	c.probeOnce(ctx, 1)
+	assert.Equal(t, int64(1), c.stats.DownloadError)
+	assert.Equal(t, 0, c.summary.failed)
 
-func TestBoolToInt(t *testing.T) {
-	assert.Equal(t, 1, boolToInt(true))
-	assert.Equal(t, 0, boolToInt(false))
-}
+	req, _, err := getCli([]string{"tcpprobe", "-download-bytes", "10MB", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10<<20), req.downloadBytes)
 
-func TestNoRedirect(t *testing.T) {
-	c := &client{}
-	assert.Error(t, c.noRedirect(nil, nil))
+	_, _, err = getCli([]string{"tcpprobe", "-download-url", "http://127.0.0.1/speedtest", "127.0.0.1"})
+	assert.Error(t, err)
+
+	cfg, err := parseConfig([]byte("targets:\n  - addr: http://127.0.0.1/health\n    download: 1MB\n    download_url: http://127.0.0.1/speedtest\n"))
+	assert.NoError(t, err)
+	r := cfg.Targets[0].request(&request{})
+	assert.Equal(t, int64(1<<20), r.downloadBytes)
+	assert.Equal(t, "http://127.0.0.1/speedtest", r.downloadURL)
 }
 
-func TestMain(t *testing.T) {
-	stdout := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
 
-	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "Hello, TCPProbe")
+	var (
+		mu       sync.Mutex
+		method   string
+		received int64
+		chunked  bool
+		zeros    bool
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		method = r.Method
+		received = int64(len(b))
+		chunked = len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		zeros = bytes.Count(b, []byte{0}) == len(b)
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
 	}))
-	os.Args = []string{"tcpprobe", "-c", "1", "-insecure", ts.URL}
-	main()
+	defer ts.Close()
 
-	buf := new(bytes.Buffer)
-	go io.Copy(buf, r)
-	time.Sleep(100 * time.Millisecond)
+	req := &request{timeout: time.Second, timeoutHTTP: 5 * time.Second, quiet: true, maxLoss: -1,
+		httpMethod: http.MethodGet, uploadBytes: 1 << 20, uploadPayload: uploadZero}
+	c := newClient(req, ts.URL)
+	c.probeOnce(ctx, 0)
 
-	assert.Contains(t, buf.String(), "target: https://127.0.0.1")
-	assert.Contains(t, buf.String(), "HTTPStatusCode:200")
+	mu.Lock()
+	assert.Equal(t, http.MethodPost, method)
+	assert.Equal(t, int64(1<<20), received)
+	assert.False(t, chunked)
+	assert.True(t, zeros)
+	mu.Unlock()
+	assert.Equal(t, http.StatusCreated, c.stats.HTTPStatusCode)
+	assert.Greater(t, c.stats.UploadTime, int64(0))
+	assert.Greater(t, c.stats.UploadRate, int64(0))
 
-	os.Stdout = stdout
-}
+	// chunked random payload by PUT
+	req.httpMethod = http.MethodPut
+	req.uploadPayload = uploadRandom
+	req.uploadChunked = true
+	c.probeOnce(ctx, 1)
 
-func TestGetLabels(t *testing.T) {
-	labels := map[string]string{"key": "value"}
-	b, _ := json.Marshal(labels)
-	ctx := context.WithValue(context.Background(), labelsKey, b)
-	l := getLabels(ctx, "127.0.0.1")
-	assert.Contains(t, l, "key")
-	assert.Contains(t, l, "target")
+	mu.Lock()
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, int64(1<<20), received)
+	assert.True(t, chunked)
+	assert.False(t, zeros)
+	mu.Unlock()
 
-	ctx = context.WithValue(context.Background(), labelsKey, []byte(""))
-	getLabels(ctx, "127.0.0.1")
-	assert.Contains(t, l, "target")
+	req, _, err := getCli([]string{"tcpprobe", "-upload-bytes", "5MB", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5<<20), req.uploadBytes)
+	assert.Equal(t, uploadZero, req.uploadPayload)
+
+	_, _, err = getCli([]string{"tcpprobe", "-upload-bytes", "5MB", "-upload-payload", "ones", "127.0.0.1"})
+	assert.Error(t, err)
 }
 
-func TestK8SStart(t *testing.T) {
+func TestSocketAddr(t *testing.T) {
 	ctx := context.Background()
-	tp := &tp{targets: make(map[string]prop)}
-	req := &request{namespace: "default"}
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Logf("%s isn't available: %v", addr, err)
+			continue
+		}
 
-	samplePod := &v1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "fake",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"tcpprobe/targets":  "faketarget",
-				"tcpprobe/interval": "6s",
-				"tcpprobe/labels":   "{\"mykey\":\"myvalue\"}",
-			},
-		},
-		Status: v1.PodStatus{Phase: "Running"},
+		req := &request{timeout: time.Second, quiet: true, maxLoss: -1}
+		c := newClient(req, ln.Addr().String())
+		assert.NoError(t, c.connect(ctx))
+
+		local := c.conn.LocalAddr().(*net.TCPAddr)
+		assert.Equal(t, local.IP.String(), c.stats.LocalAddr)
+		assert.Equal(t, local.Port, c.stats.LocalPort)
+		assert.Equal(t, ln.Addr().(*net.TCPAddr).IP.String(), c.stats.RemoteAddr)
+		assert.Equal(t, c.stats.RemoteAddr, c.getRemoteIP())
+		assert.NotZero(t, c.stats.LocalPort)
+
+		b, err := c.jsonRecord(0, false)
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), `"RemoteAddr":"`+c.stats.RemoteAddr+`"`)
+
+		c.close()
+		ln.Close()
 	}
 
-	clientset := fake.NewSimpleClientset(samplePod)
-	k := k8s{clientset: clientset, pods: sync.Map{}}
-	k.start(ctx, tp, req)
-	time.Sleep(time.Second)
-	assert.Contains(t, tp.targets, "faketarget")
-	clientset.CoreV1().Pods("default").Delete(context.TODO(), "fake", metav1.DeleteOptions{})
-	time.Sleep(time.Second)
-	assert.NotContains(t, tp.targets, "faketarget")
+	// the remote IP label
+	s := &stats{LocalPort: 50000}
+	remoteIP := func() string { return "10.0.0.1" }
+	assert.NoError(t, testutil.CollectAndCompare(newStatsCollector(s, nil, nil, "", remoteIP), strings.NewReader(`
+# HELP tp_local_port local ephemeral port of the connection
+# TYPE tp_local_port gauge
+tp_local_port{remote_ip="10.0.0.1"} 50000
+`), "tp_local_port"))
+
+	// the label is the stored remote IP rather than the stats
+	c := &client{stats: stats{RemoteAddr: "10.0.0.1", LocalPort: 50000}}
+	c.remoteIP.Store("10.0.0.2")
+	assert.NoError(t, testutil.CollectAndCompare(newStatsCollector(&c.stats, nil, nil, "", c.getRemoteIP), strings.NewReader(`
+# HELP tp_local_port local ephemeral port of the connection
+# TYPE tp_local_port gauge
+tp_local_port{remote_ip="10.0.0.2"} 50000
+`), "tp_local_port"))
 }
 
-func TestGetConfig(t *testing.T) {
-	cfgFile, err := ioutil.TempFile(t.TempDir(), "config.yml")
-	assert.Equal(t, nil, err)
+func TestPhaseTimeouts(t *testing.T) {
+	ctx := context.Background()
 
-	content := `
-  targets:
-    - addr: https://www.google.com
-      interval: 10s
-      labels:
-        pop: bur`
+	// the DNS doesn't answer within the connect timeout
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer dns.Close()
 
-	cfgFile.Write([]byte(content))
-	cfg, err := getConfig(cfgFile.Name())
-	assert.Equal(t, nil, err)
-	assert.Len(t, cfg.Targets, 1)
-	assert.Equal(t, "https://www.google.com", cfg.Targets[0].Addr)
-	assert.Equal(t, "10s", cfg.Targets[0].Interval)
-	assert.Equal(t, map[string]string{"pop": "bur"}, cfg.Targets[0].Labels)
+	req := &request{timeout: 5 * time.Second, connectTimeout: 100 * time.Millisecond, quiet: true, maxLoss: -1,
+		resolver: dns.LocalAddr().String(), resolverStrict: true}
+	c := newClient(req, "tcpprobe.test:80")
+	start := time.Now()
+	assert.Error(t, c.connect(ctx))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, int64(1), c.stats.TCPConnectTimeout)
 
-	_, err = getConfig("notfound")
-	assert.NotNil(t, err)
+	// the TLS handshake isn't answered
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
 
-	cfgFile, err = ioutil.TempFile(t.TempDir(), "config.yml")
-	assert.Equal(t, nil, err)
-	cfgFile.Write([]byte("wrongyaml"))
-	_, err = getConfig(cfgFile.Name())
-	assert.NotNil(t, err)
-}
-func TestIsIPAddr(t *testing.T) {
-	assert.True(t, isIPAddr("8.8.8.8"))
-	assert.False(t, isIPAddr("www.yahoo.com"))
-}
+	req = &request{timeout: 5 * time.Second, tlsTimeout: 100 * time.Millisecond, timeoutHTTP: 5 * time.Second, quiet: true, maxLoss: -1}
+	c = newClient(req, "https://"+ln.Addr().String())
+	c.probeOnce(ctx, 0)
+	assert.Equal(t, int64(1), c.stats.TLSTimeout)
+	assert.Equal(t, int64(0), c.stats.HTTPTimeout)
 
-func TestPubSub(t *testing.T) {
-	var s *stats
+	// the HTTP response is slow
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer ts.Close()
 
-	c := &client{
-		mu: &sync.Mutex{},
-	}
+	req = &request{timeout: 5 * time.Second, timeoutHTTP: 100 * time.Millisecond, quiet: true, maxLoss: -1}
+	c = newClient(req, ts.URL)
+	c.probeOnce(ctx, 0)
+	assert.Equal(t, int64(1), c.stats.HTTPTimeout)
+	assert.Equal(t, int64(0), c.stats.TCPConnectTimeout)
 
-	ch := make(chan *stats, 1)
-	c.subscribe(ch)
-	c.stats.RcvMss = 1460
-	c.publish()
-	select {
-	case s = <-ch:
-	default:
-	}
+	// the timeout is the cap and the default
+	assert.Equal(t, time.Second, capTimeout(0, time.Second))
+	assert.Equal(t, time.Second, capTimeout(2*time.Second, time.Second))
+	assert.Equal(t, 500*time.Millisecond, capTimeout(500*time.Millisecond, time.Second))
 
-	assert.Len(t, c.subCh, 1)
-	assert.Equal(t, uint32(1460), s.RcvMss)
+	cfg, err := parseConfig([]byte("targets:\n  - addr: https://127.0.0.1\n    connect_timeout: 500ms\n    tls_timeout: 2s\n"))
+	assert.NoError(t, err)
+	r := cfg.Targets[0].request(&request{timeout: 5 * time.Second})
+	assert.Equal(t, 500*time.Millisecond, r.connectTimeout)
+	assert.Equal(t, 2*time.Second, r.tlsTimeout)
 
-	c.unsubscribe(ch)
-	assert.Len(t, c.subCh, 0)
+	req, _, err = getCli([]string{"tcpprobe", "-connect-timeout", "500ms", "-tls-timeout", "1s", "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, req.connectTimeout)
+	assert.Equal(t, time.Second, req.tlsTimeout)
 }
 
-func TestGrpc(t *testing.T) {
-	tp := &tp{targets: make(map[string]prop)}
+func TestCancelProbe(t *testing.T) {
+	// the server accepts and never responds
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
 
-	req := &request{
-		grpcAddr: "127.0.0.1:8085",
-		cmd: &cmdReq{
-			cmd:      "add",
-			addr:     "127.0.0.1:8085",
-			interval: "5s",
-			insecure: true,
-			args:     []string{"127.0.0.1:8085"},
-		},
-	}
-	grpcServer(tp, req)
+	conns := make(chan net.Conn, 10)
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	// the accept loop is stopped before the conns is closed
+	defer func() {
+		ln.Close()
+		<-accepted
+		close(conns)
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
 
-	// add
-	grpcClient(req)
-	time.Sleep(time.Millisecond * 300)
-	assert.Contains(t, tp.targets, "127.0.0.1:8085")
+	for _, target := range []string{"http://" + ln.Addr().String(), "https://" + ln.Addr().String(), ln.Addr().String()} {
+		baseline := runtime.NumGoroutine()
 
-	req.cmd = &cmdReq{
-		cmd:      "del",
-		addr:     "127.0.0.1:8085",
-		insecure: true,
-		args:     []string{"127.0.0.1:8085"},
-	}
+		req := &request{timeout: 30 * time.Second, timeoutHTTP: 30 * time.Second, quiet: true, maxLoss: -1, count: 1,
+			sendPayload: []byte("ping")}
+		c := newClient(req, target)
 
-	// del
-	grpcClient(req)
-	time.Sleep(time.Millisecond * 300)
-	assert.NotContains(t, tp.targets, "127.0.0.1:8085")
-}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			c.probe(ctx)
+			close(done)
+		}()
 
-func TestStats2pbStruct(t *testing.T) {
-	s := &stats{State: 1, Rtt: 55, TCPCongesAlg: "reno"}
-	pbs := stats2pbStruct(s)
-	v := pbs.Fields["State"].GetNumberValue()
-	assert.Equal(t, 1.0, v)
-	v = pbs.Fields["Rtt"].GetNumberValue()
-	assert.Equal(t, 55.0, v)
-	vs := pbs.Fields["TCPCongesAlg"].GetStringValue()
-	assert.Equal(t, "reno", vs)
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("%s: the probe didn't return after cancel", target)
+		}
+
+		// the interrupted probe isn't recorded
+		assert.Equal(t, 0, c.summary.sent, target)
+		// polls without assert.Eventually since it runs the condition in a goroutine
+		for i := 0; i < 100 && runtime.NumGoroutine() > baseline; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), baseline, target)
+	}
 }
 
-func TestCheckUpdate(t *testing.T) {
-	version = "1.1.1"
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "http://fake/v1.1.1", http.StatusFound)
+func TestOTLPTraces(t *testing.T) {
+	ch := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		b, _ := ioutil.ReadAll(r.Body)
+		ch <- b
 	}))
+	defer collector.Close()
 
-	ok, _ := checkUpdate(ts.URL)
-	assert.Equal(t, false, ok)
-	version = "1.1.0"
-	ok, newVersion := checkUpdate(ts.URL)
-	assert.Equal(t, true, ok)
-	assert.Equal(t, "v1.1.1", newVersion)
+	traceparent := make(chan string, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case traceparent <- r.Header.Get("traceparent"):
+		default:
+		}
+		w.Write([]byte("tcpprobe"))
+	}))
+	defer ts.Close()
 
-	ts.Close()
-	ok, newVersion = checkUpdate(ts.URL)
-	assert.Equal(t, false, ok)
-	assert.Equal(t, "", newVersion)
+	tr := newTracer(&request{otlpTracesEndpoint: collector.URL, traceSample: 1, timeoutHTTP: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	go tr.run(ctx)
 
-	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "nothing")
-	}))
-	ok, newVersion = checkUpdate(ts.URL)
-	assert.Equal(t, false, ok)
-	assert.Equal(t, "", newVersion)
+	// sampled
+	r := request{quiet: true, timeout: time.Second * 2, insecure: true, tracePropagate: true}
+	c := newClient(&r, ts.URL)
+	c.tracer = tr
+	c.probeOnce(ctx, 1)
+
+	// the failed probe is always sampled
+	tr.sample = 0
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	c = newClient(&r, addr)
+	c.tracer = tr
+	c.probeOnce(ctx, 1)
+
+	// not sampled
+	c = newClient(&r, ts.URL)
+	c.tracer = tr
+	c.probeOnce(ctx, 1)
+
+	cancel()
+	tr.wait()
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	assert.NoError(t, json.Unmarshal(<-ch, &payload))
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+
+	var names []string
+	traces := map[string]int{}
+	for _, s := range spans {
+		names = append(names, s.Name)
+		traces[s.TraceID]++
+	}
+	// the TLS handshake is by the request's transport
+	assert.Equal(t, []string{"probe", "dns", "connect", "request", "tls", "body-read", "probe", "dns", "connect"}, names)
+	assert.Len(t, traces, 2)
+
+	root := spans[0]
+	assert.Equal(t, "", root.ParentSpanID)
+	assert.Equal(t, otlpString("target", ts.URL), root.Attributes[0])
+	assert.Contains(t, root.Attributes, otlpAttribute{Key: "tp_http_status_code", Value: map[string]string{"intValue": "200"}})
+	assert.Nil(t, root.Status)
+	for _, s := range spans[1:6] {
+		assert.Equal(t, root.TraceID, s.TraceID)
+		assert.Equal(t, root.SpanID, s.ParentSpanID)
+	}
+
+	// the server's span is the child of the request span
+	assert.Equal(t, fmt.Sprintf("00-%s-%s-01", root.TraceID, spans[3].SpanID), <-traceparent)
 
+	assert.Equal(t, &otlpStatus{Code: otlpStatusError}, spans[6].Status)
+	assert.Equal(t, &otlpStatus{Code: otlpStatusError}, spans[8].Status)
+
+	_, err = getTraceSample(1.5)
+	assert.Error(t, err)
 }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// traceMaxHops is the maximum TTL of the traceroute
+	traceMaxHops = 30
+	// traceHopTimeout is the time to wait for each hop
+	traceHopTimeout = time.Second
+)
+
+// traceHop represents a traceroute hop, the address is
+// empty if the hop didn't respond
+type traceHop struct {
+	ttl  int
+	addr string
+	rtt  time.Duration
+}
+
+func (h traceHop) String() string {
+	if h.addr == "" {
+		return fmt.Sprintf("%2d  *", h.ttl)
+	}
+
+	return fmt.Sprintf("%2d  %s  %s", h.ttl, h.addr, h.rtt)
+}
+
+// traceReply represents an ICMP time exceeded or destination
+// unreachable which quoted the traceroute's SYN
+type traceReply struct {
+	addr    string
+	t       time.Time
+	unreach bool
+}
+
+// traceOnFailure runs the traceroute once the consecutive connect failures
+// reached the threshold, the traces of a target are rate limited by the
+// trace interval and it returns true if the trace ran
+func (c *client) traceOnFailure(ctx context.Context) bool {
+	if c.req.traceOnFailure < 1 || c.connectFailures < c.req.traceOnFailure {
+		return false
+	}
+
+	if !c.traceLast.IsZero() && time.Since(c.traceLast) < c.req.traceInterval {
+		return false
+	}
+	c.traceLast = time.Now()
+
+	hops, err := c.trace(ctx)
+	if err != nil {
+		errorf("%v", err)
+		return false
+	}
+
+	var lines []string
+	for _, hop := range hops {
+		lines = append(lines, hop.String())
+	}
+	infof("%s traceroute after %d connect failure(s):\n%s",
+		c.target, c.connectFailures, strings.Join(lines, "\n"))
+
+	c.stats.TraceHops = len(hops)
+	if c.traceHops != nil && !isSamePath(c.traceHops, hops) {
+		c.stats.PathChanged++
+	}
+	c.traceHops = hops
+
+	return true
+}
+
+// trace sends SYN with increasing TTL toward the target until it accepts
+// or refuses the connection, the hop addresses are learned from the ICMP
+// time exceeded which requires the raw socket
+func (c *client) trace(ctx context.Context) ([]traceHop, error) {
+	var hops []traceHop
+
+	addr, err := c.getAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	v6 := ip.To4() == nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	replies := make(chan traceReply, 1)
+	if network, err := getICMPNetwork(v6); err == nil && !strings.HasPrefix(network, "udp") {
+		laddr := "0.0.0.0"
+		if v6 {
+			laddr = "::"
+		}
+
+		conn, err := icmp.ListenPacket(network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		go readTrace(ctx, conn, v6, ip, port, replies)
+	} else {
+		warnf("%s traceroute: raw ICMP socket isn't permitted, the hop addresses are unknown", c.target)
+	}
+
+	for ttl := 1; ttl <= traceMaxHops && ctx.Err() == nil; ttl++ {
+		hop, reached := c.traceHop(ctx, addr, ttl, replies)
+		hops = append(hops, hop)
+		if reached {
+			break
+		}
+	}
+
+	return hops, nil
+}
+
+// traceHop connects to the target with the given TTL, the hop is reached
+// once the target answered or an ICMP destination unreachable received
+func (c *client) traceHop(ctx context.Context, addr string, ttl int, replies <-chan traceReply) (traceHop, bool) {
+	hop := traceHop{ttl: ttl}
+
+	// drop the late replies of the previous hops
+	for len(replies) > 0 {
+		<-replies
+	}
+
+	req := *c.req
+	req.soIPTTL = ttl
+	req.verbose = false
+
+	d := net.Dialer{
+		LocalAddr: c.localAddr(),
+		Control:   (&client{target: c.target, req: &req, bindDevice: c.bindDevice}).control,
+	}
+
+	timeout := traceHopTimeout
+	if c.req.timeout > 0 && c.req.timeout < timeout {
+		timeout = c.req.timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	t := time.Now()
+	go func() {
+		conn, err := d.DialContext(ctx, c.network(), addr)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			hop.addr, _, _ = net.SplitHostPort(addr)
+			hop.rtt = time.Since(t)
+			return hop, true
+		}
+		return hop, false
+	case r := <-replies:
+		cancel()
+		<-done
+		hop.addr, hop.rtt = r.addr, r.t.Sub(t)
+		return hop, r.unreach
+	}
+}
+
+// readTrace reads the ICMP errors which quoted a TCP segment
+// to the target's address and port
+func readTrace(ctx context.Context, conn *icmp.PacketConn, v6 bool, ip net.IP, port string, replies chan<- traceReply) {
+	proto := 1
+	if v6 {
+		proto = 58
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		t := time.Now()
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		var (
+			data    []byte
+			unreach bool
+		)
+
+		switch body := msg.Body.(type) {
+		case *icmp.TimeExceeded:
+			data = body.Data
+		case *icmp.DstUnreach:
+			data, unreach = body.Data, true
+		default:
+			continue
+		}
+
+		if !isTraceQuote(data, v6, ip, port) {
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(peer.String())
+		if err != nil {
+			host = peer.String()
+		}
+
+		select {
+		case replies <- traceReply{addr: host, t: t, unreach: unreach}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// isTraceQuote returns true if the quoted datagram of the ICMP
+// error is a TCP segment to the given address and port
+func isTraceQuote(data []byte, v6 bool, ip net.IP, port string) bool {
+	var dst net.IP
+	hl := ipv6.HeaderLen
+
+	if v6 {
+		if len(data) < hl+4 || data[6] != syscall.IPPROTO_TCP {
+			return false
+		}
+		dst = net.IP(data[24:40])
+	} else {
+		h, err := ipv4.ParseHeader(data)
+		if err != nil || h.Protocol != syscall.IPPROTO_TCP || len(data) < h.Len+4 {
+			return false
+		}
+		dst, hl = h.Dst, h.Len
+	}
+
+	return dst.Equal(ip) && strconv.Itoa(int(data[hl+2])<<8|int(data[hl+3])) == port
+}
+
+// isSamePath returns true if the hops are the same, the hops
+// which didn't respond in either trace are not compared
+func isSamePath(a, b []traceHop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].addr != "" && b[i].addr != "" && a[i].addr != b[i].addr {
+			return false
+		}
+	}
+
+	return true
+}
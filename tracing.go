@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tracerQueue is the maximum queued traces, the traces
+	// are dropped once it's full
+	tracerQueue = 1000
+	// tracerInterval is the traces' export interval
+	tracerInterval = 5 * time.Second
+)
+
+// span kinds and status code (OTLP)
+const (
+	otlpSpanInternal = 1
+	otlpSpanClient   = 3
+	otlpStatusError  = 2
+)
+
+// tracer represents OpenTelemetry traces exporter (OTLP/HTTP JSON),
+// the probe is the root span and its phases are the child spans
+type tracer struct {
+	url        string
+	sample     float64
+	httpClient *http.Client
+
+	ch   chan []otlpSpan
+	done chan struct{}
+}
+
+// probeTrace represents the trace of a probe
+type probeTrace struct {
+	sync.Mutex
+
+	traceID [16]byte
+	root    probeSpan
+	spans   []probeSpan
+	sampled bool
+}
+
+// probeSpan represents a phase of the probe
+type probeSpan struct {
+	name   string
+	spanID [8]byte
+	start  time.Time
+	end    time.Time
+	failed bool
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+func newTracer(req *request) *tracer {
+	url := strings.TrimSuffix(req.otlpTracesEndpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	return &tracer{
+		url:        url,
+		sample:     req.traceSample,
+		httpClient: &http.Client{Timeout: req.timeoutHTTP},
+		ch:         make(chan []otlpSpan, tracerQueue),
+		done:       make(chan struct{}),
+	}
+}
+
+// run exports the queued traces by the interval, the
+// remaining traces are exported once the context is canceled
+func (t *tracer) run(ctx context.Context) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(tracerInterval)
+	defer ticker.Stop()
+
+	var spans []otlpSpan
+	for {
+		select {
+		case s := <-t.ch:
+			spans = append(spans, s...)
+		case <-ticker.C:
+			if err := t.export(spans); err != nil {
+				errorf("%v", err)
+			}
+			spans = nil
+		case <-ctx.Done():
+			for len(t.ch) > 0 {
+				spans = append(spans, <-t.ch...)
+			}
+			if err := t.export(spans); err != nil {
+				errorf("%v", err)
+			}
+			return
+		}
+	}
+}
+
+func (t *tracer) wait() {
+	<-t.done
+}
+
+// send queues the trace's spans, the trace is dropped if the queue is full
+func (t *tracer) send(spans []otlpSpan) {
+	select {
+	case t.ch <- spans:
+	default:
+		warnf("otlp traces queue is full, the trace has been dropped")
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) error {
+	if len(spans) < 1 {
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{otlpString("service.name", "tcpprobe")},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "tcpprobe", "version": version},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.httpClient.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp traces export failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// startTrace starts the probe's root span, the probe is
+// sampled by the trace sample rate
+func (c *client) startTrace() {
+	if c.tracer == nil {
+		c.probeTrace = nil
+		return
+	}
+
+	t := &probeTrace{
+		root:    probeSpan{name: "probe", spanID: newSpanID(), start: c.started},
+		sampled: rand.Float64() < c.tracer.sample,
+	}
+	crand.Read(t.traceID[:])
+	c.probeTrace = t
+}
+
+// endTrace ends the probe's root span and exports the trace,
+// the failed probe is exported regardless of the sampling
+func (c *client) endTrace(ctx context.Context) {
+	t := c.probeTrace
+	c.probeTrace = nil
+	if t == nil || ctx.Err() != nil {
+		return
+	}
+
+	failed := c.output.failed
+	if !t.sampled && !failed {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.root.end = time.Now()
+	t.root.failed = failed
+
+	traceID := hex.EncodeToString(t.traceID[:])
+	rootID := hex.EncodeToString(t.root.spanID[:])
+
+	attrs := append([]otlpAttribute{otlpString("target", c.target)},
+		otlpAttributes(getLabels(ctx, c.target))...)
+	attrs = append(attrs, statsAttributes(c.stats)...)
+
+	spans := []otlpSpan{t.root.otlp(traceID, "", otlpSpanInternal, attrs)}
+	for _, s := range t.spans {
+		// the span of the abandoned phase ends by the probe
+		if s.end.IsZero() {
+			s.end = t.root.end
+		}
+		spans = append(spans, s.otlp(traceID, rootID, otlpSpanClient,
+			[]otlpAttribute{otlpString("target", c.target)}))
+	}
+
+	c.tracer.send(spans)
+}
+
+// span starts the probe's phase span, the returned function
+// ends the span and marks it as failed by the error
+func (c *client) span(name string) func(error) {
+	t := c.probeTrace
+	if t == nil {
+		return func(error) {}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	i := len(t.spans)
+	t.spans = append(t.spans, probeSpan{name: name, spanID: newSpanID(), start: time.Now()})
+
+	return func(err error) {
+		t.Lock()
+		defer t.Unlock()
+
+		t.spans[i].end = time.Now()
+		t.spans[i].failed = err != nil
+	}
+}
+
+// traceparent returns the W3C trace context of the last
+// started span e.g. 00-<trace-id>-<parent-id>-01
+func (c *client) traceparent() string {
+	t := c.probeTrace
+	if t == nil {
+		return ""
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	parent := t.root.spanID
+	if len(t.spans) > 0 {
+		parent = t.spans[len(t.spans)-1].spanID
+	}
+
+	flags := "00"
+	if t.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(t.traceID[:]),
+		hex.EncodeToString(parent[:]), flags)
+}
+
+func (s probeSpan) otlp(traceID, parentID string, kind int, attrs []otlpAttribute) otlpSpan {
+	span := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		ParentSpanID:      parentID,
+		Name:              s.name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attrs,
+	}
+
+	if s.failed {
+		span.Status = &otlpStatus{Code: otlpStatusError}
+	}
+
+	return span
+}
+
+// statsAttributes returns the probe's non-zero stats as the
+// span attributes, they're named the same as the otlp metrics
+func statsAttributes(s stats) []otlpAttribute {
+	var attrs []otlpAttribute
+
+	t := reflect.TypeOf(s)
+	v := reflect.ValueOf(s)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("unexported") == "true" {
+			continue
+		}
+
+		var value string
+		switch fv := v.Field(i); fv.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if fv.Uint() == 0 {
+				continue
+			}
+			value = strconv.FormatUint(fv.Uint(), 10)
+		case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
+			if fv.Int() == 0 {
+				continue
+			}
+			value = strconv.FormatInt(fv.Int(), 10)
+		default:
+			continue
+		}
+
+		attrs = append(attrs, otlpAttribute{
+			Key:   "tp_" + f.Tag.Get("name"),
+			Value: map[string]string{"intValue": value},
+		})
+	}
+
+	return attrs
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	crand.Read(id[:])
+	return id
+}
+
+// getTraceSample returns the validated trace sample rate
+func getTraceSample(rate float64) (float64, error) {
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid trace-sample: %g", rate)
+	}
+
+	return rate, nil
+}
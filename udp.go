@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dialUDP returns a connected UDP socket to the target
+func (c *client) dialUDP(ctx context.Context) (net.Conn, error) {
+	addr, err := c.getAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.addr = addr
+
+	d := net.Dialer{}
+	if src, ok := c.localAddr().(*net.TCPAddr); ok {
+		d.LocalAddr = &net.UDPAddr{IP: src.IP}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.req.timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, strings.Replace(c.network(), "tcp", "udp", 1), addr)
+}
+
+// udpProbe sends the payload, a few zero bytes by default, and waits
+// for the reply if it's requested, the ICMP port unreachable is
+// reported by the socket as connection refused
+func (c *client) udpProbe(ctx context.Context) error {
+	c.probed = time.Now()
+	c.timestamp = c.probed.Unix()
+	c.stats.UDPRtt = 0
+	c.stats.UDPReplyReceived = 0
+	c.stats.UDPUnreachable = 0
+
+	conn, err := c.dialUDP(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload := c.req.sendPayload
+	if payload == nil {
+		payload = make([]byte, 4)
+	}
+
+	conn.SetDeadline(time.Now().Add(c.req.timeout))
+
+	t := time.Now()
+	if _, err = conn.Write(payload); err != nil {
+		c.stats.UDPSendError++
+		return err
+	}
+
+	if !c.req.udpReply {
+		return nil
+	}
+
+	limit := c.req.recvLimit
+	if limit < 1 {
+		limit = defaultRecvLimit
+	}
+
+	buf := make([]byte, limit)
+	n, err := conn.Read(buf)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			c.stats.UDPUnreachable = 1
+		}
+		return err
+	}
+
+	c.stats.UDPRtt = time.Since(t).Microseconds()
+	c.stats.UDPReplyReceived = 1
+	c.checkAppExpectation(buf[:n])
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// getUnixSocket returns the socket file and the request path of the
+// unix:///path/to/app.sock or http+unix://%2Fpath%2Fto%2Fapp.sock/path
+// target, the socket file is empty for other targets
+func getUnixSocket(target string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(target, "unix://"):
+		return strings.TrimPrefix(target, "unix://"), "/", nil
+	case strings.HasPrefix(target, "http+unix://"):
+		socket, path := strings.TrimPrefix(target, "http+unix://"), "/"
+		if i := strings.Index(socket, "/"); i >= 0 {
+			socket, path = socket[:i], socket[i:]
+		}
+
+		socket, err := url.PathUnescape(socket)
+		return socket, path, err
+	}
+
+	return "", "", nil
+}
+
+// isUnix returns true if the target is a unix domain socket
+func (c *client) isUnix() bool {
+	return c.unixSocket != ""
+}
+
+// unixURL returns the HTTP request's URL of the unix domain socket,
+// the host is localhost unless the host header is specified
+func (c *client) unixURL() string {
+	host := c.req.httpHeaders.Get("Host")
+	if host == "" {
+		host = "localhost"
+	}
+
+	return "http://" + host + c.unixPath
+}
+
+// connectUnix dials the unix domain socket, the address is the socket file
+func (c *client) connectUnix(ctx context.Context) error {
+	var err error
+
+	c.addr = c.unixSocket
+
+	d := net.Dialer{}
+	ctx, cancel := context.WithTimeout(ctx, c.req.timeout)
+	defer cancel()
+
+	t := time.Now()
+	c.conn, err = d.DialContext(ctx, "unix", c.unixSocket)
+	if err != nil {
+		c.stats.TCPConnectError++
+		return err
+	}
+
+	c.stats.TCPConnect = time.Since(t).Microseconds()
+
+	return nil
+}
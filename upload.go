@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// upload payloads, the random payload isn't compressible
+// by the middle boxes unlike the zeros
+const (
+	uploadZero   = "zero"
+	uploadRandom = "random"
+)
+
+// zeroReader reads the zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
+
+// uploadBody returns the generated upload body, its content length is
+// fixed unless the chunked is requested
+func (c *client) uploadBody() (io.Reader, int64) {
+	var r io.Reader = zeroReader{}
+	if c.req.uploadPayload == uploadRandom {
+		r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	length := c.req.uploadBytes
+	if c.req.uploadChunked {
+		length = -1
+	}
+
+	return io.LimitReader(r, c.req.uploadBytes), length
+}
+
+// uploadMethod returns the upload's method, it's POST
+// unless a method with body e.g. PUT is requested
+func uploadMethod(method string) string {
+	if method == "" || method == http.MethodGet || method == http.MethodHead {
+		return http.MethodPost
+	}
+
+	return method
+}
+
+// recordUpload records the upload's time and rate, the upload is
+// from the request's start until the body has been written
+func (c *client) recordUpload(start, wrote time.Time) {
+	c.stats.UploadTime, c.stats.UploadRate = 0, 0
+	if wrote.IsZero() {
+		return
+	}
+
+	elapsed := wrote.Sub(start)
+	c.stats.UploadTime = elapsed.Microseconds()
+	if elapsed > 0 {
+		c.stats.UploadRate = int64(float64(c.req.uploadBytes) / elapsed.Seconds())
+	}
+}
+
+// getUploadPayload validates the upload payload
+func getUploadPayload(payload string) (string, error) {
+	switch payload {
+	case uploadZero, uploadRandom:
+		return payload, nil
+	}
+
+	return "", fmt.Errorf("invalid upload-payload: %s, expected zero or random", payload)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+)
+
+// warmup metrics modes, the warm-up probes' metrics are either
+// suppressed or exported with the warmup="true" label
+const (
+	warmupSuppress = "suppress"
+	warmupLabel    = "label"
+)
+
+// startWarmup marks the probe as a warm-up probe until the
+// warmup probes are done, the warm-up probes are printed but
+// they're excluded from the summary, window, availability and thresholds
+func (c *client) startWarmup() {
+	c.warming = c.warmed < c.req.warmup
+	if c.warming {
+		c.warmed++
+	}
+}
+
+// isWarmingUp returns true until the first probe after the warm-up
+// probes, the metrics aren't exported before the warm-up finished
+func (c *client) isWarmingUp() bool {
+	return c.warming || c.warmed < c.req.warmup
+}
+
+// getWarmupMetrics validates the warmup metrics mode
+func getWarmupMetrics(mode string) (string, error) {
+	switch mode {
+	case warmupSuppress, warmupLabel:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("invalid warmup-metrics: %s, expected suppress or label", mode)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// webhookFuncs are the webhook template's functions
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"labels": joinLabels,
+}
+
+// webhook represents the webhook notifier, the events are posted
+// in the background so the slow receivers don't block the probes
+type webhook struct {
+	template   *template.Template
+	retries    int
+	backoff    time.Duration
+	httpClient *http.Client
+	ch         chan webhookEvent
+	done       chan struct{}
+}
+
+// webhookEvent represents an event and its receiver
+type webhookEvent struct {
+	url   string
+	event alertEvent
+}
+
+func newWebhook(req *request) *webhook {
+	return &webhook{
+		template:   req.webhookTemplate,
+		retries:    req.webhookRetries,
+		backoff:    time.Second,
+		httpClient: &http.Client{Timeout: req.webhookTimeout},
+		ch:         make(chan webhookEvent, 100),
+		done:       make(chan struct{}),
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	defer close(w.done)
+
+	for {
+		select {
+		case e := <-w.ch:
+			w.post(ctx, e)
+		case <-ctx.Done():
+			// the queued events are sent before exit
+			for {
+				select {
+				case e := <-w.ch:
+					w.post(context.Background(), e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *webhook) wait() {
+	<-w.done
+}
+
+// send queues the event, it's dropped if the queue is full
+func (w *webhook) send(url string, e alertEvent) {
+	select {
+	case w.ch <- webhookEvent{url, e}:
+	default:
+		warnf("webhook queue is full, the event dropped: %s %s", e.Target, e.State)
+	}
+}
+
+// post posts the event to the receiver, it's retried
+// with exponential backoff once it failed
+func (w *webhook) post(ctx context.Context, e webhookEvent) {
+	body, err := w.body(e.event)
+	if err != nil {
+		errorf("webhook: %v", err)
+		return
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.do(e.url, body)
+		if err == nil {
+			return
+		}
+
+		if attempt >= w.retries {
+			errorf("webhook: %s %s: %v", e.event.Target, e.event.State, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			errorf("webhook: %s %s: %v", e.event.Target, e.event.State, err)
+			return
+		}
+
+		backoff *= 2
+	}
+}
+
+// body returns the event's json or the template's body
+func (w *webhook) body(e alertEvent) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(e)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := w.template.Execute(buf, e); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (w *webhook) do(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook post failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// getWebhookTemplate compiles the webhook body template
+func getWebhookTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := template.New("webhook").Funcs(webhookFuncs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook-template: %v", err)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// websocket opcodes and the GUID of the accept header
+const (
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// wsCloseTimeout is the maximum wait for the server's close
+	wsCloseTimeout = time.Second
+)
+
+// isWebSocket returns true if the target is probed by
+// the WebSocket upgrade e.g. wss://host/path
+func (c *client) isWebSocket() bool {
+	return c.urlSchema.Scheme == "ws" || c.urlSchema.Scheme == "wss"
+}
+
+// wsProbe upgrades the connection to WebSocket instead of the HTTP
+// request, the pong's RTT is measured if the ping is requested
+// and then the connection is closed by the close handshake
+func (c *client) wsProbe(ctx context.Context) error {
+	c.stats.WSUpgrade = 0
+	c.stats.WSPongRtt = 0
+	c.stats.HTTPStatusCode = 0
+
+	conn := c.conn
+	if c.urlSchema.Scheme == "wss" {
+		config := c.tlsConfig()
+		config.NextProtos = nil
+
+		var err error
+		if conn, err = c.tlsHandshake(ctx, config); err != nil {
+			return err
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(c.req.timeout))
+	defer conn.SetDeadline(time.Time{})
+	defer abortOnCancel(ctx, c.conn)()
+
+	r, err := c.wsUpgrade(conn)
+	if err != nil {
+		return err
+	}
+
+	if c.req.wsPing {
+		if err = c.wsPing(conn, r); err != nil {
+			return err
+		}
+	}
+
+	// the close's status code is 1000 normal closure
+	conn.Write(wsFrame(wsOpClose, []byte{0x03, 0xe8}))
+	conn.SetReadDeadline(time.Now().Add(capTimeout(wsCloseTimeout, c.req.timeout)))
+	wsReadFrame(r, wsOpClose)
+
+	return nil
+}
+
+// wsUpgrade sends the upgrade request and validates the server's
+// accept, it returns the reader of the server's frames
+func (c *client) wsUpgrade(conn net.Conn) (*bufio.Reader, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+
+	u := *c.urlSchema
+	u.Scheme = "http"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.req.httpHeaders {
+		req.Header[k] = v
+	}
+
+	if host := c.req.httpHeaders.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	t := time.Now()
+	if err = req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	c.stats.WSUpgrade = time.Since(t).Microseconds()
+	c.stats.HTTPStatusCode = resp.StatusCode
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, c.req.expectBodyLimit))
+		resp.Body.Close()
+		c.stats.WSRejected++
+		return nil, fmt.Errorf("%s: websocket upgrade rejected: %s", c.target, resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		c.stats.WSBadAccept++
+		return nil, fmt.Errorf("%s: websocket upgrade: invalid Sec-WebSocket-Accept", c.target)
+	}
+
+	return r, nil
+}
+
+// wsPing sends the ping and measures the round trip to its pong,
+// the server's data frames before the pong are discarded
+func (c *client) wsPing(conn net.Conn, r *bufio.Reader) error {
+	t := time.Now()
+	if _, err := conn.Write(wsFrame(wsOpPing, []byte("tcpprobe"))); err != nil {
+		return err
+	}
+
+	if err := wsReadFrame(r, wsOpPong); err != nil {
+		if isTimeout(err) {
+			c.stats.WSPongTimeout++
+		}
+		return fmt.Errorf("%s: websocket pong: %v", c.target, err)
+	}
+	c.stats.WSPongRtt = time.Since(t).Microseconds()
+
+	return nil
+}
+
+// wsAccept returns the expected Sec-WebSocket-Accept of the key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsFrame returns the client's final frame, the client's
+// frames are masked and the control's payload is tiny
+func wsFrame(opcode byte, payload []byte) []byte {
+	mask := make([]byte, 4)
+	rand.Read(mask)
+
+	b := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i := range payload {
+		b = append(b, payload[i]^mask[i%4])
+	}
+
+	return b
+}
+
+// wsReadFrame reads the server's frames until the opcode,
+// the other frames' payload is discarded
+func wsReadFrame(r *bufio.Reader, opcode byte) error {
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header[:2]); err != nil {
+			return err
+		}
+
+		op := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		size := int64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			if _, err := io.ReadFull(r, header[:2]); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint16(header[:2]))
+		case 127:
+			if _, err := io.ReadFull(r, header); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header))
+		}
+
+		// the server's frames aren't masked though
+		if masked {
+			size += 4
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+			return err
+		}
+
+		if op == opcode {
+			return nil
+		}
+
+		if op == wsOpClose {
+			return errors.New("closed by the server")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+)
+
+// defaultRttWindow is the number of the RTTs in the window
+const defaultRttWindow = 100
+
+// rttWindow represents the last probes' RTTs of a target, the
+// percentiles are over the probes rather than time-weighted
+type rttWindow struct {
+	samples []uint32
+	next    int
+	full    bool
+}
+
+func newRttWindow(n int) *rttWindow {
+	if n < 1 {
+		n = defaultRttWindow
+	}
+
+	return &rttWindow{samples: make([]uint32, n)}
+}
+
+// add adds the RTT and drops the oldest one once the window is full
+func (w *rttWindow) add(rtt uint32) {
+	w.samples[w.next] = rtt
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// reset empties the window
+func (w *rttWindow) reset() {
+	w.next = 0
+	w.full = false
+}
+
+// values returns the RTTs from the oldest to the newest
+func (w *rttWindow) values() []uint32 {
+	if !w.full {
+		return append([]uint32(nil), w.samples[:w.next]...)
+	}
+
+	return append(append([]uint32(nil), w.samples[w.next:]...), w.samples[:w.next]...)
+}
+
+// update sets the window's jitter, percentiles, min and max into the
+// stats, the jitter is the mean absolute difference of the consecutive
+// RTTs as RFC 3550 without the smoothing
+func (w *rttWindow) update(st *stats) {
+	values := w.values()
+	if len(values) < 1 {
+		st.RttJitter, st.RttP50, st.RttP95, st.RttP99, st.RttMin, st.RttMax = 0, 0, 0, 0, 0, 0
+		return
+	}
+
+	var diff uint64
+	for i := 1; i < len(values); i++ {
+		if values[i] > values[i-1] {
+			diff += uint64(values[i] - values[i-1])
+		} else {
+			diff += uint64(values[i-1] - values[i])
+		}
+	}
+
+	st.RttJitter = 0
+	if len(values) > 1 {
+		st.RttJitter = uint32(diff / uint64(len(values)-1))
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	st.RttP50 = percentile(values, 50)
+	st.RttP95 = percentile(values, 95)
+	st.RttP99 = percentile(values, 99)
+	st.RttMin = values[0]
+	st.RttMax = values[len(values)-1]
+}
+
+// sampleRtt adds the succeeded probe's RTT to the window
+// and updates the window's stats, the warm-up probes are skipped
+func (c *client) sampleRtt(err error) {
+	if c.warming {
+		return
+	}
+
+	if c.window == nil {
+		c.window = newRttWindow(c.req.rttWindow)
+	}
+
+	if err == nil && c.stats.Rtt > 0 {
+		c.window.add(c.stats.Rtt)
+	}
+
+	c.window.update(&c.stats)
+}
+
+// percentile returns the nearest rank percentile of the sorted values
+func percentile(sorted []uint32, p int) uint32 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}